@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger serializes the output of the fuzzing workers, so that the
+// reports of crashes happening at the same time don't interleave.
+// With -json-logs, every message is written as a JSON object on its
+// own line instead.
+type logger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	json bool
+}
+
+var lg = &logger{w: os.Stdout}
+
+// event is implemented by the structs written by logger.Event.
+type event interface {
+	header() *eventHeader
+}
+
+// eventHeader holds the fields shared by all the JSON events.
+type eventHeader struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+}
+
+func (h *eventHeader) header() *eventHeader { return h }
+
+// logEvent is a free-form message.
+type logEvent struct {
+	eventHeader
+	Msg string `json:"msg"`
+}
+
+// crashEvent is a compiler crash.
+type crashEvent struct {
+	eventHeader
+	Program   string `json:"program"`
+	Arch      string `json:"arch"`
+	Phase     string `json:"phase"`
+	Build     string `json:"build"`
+	Signature string `json:"signature"`
+	Path      string `json:"path"`
+	New       bool   `json:"new"`            // first crash with this signature
+	Diag      bool   `json:"diag,omitempty"` // compiled with -m=2
+	Seed      *int64 `json:"seed,omitempty"`
+	Worker    int    `json:"worker,omitempty"`
+	Index     int    `json:"index,omitempty"`
+}
+
+// Printf writes a formatted message. With -json-logs, the message is
+// written as a "log" event.
+func (l *logger) Printf(format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	if l.json {
+		l.Event("log", &logEvent{Msg: strings.TrimSuffix(msg, "\n")}, "")
+		return
+	}
+	l.write([]byte(msg))
+}
+
+// Println is like Printf, but formats the message like fmt.Println.
+func (l *logger) Println(a ...any) {
+	l.Printf("%s", fmt.Sprintln(a...))
+}
+
+// Event writes e as a JSON object of the given kind with -json-logs,
+// and text otherwise.
+func (l *logger) Event(kind string, e event, text string) {
+	if !l.json {
+		l.write([]byte(text))
+		return
+	}
+	h := e.header()
+	h.Time, h.Event = time.Now(), kind
+	b, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	l.write(append(b, '\n'))
+}
+
+func (l *logger) write(b []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(b)
+}
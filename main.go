@@ -1,202 +1,1442 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/ALTree/microsmith/microsmith"
 )
 
-var BuildCount int64
-var CrashCount int64
-var KnownCount int64
+// fuzzStats holds the statistics shared by the fuzzing workers and
+// printed by the periodic status line. The counters are updated
+// atomically, the other fields while holding mu.
+type fuzzStats struct {
+	builds, crashes, linkCrashes, nooptCrashes int64
+	known, mutants, mismatches, disagreements  int64
+	badgen, nondet, escapes                    int64
+
+	mu        sync.Mutex
+	archs     map[string]*archStats
+	sigs      map[string]bool // signatures of the crashes so far
+	lastCrash time.Time
+	lastSig   string        // signature of the last crash
+	slowest   time.Duration // the slowest compile so far
+	slowestOf string        // program and arch of the slowest compile
+}
+
+// archStats holds the number of compiles for a GOARCH, and the time
+// spent in them.
+type archStats struct {
+	compiles int
+	time     time.Duration
+}
+
+var stats = fuzzStats{
+	archs: make(map[string]*archStats),
+	sigs:  make(map[string]bool),
+}
+
+// compiled records that compiling program name for arch took d.
+func (s *fuzzStats) compiled(name, arch string, d time.Duration) {
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	as, ok := s.archs[arch]
+	if !ok {
+		as = &archStats{}
+		s.archs[arch] = as
+	}
+	as.compiles++
+	as.time += d
+	if d > s.slowest {
+		s.slowest, s.slowestOf = d, name+" on "+arch
+	}
+}
+
+// crashed records a crash with compiler output out, and reports
+// whether it's the first crash with its signature.
+func (s *fuzzStats) crashed(out string) bool {
+	atomic.AddInt64(&s.crashes, 1)
+	sig := crashSignature(out)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastCrash, s.lastSig = time.Now(), sig
+	if s.sigs[sig] {
+		return false
+	}
+	s.sigs[sig] = true
+	return true
+}
+
+// statusEvent is a snapshot of the fuzzing statistics, written by
+// the periodic status line.
+type statusEvent struct {
+	eventHeader
+	Builds        int64   `json:"builds"`
+	PerMin        float64 `json:"per_min"`
+	Crashes       int64   `json:"crashes"`
+	UniqueCrashes int     `json:"unique_crashes"`
+	LinkCrashes   int64   `json:"link_crashes"`
+	NooptCrashes  int64   `json:"noopt_crashes"`
+	Known         int64   `json:"known"`
+	Badgen        int64   `json:"badgen"`
+	Disagreements int64   `json:"disagreements"`
+	Mutants       int64   `json:"mutants"`
+	Mismatches    int64   `json:"mismatches"`
+	Nondet        int64   `json:"nondeterministic"`
+	Escapes       int64   `json:"escapes"`
+	Conversions   int     `json:"conversions,omitempty"`
+
+	Pragmas map[string]int64 `json:"pragmas,omitempty"`
+
+	Archs     map[string]archEvent `json:"archs"`
+	LastCrash *time.Time           `json:"last_crash,omitempty"`
+	LastSig   string               `json:"last_signature,omitempty"`
+	SlowestMs int64                `json:"slowest_ms,omitempty"`
+	SlowestOf string               `json:"slowest_of,omitempty"`
+}
+
+// archEvent holds the compiles of a GOARCH in a statusEvent.
+type archEvent struct {
+	Compiles int   `json:"compiles"`
+	MeanMs   int64 `json:"mean_ms"`
+}
+
+// status returns a snapshot of the statistics, for a fuzzing session
+// started at start.
+func (s *fuzzStats) status(start time.Time) *statusEvent {
+	e := &statusEvent{
+		Builds:        atomic.LoadInt64(&s.builds),
+		Crashes:       atomic.LoadInt64(&s.crashes),
+		LinkCrashes:   atomic.LoadInt64(&s.linkCrashes),
+		NooptCrashes:  atomic.LoadInt64(&s.nooptCrashes),
+		Known:         atomic.LoadInt64(&s.known),
+		Badgen:        atomic.LoadInt64(&s.badgen),
+		Disagreements: atomic.LoadInt64(&s.disagreements),
+		Mutants:       atomic.LoadInt64(&s.mutants),
+		Mismatches:    atomic.LoadInt64(&s.mismatches),
+		Nondet:        atomic.LoadInt64(&s.nondet),
+		Escapes:       atomic.LoadInt64(&s.escapes),
+		Archs:         make(map[string]archEvent),
+	}
+	e.PerMin = float64(e.Builds) / time.Since(start).Minutes()
+	if *statsF {
+		e.Conversions = len(microsmith.CastStats())
+		e.Pragmas = microsmith.PragmaStats()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.UniqueCrashes = len(s.sigs)
+	for a, as := range s.archs {
+		e.Archs[a] = archEvent{as.compiles, (as.time / time.Duration(as.compiles)).Milliseconds()}
+	}
+	if !s.lastCrash.IsZero() {
+		lc := s.lastCrash
+		e.LastCrash, e.LastSig = &lc, s.lastSig
+	}
+	e.SlowestMs, e.SlowestOf = s.slowest.Milliseconds(), s.slowestOf
+	return e
+}
+
+// found reports whether the fuzzing session summarized by e found
+// anything: a crash, a go/types disagreement or mismatch, a
+// nondeterministic build, or a variable that should not escape moved
+// to the heap.
+func (e *statusEvent) found() bool {
+	return e.Crashes+e.Disagreements+e.Mismatches+e.Nondet+e.Escapes > 0
+}
+
+// line returns the human-readable status line of e.
+func (e *statusEvent) line() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Built %4d (%5.1f/min)  |  crashes: %v", e.Builds, e.PerMin, e.Crashes)
+	if e.LinkCrashes > 0 {
+		fmt.Fprintf(&sb, " (link: %v)", e.LinkCrashes)
+	}
+	if *bothF {
+		fmt.Fprintf(&sb, " (opt: %v, noopt: %v)", e.Crashes-e.NooptCrashes, e.NooptCrashes)
+	}
+	if *gotypesF {
+		fmt.Fprintf(&sb, " (disagreements: %v)", e.Disagreements)
+	}
+	if e.Badgen > 0 {
+		fmt.Fprintf(&sb, " (invalid programs: %v)", e.Badgen)
+	}
+	if *recompileF > 1 {
+		fmt.Fprintf(&sb, " (nondeterministic: %v)", e.Nondet)
+	}
+	if *noEscapeF {
+		fmt.Fprintf(&sb, " (escapes: %v)", e.Escapes)
+	}
+	if *statsF {
+		fmt.Fprintf(&sb, "  |  conversions: %v pairs", e.Conversions)
+		if len(e.Pragmas) > 0 {
+			fmt.Fprintf(&sb, "  |  pragmas: %v", pragmasString(e.Pragmas))
+		}
+	}
+	if *mutateF {
+		fmt.Fprintf(&sb, "  |  mutants: %v (mismatches: %v)", e.Mutants, e.Mismatches)
+	}
+	if e.Known > 0 {
+		fmt.Fprintf(&sb, "  (known: %v)", e.Known)
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// details returns the compiles and the mean compile time of every
+// arch, the last crash, and the slowest compile.
+func (e *statusEvent) details() string {
+	var sb strings.Builder
+	names := make([]string, 0, len(e.Archs))
+	for a := range e.Archs {
+		names = append(names, a)
+	}
+	sort.Strings(names)
+	for _, a := range names {
+		ae := e.Archs[a]
+		fmt.Fprintf(&sb, "  %-8s %6d compiles (%v each)\n",
+			a, ae.Compiles, time.Duration(ae.MeanMs)*time.Millisecond)
+	}
+	if e.LastCrash == nil {
+		sb.WriteString("  last crash: none\n")
+	} else {
+		fmt.Fprintf(&sb, "  last crash: %v ago (%v) %q\n",
+			time.Since(*e.LastCrash).Round(time.Second), e.LastCrash.Format("Jan 2 15:04:05"), e.LastSig)
+	}
+	if e.SlowestMs > 0 {
+		fmt.Fprintf(&sb, "  slowest compile: %v (%v)\n", time.Duration(e.SlowestMs)*time.Millisecond, e.SlowestOf)
+	}
+	return sb.String()
+}
+
+var (
+	archF       = flag.String("arch", "", "GOARCHs to fuzz (comma separated list)")
+	debugF      = flag.Bool("debug", false, "Run microsmith in debug mode")
+	singlePkgF  = flag.Bool("singlepkg", false, "Generate single-package programs")
+	multiFileF  = flag.Bool("multifile", false, "Split every package across several files")
+	archFilesF  = flag.Bool("archfiles", false, "Also declare a function differently in per-GOARCH files with build constraints")
+	nooptF      = flag.Bool("noopt", false, "Compile with optimizations disabled")
+	bothF       = flag.Bool("both", false, "Compile every program both with and without optimizations")
+	pF          = flag.Int("p", 1, "Number of fuzzing workers")
+	raceF       = flag.Bool("race", false, "Compile with -race")
+	ssacheckF   = flag.Bool("ssacheck", false, "Compile with -d=ssa/check/on")
+	diagF       = flag.Int("diag", 0, "Also compile one every N programs with -m=2, e.g. 50 (gc only)")
+	binF        = flag.String("bin", "", "Go toolchain to fuzz")
+	workdirF    = flag.String("work", "work", "Workdir for the fuzzing process")
+	notpF       = flag.Bool("notp", false, "Don't use type-parameters")
+	genericF    = flag.Float64("generic", 1, "Fraction of functions that use type-parameters (0 is the same as -notp)")
+	wbF         = flag.Bool("wb", false, "Generate programs stressing GC write barriers")
+	onlyTypeF   = flag.String("onlytype", "", "Generate programs using almost only the given basic type (like float32)")
+	noFloatF    = flag.Bool("nofloat", false, "Generate programs without floating-point types")
+	minImportsF = flag.Bool("minimports", false, "Generate programs that only import the packages needed by the other options")
+	noEscapeF   = flag.Bool("noescape", false, "Generate programs with many local variables that should not escape to the heap, and report the ones moved to it (gc only)")
+	mapsF       = flag.Bool("maps", false, "Generate programs that fill and empty maps of many key types and sizes")
+	goroutinesF = flag.Int("goroutines", 0, "Generate programs spawning up to N goroutines at once, to stress the scheduler (0 to disable)")
+	runtimeF    = flag.Bool("runtime", false, "Generate calls to runtime.GC and runtime.GOMAXPROCS (not when fuzzing wasm)")
+	traceF      = flag.Bool("trace", false, "Log the generator's last decisions (for debugging microsmith)")
+	gotypesF    = flag.Bool("gotypes", false, "Also typecheck programs with go/types, and report disagreements with gc (requires -singlepkg)")
+	nomainF     = flag.Bool("nomain", false, "Generate library packages without a main, and only compile them (gc only, requires -singlepkg)")
+	statsF      = flag.Bool("stats", false, "Also report how many integer conversion pairs, and functions with each compiler directive, were generated")
+	inlineF     = flag.Bool("inline", false, "Generate functions near the inlining budget, and compile with every inlining level (gc only)")
+	selftestF   = flag.Int("selftest", 0, "Typecheck N programs generated from -seed (or a random seed) with go/types, and exit")
+	checkF      = flag.String("check", "", "Typecheck and build the given Go file, and report any crash")
+	mutateF     = flag.Bool("mutate", false, "Also fuzz go/types with mutated programs (gc only, requires -singlepkg)")
+	recompileF  = flag.Int("recompile", 0, "Compile every program N times, and report the ones whose builds give different results")
+	minimizeF   = flag.String("minimize", "", "Reduce and deduplicate the crashers in the given folder")
+	vetF        = flag.Bool("vet", false, "Run go vet on the generated programs when checking them")
+	keepGoingF  = flag.Bool("keep-going", false, "Typecheck the generated programs, and move the invalid ones in workdir/badgen instead of exiting")
+	workerF     = flag.Int("worker", 0, "Worker to regenerate the program of (with -debug and -seed)")
+	indexF      = flag.Int("index", 0, "Index of the program to regenerate (with -debug and -seed)")
+	sampleF     = flag.Int("sample", 0, "Archive one every N successfully built programs in workdir/corpus")
+	sampleMaxF  = flag.Int64("samplemax", 100, "Max size of the archived programs, in MB")
+	journalF    = flag.String("journal", "", "Append the worker, index, and build result of every program to the given file, to regenerate them with -debug (picks a random -seed if none is given)")
+	rotateF     = flag.Int64("rotate", 0, "Rotate the journal when it gets larger than N MB (0 to never rotate)")
+	crashLinesF = flag.Int("crashlines", 5, "Number of lines of compiler output to print for each crash (0 for the full output)")
+	maxTimeF    = flag.Duration("max-time", 0, "Stop fuzzing after the given time, and exit with status 0 if nothing was found (0 to never stop)")
+	intervalF   = flag.Duration("stats-interval", 30*time.Second, "Interval between status lines (0 to disable them)")
+	quietF      = flag.Bool("quiet", false, "Don't print the startup banner and the status lines")
+	jsonLogsF   = flag.Bool("json-logs", false, "Write the status lines, crashes, and other messages as one JSON object per line")
+	pragmasF    = flag.Bool("pragmas", false, "Put compiler directives like //go:noinline (and //go:norace, with -race) on some of the generated functions")
+	profileF    = flag.String("profile", "", "Set the generation flags targeting a compiler subsystem ("+strings.Join(profileNames(), ", ")+"); the flags given explicitly take precedence")
+	emitASTF    = flag.Bool("emit-ast", false, "Also write the AST of every generated file as JSON, next to its source (kept with the crashers)")
+)
 
 var (
-	archF      = flag.String("arch", "", "GOARCHs to fuzz (comma separated list)")
-	debugF     = flag.Bool("debug", false, "Run microsmith in debug mode")
-	singlePkgF = flag.Bool("singlepkg", false, "Generate single-package programs")
-	nooptF     = flag.Bool("noopt", false, "Compile with optimizations disabled")
-	pF         = flag.Int("p", 1, "Number of fuzzing workers")
-	raceF      = flag.Bool("race", false, "Compile with -race")
-	ssacheckF  = flag.Bool("ssacheck", false, "Compile with -d=ssa/check/on")
-	binF       = flag.String("bin", "", "Go toolchain to fuzz")
-	workdirF   = flag.String("work", "work", "Workdir for the fuzzing process")
-	notpF      = flag.Bool("notp", false, "Don't use type-parameters")
-	expF       = flag.String("exp", "", "GOEXPERIMENT")
+	expF  experiments
+	seedF seedFlag
 )
 
+func init() {
+	flag.Var(&expF, "exp", "GOEXPERIMENTs to enable (comma separated list, repeatable)")
+	flag.Var(&seedF, "seed", "Generate programs deterministically from the given seed")
+}
+
+// experiments is a flag.Value collecting the GOEXPERIMENTs passed
+// with one or more -exp flags.
+type experiments []string
+
+func (e *experiments) String() string {
+	return strings.Join(*e, ",")
+}
+
+func (e *experiments) Set(s string) error {
+	for _, exp := range strings.Split(s, ",") {
+		if err := microsmith.CheckExperiment(exp); err != nil {
+			return err
+		}
+		*e = append(*e, exp)
+	}
+	return nil
+}
+
+// seedFlag is the flag.Value of -seed. It records whether the flag
+// was given, since 0 is a valid seed.
+type seedFlag struct {
+	seed int64
+	set  bool
+}
+
+func (s *seedFlag) String() string {
+	if !s.set {
+		return ""
+	}
+	return strconv.FormatInt(s.seed, 10)
+}
+
+func (s *seedFlag) Set(v string) error {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return err
+	}
+	s.seed, s.set = n, true
+	return nil
+}
+
 var archs []string
 
+var corpus *microsmith.Corpus
+
+var journal *microsmith.Journal
+
 func main() {
 
 	flag.Parse()
 	rand.Seed(int64(time.Now().UnixNano()))
+	lg.json = *jsonLogsF
+
+	if *profileF != "" {
+		if err := applyProfile(*profileF); err != nil {
+			lg.Println(err)
+			os.Exit(2)
+		}
+	}
 
 	if *debugF {
 		debugRun()
 		os.Exit(0)
 	}
 
+	if *selftestF < 0 {
+		lg.Println("-selftest must be non-negative")
+		os.Exit(2)
+	}
+	if *selftestF > 0 {
+		if !selftestRun(*selftestF) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if *binF == "" {
-		fmt.Println("-bin must be set")
+		lg.Println("-bin must be set")
+		os.Exit(2)
+	}
+
+	if *genericF < 0 || *genericF > 1 {
+		lg.Println("-generic must be between 0 and 1")
+		os.Exit(2)
+	}
+
+	if *onlyTypeF != "" {
+		if err := microsmith.CheckOnlyType(*onlyTypeF); err != nil {
+			lg.Println(err)
+			os.Exit(2)
+		}
+	}
+
+	if *noFloatF && microsmith.IsFloat(microsmith.BT{N: *onlyTypeF}) {
+		lg.Println("-nofloat and -onlytype " + *onlyTypeF + " cannot be used together")
+		os.Exit(2)
+	}
+
+	if *goroutinesF < 0 || *goroutinesF > microsmith.MaxGoroutines {
+		lg.Printf("-goroutines must be between 0 and %v\n", microsmith.MaxGoroutines)
+		os.Exit(2)
+	}
+
+	if *crashLinesF < 0 {
+		lg.Println("-crashlines must be non-negative")
+		os.Exit(2)
+	}
+
+	if *recompileF < 0 {
+		lg.Println("-recompile must be non-negative")
+		os.Exit(2)
+	}
+
+	if *intervalF < 0 {
+		lg.Println("-stats-interval must be non-negative")
+		os.Exit(2)
+	}
+
+	if *nooptF && *bothF {
+		lg.Println("-noopt and -both cannot be used together")
+		os.Exit(2)
+	}
+
+	if *mutateF && !*singlePkgF {
+		lg.Println("-mutate requires -singlepkg")
+		os.Exit(2)
+	}
+
+	if *gotypesF && !*singlePkgF {
+		lg.Println("-gotypes requires -singlepkg")
+		os.Exit(2)
+	}
+
+	if *nomainF && !*singlePkgF {
+		lg.Println("-nomain requires -singlepkg")
+		os.Exit(2)
+	}
+
+	if *multiFileF && *mutateF {
+		lg.Println("-multifile and -mutate cannot be used together")
+		os.Exit(2)
+	}
+
+	if *archFilesF && *mutateF {
+		lg.Println("-archfiles and -mutate cannot be used together")
+		os.Exit(2)
+	}
+
+	if *nomainF && *mutateF {
+		lg.Println("-nomain and -mutate cannot be used together")
 		os.Exit(2)
 	}
 
 	if *raceF && runtime.GOOS == "windows" {
-		fmt.Println("-race fuzzing is not supported on Windows")
+		lg.Println("-race fuzzing is not supported on Windows")
 		os.Exit(2)
 	}
 
 	tc := guessToolchain(*binF)
 	if tc == "gc" && *archF == "" {
-		fmt.Println("-arch must be set when fuzzing gc")
+		lg.Println("-arch must be set when fuzzing gc")
 		os.Exit(2)
 	}
 	if tc != "gc" && *archF != "" {
-		fmt.Println("-arch must not be set when not fuzzing gc")
+		lg.Println("-arch must not be set when not fuzzing gc")
+		os.Exit(2)
+	}
+
+	if tc != "gc" {
+		*diagF = 0
+	}
+	if tc != "gc" && (*mutateF || *gotypesF || *nomainF || *inlineF) {
+		lg.Println("-mutate, -gotypes, -nomain, and -inline are only supported when fuzzing gc")
 		os.Exit(2)
 	}
 
 	if _, err := os.Stat(*binF); os.IsNotExist(err) {
-		fmt.Printf("toolchain %v does not exist\n", *binF)
+		lg.Printf("toolchain %v does not exist\n", *binF)
 		os.Exit(2)
 	}
 
 	fz := microsmith.BuildOptions{
-		Toolchain:  *binF,
-		Noopt:      *nooptF,
-		Race:       *raceF,
-		Ssacheck:   *ssacheckF,
-		Experiment: *expF,
+		Toolchain:   *binF,
+		Noopt:       *nooptF,
+		Race:        *raceF,
+		Ssacheck:    *ssacheckF,
+		Experiments: expF,
 	}
 
 	archs = strings.Split(*archF, ",")
 
 	if tc == "gc" {
+		for _, a := range archs {
+			if err := fz.CheckArch(a); err != nil {
+				lg.Println(err)
+				os.Exit(2)
+			}
+		}
 		for _, a := range archs {
 			installDeps(a, fz)
 		}
 	}
-	if *ssacheckF {
-		fmt.Printf("ssacheck [seed = %v]\n", microsmith.CheckSeed)
-	}
-
 	// Create workdir if not already there
 	if _, err := os.Stat(*workdirF); os.IsNotExist(err) {
 		err := os.MkdirAll(*workdirF, os.ModePerm)
 		if err != nil {
-			fmt.Println(err)
+			lg.Println(err)
+			os.Exit(2)
+		}
+	}
+
+	if *sampleF > 0 {
+		var err error
+		corpus, err = microsmith.NewCorpus(
+			filepath.Join(*workdirF, "corpus"), *sampleF, *sampleMaxF<<20)
+		if err != nil {
+			lg.Printf("Could not create corpus: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if *journalF != "" {
+		// Only the programs of a seeded run can be regenerated from
+		// the journal.
+		if !seedF.set {
+			seedF.seed, seedF.set = rand.Int63(), true
+		}
+		var err error
+		journal, err = microsmith.NewJournal(*journalF, *rotateF<<20)
+		if err != nil {
+			lg.Printf("Could not open journal: %v\n", err)
 			os.Exit(2)
 		}
 	}
 
+	if *minimizeF != "" {
+		minimizeRun(*minimizeF, fz)
+		os.Exit(0)
+	}
+
+	if *checkF != "" {
+		if !checkRun(*checkF, fz) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if !*quietF {
+		lg.Printf("Fuzzing %v (%v) with %v workers in %v\n", *binF, tc, *pF, *workdirF)
+		if *ssacheckF {
+			lg.Printf("ssacheck [seed = %v]\n", microsmith.CheckSeed)
+		}
+	}
+
 	startTime := time.Now()
 
+	var workers sync.WaitGroup
 	for i := 1; i <= *pF; i++ {
-		go Fuzz(fz)
+		workers.Add(1)
+		go func(i int) {
+			defer workers.Done()
+			Fuzz(fz, i)
+		}(i)
 	}
 
-	ticker := time.Tick(30 * time.Second)
-	for range ticker {
-		fmt.Printf("Built %4d (%5.1f/min)  |  crashes: %v",
-			atomic.LoadInt64(&BuildCount),
-			float64(atomic.LoadInt64(&BuildCount))/time.Since(startTime).Minutes(),
-			atomic.LoadInt64(&CrashCount),
-		)
-		if kc := atomic.LoadInt64(&KnownCount); kc == 0 {
-			fmt.Print("\n")
-		} else {
-			fmt.Printf("  (known: %v)\n", kc)
-		}
+	var ticker, deadline <-chan time.Time
+	if !*quietF && *intervalF > 0 {
+		ticker = time.Tick(*intervalF)
+	}
+	if *maxTimeF > 0 {
+		deadline = time.After(*maxTimeF)
 	}
 
-	select {}
+	// The details are only printed when some programs were built
+	// since the last tick, so a stuck fuzzer only prints one line.
+	var lastBuilds int64
+	for {
+		select {
+		case <-ticker:
+			st := stats.status(startTime)
+			text := st.line()
+			if st.Builds > lastBuilds {
+				text += st.details()
+			}
+			lg.Event("status", st, text)
+			lastBuilds = st.Builds
+		case <-deadline:
+			// Kill the builds in progress (with the compiler
+			// processes they started), and give the workers some
+			// time to clean up. The programs they were building are
+			// discarded.
+			lg.Printf("Reached -max-time, stopping the workers\n")
+			stopFuzzing()
+			done := make(chan struct{})
+			go func() {
+				workers.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(stopGrace):
+				lg.Printf("The workers did not stop within %v, exiting anyway\n", stopGrace)
+			}
+			st := stats.status(startTime)
+			lg.Event("done", st, st.line()+st.details())
+			if st.found() {
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+	}
 }
 
+// fuzzCtx is canceled by stopFuzzing when the workers must stop. The
+// builds in progress are killed.
+var fuzzCtx, stopFuzzing = context.WithCancel(context.Background())
+
+// stopGrace is how long the workers are waited for after
+// stopFuzzing, before exiting.
+const stopGrace = 15 * time.Second
+
 var crashWhitelist = []*regexp.Regexp{
 	//regexp.MustCompile("found illegal assignment"),
 }
 
-func Fuzz(bo microsmith.BuildOptions) {
-	conf := microsmith.ProgramConf{
-		MultiPkg:   !*singlePkgF,
-		TypeParams: !*notpF,
-	}
+func Fuzz(bo microsmith.BuildOptions, worker int) {
+	conf := programConf()
 
-	for {
-		gp := microsmith.NewProgram(conf)
+	for index := 0; ; index++ {
+		if fuzzCtx.Err() != nil {
+			return
+		}
+
+		gp := newProgram(conf, worker, index)
 		err := gp.WriteToDisk(*workdirF)
 		if err != nil {
-			fmt.Printf("Could not write program to disk: %s", err)
+			lg.Printf("Could not write program to disk: %s", err)
 			os.Exit(2)
 		}
+		if *emitASTF {
+			if err := gp.WriteAST(); err != nil {
+				lg.Printf("Could not write AST to disk: %s", err)
+				os.Exit(2)
+			}
+		}
+
+		// With -keep-going, an invalid program is saved for later
+		// and skipped. With -gotypes, go/types rejecting a program is
+		// reported as a disagreement instead. A program failing vet
+		// (with -vet) is a microsmith bug, not a compiler one, so
+		// it's not counted as a crash.
+		if *keepGoingF || conf.Vet != "" {
+			err := gp.Check()
+			var vetErr *microsmith.VetError
+			errors.As(err, &vetErr)
+			switch {
+			case err == nil:
+			case *gotypesF && vetErr == nil:
+			case *keepGoingF:
+				reportBadgen(gp, fmt.Sprintf("failed checking with error:\n%v", err))
+				record(gp, worker, index, "badgen")
+				continue
+			case vetErr != nil:
+				saveCrasher(gp, "crash")
+				lg.Printf("Program %v failed go vet with error:\n%v\n%s", gp.Name(), err, gp.Trace())
+				os.Exit(2)
+			}
+		}
+
+		builds := buildsOf(bo)
+
+		// With -gotypes, check whether go/types accepts the program,
+		// to compare its verdict with gc's.
+		var tcErr error
+		if *gotypesF {
+			var crash any
+			crash, tcErr = typecheck(gp)
+			if crash != nil {
+				reportDisagreement(gp, fmt.Sprintf("go/types panicked: %v", crash))
+				record(gp, worker, index, "crash")
+				gp.DeleteSource()
+				continue
+			}
+		}
+
+		// A few programs are also compiled with -m=2, to exercise the
+		// code printing the escape analysis and inlining diagnostics.
+		// With -noescape all of them are, to check that the variables
+		// declared by NoEscapeStmt stay on the stack.
+		if diagBuild(gp) || *noEscapeF {
+			for i := range builds {
+				builds[i].Diag = true
+			}
+		}
 
-		var known bool
+		var known, crashed bool
+	archLoop:
 		for _, arch := range archs {
-			timeout := time.AfterFunc(
-				60*time.Second,
-				func() {
-					gp.MoveCrasher()
-					fmt.Printf("%v took too long to compile [GOARCH=%v]\n", gp.Name(), arch)
+			for _, b := range builds {
+				res, diff := compile(gp, arch, b)
+				if res.Outcome == microsmith.Canceled {
+					deleteBinaries(gp)
+					gp.DeleteSource()
+					return
+				}
+				if res.Outcome == microsmith.Timeout {
+					saveCrasher(gp, "crash")
+					lg.Printf("%v took too long to compile [GOARCH=%v, %v]\n", gp.Name(), arch, optLabel(b))
 					os.Exit(2)
-				},
-			)
-			out, err := gp.Compile(arch, bo)
-			timeout.Stop()
+				}
 
-			if err != nil {
-				for _, crash := range crashWhitelist {
-					if crash.MatchString(out) {
-						known = true
-						break
+				if diff != "" {
+					reportNondeterminism(gp, arch, b, diff)
+					crashed = true
+					break archLoop
+				}
+
+				if !res.Failed() {
+					if moved := microsmith.HeapMoves(res.Output); *noEscapeF && len(moved) > 0 {
+						reportEscape(gp, arch, b, moved)
+						crashed = true
+						break archLoop
 					}
+					continue
 				}
+				out := res.Output
 
-				if known {
-					atomic.AddInt64(&KnownCount, 1)
-					break
+				// The whitelist is checked against the output of each
+				// build, so a known crash with optimizations enabled
+				// doesn't hide a new one without them (or vice versa).
+				if isKnown(out) {
+					known = true
+					atomic.AddInt64(&stats.known, 1)
+					deleteBinaries(gp)
+					continue
 				}
 
-				atomic.AddInt64(&CrashCount, 1)
-				if arch != "" {
-					fmt.Printf("-- CRASH (%v) ----------------------------------------------\n", arch)
-				} else {
-					fmt.Printf("-- CRASH ---------------------------------------------------\n")
+				phase := res.Phase()
+
+				// A program rejected by gc but accepted by go/types is
+				// a disagreement, not a compiler crash.
+				if *gotypesF && tcErr == nil && res.Outcome == microsmith.CompileError {
+					reportDisagreement(gp, fmt.Sprintf("accepted by go/types, rejected by gc:\n%s", firstLines(out, 5)))
+					crashed = true
+					break archLoop
 				}
-				fmt.Println(fiveLines(out))
-				fmt.Println("------------------------------------------------------------")
-				gp.MoveCrasher()
-				break
+
+				isNew := stats.crashed(out)
+				if phase == microsmith.LinkPhase {
+					atomic.AddInt64(&stats.linkCrashes, 1)
+				}
+				if b.Noopt {
+					atomic.AddInt64(&stats.nooptCrashes, 1)
+				}
+
+				path := saveCrasher(gp, "crash")
+				ce := newCrashEvent(gp.Name(), path, arch, phase, b, out)
+				ce.New = isNew
+				text := crashReport(ce, arch, b, out)
+				if seedF.set {
+					ce.Seed, ce.Worker, ce.Index = &seedF.seed, worker, index
+					text += fmt.Sprintf("seed=%v worker=%v index=%v\n", seedF.seed, worker, index)
+				}
+				// A program gc rejects is usually a microsmith bug,
+				// so the generator's last decisions are shown too.
+				if res.Outcome == microsmith.CompileError {
+					text += gp.Trace()
+				}
+				lg.Event("crash", ce, text+separator)
+				crashed = true
+				break archLoop
 			}
 		}
 
-		atomic.AddInt64(&BuildCount, 1)
+		if *gotypesF && tcErr != nil && !known && !crashed {
+			reportDisagreement(gp, fmt.Sprintf("rejected by go/types, accepted by gc:\n%v", tcErr))
+			crashed = true
+		}
+
+		if *mutateF && !crashed {
+			checkMutant(gp, bo)
+		}
+
+		atomic.AddInt64(&stats.builds, 1)
+		switch {
+		case crashed:
+			record(gp, worker, index, "crash")
+		case known:
+			record(gp, worker, index, "known")
+		default:
+			record(gp, worker, index, "ok")
+		}
+		if corpus != nil && !known && !crashed {
+			if err := corpus.Add(gp); err != nil {
+				lg.Printf("Could not archive program: %v\n", err)
+			}
+		}
 		gp.DeleteSource()
 	}
 }
 
-func debugRun() {
-	conf := microsmith.ProgramConf{
-		MultiPkg:   !*singlePkgF,
-		TypeParams: !*notpF,
+// compiles returns how many times every build of a program is
+// compiled.
+func compiles() int {
+	if *recompileF > 1 {
+		return *recompileF
+	}
+	return 1
+}
+
+// compile builds gp for arch with options b, and returns the result
+// of the build. A build running for longer than a minute is killed,
+// and so is one still running when stopFuzzing is called.
+// With -recompile N, gp is built N times, and if the builds don't all
+// give the same result (the same outcome and output, or the same
+// object files) compile also returns a description of the results,
+// since the compiler is supposed to be deterministic. The returned
+// result is then the one of the last build.
+func compile(gp *microsmith.Program, arch string, b microsmith.BuildOptions) (microsmith.CompileResult, string) {
+	n := compiles()
+	b.Hash = n > 1
+	b.Timeout = 60 * time.Second
+
+	var res microsmith.CompileResult
+	results := make([]string, n)
+	outs := make(map[string]string) // result -> output
+	for i := range results {
+		start := time.Now()
+		res = gp.CompileContext(fuzzCtx, arch, b)
+		exitOnInfraError(gp, res)
+		if res.Outcome == microsmith.Canceled {
+			return res, ""
+		}
+		stats.compiled(gp.Name(), arch, time.Since(start))
+		if res.Outcome == microsmith.Timeout {
+			return res, ""
+		}
+		if !res.Failed() {
+			results[i] = "ok"
+			if b.Hash {
+				results[i] += ", output hash " + gp.OutputHash()[:16]
+			}
+		} else {
+			results[i] = fmt.Sprintf("%v: %v", res.Phase(), crashSignature(res.Output))
+			outs[results[i]] = res.Output
+		}
+	}
+
+	same := true
+	for _, r := range results[1:] {
+		same = same && r == results[0]
+	}
+	if same {
+		return res, ""
+	}
+
+	// list the results of the builds, and then the output of each
+	// kind of failure
+	var diff strings.Builder
+	for i, r := range results {
+		fmt.Fprintf(&diff, "build %v: %v\n", i+1, r)
+	}
+	failures := make([]string, 0, len(outs))
+	for r := range outs {
+		failures = append(failures, r)
+	}
+	sort.Strings(failures)
+	for _, r := range failures {
+		fmt.Fprintf(&diff, "\n%v:\n%s\n", r, firstLines(outs[r], *crashLinesF))
+	}
+	return res, diff.String()
+}
+
+// exitOnInfraError exits if res is the result of a build of gp that
+// couldn't be run, or whose outputs couldn't be handled: it says
+// nothing about the toolchain, and the next builds would fail too.
+func exitOnInfraError(gp *microsmith.Program, res microsmith.CompileResult) {
+	if res.Outcome == microsmith.InfraError {
+		lg.Printf("Could not build %v: %v\n", gp.Name(), res.Err)
+		os.Exit(2)
+	}
+}
+
+// record appends gp, generated by worker at index, and its build
+// result res to the journal, if there's one.
+func record(gp *microsmith.Program, worker, index int, res string) {
+	if journal == nil {
+		return
+	}
+	if err := journal.Record(gp, seedF.seed, worker, index, res); err != nil {
+		lg.Printf("Could not write to journal: %v\n", err)
+		os.Exit(2)
+	}
+}
+
+// checkMutant applies a random mutation to gp, and then checks the
+// mutant with both go/types and gc. A go/types panic, a gc crash or
+// timeout, or a mutant accepted by only one of them, is reported and
+// the mutant is moved in the crash folder.
+func checkMutant(gp *microsmith.Program, bo microsmith.BuildOptions) {
+	mp, desc, err := gp.Mutate()
+	if err != nil {
+		return
+	}
+	atomic.AddInt64(&stats.mutants, 1)
+
+	if err := mp.WriteToDisk(*workdirF); err != nil {
+		lg.Printf("Could not write program to disk: %s", err)
+		os.Exit(2)
+	}
+
+	crash, tcErr := typecheck(mp)
+	res := mp.CompileContext(fuzzCtx, archs[0], bo)
+	exitOnInfraError(mp, res)
+	if res.Outcome == microsmith.Canceled {
+		deleteBinaries(mp)
+		mp.DeleteSource()
+		return
+	}
+	if res.Outcome == microsmith.LinkError {
+		deleteBinaries(mp)
+	}
+
+	// A crash or a timeout is not a verdict on the mutant, so it's
+	// reported as such, and not compared with go/types.
+	switch res.Outcome {
+	case microsmith.ICE:
+		stats.crashed(res.Output)
+		lg.Printf("-- MUTANT %s\n%v (%v)\ngc crashed:\n%s\n%s",
+			strings.Repeat("-", 50), mp.Name(), desc, firstLines(res.Output, 5), separator)
+		saveCrasher(mp, "crash")
+		return
+	case microsmith.Timeout:
+		lg.Printf("%v took too long to compile [GOARCH=%v]\n", mp.Name(), archs[0])
+		saveCrasher(mp, "crash")
+		return
+	}
+
+	// Only a compilation error is a rejection: after a link error gc
+	// accepted the program, and the problem is elsewhere.
+	gcErr := res.Outcome == microsmith.CompileError
+
+	var msg string
+	switch {
+	case crash != nil:
+		msg = fmt.Sprintf("go/types panicked: %v", crash)
+	case tcErr == nil && gcErr:
+		msg = fmt.Sprintf("accepted by go/types, rejected by gc:\n%s", firstLines(res.Output, 5))
+	case tcErr != nil && !gcErr:
+		msg = fmt.Sprintf("rejected by go/types, accepted by gc:\n%v", tcErr)
+	default:
+		mp.DeleteSource()
+		return
+	}
+
+	atomic.AddInt64(&stats.mismatches, 1)
+	lg.Printf("-- MUTANT %s\n%v (%v)\n%s\n%s",
+		strings.Repeat("-", 50), mp.Name(), desc, msg, separator)
+	saveCrasher(mp, "crash")
+}
+
+// deleteBinaries deletes the files written by gp's last build,
+// logging the ones that couldn't be deleted.
+func deleteBinaries(gp *microsmith.Program) {
+	if err := gp.DeleteBinaries(); err != nil {
+		lg.Printf("could not delete the binaries of %v: %v\n", gp.Name(), err)
+	}
+}
+
+// saveCrasher moves gp's files in a new subfolder of the given
+// workdir folder, and returns the new path of its main file. A
+// crasher that can't be saved can't be reproduced, so the fuzzing
+// stops.
+func saveCrasher(gp *microsmith.Program, folder string) string {
+	path, err := gp.MoveCrasherTo(folder)
+	if err != nil {
+		lg.Printf("Could not save %v: %v\n", gp.Name(), err)
+		os.Exit(2)
+	}
+	return path
+}
+
+// reportBadgen reports an invalid program generated by microsmith,
+// and moves it in the workdir subfolder "badgen".
+func reportBadgen(gp *microsmith.Program, msg string) {
+	atomic.AddInt64(&stats.badgen, 1)
+	lg.Printf("-- BADGEN %s\n%v %s\n%s%s",
+		strings.Repeat("-", 50), gp.Name(), firstLines(msg, 5), gp.Trace(), separator)
+	saveCrasher(gp, "badgen")
+}
+
+// reportNondeterminism reports a program whose builds for arch with
+// options b gave different results, described by diff, and moves it
+// in the workdir subfolder "nondet".
+func reportNondeterminism(gp *microsmith.Program, arch string, b microsmith.BuildOptions, diff string) {
+	atomic.AddInt64(&stats.nondet, 1)
+	path := saveCrasher(gp, "nondet")
+	lg.Printf("-- NONDETERMINISM %s\n%v [GOARCH=%v, %v] saved as %v\n%s%s",
+		strings.Repeat("-", 42), gp.Name(), arch, buildSummary(b), path, diff, separator)
+}
+
+// reportEscape reports a program whose NoEscapeStmt variables were
+// moved to the heap, as listed in moved, and moves it in the workdir
+// subfolder "escape".
+func reportEscape(gp *microsmith.Program, arch string, b microsmith.BuildOptions, moved []string) {
+	atomic.AddInt64(&stats.escapes, 1)
+	path := saveCrasher(gp, "escape")
+	lg.Printf("-- ESCAPE %s\n%v [GOARCH=%v, %v] saved as %v\n%s\n%s",
+		strings.Repeat("-", 50), gp.Name(), arch, buildSummary(b), path, strings.Join(moved, "\n"), separator)
+}
+
+// reportDisagreement reports a program that go/types and gc don't
+// agree on, and moves it in the workdir subfolder "disagree".
+func reportDisagreement(gp *microsmith.Program, msg string) {
+	atomic.AddInt64(&stats.disagreements, 1)
+	lg.Printf("-- DISAGREEMENT %s\n%v %s\n%s%s",
+		strings.Repeat("-", 44), gp.Name(), msg, gp.Trace(), separator)
+	saveCrasher(gp, "disagree")
+}
+
+// typecheck runs gp.Check, recovering from panics in go/types.
+func typecheck(gp *microsmith.Program) (crash any, err error) {
+	defer func() { crash = recover() }()
+	return nil, gp.Check()
+}
+
+// buildsOf returns the builds to run on every program. With -both,
+// every program is built twice for each arch, once with and once
+// without optimizations. With -inline, the builds with optimizations
+// are repeated with every inlining level.
+func buildsOf(bo microsmith.BuildOptions) []microsmith.BuildOptions {
+	builds := []microsmith.BuildOptions{bo}
+	if *bothF {
+		noopt := bo
+		noopt.Noopt = true
+		builds = append(builds, noopt)
+	}
+	if *inlineF {
+		var inl []microsmith.BuildOptions
+		for _, b := range builds {
+			if b.Noopt { // already built with -l
+				inl = append(inl, b)
+				continue
+			}
+			for _, l := range microsmith.InlineLevels {
+				b.Inline = l
+				inl = append(inl, b)
+			}
+		}
+		builds = inl
+	}
+	return builds
+}
+
+// separator ends the crash reports.
+const separator = "------------------------------------------------------------\n"
+
+// newCrashEvent returns the crashEvent of a build of the program name
+// that failed during phase with output out. path is where the crasher
+// was saved.
+func newCrashEvent(name, path, arch string, phase microsmith.BuildPhase, b microsmith.BuildOptions, out string) *crashEvent {
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	return &crashEvent{
+		Program:   name,
+		Arch:      arch,
+		Phase:     phase.String(),
+		Build:     buildSummary(b),
+		Signature: crashSignature(out),
+		Path:      path,
+		Diag:      b.Diag,
+	}
+}
+
+// diagBuild reports whether gp is one of the programs also compiled
+// with -m=2. The choice only depends on gp's seed, so replaying a
+// -seed compiles the same programs with -m=2.
+func diagBuild(gp *microsmith.Program) bool {
+	return *diagF > 0 && gp.Seed()%int64(*diagF) == 0
+}
+
+// crashReport returns the header and the first -crashlines lines of
+// the output out of the build b for arch that crashed with ce.
+func crashReport(ce *crashEvent, arch string, b microsmith.BuildOptions, out string) string {
+	tag := ce.Phase
+	if *bothF {
+		tag += ", " + optLabel(b)
+	}
+	if b.Inline != "" && !*bothF {
+		tag += ", " + b.Inline
+	}
+	if b.Diag {
+		tag += ", -m=2"
+	}
+
+	// the inlining flags can make the tag long enough to overflow
+	// the header
+	pad := 48 - len(tag)
+	if arch != "" {
+		tag = arch + ", " + tag
+		pad -= len(arch) + 2
+	}
+	if pad < 2 {
+		pad = 2
+	}
+	return fmt.Sprintf("-- CRASH (%v) %s\n%v [GOARCH=%v, %v] saved as %v\n%s\n",
+		tag, strings.Repeat("-", pad), ce.Program, ce.Arch, ce.Build, ce.Path, firstLines(out, *crashLinesF))
+}
+
+// buildSummary describes all the options of the build b, for the
+// crash reports.
+func buildSummary(b microsmith.BuildOptions) string {
+	s := optLabel(b)
+	if b.Race {
+		s += ", -race"
+	}
+	if b.Ssacheck {
+		s += ", -d=ssa/check/on"
+	}
+	if b.Diag {
+		s += ", -m=2"
+	}
+	if len(b.Experiments) > 0 {
+		s += ", GOEXPERIMENT=" + strings.Join(b.Experiments, ",")
 	}
-	gp := microsmith.NewProgram(conf)
+	return s
+}
+
+// checkRun typechecks the Go file at path, and then builds it for
+// every arch like Fuzz does, reporting crashes in the same way. It
+// returns false if any of the builds crashed.
+func checkRun(path string, bo microsmith.BuildOptions) bool {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		lg.Println(err)
+		os.Exit(2)
+	}
+
+	gp := microsmith.NewProgramFromSource(programConf(), src)
+	if err := gp.Check(); err != nil {
+		lg.Printf("%v failed checking with error:\n%v\n", path, err)
+	}
+
+	if err := gp.WriteToDisk(*workdirF); err != nil {
+		lg.Printf("Could not write program to disk: %s", err)
+		os.Exit(2)
+	}
+	defer gp.DeleteSource()
+
+	ok := true
+	for _, arch := range archs {
+		for _, b := range buildsOf(bo) {
+			res := gp.Compile(arch, b)
+			exitOnInfraError(gp, res)
+			switch {
+			case !res.Failed():
+				lg.Printf("%v: ok [GOARCH=%v, %v]\n", path, arch, optLabel(b))
+			case isKnown(res.Output):
+				lg.Printf("%v: known crash [GOARCH=%v, %v]\n", path, arch, optLabel(b))
+			default:
+				ce := newCrashEvent(path, path, arch, res.Phase(), b, res.Output)
+				lg.Event("crash", ce, crashReport(ce, arch, b, res.Output)+separator)
+				ok = false
+			}
+			deleteBinaries(gp)
+		}
+	}
+	return ok
+}
+
+// isKnown reports whether the compiler output out matches one of
+// the crashes in crashWhitelist.
+func isKnown(out string) bool {
+	for _, crash := range crashWhitelist {
+		if crash.MatchString(out) {
+			return true
+		}
+	}
+	return false
+}
+
+// optLabel describes the optimization level of a build, for the
+// crash reports.
+func optLabel(bo microsmith.BuildOptions) string {
+	if bo.Noopt {
+		return "noopt"
+	}
+	if bo.Inline != "" {
+		return "opt " + bo.Inline
+	}
+	return "opt"
+}
+
+// programConf returns the ProgramConf selected by the flags.
+func programConf() microsmith.ProgramConf {
+	return microsmith.ProgramConf{
+		MultiPkg:      !*singlePkgF,
+		TypeParams:    !*notpF && *genericF > 0,
+		GenericRatio:  *genericF,
+		WriteBarriers: *wbF,
+		Runtime:       *runtimeF,
+		Trace:         *traceF,
+		NoMain:        *nomainF,
+		Inline:        *inlineF,
+		MultiFile:     *multiFileF,
+		ArchFiles:     *archFilesF,
+		Pragmas:       *pragmasF,
+		Race:          *raceF,
+		NoFloat:       *noFloatF,
+		MinImports:    *minImportsF,
+		NoEscape:      *noEscapeF,
+		Maps:          *mapsF,
+		OnlyType:      *onlyTypeF,
+		Goroutines:    *goroutinesF,
+		PtrSize:       microsmith.PtrSize(archs),
+		Archs:         archs,
+		Target:        guessToolchain(*binF),
+		Vet:           vetTool(),
+	}
+}
+
+// vetTool returns the go command used to run go vet with -vet, or ""
+// without it: the one being fuzzed, or the one in PATH when fuzzing
+// gccgo or tinygo, or with no -bin (for -selftest).
+func vetTool() string {
+	switch {
+	case !*vetF:
+		return ""
+	case *binF != "" && guessToolchain(*binF) == "gc":
+		return *binF
+	default:
+		return "go"
+	}
+}
+
+// selftestRun generates n programs, from the given -seed or from a
+// random one, and typechecks them with go/types. It stops at the
+// first invalid program, printing how to regenerate it, and returns
+// false if there was one.
+func selftestRun(n int) bool {
+	if !seedF.set {
+		seedF.seed, seedF.set = rand.Int63(), true
+	}
+	conf := programConf()
+	conf.Trace = true
+	for index := 0; index < n; index++ {
+		gp := newProgram(conf, 0, index)
+		if err := gp.Check(); err != nil {
+			lg.Printf("%v failed typechecking with error:\n%s\n%s", gp.Name(), err, gp.Trace())
+			lg.Printf("regenerate it with the same flags and -debug -seed %v -index %v\n", seedF.seed, index)
+			return false
+		}
+	}
+	lg.Printf("%v programs ok [seed = %v]\n", n, seedF.seed)
+	return true
+}
+
+func debugRun() {
+	conf := programConf()
+	gp := newProgram(conf, *workerF, *indexF)
 	err := gp.Check()
 	fmt.Println(gp)
+	if *statsF {
+		printCastStats()
+		if ps := microsmith.PragmaStats(); len(ps) > 0 {
+			fmt.Printf("pragmas: %v\n", pragmasString(ps))
+		}
+	}
 	if err != nil {
-		fmt.Printf("Program failed typechecking with error:\n%s\n", err)
+		lg.Printf("Program failed typechecking with error:\n%s\n", err)
+		lg.Printf("%s", gp.Trace())
 		os.Exit(2)
 	}
 }
 
+// printCastStats prints how many times each integer conversion was
+// generated, sorted by (from, to).
+func printCastStats() {
+	stats := microsmith.CastStats()
+	pairs := make([]microsmith.CastPair, 0, len(stats))
+	for p := range stats {
+		pairs = append(pairs, p)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].From != pairs[j].From {
+			return pairs[i].From < pairs[j].From
+		}
+		return pairs[i].To < pairs[j].To
+	})
+	for _, p := range pairs {
+		fmt.Printf("%8s -> %-8s %v\n", p.From, p.To, stats[p])
+	}
+}
+
+// pragmasString returns the number of functions with each compiler
+// directive in stats, like "noinline 12, norace 3".
+func pragmasString(stats map[string]int64) string {
+	names := make([]string, 0, len(stats))
+	for p := range stats {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for i, p := range names {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%v %v", p, stats[p])
+	}
+	return sb.String()
+}
+
+// newProgram returns the index-th program generated by worker. When
+// -seed is set, the program's name and content only depend on
+// (seed, worker, index); otherwise they are random.
+func newProgram(conf microsmith.ProgramConf, worker, index int) *microsmith.Program {
+	if seedF.set {
+		return microsmith.NewProgram(
+			conf,
+			microsmith.ProgramID(worker, index),
+			microsmith.ProgramSeed(seedF.seed, worker, index),
+		)
+	}
+	return microsmith.NewProgram(conf, microsmith.RandID(), rand.Int63())
+}
+
+// minimizeRun reduces every crasher in dir, and then writes one
+// representative for each distinct reduced program in dir/min. A
+// crasher is either a .go file, or a subfolder (where Fuzz saves them)
+// holding all the files of a program.
+//
+// A crasher is reduced for the first arch it crashes on, and the
+// reduced program must crash there in the same way: an internal
+// compiler error or a failed link with the same signature, and not
+// just any compilation error.
+func minimizeRun(dir string, bo microsmith.BuildOptions) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		lg.Println(err)
+		os.Exit(2)
+	}
+
+	// Returns the outcome and signature of the crash of gp when
+	// built for arch, or "" if gp compiles fine or has a
+	// compilation error.
+	crash := func(gp *microsmith.Program, arch string) string {
+		if err := gp.WriteToDisk(*workdirF); err != nil {
+			lg.Printf("Could not write program to disk: %s", err)
+			os.Exit(2)
+		}
+		defer gp.DeleteSource()
+		res := gp.Compile(arch, bo)
+		exitOnInfraError(gp, res)
+		deleteBinaries(gp)
+		if res.Outcome != microsmith.ICE && res.Outcome != microsmith.LinkError {
+			return ""
+		}
+		return fmt.Sprintf("%v: %v", res.Outcome, crashSignature(res.Output))
+	}
+
+	type crasher struct {
+		name string // the crasher's file or folder in dir
+		prog *microsmith.Program
+	}
+	n := 0
+	var reduced []crasher
+	seen := make(map[string]string) // reduced source -> crasher name
+	for _, e := range entries {
+		name, path := e.Name(), filepath.Join(dir, e.Name())
+		var gp *microsmith.Program
+		switch {
+		case strings.HasPrefix(name, ".") || name == "min":
+			continue // folders still being written by MoveCrasher, or our output
+		case e.IsDir():
+			gp, err = microsmith.NewProgramFromDir(path)
+			if err != nil {
+				lg.Printf("%v: %v, skipping\n", path, err)
+				continue
+			}
+		case strings.HasSuffix(name, ".go"):
+			src, err := os.ReadFile(path)
+			if err != nil {
+				lg.Println(err)
+				os.Exit(2)
+			}
+			gp = microsmith.NewProgramFromSource(microsmith.ProgramConf{}, src)
+		default:
+			continue
+		}
+		n++
+
+		var arch, sig string
+		for _, arch = range archs {
+			if sig = crash(gp, arch); sig != "" {
+				break
+			}
+		}
+		if sig == "" {
+			lg.Printf("%v: does not crash, skipping\n", path)
+			continue
+		}
+
+		red, err := microsmith.ReduceProgram(gp, func(p *microsmith.Program) bool {
+			return crash(p, arch) == sig
+		})
+		if err != nil {
+			lg.Printf("%v: %v, skipping\n", path, err)
+			continue
+		}
+
+		if f, ok := seen[red.String()]; ok {
+			lg.Printf("%v: same as %v\n", path, f)
+			continue
+		}
+		seen[red.String()] = name
+		reduced = append(reduced, crasher{name, red})
+	}
+
+	out := filepath.Join(dir, "min")
+	if err := os.MkdirAll(out, os.ModePerm); err != nil {
+		lg.Println(err)
+		os.Exit(2)
+	}
+	for _, c := range reduced {
+		var err error
+		if strings.HasSuffix(c.name, ".go") {
+			err = os.WriteFile(filepath.Join(out, c.name), []byte(c.prog.String()), 0644)
+		} else if err = os.MkdirAll(filepath.Join(out, c.name), os.ModePerm); err == nil {
+			err = c.prog.WriteToDisk(filepath.Join(out, c.name))
+		}
+		if err != nil {
+			lg.Println(err)
+			os.Exit(2)
+		}
+	}
+	lg.Printf("%v crashers, %v distinct\n", n, len(reduced))
+}
+
+var posRe = regexp.MustCompile(`^[^ ]*:\d+:\d+: `)
+
+// crashSignature returns the first line of the compiler output out,
+// stripped of source positions (which change during reduction).
+func crashSignature(out string) string {
+	line, _, _ := strings.Cut(out, "\n")
+	return posRe.ReplaceAllString(line, "")
+}
+
 func installDeps(arch string, bo microsmith.BuildOptions) {
 	var cmd *exec.Cmd
 	if bo.Race {
@@ -220,15 +1460,13 @@ func installDeps(arch string, bo microsmith.BuildOptions) {
 
 	env = append(env, "GOOS="+goos, "GOARCH="+arch, "GODEBUG=installgoroot=all")
 
-	if exp := bo.Experiment; exp != "" {
-		env = append(env, "GOEXPERIMENT="+exp)
-	}
+	env = bo.SetExperiments(env)
 
 	cmd.Env = env
 
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		fmt.Printf("Installing dependencies failed with error:\n----\n%s\n%s\n----\n", out, err)
+		lg.Printf("Installing dependencies failed with error:\n----\n%s\n%s\n----\n", out, err)
 		os.Exit(2)
 	}
 }
@@ -236,7 +1474,7 @@ func installDeps(arch string, bo microsmith.BuildOptions) {
 func guessToolchain(bin string) string {
 	switch {
 	case strings.Contains(bin, "gcc"):
-		return "gcc"
+		return "gccgo"
 	case strings.Contains(bin, "tinygo"):
 		return "tinygo"
 	default:
@@ -244,15 +1482,24 @@ func guessToolchain(bin string) string {
 	}
 }
 
-func fiveLines(s string) string {
+// firstLines returns the first n lines of s, or all of s if n is 0.
+// Since a single line can be very long, s is also truncated after
+// about 200 bytes per line.
+func firstLines(s string, n int) string {
+	if n == 0 {
+		return s
+	}
 	nl := 0
 	for i := range s {
 		if s[i] == '\n' {
 			nl++
 		}
-		if nl == 5 {
+		if nl == n {
 			return s[:i] + "\n..."
 		}
+		if i >= 200*n {
+			return s[:i] + "..."
+		}
 	}
 	return s
 }
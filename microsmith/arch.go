@@ -0,0 +1,168 @@
+package microsmith
+
+import (
+	"bytes"
+	"go/ast"
+	"go/build/constraint"
+	"go/types"
+	"runtime"
+	"strings"
+)
+
+// The GOARCHes ArchFuncs splits among the per-arch files.
+var goarches = []string{
+	"386", "amd64", "arm", "arm64", "loong64", "mips", "mipsle",
+	"mips64", "mips64le", "ppc64", "ppc64le", "riscv64", "s390x", "wasm",
+}
+
+// goosArch returns the GOOS and GOARCH that programs are built for
+// when fuzzing arch, which can also be one of the 386sf and amd64_v3
+// variants, or empty for the host's GOARCH.
+func goosArch(arch string) (string, string) {
+	switch arch {
+	case "":
+		return "linux", runtime.GOARCH
+	case "wasm":
+		return "js", "wasm"
+	case "386sf":
+		return "linux", "386"
+	case "amd64_v3":
+		return "linux", "amd64"
+	default:
+		return "linux", arch
+	}
+}
+
+// PtrSize returns the pointer width of the narrowest of the given
+// archs (as accepted by goosArch), so that generated programs are
+// valid on all of them.
+func PtrSize(archs []string) int {
+	size := 8
+	for _, a := range archs {
+		_, goarch := goosArch(a)
+		if s := types.SizesFor("gc", goarch); s != nil {
+			if ps := int(s.Sizeof(types.Typ[types.Uintptr])); ps < size {
+				size = ps
+			}
+		}
+	}
+	return size
+}
+
+// An archGroup is one of the files generated by ArchFuncs, with the
+// declarations it makes for the GOARCHes satisfying its build
+// constraint.
+type archGroup struct {
+	constraint constraint.Expr
+	decls      []ast.Decl
+	file       *ast.File // set by Files
+}
+
+// ArchFuncs declares a function with a different body in each of 2
+// to 4 files with //go:build constraints, one for each of a few
+// random groups of GOARCHes, and a last one for all the others:
+//
+//	//go:build arm64 || riscv64
+//	func F5() (int, string) { ... }
+//
+//	//go:build !(arm64 || riscv64)
+//	func F5() (int, string) { ... }
+//
+// For every GOARCH exactly one of the files is built, so F5, which
+// is added to the package functions, is declared once. The files are
+// returned by Files after the other ones.
+func (pb *PackageBuilder) ArchFuncs() {
+	seq := pb.ctx.Trace("ArchFuncs", nil, 0)
+
+	returnTypes := []Type{}
+	results := &ast.FieldList{}
+	for i := 0; i < 1+pb.rs.Intn(3); i++ {
+		typ := RandItem(pb.rs, pb.baseTypes)
+		results.List = append(results.List, &ast.Field{Type: typ.Ast()})
+		returnTypes = append(returnTypes, typ)
+	}
+	name := pb.FuncIdent(len(pb.funcs))
+	typ := &ast.FuncType{Params: &ast.FieldList{}, Results: results}
+
+	// n groups of the shuffled GOARCHes, from the first k of them.
+	perm := pb.rs.Perm(len(goarches))
+	n := 1 + pb.rs.Intn(3)
+	k := n + pb.rs.Intn(len(goarches)-n+1)
+	var all constraint.Expr
+	for i := 0; i < n; i++ {
+		var expr constraint.Expr
+		for _, j := range perm[i*k/n : (i+1)*k/n] {
+			tag := &constraint.TagExpr{Tag: goarches[j]}
+			if expr == nil {
+				expr = tag
+			} else {
+				expr = &constraint.OrExpr{X: expr, Y: tag}
+			}
+		}
+		pb.archGroups = append(pb.archGroups, archGroup{constraint: expr})
+		if all == nil {
+			all = expr
+		} else {
+			all = &constraint.OrExpr{X: all, Y: expr}
+		}
+	}
+	pb.archGroups = append(pb.archGroups, archGroup{constraint: &constraint.NotExpr{X: all}})
+
+	for i := range pb.archGroups {
+		fd := &ast.FuncDecl{Name: name, Type: typ, Body: pb.sb.FuncBody(returnTypes)}
+		pb.archGroups[i].decls = []ast.Decl{fd}
+		if i == 0 {
+			pb.funcs = append(pb.funcs, fd)
+		}
+	}
+	pb.ctx.TraceNode(seq, pb.funcs[len(pb.funcs)-1])
+}
+
+// buildConstraint returns the //go:build line of f, if it's one of
+// the files of the archGroups, or "".
+func (pb *PackageBuilder) buildConstraint(f *ast.File) string {
+	for _, g := range pb.archGroups {
+		if g.file == f {
+			return "//go:build " + g.constraint.String()
+		}
+	}
+	return ""
+}
+
+// matches reports whether the //go:build constraint of f, if there's
+// one, is satisfied when building for arch.
+func (f *SourceFile) matches(arch string) bool {
+	goos, goarch := goosArch(arch)
+	src := f.source
+	for len(src) > 0 {
+		var l []byte
+		l, src, _ = bytes.Cut(src, []byte("\n"))
+		line := string(l)
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+		if !constraint.IsGoBuild(line) {
+			continue
+		}
+		expr, err := constraint.Parse(line)
+		if err != nil {
+			return true // let the toolchain report it
+		}
+		return expr.Eval(func(tag string) bool {
+			return tag == goos || tag == goarch || (tag == "unix" && goos == "linux")
+		})
+	}
+	return true
+}
+
+// filenamesFor is like filenames, but only returns the files built
+// for arch.
+func (pkg *Package) filenamesFor(arch string) []string {
+	res := make([]string, 0, len(pkg.files))
+	for _, f := range pkg.files {
+		if f.matches(arch) {
+			res = append(res, f.filename)
+		}
+	}
+	return res
+}
@@ -0,0 +1,110 @@
+package microsmith
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+)
+
+// ASTJSON parses the Go source src, and returns its AST as JSON, for
+// the tools that consume the generated programs structurally. Every
+// node is an object with:
+//
+//   - "kind": the name of its go/ast type, like "CallExpr"
+//   - "pos" and "end": the positions of its first character and of
+//     the character just after it, as {"offset", "line", "column"}
+//   - the other fields of the go/ast type, with the same names: child
+//     nodes as objects, lists as arrays, tokens (like Op or Tok) as
+//     strings, and a missing child as null.
+//
+// The position fields of the go/ast types (like Lparen) are left out,
+// and so are the resolved objects and scopes, and File.Imports and
+// File.Unresolved, which duplicate other nodes.
+func ASTJSON(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, 0)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(astEncoder{fset}.node(f))
+}
+
+type astEncoder struct {
+	fset *token.FileSet
+}
+
+type astPosition struct {
+	Offset int `json:"offset"`
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (e astEncoder) pos(p token.Pos) *astPosition {
+	if !p.IsValid() {
+		return nil
+	}
+	pos := e.fset.Position(p)
+	return &astPosition{pos.Offset, pos.Line, pos.Column}
+}
+
+func (e astEncoder) node(n ast.Node) map[string]any {
+	v := reflect.ValueOf(n).Elem()
+	res := map[string]any{
+		"kind": v.Type().Name(),
+		"pos":  e.pos(n.Pos()),
+		"end":  e.pos(n.End()),
+	}
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if _, ok := n.(*ast.File); ok && (name == "Imports" || name == "Unresolved") {
+			continue
+		}
+		if val, ok := e.value(v.Field(i)); ok {
+			res[name] = val
+		}
+	}
+	return res
+}
+
+// value returns the JSON value of the field v of a node, or false if
+// the field is left out.
+func (e astEncoder) value(v reflect.Value) (any, bool) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if _, ok := v.Interface().(*ast.Object); ok {
+			return nil, false
+		}
+		if _, ok := v.Interface().(*ast.Scope); ok {
+			return nil, false
+		}
+		if v.IsNil() {
+			return nil, true
+		}
+		if n, ok := v.Interface().(ast.Node); ok {
+			return e.node(n), true
+		}
+		return nil, false
+	case reflect.Slice:
+		res := make([]any, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if val, ok := e.value(v.Index(i)); ok {
+				res = append(res, val)
+			}
+		}
+		return res, true
+	}
+
+	switch x := v.Interface().(type) {
+	case token.Pos:
+		return nil, false // covered by pos and end
+	case token.Token:
+		return x.String(), true
+	}
+	switch v.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int:
+		return v.Interface(), true
+	}
+	return nil, false
+}
@@ -2,6 +2,7 @@ package microsmith
 
 import (
 	"go/ast"
+	"go/token"
 	"math/rand"
 	"strconv"
 	"strings"
@@ -29,19 +30,140 @@ type Context struct { // TODO(alb): rename to PackageContext
 	// Wheter we are building a loop body or the argument of a defer
 	// statement.
 	inLoop, inDefer bool
+
+	// The labeled loops enclosing the statement being built, and the
+	// number of loops enclosing it, in the function being built.
+	labels []*loopLabel
+	loops  int
+
+	// the last builder calls, when ProgramConf.Trace is set
+	trace *tracer
+
+	// The declarations of the variables that the statement being
+	// built needs but weren't in scope. nil when not building a
+	// block.
+	pending *pendingDecls
+}
+
+// pendingDecls are declarations that BlockStmt emits before the
+// statement being built, see ExprBuilder.ScopeVar.
+type pendingDecls struct {
+	stmts []ast.Stmt
+	vars  []*ast.Ident
+}
+
+// A loopLabel is the label of a loop being built.
+type loopLabel struct {
+	name  string
+	kind  token.Token // token.FOR or token.RANGE
+	depth int         // the loops enclosing the labeled loop
+	used  bool        // whether a branch statement targets it
+}
+
+// enterFunc hides the labels and loops of the enclosing function
+// while the body of a function literal is built, since the scope of
+// a label excludes the bodies of nested functions. The returned func
+// restores them.
+func (c *Context) enterFunc() func() {
+	labels, loops := c.labels, c.loops
+	c.labels, c.loops = nil, 0
+	return func() { c.labels, c.loops = labels, loops }
+}
+
+// ptrSize returns the size of pointers in the target arch.
+func (c *Context) ptrSize() int {
+	if c.programConf.PtrSize == 0 {
+		return 8
+	}
+	return c.programConf.PtrSize
 }
 
 func NewContext(pc ProgramConf) *Context {
-	return &Context{
+	c := &Context{
 		programConf: pc,
 	}
+	if pc.Trace {
+		c.trace = &tracer{}
+	}
+	return c
 }
 
 // ProgramConf holds program-wide configuration settings that change
 // the kind of programs that are generated.
 type ProgramConf struct {
-	MultiPkg   bool // for -multipkg
-	TypeParams bool // for -tp
+	MultiPkg      bool // for -multipkg
+	TypeParams    bool // for -tp
+	WriteBarriers bool // for -wb
+	Runtime       bool // for -runtime
+	Trace         bool // for -trace
+	NoMain        bool // for -nomain
+	Inline        bool // for -inline
+	MultiFile     bool // for -multifile
+	NoFloat       bool // for -nofloat
+	MinImports    bool // for -minimports
+	NoEscape      bool // for -noescape
+	Maps          bool // for -maps
+	ArchFiles     bool // for -archfiles
+	Pragmas       bool // for -pragmas
+	Race          bool // for -race (only used with Pragmas)
+	PtrSize       int  // pointer width of the target arch (0 means 8)
+	Goroutines    int  // for -goroutines (0 means no goroutine stress)
+
+	// For -onlytype, the name of the basic type that almost all the
+	// generated expressions have (int and bool are still used for
+	// control flow). Empty means all types are used.
+	OnlyType string
+
+	// With TypeParams, the fraction of functions that are generic (0
+	// means all of them).
+	GenericRatio float64
+
+	// For -vet, the go command used by Program.Check to also run go
+	// vet on the programs. Empty means they are not vetted.
+	Vet string
+
+	// The GOARCHes the programs are built for. The constructs in
+	// archSkips for any of them are never generated.
+	Archs []string
+
+	// The toolchain the programs are for: "gc" (or empty), "gccgo",
+	// or "tinygo". The constructs in targetSkips[Target] are never
+	// generated.
+	Target string
+}
+
+// targetSkips lists, for each ProgramConf.Target, the packages,
+// functions, and predeclared types that the toolchain doesn't
+// support, or that make it fail too often for reasons that are
+// already known.
+var targetSkips = map[string][]string{
+	"gccgo":  {"slices", "min", "max"},
+	"tinygo": {"reflect", "complex128"},
+}
+
+// archSkips lists, for each GOARCH, the packages and functions that
+// are pointless to generate in programs built for it. On wasm, which
+// has no threads, runtime.GOMAXPROCS clamps its argument to 1.
+var archSkips = map[string][]string{
+	"wasm": {"runtime.GOMAXPROCS"},
+}
+
+// Skips reports whether the programs for pc.Target and pc.Archs must
+// not use name, which is a package ("reflect"), a function ("min" or
+// "reflect.TypeOf"), or a predeclared type.
+func (pc ProgramConf) Skips(name string) bool {
+	lists := [][]string{targetSkips[pc.Target]}
+	for _, a := range pc.Archs {
+		lists = append(lists, archSkips[a])
+	}
+	for _, l := range lists {
+		for _, s := range l {
+			if name == s || strings.HasPrefix(name, s+".") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // --------------------------------
@@ -70,7 +192,8 @@ func (pb PackageBuilder) RandTypes(n int) []Type {
 }
 
 // Returns a single random type (including structs, array, maps,
-// chans).
+// chans). Struct and interface types are usually taken from the
+// package's pools, rather than built anew.
 func (pb PackageBuilder) RandType() Type {
 	pb.typedepth++
 	defer func() { pb.typedepth-- }()
@@ -78,6 +201,9 @@ func (pb PackageBuilder) RandType() Type {
 	if pb.typedepth >= 5 {
 		return pb.RandBaseType()
 	}
+	if pb.Conf().OnlyType != "" && pb.rs.Intn(2) == 0 {
+		return pb.RandBaseType()
+	}
 
 	switch pb.rs.Intn(15) {
 	case 0, 1:
@@ -92,16 +218,76 @@ func (pb PackageBuilder) RandType() Type {
 	case 5, 6:
 		return PointerOf(pb.RandType())
 	case 7, 8:
+		if len(pb.structPool) > 0 && pb.rs.Intn(4) > 0 {
+			return RandItem(pb.rs, pb.structPool)
+		}
 		return pb.RandStructType()
 	case 9:
 		return pb.RandFuncType()
 	case 10:
+		if len(pb.ifacePool) > 0 && pb.rs.Intn(4) > 0 {
+			return RandItem(pb.rs, pb.ifacePool)
+		}
 		return pb.RandInterfaceType()
+	case 11:
+		if len(pb.namedSlices) > 0 {
+			return RandItem(pb.rs, pb.namedSlices)
+		}
+		return pb.RandBaseType()
 	default:
 		return pb.RandBaseType()
 	}
 }
 
+// Returns a composite type with one of the type parameters of the
+// function being built as element type, like []G0, map[int]G1, or
+// struct{ G0_0 G0 }, or sometimes one mixing two type parameters (see
+// RandTypeParamPair). Must only be called when building a generic
+// function.
+func (pb PackageBuilder) RandTypeParamComposite() Type {
+	if len(pb.ctx.typeparams.vars) > 1 && pb.rs.Intn(4) == 0 {
+		return pb.RandTypeParamPair()
+	}
+	g := MakeTypeParam(RandItem(pb.rs, pb.ctx.typeparams.vars))
+	switch pb.rs.Intn(4) {
+	case 0:
+		return ArrayOf(g)
+	case 1:
+		return MapOf(pb.RandComparableType(), g)
+	case 2:
+		return PointerOf(g)
+	default:
+		return StructType{[]Type{g}, []string{strings.Title(Ident(g)) + "0"}, nil}
+	}
+}
+
+// RandTypeParamPair returns a composite type mixing two different
+// type parameters of the function being built, like map[G0]G1,
+// func(G0) G1, or struct{ G0_0 G0; G1_1 G1 }. Must only be called
+// when building a function with at least two type parameters.
+func (pb PackageBuilder) RandTypeParamPair() Type {
+	vs := pb.ctx.typeparams.vars
+	i := pb.rs.Intn(len(vs))
+	j := (i + 1 + pb.rs.Intn(len(vs)-1)) % len(vs)
+	g0, g1 := MakeTypeParam(vs[i]), MakeTypeParam(vs[j])
+
+	switch pb.rs.Intn(3) {
+	case 0:
+		if g0.Comparable() {
+			return MapOf(g0, g1)
+		}
+		fallthrough
+	case 1:
+		return FuncType{"FU", []Type{g0}, []Type{g1}, true}
+	default:
+		return StructType{
+			[]Type{g0, g1},
+			[]string{strings.Title(Ident(g0)) + "0", strings.Title(Ident(g1)) + "1"},
+			nil,
+		}
+	}
+}
+
 func (pb PackageBuilder) RandComparableType() Type {
 	types := make([]Type, 0, 32)
 
@@ -126,6 +312,9 @@ func (pb PackageBuilder) RandComparableType() Type {
 
 // Returns a single BaseType (primitives, or a type parameter).
 func (pb PackageBuilder) RandBaseType() Type {
+	if t := pb.Conf().OnlyType; t != "" && pb.rs.Intn(4) > 0 {
+		return BT{t}
+	}
 	if tp := pb.ctx.typeparams; tp != nil {
 		i := pb.rs.Intn(len(pb.baseTypes) + len(tp.vars))
 		if i < len(pb.baseTypes) {
@@ -147,16 +336,85 @@ func (pb PackageBuilder) RandNumericType() BasicType {
 }
 
 func (pb PackageBuilder) RandStructType() StructType {
-	st := StructType{[]Type{}, []string{}}
+	st := StructType{[]Type{}, []string{}, nil}
 	for i := 0; i < pb.rs.Intn(6); i++ {
 		t := pb.RandType()
 		st.Ftypes = append(st.Ftypes, t)
 		st.Fnames = append(st.Fnames, strings.Title(Ident(t))+strconv.Itoa(i))
 	}
+
+	// Sometimes add a field of an interface type with methods, so
+	// that methods can be called through it.
+	if pb.rs.Intn(8) == 0 {
+		if t := pb.RandInterfaceType(); len(t.Methods) > 0 {
+			st.Ftypes = append(st.Ftypes, t)
+			st.Fnames = append(st.Fnames, strings.Title(Ident(t))+strconv.Itoa(len(st.Fnames)))
+		}
+	}
+
+	// Sometimes tag some of the fields.
+	if len(st.Fnames) > 0 && pb.rs.Intn(4) == 0 {
+		st.Ftags = make([]string, len(st.Fnames))
+		for i := range st.Ftags {
+			if pb.rs.Intn(2) == 0 {
+				st.Ftags[i] = pb.RandTag(st.Fnames[i])
+			}
+		}
+	}
+	return st
+}
+
+var tagKeys = []string{"json", "xml", "yaml", "db", "ms"}
+
+// RandTag returns a tag for the struct field name, usually a few
+// key:"value" pairs, like
+//
+//	json:"a0,omitempty" xml:"a0"
+//
+// and sometimes an unusual one: a very long tag, one with duplicate
+// keys, or one with characters that can't appear in a raw string
+// literal. They all follow the reflect.StructTag conventions, which
+// go vet checks.
+func (pb PackageBuilder) RandTag(name string) string {
+	name = strings.ToLower(name)
+	switch pb.rs.Intn(16) {
+	case 0:
+		return `json:"` + strings.Repeat(name, 100+pb.rs.Intn(400)) + `"`
+	case 1:
+		return `ms:"` + name + `" json:"` + name + `" ms:"-"`
+	case 2:
+		return `ms:"` + "`" + name + "\x00\x7f\ufeffè" + `" ms:""`
+	}
+
+	var pairs []string
+	for i := 0; i < 1+pb.rs.Intn(3); i++ {
+		v := name
+		if pb.rs.Intn(3) == 0 {
+			v += ",omitempty"
+		}
+		pairs = append(pairs, RandItem(pb.rs, tagKeys)+":"+strconv.Quote(v))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// Returns a struct type with 8 to 16 fields of base types, so that
+// copying its values is expensive.
+func (pb PackageBuilder) RandBigStructType() StructType {
+	st := StructType{[]Type{}, []string{}, nil}
+	for i := 0; i < 8+pb.rs.Intn(9); i++ {
+		t := pb.RandBaseType()
+		st.Ftypes = append(st.Ftypes, t)
+		st.Fnames = append(st.Fnames, strings.Title(Ident(t))+strconv.Itoa(i))
+	}
 	return st
 }
 
 func (pb PackageBuilder) RandFuncType() FuncType {
+	// func(), the type of callbacks, cleanups, and goroutine bodies
+	if pb.rs.Intn(8) == 0 {
+		return FuncType{"FU", []Type{}, []Type{}, true}
+	}
+
 	args := make([]Type, 0, pb.rs.Intn(8))
 
 	// arguments
@@ -169,8 +427,12 @@ func (pb PackageBuilder) RandFuncType() FuncType {
 		args[len(args)-1] = EllipsisType{Base: args[len(args)-1]}
 	}
 
-	// return type
-	ret := []Type{pb.RandType()}
+	// return type, or none. Calls to functions with no results can
+	// only be statements, so Contains and RandFuncRet exclude them.
+	ret := []Type{}
+	if pb.rs.Intn(6) > 0 {
+		ret = append(ret, pb.RandType())
+	}
 
 	return FuncType{"FU", args, ret, true}
 }
@@ -0,0 +1,119 @@
+package microsmith
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Corpus archives a sample of the generated Programs in a folder, as
+// gzipped files holding the Program source and the settings used to
+// generate it. When the total size of the archived files exceeds a
+// limit, the oldest ones are evicted.
+type Corpus struct {
+	dir     string
+	every   int   // archive one Program every `every`
+	maxSize int64 // max total size of the archived files, in bytes
+
+	mu    sync.Mutex
+	count int           // Programs seen so far
+	files []corpusEntry // archived files, oldest first
+	size  int64         // total size of the archived files
+}
+
+type corpusEntry struct {
+	path string
+	size int64
+}
+
+// NewCorpus returns a Corpus archiving one Program every `every` in
+// the folder dir, which is created if it doesn't exist. Files already
+// in dir count towards the size limit, and are the first to be
+// evicted.
+func NewCorpus(dir string, every int, maxSize int64) (*Corpus, error) {
+	if every < 1 {
+		return nil, fmt.Errorf("invalid sampling rate %v", every)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	c := &Corpus{dir: dir, every: every, maxSize: maxSize}
+
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for _, de := range des {
+		if fi, err := de.Info(); err == nil && fi.Mode().IsRegular() {
+			infos = append(infos, fi)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for _, fi := range infos {
+		c.files = append(c.files, corpusEntry{filepath.Join(dir, fi.Name()), fi.Size()})
+		c.size += fi.Size()
+	}
+
+	return c, nil
+}
+
+// Add signals to the Corpus that prog was successfully built. One
+// every c.every calls, prog is archived.
+func (c *Corpus) Add(prog *Program) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.count++
+	if c.count%c.every != 0 {
+		return nil
+	}
+
+	path := filepath.Join(c.dir, prog.Name()+".go.gz")
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(fh)
+	fmt.Fprintf(zw, "// seed: %v\n// conf: %+v\n\n", prog.seed, prog.conf)
+	fmt.Fprint(zw, prog.String())
+	if err := zw.Close(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	c.files = append(c.files, corpusEntry{path, fi.Size()})
+	c.size += fi.Size()
+
+	// evict the oldest files, but never the one we just added
+	for c.size > c.maxSize && len(c.files) > 1 {
+		if err := os.Remove(c.files[0].path); err != nil {
+			return err
+		}
+		c.size -= c.files[0].size
+		c.files = c.files[1:]
+	}
+
+	return nil
+}
+
+// Size returns the number of files in the Corpus and their total
+// size.
+func (c *Corpus) Size() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.files), c.size
+}
@@ -0,0 +1,116 @@
+package microsmith
+
+import (
+	"bytes"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"math/rand"
+)
+
+// SetRename replaces the function used by MoveCrasherTo to move
+// files, and returns a function restoring it.
+func SetRename(f func(from, to string) error) func() {
+	old := rename
+	rename = f
+	return func() { rename = old }
+}
+
+// SetRenameDir replaces the function used by MoveCrasherTo to rename
+// its temporary folder, and returns a function restoring it.
+func SetRenameDir(f func(from, to string) error) func() {
+	old := renameDir
+	renameDir = f
+	return func() { renameDir = old }
+}
+
+// SetVet sets the go command prog is vetted with by Check.
+func SetVet(prog *Program, tc string) {
+	prog.conf.Vet = tc
+}
+
+// VetTool returns the go command prog is vetted with by Check.
+func VetTool(prog *Program) string {
+	return prog.conf.Vet
+}
+
+// RandVarSubTypes returns n variables drawn by RandVarSubType(t) from
+// a scope holding vars.
+func RandVarSubTypes(vars []Variable, t Type, n int) []Variable {
+	s := Scope{pb: &PackageBuilder{rs: rand.New(rand.NewSource(1))}, vars: vars}
+	res := make([]Variable, 0, n)
+	for i := 0; i < n; i++ {
+		v, ok := s.RandVarSubType(t)
+		if !ok {
+			break
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+// EmptyScopeSource returns the source of a package p built starting
+// from a scope holding only the predeclared functions: a package-level
+// variable initialized by Expr for every base type, and a function
+// whose body is built by BlockStmt, followed by the types they use.
+func EmptyScopeSource(seed int64) []byte {
+	conf := ProgramConf{MinImports: true}
+	pb := NewPackageBuilder(conf, "p", NewProgramBuilder(conf, "p", seed))
+
+	f := &ast.File{Name: &ast.Ident{Name: "p"}}
+	for _, t := range pb.baseTypes {
+		vs := &ast.ValueSpec{Names: []*ast.Ident{{Name: "_"}}, Type: t.Ast(), Values: []ast.Expr{pb.eb.Expr(t)}}
+		f.Decls = append(f.Decls, &ast.GenDecl{Tok: token.VAR, Specs: []ast.Spec{vs}})
+	}
+	f.Decls = append(f.Decls, &ast.FuncDecl{
+		Name: &ast.Ident{Name: "F"},
+		Type: &ast.FuncType{Params: &ast.FieldList{}},
+		Body: pb.sb.BlockStmt(),
+	})
+	f.Decls = append(f.Decls, pb.Impls()...)
+
+	var buf bytes.Buffer
+	printer.Fprint(&buf, token.NewFileSet(), f)
+	return buf.Bytes()
+}
+
+// PackagesSource returns the concatenated sources of pkgs.
+func PackagesSource(pkgs []*Package) string {
+	var buf bytes.Buffer
+	for _, p := range pkgs {
+		for _, f := range p.files {
+			buf.Write(f.source)
+		}
+	}
+	return buf.String()
+}
+
+// FilenamesFor returns the names of the files of each package of
+// prog that are built for arch.
+func FilenamesFor(prog *Program, arch string) [][]string {
+	res := make([][]string, 0, len(prog.pkgs))
+	for _, pkg := range prog.pkgs {
+		res = append(res, pkg.filenamesFor(arch))
+	}
+	return res
+}
+
+// Sources returns the source of every file of prog.
+func Sources(prog *Program) [][]byte {
+	var srcs [][]byte
+	for _, p := range prog.pkgs {
+		for _, f := range p.files {
+			srcs = append(srcs, f.source)
+		}
+	}
+	return srcs
+}
+
+// PackageNames returns the names of prog's packages, in order.
+func PackageNames(prog *Program) []string {
+	var res []string
+	for _, p := range prog.pkgs {
+		res = append(res, p.name)
+	}
+	return res
+}
@@ -3,6 +3,7 @@ package microsmith
 import (
 	"go/ast"
 	"go/token"
+	"math"
 	"math/rand"
 	"strconv"
 	"strings"
@@ -18,7 +19,8 @@ type ExprBuilder struct {
 	R  *rand.Rand
 	S  *Scope
 
-	depth int // how deep the expr hierarchy is
+	depth   int // how deep the expr hierarchy is
+	ptrSize int // size of int, uint, and uintptr in the target arch
 }
 
 func NewExprBuilder(pb *PackageBuilder) *ExprBuilder {
@@ -27,6 +29,8 @@ func NewExprBuilder(pb *PackageBuilder) *ExprBuilder {
 		C:  pb.ctx,
 		R:  pb.rs,
 		S:  pb.ctx.scope,
+
+		ptrSize: pb.ctx.ptrSize(),
 	}
 }
 
@@ -41,18 +45,42 @@ func (eb *ExprBuilder) Deepen() bool {
 }
 
 func (eb *ExprBuilder) BasicLit(t BasicType) ast.Expr {
+	switch t.Name() {
+	case "byte", "uint32", "uint64", "uint", "uintptr", "int", "int8", "int16", "int32", "int64":
+		// Once in a while, draw from the whole range of t in the
+		// target arch (int, uint, and uintptr are only 32 bits wide
+		// on 32-bit arches). Signed literals stay a little below the
+		// max, so the unary operators applied to them can't make
+		// them overflow.
+		if eb.R.Intn(16) == 0 {
+			max := eb.IntMax(t)
+			v := eb.R.Uint64() & max
+			if !strings.HasPrefix(t.N, "u") && t.N != "byte" && v > max-16 {
+				v = max - 16
+			}
+			return &ast.BasicLit{Kind: token.INT, Value: strconv.FormatUint(v, 10)}
+		}
+		return IntLits[eb.R.Intn(100)]
+	case "any":
+		return IntLits[eb.R.Intn(100)]
+	}
+
 	bl := new(ast.BasicLit)
 	switch t.Name() {
-	case "byte", "uint32", "uint64", "uint", "uintptr", "int", "int8", "int16", "int32", "int64", "any":
-		bl.Kind = token.INT
-		bl.Value = strconv.Itoa(eb.R.Intn(100))
 	case "rune":
 		bl.Kind = token.CHAR
-		bl.Value = RandRune()
+		bl.Value = RandRune(eb.R)
 	case "float32", "float64":
 		bl.Kind = token.FLOAT
 		bl.Value = strconv.FormatFloat(1e4*(eb.R.Float64()), 'f', 1, 64)
 	case "complex128":
+		// Sometimes combine a real and an imaginary part.
+		if eb.R.Intn(3) == 0 {
+			return &ast.CallExpr{
+				Fun:  SharedIdent("complex"),
+				Args: []ast.Expr{eb.BasicLit(BT{"float64"}), eb.BasicLit(BT{"float64"})},
+			}
+		}
 		// There's no complex basiclit, generate an IMAG
 		bl.Kind = token.IMAG
 		bl.Value = strconv.FormatFloat(1e4*(eb.R.Float64()), 'f', 2, 64) + "i"
@@ -64,7 +92,7 @@ func (eb *ExprBuilder) BasicLit(t BasicType) ast.Expr {
 		}
 	case "string":
 		bl.Kind = token.STRING
-		bl.Value = RandString()
+		bl.Value = RandString(eb.R)
 	default:
 		panic("Unimplemented for " + t.Name())
 	}
@@ -72,6 +100,72 @@ func (eb *ExprBuilder) BasicLit(t BasicType) ast.Expr {
 	return bl
 }
 
+// UsesTypeParams reports whether t mentions one of the type
+// parameters of the function being built.
+func (eb *ExprBuilder) UsesTypeParams(t Type) bool {
+	tp := eb.C.typeparams
+	if tp == nil {
+		return false
+	}
+	found := false
+	ast.Inspect(t.Ast(), func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok {
+			for _, v := range tp.vars {
+				if v.Name.Name == id.Name {
+					found = true
+				}
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// IntMax returns the largest value of the integer type t (or of its
+// underlying type, if t is a named type) in the target arch, or
+// math.MaxUint64 if t is not an integer type.
+func (eb *ExprBuilder) IntMax(t Type) uint64 {
+	bits := eb.IntBits(t)
+	if bits == 0 {
+		return math.MaxUint64
+	}
+	if n := underlying(t).N; strings.HasPrefix(n, "int") || n == "rune" {
+		bits--
+	}
+	return ^uint64(0) >> (64 - bits)
+}
+
+// IntBits returns the width in bits of the integer type t (or of its
+// underlying type, if t is a named type) in the target arch, or 0 if
+// t is not an integer type.
+func (eb *ExprBuilder) IntBits(t Type) int {
+	switch underlying(t).N {
+	case "int8", "byte":
+		return 8
+	case "int16":
+		return 16
+	case "int32", "uint32", "rune":
+		return 32
+	case "int64", "uint64":
+		return 64
+	case "int", "uint", "uintptr":
+		return 8 * eb.ptrSize
+	default:
+		return 0
+	}
+}
+
+// underlying returns t if it's a BasicType, or the underlying type
+// of t if it's a NamedType with a basic underlying type. Otherwise
+// it returns the zero BasicType.
+func underlying(t Type) BasicType {
+	if nt, ok := t.(NamedType); ok {
+		t = nt.U
+	}
+	bt, _ := t.(BasicType)
+	return bt
+}
+
 func (eb *ExprBuilder) CompositeLit(t Type) *ast.CompositeLit {
 	switch t := t.(type) {
 	case BasicType:
@@ -81,7 +175,9 @@ func (eb *ExprBuilder) CompositeLit(t Type) *ast.CompositeLit {
 		elems := []ast.Expr{}
 		if eb.R.Intn(4) > 0 { // plain array literal
 			for i := 0; i < eb.R.Intn(5); i++ {
-				if eb.Deepen() {
+				if ft, ok := t.Base().(FuncType); ok && eb.R.Intn(2) == 0 {
+					elems = append(elems, eb.FuncLit(ft))
+				} else if eb.Deepen() {
 					elems = append(elems, eb.Expr(t.Base()))
 				} else {
 					elems = append(elems, eb.VarOrLit(t.Base()))
@@ -90,12 +186,12 @@ func (eb *ExprBuilder) CompositeLit(t Type) *ast.CompositeLit {
 		} else { // keyed literals
 			if eb.Deepen() {
 				elems = append(elems, &ast.KeyValueExpr{
-					Key:   eb.BasicLit(BT{N: "int"}),
+					Key:   IntLits[eb.R.Intn(100)],
 					Value: eb.Expr(t.Base()),
 				})
 			} else {
 				elems = append(elems, &ast.KeyValueExpr{
-					Key:   eb.BasicLit(BT{N: "int"}),
+					Key:   IntLits[eb.R.Intn(100)],
 					Value: eb.VarOrLit(t.Base()),
 				})
 			}
@@ -110,7 +206,13 @@ func (eb *ExprBuilder) CompositeLit(t Type) *ast.CompositeLit {
 			// compilation error.
 			for i := 0; i < eb.R.Intn(4); i++ {
 				ek, ok := eb.NonConstantExpr(t.KeyT)
-				cl.Elts = append(cl.Elts, &ast.KeyValueExpr{Key: ek, Value: eb.Expr(t.ValueT)})
+				var ev ast.Expr
+				if ft, isFunc := t.ValueT.(FuncType); isFunc && eb.R.Intn(2) == 0 {
+					ev = eb.FuncLit(ft)
+				} else {
+					ev = eb.Expr(t.ValueT)
+				}
+				cl.Elts = append(cl.Elts, &ast.KeyValueExpr{Key: ek, Value: ev})
 				if !ok {
 					break
 				}
@@ -127,6 +229,13 @@ func (eb *ExprBuilder) CompositeLit(t Type) *ast.CompositeLit {
 		cl := &ast.CompositeLit{Type: t.Ast()}
 		elems := []ast.Expr{}
 		for _, t := range t.Ftypes {
+			// Populate interface fields with a value of a type
+			// implementing them, so calling methods through the
+			// field doesn't always panic.
+			if it, ok := t.(InterfaceType); ok && len(it.Methods) > 0 && !eb.UsesTypeParams(it) {
+				elems = append(elems, &ast.CompositeLit{Type: eb.pb.MakeImpl(it)})
+				continue
+			}
 			if eb.Deepen() {
 				elems = append(elems, eb.Expr(t))
 			} else {
@@ -148,7 +257,24 @@ func (eb *ExprBuilder) TypeParamLit(t TypeParam) ast.Expr {
 	}
 }
 
-func (eb *ExprBuilder) Expr(t Type) ast.Expr {
+// TypeParamConv returns a conversion to t of a variable in scope of
+// another type parameter, like G1(g0_0), or false if there isn't one
+// that can be converted to t.
+func (eb *ExprBuilder) TypeParamConv(t TypeParam) (ast.Expr, bool) {
+	v, ok := eb.S.RandPred(func(v Variable, _ ...Type) bool {
+		tp, ok := v.Type.(TypeParam)
+		return ok && !tp.Equal(t) && tp.ConvertibleTo(t)
+	})
+	if !ok {
+		return nil, false
+	}
+	return &ast.CallExpr{Fun: t.Ast(), Args: []ast.Expr{v.Name}}, true
+}
+
+func (eb *ExprBuilder) Expr(t Type) (e ast.Expr) {
+	seq := eb.C.Trace("Expr", t, eb.depth)
+	defer func() { eb.C.TraceNode(seq, e) }()
+
 	eb.depth++
 	defer func() { eb.depth-- }()
 
@@ -162,8 +288,21 @@ func (eb *ExprBuilder) Expr(t Type) ast.Expr {
 		switch eb.R.Intn(7) {
 		case 0:
 			if bt, ok := t.(BasicType); ok {
+				if eb.IntBits(bt) > 0 {
+					switch eb.R.Intn(4) {
+					case 0, 1:
+						return eb.ChainedCast(bt)
+					case 2:
+						if e, ok := eb.UintptrCast(bt); ok {
+							return e
+						}
+					}
+				}
 				return eb.Cast(bt)
 			}
+			if e, ok := eb.TypeParamConv(t.(TypeParam)); ok {
+				return e
+			}
 			fallthrough
 		case 1, 2, 3:
 			return eb.UnaryExpr(t)
@@ -187,6 +326,12 @@ func (eb *ExprBuilder) Expr(t Type) ast.Expr {
 			}
 		}
 
+		// Once in a while, convert from a named slice type:
+		//   []T(S0)
+		if ns, ok := eb.RandNamedSlice(t); ok && eb.R.Intn(4) == 0 {
+			return &ast.CallExpr{Fun: ConvFun(t), Args: []ast.Expr{eb.VarOrLit(ns)}}
+		}
+
 		if eb.R.Intn(2) == 0 {
 			return eb.MakeAppendCall(t)
 		}
@@ -196,7 +341,29 @@ func (eb *ExprBuilder) Expr(t Type) ast.Expr {
 		return eb.VarOrLit(t)
 
 	case InterfaceType:
-		return &ast.Ident{Name: "nil"}
+		// Sometimes use a value of a package-level type implementing
+		// t. The parentheses avoid a parsing ambiguity when the
+		// literal ends up in an if or for header.
+		if !eb.UsesTypeParams(t) && eb.R.Intn(2) == 0 {
+			return &ast.ParenExpr{X: &ast.CompositeLit{Type: eb.pb.MakeImpl(t)}}
+		}
+		return NilIdent
+
+	case NamedType:
+		if _, ok := t.U.(ArrayType); ok {
+			if eb.R.Intn(2) == 0 {
+				return eb.Conversion(t)
+			}
+			return eb.VarOrLit(t)
+		}
+		switch eb.R.Intn(3) {
+		case 0:
+			return eb.Conversion(t)
+		case 1:
+			return eb.UnaryExpr(t)
+		default:
+			return eb.BinaryExpr(t)
+		}
 
 	case PointerType:
 		// Either return a literal of the requested pointer type, &x
@@ -240,7 +407,7 @@ func (eb *ExprBuilder) Expr(t Type) ast.Expr {
 			// pointer returned by Expr() in UnaryExpr(), and there we
 			// only do that when there's a pointer of that type in
 			// scope, so above we'll always enter the if typeInScope.
-			return &ast.Ident{Name: "nil"}
+			return NilIdent
 		}
 
 	default:
@@ -256,7 +423,7 @@ func (eb *ExprBuilder) NonConstantExpr(t Type) (ast.Expr, bool) {
 	defer func() { eb.depth-- }()
 
 	switch t := t.(type) {
-	case BasicType:
+	case BasicType, NamedType:
 		v, ok := eb.S.RandVar(t)
 		if !ok {
 			return eb.Expr(t), false
@@ -275,6 +442,23 @@ func (eb *ExprBuilder) NonConstantExpr(t Type) (ast.Expr, bool) {
 			Op: op,
 			Y:  eb.Expr(t),
 		}, true
+	case PointerType:
+		// Pointers compare by address, so a newly built pointer
+		// would never match. Use nil, a pointer variable, or the
+		// address of a variable.
+		switch eb.R.Intn(3) {
+		case 1:
+			if v, ok := eb.S.RandVar(t); ok {
+				return v.Name, true
+			}
+		case 2:
+			if _, ok := t.Base().(FuncType); !ok {
+				if v, ok := eb.S.RandVar(t.Base()); ok {
+					return &ast.UnaryExpr{Op: token.AND, X: v.Name}, true
+				}
+			}
+		}
+		return NilIdent, true
 	default:
 		return eb.Expr(t), true
 	}
@@ -290,11 +474,11 @@ func (eb *ExprBuilder) VarOrLit(t Type) ast.Expr {
 		if tp.HasLiterals() && eb.R.Intn(2) == 0 {
 			return eb.TypeParamLit(tp)
 		}
-		if v, ok := eb.S.RandVar(t); !ok {
-			panic("VarOrLit couldn't find a type parameter variable")
-		} else {
+		if v, ok := eb.ScopeVar(t); ok {
 			return v.Name
 		}
+		// *new(G)
+		return &ast.StarExpr{X: &ast.CallExpr{Fun: NewIdent, Args: []ast.Expr{t.Ast()}}}
 	}
 
 	vst, typeCanDerive := eb.S.RandVarSubType(t)
@@ -315,16 +499,24 @@ func (eb *ExprBuilder) VarOrLit(t Type) ast.Expr {
 			}
 		case StructType:
 			return eb.CompositeLit(t)
+		case NamedType:
+			var arg ast.Expr
+			if bt, ok := t.U.(BasicType); ok {
+				arg = eb.BasicLit(bt)
+			} else {
+				arg = eb.VarOrLit(t.U)
+			}
+			return &ast.CallExpr{Fun: t.Ast(), Args: []ast.Expr{arg}}
 		case ChanType:
 			// No literal of type Chan, but we can return make(chan t)
 			return &ast.CallExpr{
-				Fun: &ast.Ident{Name: "make"},
+				Fun: MakeIdent,
 				Args: []ast.Expr{
 					&ast.ChanType{Dir: 3, Value: t.Base().Ast()},
 				},
 			}
 		case PointerType, FuncType, InterfaceType:
-			return &ast.Ident{Name: "nil"}
+			return NilIdent
 		case TypeParam:
 			return eb.TypeParamLit(t)
 
@@ -348,6 +540,43 @@ func (eb *ExprBuilder) VarOrLit(t Type) ast.Expr {
 	return eb.SubTypeExpr(vst.Name, vst.Type, t)
 }
 
+// ScopeVar returns a random variable of type t. If there isn't one in
+// scope, a new one is declared in the block being built, right before
+// the statement using it. It returns false if there isn't one and
+// we're not building a block.
+func (eb *ExprBuilder) ScopeVar(t Type) (Variable, bool) {
+	if v, ok := eb.S.RandVar(t); ok {
+		return v, true
+	}
+	if eb.C.pending == nil {
+		return Variable{}, false
+	}
+
+	// var <id> <t>
+	id := eb.S.NewIdent(t)
+	eb.C.pending.stmts = append(eb.C.pending.stmts, &ast.DeclStmt{
+		Decl: &ast.GenDecl{
+			Tok:   token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{id}, Type: t.Ast()}},
+		},
+	})
+	eb.C.pending.vars = append(eb.C.pending.vars, id)
+	return Variable{t, id}, true
+}
+
+// NonConstantInt returns an int expression that is never constant:
+// an int variable, or len of a slice literal if there's no way to get
+// one.
+func (eb *ExprBuilder) NonConstantInt() ast.Expr {
+	if v, ok := eb.ScopeVar(BT{"int"}); ok {
+		return v.Name
+	}
+	return &ast.CallExpr{
+		Fun:  LenIdent,
+		Args: []ast.Expr{&ast.CompositeLit{Type: &ast.ArrayType{Elt: TypeIdent("int")}}},
+	}
+}
+
 // e: the Expr being built
 // t: the current type of e
 // target: the target type of e
@@ -434,7 +663,11 @@ func (eb *ExprBuilder) MethodExpr(e ast.Expr, t InterfaceType, target Type) ast.
 func (eb *ExprBuilder) IndexExpr(e ast.Expr) *ast.IndexExpr {
 	var i ast.Expr
 	if eb.R.Intn(2) == 0 && eb.Deepen() {
-		i, _ = eb.NonConstantExpr(BT{"int"})
+		var ok bool
+		if i, ok = eb.NonConstantExpr(BT{"int"}); !ok {
+			// could be a negative constant
+			i = eb.NonConstantInt()
+		}
 	} else {
 		i = eb.VarOrLit(BT{"int"})
 	}
@@ -465,7 +698,7 @@ func (eb *ExprBuilder) StructFieldExpr(e ast.Expr, t StructType, target Type) as
 		if ft.Contains(target) {
 			sl := &ast.SelectorExpr{
 				X:   e,
-				Sel: &ast.Ident{Name: t.Fnames[i]},
+				Sel: SharedIdent(t.Fnames[i]),
 			}
 			return eb.SubTypeExpr(sl, ft, target)
 		}
@@ -489,13 +722,13 @@ func (eb *ExprBuilder) SliceExpr(v Variable) *ast.SliceExpr {
 		if eb.R.Intn(8) > 0 {
 			low, ok = eb.NonConstantExpr(BT{"int"})
 			if !ok {
-				panic("NonConstantExpr of int failed")
+				low = eb.NonConstantInt()
 			}
 		}
 		if eb.R.Intn(8) > 0 {
 			high, ok = eb.NonConstantExpr(BT{"int"})
 			if !ok {
-				panic("NonConstantExpr of int failed")
+				high = eb.NonConstantInt()
 			}
 		}
 	} else {
@@ -558,11 +791,9 @@ func (eb *ExprBuilder) BinaryExpr(t Type) ast.Expr {
 		// for booleans, we 50/50 between <bool> BOOL_OP <bool> and
 		// <any comparable> COMPARISON <any comparable>.
 		t = eb.pb.RandComparableType()
-		ops = []token.Token{token.EQL, token.NEQ}
+		ops = eqOps
 		if IsOrdered(t) {
-			ops = append(ops, []token.Token{
-				token.LSS, token.LEQ,
-				token.GTR, token.GEQ}...)
+			ops = ordOps
 		}
 	}
 	if len(ops) > 0 {
@@ -571,6 +802,17 @@ func (eb *ExprBuilder) BinaryExpr(t Type) ast.Expr {
 		return eb.VarOrLit(t)
 	}
 
+	if (ue.Op == token.LAND || ue.Op == token.LOR) && t.Equal(BT{"bool"}) && eb.R.Intn(4) == 0 {
+		return eb.ShortCircuitExpr()
+	}
+
+	// Shifts of type parameters are built below, the others by
+	// ShiftExpr.
+	_, isTP := t.(TypeParam)
+	if (ue.Op == token.SHL || ue.Op == token.SHR) && !isTP {
+		return eb.ShiftExpr(t, ue.Op)
+	}
+
 	t2 := t
 	if ue.Op == token.SHR { // ensure rhs > 0 for shifts
 		t2 = BT{"uint"}
@@ -580,8 +822,12 @@ func (eb *ExprBuilder) BinaryExpr(t Type) ast.Expr {
 	// tree is a variable, or we'll trigger compilation errors as
 	// "constant overflows uint" on Exprs that end up being all
 	// literals (and thus computable at compile time), and outside the
-	// type's range.
-	if _, isTP := t.(TypeParam); IsNumeric(t) || isTP {
+	// type's range. This includes the float and complex types, since
+	// a product of literals can overflow float32. Divisions also need
+	// a variable RHS, or we could end up dividing by a constant zero.
+	nt, isNamed := t.(NamedType)
+	u := underlying(t).N
+	if IsNumeric(t) || isTP || (isNamed && IsNumeric(nt.U)) || u == "uintptr" || u == "complex128" || ue.Op == token.QUO {
 
 		// LHS can be whatever
 		if eb.Deepen() {
@@ -598,13 +844,21 @@ func (eb *ExprBuilder) BinaryExpr(t Type) ast.Expr {
 			ue.Y = eb.SubTypeExpr(vi.Name, vi.Type, t2)
 		} else {
 			// Otherwise, cast from an int.
-			vi, ok := eb.S.RandVar(BT{"int"})
-			if !ok {
-				panic("BinaryExpr: no int in scope")
+			var arg ast.Expr = eb.NonConstantInt()
+			if t2.Name() == "complex128" || (isNamed && nt.U.Name() == "complex128") {
+				// ints can't be converted to complex, build a
+				// complex(float64(i), 0) instead.
+				arg = &ast.CallExpr{
+					Fun: &ast.Ident{Name: "complex"},
+					Args: []ast.Expr{
+						&ast.CallExpr{Fun: TypeIdent("float64"), Args: []ast.Expr{arg}},
+						&ast.BasicLit{Kind: token.INT, Value: "0"},
+					},
+				}
 			}
 			ue.Y = &ast.CallExpr{
 				Fun:  TypeIdent(t2.Name()),
-				Args: []ast.Expr{vi.Name},
+				Args: []ast.Expr{arg},
 			}
 		}
 
@@ -628,6 +882,128 @@ func (eb *ExprBuilder) BinaryExpr(t Type) ast.Expr {
 	return ue
 }
 
+// ShortCircuitExpr returns a boolean expression where the operands
+// evaluated conditionally call a function, or read from a map or
+// through a pointer, like
+//
+//	b && (F() || *p == 5)
+//
+// so that the short-circuit semantics matter.
+func (eb *ExprBuilder) ShortCircuitExpr() *ast.BinaryExpr {
+	ops := []token.Token{token.LAND, token.LOR}
+
+	var x ast.Expr
+	if eb.Deepen() {
+		x = eb.Expr(BT{"bool"})
+	} else {
+		x = eb.VarOrLit(BT{"bool"})
+	}
+
+	return &ast.BinaryExpr{
+		X:  x,
+		Op: RandItem(eb.R, ops),
+		Y: &ast.ParenExpr{
+			X: &ast.BinaryExpr{
+				X:  eb.condOperand(),
+				Op: RandItem(eb.R, ops),
+				Y:  eb.condOperand(),
+			},
+		},
+	}
+}
+
+// condOperand returns a bool expression that calls a function, or
+// that compares a map element or a pointer's target.
+func (eb *ExprBuilder) condOperand() ast.Expr {
+	v, ok := eb.S.RandComparableElem()
+	if !ok || eb.R.Intn(2) == 0 {
+		return eb.RandCallExpr(BT{"bool"})
+	}
+
+	var x ast.Expr
+	var t Type
+	switch vt := v.Type.(type) {
+	case MapType:
+		x, t = eb.MapIndexExpr(v.Name, vt.KeyT), vt.ValueT
+	case PointerType:
+		x, t = eb.StarExpr(v.Name), vt.Base()
+	}
+	return &ast.BinaryExpr{
+		X:  x,
+		Op: RandItem(eb.R, []token.Token{token.EQL, token.NEQ}),
+		Y:  eb.VarOrLit(t),
+	}
+}
+
+// ShiftExpr returns a shift expression of type t, like
+//
+//	x << (e & 63)
+//
+// int expressions are used as args for float64() conversions, and
+// in this:
+//
+//	float64(8 >> i)
+//
+// 8 is actually of type float64 since, from the spec:
+//
+//	If the left operand of a non-constant shift expression is an
+//	untyped constant, it is first implicitly converted to the type
+//	it would assume if the shift expression were replaced by its
+//	left operand alone.
+//
+// and the expression fails to compile with "shift of type float64".
+// To avoid this, the LHS is always typed: a variable, or a converted
+// literal.
+func (eb *ExprBuilder) ShiftExpr(t Type, op token.Token) *ast.BinaryExpr {
+	var x ast.Expr
+	v, isVar := eb.S.RandVar(t)
+	if isVar {
+		x = v.Name
+	} else {
+		x = &ast.CallExpr{Fun: t.Ast(), Args: []ast.Expr{eb.BasicLit(underlying(t))}}
+	}
+
+	return &ast.BinaryExpr{X: x, Op: op, Y: eb.ShiftCount(t, isVar)}
+}
+
+// ShiftCount returns the count for a shift of an integer of type t.
+// Most counts are either masked to be less than t's width, like
+//
+//	(e & 31)
+//
+// or small constants, so that the compiler can prove the shift is
+// bounded. The rest are unbounded. Constant counts are only returned
+// if constOK is true, since if the LHS of the shift is also constant,
+// the shift could overflow.
+func (eb *ExprBuilder) ShiftCount(t Type, constOK bool) ast.Expr {
+	w := eb.IntBits(t)
+	switch r := eb.R.Intn(8); {
+	case r < 2 && constOK:
+		return &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(eb.R.Intn(w))}
+	case r < 6:
+		return &ast.ParenExpr{
+			X: &ast.BinaryExpr{
+				X:  eb.shiftOperand(),
+				Op: token.AND,
+				Y:  &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(w - 1)},
+			},
+		}
+	default:
+		return eb.shiftOperand()
+	}
+}
+
+// shiftOperand returns a non-constant uint expression.
+func (eb *ExprBuilder) shiftOperand() ast.Expr {
+	y, ok := eb.NonConstantExpr(BT{"uint"})
+	if !ok {
+		y = &ast.CallExpr{Fun: TypeIdent("uint"), Args: []ast.Expr{eb.NonConstantInt()}}
+	} else {
+		y = &ast.ParenExpr{X: y}
+	}
+	return y
+}
+
 func (eb *ExprBuilder) Cast(t BasicType) *ast.CallExpr {
 
 	// handle string([]byte) cast
@@ -644,6 +1020,14 @@ func (eb *ExprBuilder) Cast(t BasicType) *ast.CallExpr {
 		}
 	}
 
+	// Once in a while, convert from a named type.
+	if nt, ok := eb.RandConvertibleNamed(t); ok && eb.R.Intn(3) == 0 {
+		return &ast.CallExpr{
+			Fun:  &ast.Ident{Name: t.N},
+			Args: []ast.Expr{eb.castOperand(nt, t)},
+		}
+	}
+
 	// numeric casts
 	t2 := t
 	if IsNumeric(t) {
@@ -655,15 +1039,176 @@ func (eb *ExprBuilder) Cast(t BasicType) *ast.CallExpr {
 
 	return &ast.CallExpr{
 		Fun:  &ast.Ident{Name: t.N},
-		Args: []ast.Expr{eb.VarOrLit(t2)},
+		Args: []ast.Expr{eb.castOperand(t2, t)},
 	}
 }
 
+// castOperand returns a variable or a literal of type from, to be
+// converted to t. Since constant conversions must not overflow, a
+// literal from a type wider than t is drawn from t's range:
+//
+//	int8(int64(37))
+func (eb *ExprBuilder) castOperand(from Type, t BasicType) ast.Expr {
+	if eb.IntMax(from) <= eb.IntMax(t) {
+		return eb.VarOrLit(from)
+	}
+	if v, ok := eb.S.RandVar(from); ok {
+		return v.Name
+	}
+	return &ast.CallExpr{Fun: from.Ast(), Args: []ast.Expr{eb.BasicLit(t)}}
+}
+
+// ChainedCast returns a chain of 2 to 4 conversions between integer
+// types, ending in the integer type t, like
+//
+//	uint8(int64(rune(x)))
+//
+// The innermost operand is never constant, so the chain is not
+// constant-folded and the compiler has to generate the sign and zero
+// extensions.
+func (eb *ExprBuilder) ChainedCast(t Type) ast.Expr {
+	var ints []Type
+	for _, bt := range eb.pb.baseTypes {
+		if eb.IntBits(bt) > 0 {
+			ints = append(ints, bt)
+		}
+	}
+
+	from := RandItem(eb.R, ints)
+	var e ast.Expr
+	if v, ok := eb.S.RandVar(from); ok {
+		e = v.Name
+	} else {
+		from, e = BT{"int"}, eb.NonConstantInt()
+	}
+
+	for n := 1 + eb.R.Intn(3); n >= 0; n-- {
+		to := t
+		if n > 0 {
+			to = RandItem(eb.R, ints)
+		}
+		countCast(from, to)
+		e = &ast.CallExpr{Fun: to.Ast(), Args: []ast.Expr{e}}
+		from = to
+	}
+	return e
+}
+
+// UintptrCast returns a conversion to the integer type t of a uintptr
+// obtained from a 64-bit integer variable, or from a pointer:
+//
+//	int8(uintptr(i64))               // on 64-bit targets
+//	int8(uintptr(i64 & 0xFFFFFFFF))  // on 32-bit targets
+//	int8(uintptr(unsafe.Pointer(p)))
+//
+// On 32-bit targets, the 64-bit operand is masked, so converting it
+// to uintptr doesn't silently drop its high bits. It returns false if
+// uintptr is not one of the package's types.
+func (eb *ExprBuilder) UintptrCast(t BasicType) (ast.Expr, bool) {
+	found := false
+	for _, bt := range eb.pb.baseTypes {
+		found = found || bt.Name() == "uintptr"
+	}
+	if !found {
+		return nil, false
+	}
+
+	var arg ast.Expr
+	if p, ok := eb.S.RandPointer(); ok && !eb.pb.Conf().MinImports && eb.R.Intn(3) == 0 {
+		arg = &ast.CallExpr{Fun: &ast.Ident{Name: "unsafe.Pointer"}, Args: []ast.Expr{p.Name}}
+	} else {
+		from := RandItem(eb.R, []Type{BT{"int64"}, BT{"uint64"}})
+		v, ok := eb.S.RandVar(from)
+		if ok {
+			arg = v.Name
+		} else {
+			arg = &ast.CallExpr{Fun: from.Ast(), Args: []ast.Expr{eb.NonConstantInt()}}
+		}
+		if eb.ptrSize == 4 {
+			arg = &ast.BinaryExpr{
+				X:  arg,
+				Op: token.AND,
+				Y:  &ast.BasicLit{Kind: token.INT, Value: "0xFFFFFFFF"},
+			}
+		}
+	}
+
+	e := &ast.CallExpr{Fun: BT{"uintptr"}.Ast(), Args: []ast.Expr{arg}}
+	if t.Name() == "uintptr" {
+		return e, true
+	}
+	return &ast.CallExpr{Fun: t.Ast(), Args: []ast.Expr{e}}, true
+}
+
+// Returns a random named type that can be converted to t without
+// risking constant truncation errors. Named types with a float
+// underlying type are never returned for numeric t.
+func (eb *ExprBuilder) RandConvertibleNamed(t BasicType) (NamedType, bool) {
+	nts := make([]NamedType, 0, len(eb.pb.namedTypes))
+	for _, nt := range eb.pb.namedTypes {
+		u := nt.U.(BasicType)
+		if IsNumeric(t) && IsNumeric(u) && !strings.HasPrefix(u.N, "float") {
+			nts = append(nts, nt)
+		} else if t.Equal(u) {
+			nts = append(nts, nt)
+		}
+	}
+	if len(nts) == 0 {
+		return NamedType{}, false
+	}
+	return RandItem(eb.R, nts), true
+}
+
+// Returns a random named slice type with underlying type t.
+func (eb *ExprBuilder) RandNamedSlice(t ArrayType) (NamedType, bool) {
+	nts := make([]NamedType, 0, len(eb.pb.namedSlices))
+	for _, nt := range eb.pb.namedSlices {
+		if nt.U.Equal(t) {
+			nts = append(nts, nt)
+		}
+	}
+	if len(nts) == 0 {
+		return NamedType{}, false
+	}
+	return RandItem(eb.R, nts), true
+}
+
+// Conversion returns a conversion to the named type t, from either
+// its underlying type or a different named type with the same
+// underlying type:
+//
+//	N0(<expr>)
+func (eb *ExprBuilder) Conversion(t NamedType) *ast.CallExpr {
+	nts := eb.pb.namedTypes
+	if _, ok := t.U.(ArrayType); ok {
+		nts = eb.pb.namedSlices
+	}
+
+	from := t.U
+	for _, nt := range nts {
+		if !nt.Equal(t) && nt.U.Equal(t.U) && eb.R.Intn(2) == 0 {
+			from = nt
+			break
+		}
+	}
+
+	var arg ast.Expr
+	if eb.Deepen() {
+		arg = eb.Expr(from)
+	} else {
+		arg = eb.VarOrLit(from)
+	}
+	return &ast.CallExpr{Fun: t.Ast(), Args: []ast.Expr{arg}}
+}
+
 // CallExpr returns a call expression with return value of type t. The
 // function can be a builtin or stdlib function, a locally defined
 // function variable, or a function literal that is immediately
 // called.
 func (eb *ExprBuilder) RandCallExpr(t Type) *ast.CallExpr {
+	if ce, ok := eb.ReflectCall(t); ok && !eb.C.inDefer && eb.R.Intn(3) == 0 {
+		return ce
+	}
 	if v, ok := eb.S.RandFuncRet(t); ok && !eb.C.inDefer && eb.R.Intn(4) > 0 {
 		return eb.CallFunction(v, t)
 	} else {
@@ -680,6 +1225,8 @@ func (eb *ExprBuilder) CallFunction(v Variable, ct ...Type) *ast.CallExpr {
 		panic("CallFunction: not a function: " + v.Name.Name)
 	}
 
+	seq := eb.C.Trace("CallFunction", f, eb.depth)
+
 	name := v.Name.Name
 	ce := &ast.CallExpr{}
 	if i := strings.Index(name, "."); i >= 0 {
@@ -744,7 +1291,7 @@ func (eb *ExprBuilder) CallFunction(v Variable, ct ...Type) *ast.CallExpr {
 		if ok && len(v.Type.(StructType).Fnames) > 0 {
 			sl = &ast.SelectorExpr{
 				X:   v.Name,
-				Sel: &ast.Ident{Name: RandItem(eb.R, v.Type.(StructType).Fnames)},
+				Sel: SharedIdent(RandItem(eb.R, v.Type.(StructType).Fnames)),
 			}
 		} else {
 			var st StructType
@@ -753,7 +1300,7 @@ func (eb *ExprBuilder) CallFunction(v Variable, ct ...Type) *ast.CallExpr {
 			}
 			sl = &ast.SelectorExpr{
 				X:   eb.VarOrLit(st),
-				Sel: &ast.Ident{Name: RandItem(eb.R, st.Fnames)},
+				Sel: SharedIdent(RandItem(eb.R, st.Fnames)),
 			}
 		}
 		ce.Args = []ast.Expr{sl}
@@ -787,6 +1334,15 @@ func (eb *ExprBuilder) CallFunction(v Variable, ct ...Type) *ast.CallExpr {
 		}
 
 	case "reflect.DeepEqual":
+		// Sometimes compare a struct with tags, so that its tags are
+		// in the reflect metadata of the binary.
+		if v, ok := eb.S.RandPred(func(v Variable, _ ...Type) bool {
+			st, ok := v.Type.(StructType)
+			return ok && len(st.Ftags) > 0
+		}); ok && eb.R.Intn(2) == 0 {
+			ce.Args = []ast.Expr{v.Name, eb.VarOrLit(v.Type)}
+			break
+		}
 		t1, t2 := eb.pb.RandType(), eb.pb.RandType()
 		if eb.Deepen() {
 			ce.Args = []ast.Expr{eb.Expr(t1), eb.Expr(t2)}
@@ -827,6 +1383,7 @@ func (eb *ExprBuilder) CallFunction(v Variable, ct ...Type) *ast.CallExpr {
 		ce.Args = args
 	}
 
+	eb.C.TraceNode(seq, ce)
 	return ce
 
 }
@@ -834,11 +1391,13 @@ func (eb *ExprBuilder) CallFunction(v Variable, ct ...Type) *ast.CallExpr {
 func (eb *ExprBuilder) MakeAppendCall(t ArrayType) *ast.CallExpr {
 	ce := &ast.CallExpr{Fun: AppendIdent}
 
-	t2 := t.Base()
-	ellips := token.Pos(0)
+	var t2 Type = t.Base()
 	if eb.R.Intn(3) == 0 { // 2nd arg is ...
 		t2 = t
-		ellips = token.Pos(1)
+		ce.Ellipsis = token.Pos(1)
+		if t.Base().Equal(BT{"byte"}) && eb.R.Intn(3) == 0 {
+			t2 = BT{"string"} // append([]byte, string...)
+		}
 	}
 
 	if eb.Deepen() {
@@ -846,7 +1405,21 @@ func (eb *ExprBuilder) MakeAppendCall(t ArrayType) *ast.CallExpr {
 	} else {
 		ce.Args = []ast.Expr{eb.VarOrLit(t), eb.VarOrLit(t2)}
 	}
-	ce.Ellipsis = ellips
+
+	// Spread a different slice variable with the same element type,
+	// possibly of a named slice type.
+	if ce.Ellipsis.IsValid() && t2.Equal(t) && eb.R.Intn(2) == 0 {
+		if v, ok := eb.S.RandPred(func(v Variable, _ ...Type) bool {
+			if nt, ok := v.Type.(NamedType); ok {
+				return nt.U.Equal(t)
+			}
+			return v.Type.Equal(t)
+		}); ok {
+			if id, ok := ce.Args[0].(*ast.Ident); !ok || id.Name != v.Name.Name {
+				ce.Args[1] = v.Name
+			}
+		}
+	}
 
 	return ce
 }
@@ -858,7 +1431,9 @@ func (eb *ExprBuilder) MakeMakeCall(t Type) *ast.CallExpr {
 	switch t := t.(type) {
 	case ArrayType:
 		tn := t.Base().Ast()
-		if eb.Deepen() {
+		if eb.R.Intn(4) == 0 {
+			ce.Args = append([]ast.Expr{&ast.ArrayType{Elt: tn}}, eb.MakeLenCap()...)
+		} else if eb.Deepen() {
 			ce.Args = []ast.Expr{&ast.ArrayType{Elt: tn}, eb.BinaryExpr(BT{"int"})}
 		} else {
 			ce.Args = []ast.Expr{&ast.ArrayType{Elt: tn}, eb.VarOrLit(BT{"int"})}
@@ -877,6 +1452,169 @@ func (eb *ExprBuilder) MakeMakeCall(t Type) *ast.CallExpr {
 	return ce
 }
 
+// ReflectCall returns, when t is string or int and the reflect
+// package can be used, a call to a method of the result of
+// reflect.TypeOf or reflect.ValueOf, one of
+//
+//	reflect.TypeOf(x).String()
+//	reflect.TypeOf(x).Kind().String()
+//	reflect.TypeOf(x).Name()
+//	reflect.ValueOf(x).NumField(), with x a struct
+//	reflect.ValueOf(x).NumMethod()
+//	int(reflect.ValueOf(x).Kind())
+//
+// TypeOf returns nil for a nil interface, and a nil interface has no
+// methods, so in all but the last one x is never one. The Kind of a
+// nil interface is Invalid, so there x can be anything, including a
+// type parameter.
+func (eb *ExprBuilder) ReflectCall(t Type) (*ast.CallExpr, bool) {
+	conf := eb.pb.Conf()
+	if conf.MinImports || conf.Skips("reflect") || !(t.Equal(BT{"string"}) || t.Equal(BT{"int"})) {
+		return nil, false
+	}
+	method := func(x ast.Expr, name string) *ast.CallExpr {
+		return &ast.CallExpr{Fun: &ast.SelectorExpr{X: x, Sel: &ast.Ident{Name: name}}}
+	}
+	randConcrete := func() Type {
+		t := eb.pb.RandType()
+		for !concrete(t) {
+			t = eb.pb.RandType()
+		}
+		return t
+	}
+
+	if t.Equal(BT{"string"}) {
+		rt := eb.ReflectOf("TypeOf", randConcrete(), concrete)
+		switch eb.R.Intn(3) {
+		case 0:
+			return method(rt, "String"), true
+		case 1:
+			return method(method(rt, "Kind"), "String"), true
+		default:
+			return method(rt, "Name"), true
+		}
+	}
+
+	switch eb.R.Intn(3) {
+	case 0:
+		isStruct := func(t Type) bool {
+			if nt, ok := t.(NamedType); ok {
+				t = nt.U
+			}
+			_, ok := t.(StructType)
+			return ok
+		}
+		rv := eb.ReflectOf("ValueOf", eb.pb.RandStructType(), isStruct)
+		return method(rv, "NumField"), true
+	case 1:
+		rv := eb.ReflectOf("ValueOf", randConcrete(), concrete)
+		return method(rv, "NumMethod"), true
+	default:
+		rv := eb.ReflectOf("ValueOf", eb.pb.RandType(), func(Type) bool { return true })
+		return &ast.CallExpr{Fun: SharedIdent("int"), Args: []ast.Expr{method(rv, "Kind")}}, true
+	}
+}
+
+// ReflectOf returns a call to reflect.TypeOf or reflect.ValueOf (as
+// given by fun), passing either a variable in scope whose type
+// satisfies ok, or an expression of type t.
+func (eb *ExprBuilder) ReflectOf(fun string, t Type, ok func(Type) bool) *ast.CallExpr {
+	var arg ast.Expr
+	if v, found := eb.S.RandPred(func(v Variable, _ ...Type) bool {
+		_, isFunc := v.Type.(FuncType) // may be a builtin
+		return !isFunc && ok(v.Type)
+	}); found && eb.R.Intn(2) == 0 {
+		arg = v.Name
+	} else if eb.Deepen() {
+		arg = eb.Expr(t)
+	} else {
+		arg = eb.VarOrLit(t)
+	}
+
+	// An untyped nil would be passed as a nil interface.
+	if arg == NilIdent {
+		arg = &ast.CallExpr{Fun: &ast.ParenExpr{X: t.Ast()}, Args: []ast.Expr{arg}}
+	}
+	return &ast.CallExpr{
+		Fun:  &ast.SelectorExpr{X: &ast.Ident{Name: "reflect"}, Sel: &ast.Ident{Name: fun}},
+		Args: []ast.Expr{arg},
+	}
+}
+
+// concrete reports whether the values of type t are never nil
+// interfaces: t is not an interface type, any, or a type parameter
+// (which can be instantiated with any).
+func concrete(t Type) bool {
+	switch t := t.(type) {
+	case InterfaceType, TypeParam:
+		return false
+	case BasicType:
+		return t.N != "any"
+	}
+	return true
+}
+
+// MakeLenCap returns the length and capacity arguments of a
+// make([]T, len, cap) call, with 0 <= len <= cap, in one of these
+// forms:
+//
+//	make([]T, 4, 9)
+//	make([]T, 4, 6+len(x))
+//	make([]T, len(x), len(x)+5)
+//
+// where x is a slice or string variable in scope. The last two have
+// a capacity only known at run time, which can't be out of range.
+func (eb *ExprBuilder) MakeLenCap() []ast.Expr {
+	l := eb.R.Intn(10)
+	c := l + eb.R.Intn(90)
+	lenX := func(v Variable) ast.Expr {
+		return &ast.CallExpr{Fun: LenIdent, Args: []ast.Expr{v.Name}}
+	}
+	plus := func(x ast.Expr, n int) ast.Expr {
+		return &ast.BinaryExpr{X: x, Op: token.ADD, Y: IntLits[n]}
+	}
+
+	v, ok := eb.S.RandPred(func(v Variable, _ ...Type) bool {
+		_, isSlice := v.Type.(ArrayType)
+		return isSlice || v.Type.Equal(BT{"string"})
+	})
+	if !ok {
+		return []ast.Expr{IntLits[l], IntLits[c]}
+	}
+	switch eb.R.Intn(3) {
+	case 0:
+		return []ast.Expr{IntLits[l], IntLits[c]}
+	case 1:
+		return []ast.Expr{IntLits[l], plus(lenX(v), c)}
+	default:
+		return []ast.Expr{lenX(v), plus(lenX(v), c-l)}
+	}
+}
+
+// BuildCapturingClosure returns a func literal that captures the
+// variable v by reference and assigns to it, then sends it on the
+// channel ch (or, if ch is nil, assigns it to _):
+//
+//	func() {
+//	  v = <expr>
+//	  ch <- v
+//	}
+func (eb *ExprBuilder) BuildCapturingClosure(v Variable, ch ast.Expr) *ast.FuncLit {
+	var use ast.Stmt
+	if ch != nil {
+		use = &ast.SendStmt{Chan: ch, Value: v.Name}
+	} else {
+		use = &ast.AssignStmt{Lhs: []ast.Expr{&noName}, Tok: token.ASSIGN, Rhs: []ast.Expr{v.Name}}
+	}
+	return &ast.FuncLit{
+		Type: &ast.FuncType{Params: &ast.FieldList{}},
+		Body: &ast.BlockStmt{List: []ast.Stmt{
+			&ast.AssignStmt{Lhs: []ast.Expr{v.Name}, Tok: token.ASSIGN, Rhs: []ast.Expr{eb.Expr(v.Type)}},
+			use,
+		}},
+	}
+}
+
 func (eb *ExprBuilder) ConjureAndCallFunc(t Type) *ast.CallExpr {
 
 	ft := &FuncType{"FU", []Type{}, []Type{t}, true}
@@ -884,6 +1622,30 @@ func (eb *ExprBuilder) ConjureAndCallFunc(t Type) *ast.CallExpr {
 		ft.Args = append(ft.Args, eb.pb.RandType())
 	}
 
+	// The arguments of a deferred or go'd call are evaluated and
+	// stored when the statement is executed, so sometimes pass a big
+	// struct, or a closure over a variable in scope.
+	var closure ast.Expr
+	if eb.C.inDefer {
+		if eb.R.Intn(4) == 0 {
+			ft.Args = append(ft.Args, eb.pb.RandBigStructType())
+		}
+		if v, ok := eb.S.RandPred(func(v Variable, _ ...Type) bool {
+			_, fnc := v.Type.(FuncType)
+			return !fnc
+		}); ok && eb.R.Intn(4) == 0 {
+			cft := FuncType{"FU", []Type{}, []Type{v.Type}, true}
+			ft.Args = append(ft.Args, cft)
+			p, r := cft.MakeFieldLists(false, 0)
+			closure = &ast.FuncLit{
+				Type: &ast.FuncType{Params: p, Results: r},
+				Body: &ast.BlockStmt{List: []ast.Stmt{
+					&ast.ReturnStmt{Results: []ast.Expr{v.Name}},
+				}},
+			}
+		}
+	}
+
 	var retExpr ast.Expr
 	if eb.Deepen() {
 		retExpr = eb.Expr(t)
@@ -904,15 +1666,44 @@ func (eb *ExprBuilder) ConjureAndCallFunc(t Type) *ast.CallExpr {
 	// the return statement.
 	if eb.C.inDefer && eb.R.Intn(4) == 0 {
 		fl.Body.List = append(
-			[]ast.Stmt{&ast.ExprStmt{&ast.CallExpr{Fun: &ast.Ident{Name: "recover"}}}},
+			[]ast.Stmt{&ast.ExprStmt{X: &ast.CallExpr{Fun: SharedIdent("recover")}}},
 			fl.Body.List...,
 		)
 	}
 
 	// Finally, call it.
 	args := make([]ast.Expr, 0, len(ft.Args))
-	for _, arg := range ft.Args {
-		args = append(args, eb.VarOrLit(arg))
+	for i, arg := range ft.Args {
+		switch {
+		case closure != nil && i == len(ft.Args)-1:
+			args = append(args, closure)
+		case eb.Deepen():
+			args = append(args, eb.Expr(arg))
+		default:
+			args = append(args, eb.VarOrLit(arg))
+		}
 	}
 	return &ast.CallExpr{Fun: fl, Args: args}
 }
+
+// FuncLit returns a closure of type t, with a body of one statement
+// and a return:
+//
+//	func(int, string) bool {
+//		i0 = <expr>
+//		return <bool expr>
+//	}
+//
+// The statement and the return can use the variables in scope, so the
+// closure usually captures some of them.
+func (eb *ExprBuilder) FuncLit(t FuncType) *ast.FuncLit {
+	ret := &ast.ReturnStmt{}
+	for _, rt := range t.Ret {
+		ret.Results = append(ret.Results, eb.VarOrLit(rt))
+	}
+	p, r := t.MakeFieldLists(false, 0)
+	return &ast.FuncLit{
+		Type: &ast.FuncType{Params: p, Results: r},
+		Body: &ast.BlockStmt{List: []ast.Stmt{eb.pb.sb.AssignStmt(), ret}},
+	}
+}
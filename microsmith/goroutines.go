@@ -0,0 +1,205 @@
+package microsmith
+
+import (
+	"go/ast"
+	"go/token"
+	"strconv"
+)
+
+// MaxGoroutines is the largest value of ProgramConf.Goroutines. The
+// goroutines spawned by a function are all alive at the same time,
+// and each one grows its stack, so a bound is needed to keep the
+// programs' memory usage reasonable when they are run. It's also
+// below the race detector's limit of 8128 live goroutines.
+const MaxGoroutines = 8000
+
+// GoroutineFuncs builds a recursive helper that grows the stack of
+// the goroutine calling it:
+//
+//	func goDeep(n int) int {
+//	  var buf [12]int
+//	  buf[n%12] = n
+//	  if n <= 0 {
+//	    return buf[0]
+//	  }
+//	  return goDeep(n-1) + buf[n%12]
+//	}
+//
+// and a function spawning between ProgramConf.Goroutines/2 and
+// ProgramConf.Goroutines goroutines, which is added to the package
+// functions:
+//
+//	func F4() {
+//	  var wg sync.WaitGroup
+//	  res := make([]int, 731)
+//	  for g := 0; g < 731; g++ {
+//	    wg.Add(1)
+//	    go func(x int) {
+//	      idx := x
+//	      defer wg.Done()
+//	      y := goDeep(x % 23)
+//	      x += y * 3
+//	      res[idx] = x + y
+//	    }(g)
+//	  }
+//	  wg.Wait()
+//	  i = res[730]
+//	}
+//
+// Every goroutine only writes to its own element of res, and the
+// parent only reads res after all of them are done, so the program
+// is race-free.
+func (pb *PackageBuilder) GoroutineFuncs() []ast.Decl {
+	intLit := func(n int) *ast.BasicLit {
+		return &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(n)}
+	}
+	intType := &ast.Ident{Name: "int"}
+	deep := &ast.Ident{Name: "goDeep"}
+
+	// the stack growth helper
+	n, buf := &ast.Ident{Name: "n"}, &ast.Ident{Name: "buf"}
+	size := 4 + pb.rs.Intn(29)
+	elem := func() ast.Expr {
+		return &ast.IndexExpr{X: buf, Index: &ast.BinaryExpr{X: n, Op: token.REM, Y: intLit(size)}}
+	}
+	helper := &ast.FuncDecl{
+		Name: deep,
+		Type: &ast.FuncType{
+			Params:  &ast.FieldList{List: []*ast.Field{{Names: []*ast.Ident{n}, Type: intType}}},
+			Results: &ast.FieldList{List: []*ast.Field{{Type: intType}}},
+		},
+		Body: &ast.BlockStmt{List: []ast.Stmt{
+			&ast.DeclStmt{Decl: &ast.GenDecl{
+				Tok: token.VAR,
+				Specs: []ast.Spec{&ast.ValueSpec{
+					Names: []*ast.Ident{buf},
+					Type:  &ast.ArrayType{Len: intLit(size), Elt: intType},
+				}},
+			}},
+			&ast.AssignStmt{Lhs: []ast.Expr{elem()}, Tok: token.ASSIGN, Rhs: []ast.Expr{n}},
+			&ast.IfStmt{
+				Cond: &ast.BinaryExpr{X: n, Op: token.LEQ, Y: intLit(0)},
+				Body: &ast.BlockStmt{List: []ast.Stmt{
+					&ast.ReturnStmt{Results: []ast.Expr{&ast.IndexExpr{X: buf, Index: intLit(0)}}},
+				}},
+			},
+			&ast.ReturnStmt{Results: []ast.Expr{&ast.BinaryExpr{
+				X:  &ast.CallExpr{Fun: deep, Args: []ast.Expr{&ast.BinaryExpr{X: n, Op: token.SUB, Y: intLit(1)}}},
+				Op: token.ADD,
+				Y:  elem(),
+			}}},
+		}},
+	}
+
+	// the goroutines' body
+	count := pb.Conf().Goroutines/2 + pb.rs.Intn(pb.Conf().Goroutines/2+1)
+	if count == 0 {
+		count = 1
+	}
+	wg, res, g := &ast.Ident{Name: "wg"}, &ast.Ident{Name: "res"}, &ast.Ident{Name: "g"}
+	x, y := &ast.Ident{Name: "x"}, &ast.Ident{Name: "y"}
+	wgCall := func(m string, args ...ast.Expr) ast.Expr {
+		return &ast.CallExpr{Fun: &ast.SelectorExpr{X: wg, Sel: &ast.Ident{Name: m}}, Args: args}
+	}
+	body := []ast.Stmt{
+		&ast.DeferStmt{Call: wgCall("Done").(*ast.CallExpr)},
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{y},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.CallExpr{
+				Fun:  deep,
+				Args: []ast.Expr{&ast.BinaryExpr{X: x, Op: token.REM, Y: intLit(1 + pb.rs.Intn(64))}},
+			}},
+		},
+	}
+	for i := 0; i < pb.rs.Intn(4); i++ {
+		body = append(body, pb.cheapStmt(x, y))
+	}
+
+	// x is modified by the cheap statements, so the index is saved
+	// before them.
+	idx := &ast.Ident{Name: "idx"}
+	body = append([]ast.Stmt{
+		&ast.AssignStmt{Lhs: []ast.Expr{idx}, Tok: token.DEFINE, Rhs: []ast.Expr{x}},
+	}, body...)
+	body = append(body, &ast.AssignStmt{
+		Lhs: []ast.Expr{&ast.IndexExpr{X: res, Index: idx}},
+		Tok: token.ASSIGN,
+		Rhs: []ast.Expr{&ast.BinaryExpr{X: x, Op: token.ADD, Y: y}},
+	})
+
+	// The goroutines either get the index as an argument, or
+	// capture a per-iteration copy of the loop variable.
+	var goStmt []ast.Stmt
+	if pb.rs.Intn(2) == 0 {
+		goStmt = []ast.Stmt{&ast.GoStmt{Call: &ast.CallExpr{
+			Fun: &ast.FuncLit{
+				Type: &ast.FuncType{Params: &ast.FieldList{List: []*ast.Field{{Names: []*ast.Ident{x}, Type: intType}}}},
+				Body: &ast.BlockStmt{List: body},
+			},
+			Args: []ast.Expr{g},
+		}}}
+	} else {
+		goStmt = []ast.Stmt{
+			&ast.AssignStmt{Lhs: []ast.Expr{x}, Tok: token.DEFINE, Rhs: []ast.Expr{g}},
+			&ast.GoStmt{Call: &ast.CallExpr{
+				Fun: &ast.FuncLit{
+					Type: &ast.FuncType{Params: &ast.FieldList{}},
+					Body: &ast.BlockStmt{List: body},
+				},
+			}},
+		}
+	}
+
+	// wg.Add is either called once before the loop, or once per
+	// goroutine.
+	loop := &ast.ForStmt{
+		Init: &ast.AssignStmt{Lhs: []ast.Expr{g}, Tok: token.DEFINE, Rhs: []ast.Expr{intLit(0)}},
+		Cond: &ast.BinaryExpr{X: g, Op: token.LSS, Y: intLit(count)},
+		Post: &ast.IncDecStmt{X: g, Tok: token.INC},
+		Body: &ast.BlockStmt{List: goStmt},
+	}
+	var add ast.Stmt
+	if pb.rs.Intn(2) == 0 {
+		add = &ast.ExprStmt{X: wgCall("Add", intLit(count))}
+	} else {
+		loop.Body.List = append([]ast.Stmt{&ast.ExprStmt{X: wgCall("Add", intLit(1))}}, loop.Body.List...)
+	}
+
+	spawner := &ast.FuncDecl{
+		Name: pb.FuncIdent(len(pb.funcs)),
+		Type: &ast.FuncType{Params: &ast.FieldList{}, Results: &ast.FieldList{}},
+		Body: &ast.BlockStmt{List: []ast.Stmt{
+			&ast.DeclStmt{Decl: &ast.GenDecl{
+				Tok: token.VAR,
+				Specs: []ast.Spec{&ast.ValueSpec{
+					Names: []*ast.Ident{wg},
+					Type:  &ast.Ident{Name: "sync.WaitGroup"},
+				}},
+			}},
+			&ast.AssignStmt{
+				Lhs: []ast.Expr{res},
+				Tok: token.DEFINE,
+				Rhs: []ast.Expr{&ast.CallExpr{
+					Fun:  &ast.Ident{Name: "make"},
+					Args: []ast.Expr{&ast.ArrayType{Elt: intType}, intLit(count)},
+				}},
+			},
+		}},
+	}
+	if add != nil {
+		spawner.Body.List = append(spawner.Body.List, add)
+	}
+	spawner.Body.List = append(spawner.Body.List,
+		loop,
+		&ast.ExprStmt{X: wgCall("Wait")},
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{&ast.Ident{Name: "i"}},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{&ast.IndexExpr{X: res, Index: intLit(pb.rs.Intn(count))}},
+		},
+	)
+	pb.funcs = append(pb.funcs, spawner)
+
+	return []ast.Decl{helper, spawner}
+}
@@ -0,0 +1,190 @@
+package microsmith
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strconv"
+)
+
+// The rough costs used by InlineFuncs to estimate the inlining cost
+// of a function, following the ones used by gc: every node costs 1,
+// and a call to a function that can't be inlined costs extra.
+const (
+	inlineBudget   = 80
+	inlineCallCost = 57
+)
+
+// InlineFuncs builds a few small helper functions with an estimated
+// inlining cost close to gc's inlining budget, each one with a single
+// call and a few cheap statements:
+//
+//	func H3(x, y int) int {
+//	  x += y * 3
+//	  y ^= x >> 2
+//	  return H1(x, y) + y
+//	}
+//
+// and a large function calling all of them, which is added to the
+// package functions. Since the costs are only estimates, the helpers
+// land on both sides of the budget, and small changes in the
+// inliner's decisions (like the ones from the -l flags) flip them.
+func (pb *PackageBuilder) InlineFuncs() []ast.Decl {
+	var decls []ast.Decl
+	var costs []int
+
+	x, y := &ast.Ident{Name: "x"}, &ast.Ident{Name: "y"}
+	n := 4 + pb.rs.Intn(8)
+	for i := 0; i < n; i++ {
+		target := inlineBudget - 20 + pb.rs.Intn(41)
+
+		// the single call: either to one of the previous helpers,
+		// whose cost is added to ours if it's inlined, or to a
+		// function that is never inlined.
+		var call ast.Expr
+		callCost := inlineCallCost
+		if i > 0 && pb.rs.Intn(3) > 0 {
+			j := pb.rs.Intn(i)
+			call = &ast.CallExpr{Fun: helperIdent(j), Args: []ast.Expr{x, y}}
+			if costs[j] <= inlineBudget {
+				callCost = costs[j]
+			}
+		} else {
+			call = &ast.CallExpr{
+				Fun: &ast.Ident{Name: "int"},
+				Args: []ast.Expr{&ast.CallExpr{
+					Fun:  &ast.SelectorExpr{X: &ast.Ident{Name: "strings"}, Sel: &ast.Ident{Name: "Count"}},
+					Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: `"microsmith"`}, &ast.BasicLit{Kind: token.STRING, Value: `"i"`}},
+				}},
+			}
+		}
+		ret := &ast.ReturnStmt{Results: []ast.Expr{
+			&ast.BinaryExpr{X: call, Op: token.ADD, Y: y},
+		}}
+
+		body := &ast.BlockStmt{List: []ast.Stmt{ret}}
+		cost := inlineCost(body) + callCost
+		for cost < target {
+			st := pb.cheapStmt(x, y)
+			body.List = append([]ast.Stmt{st}, body.List...)
+			cost += inlineCost(st)
+		}
+		costs = append(costs, cost)
+
+		decls = append(decls, &ast.FuncDecl{
+			Name: helperIdent(i),
+			Type: &ast.FuncType{
+				Params: &ast.FieldList{List: []*ast.Field{
+					{Names: []*ast.Ident{x, y}, Type: &ast.Ident{Name: "int"}},
+				}},
+				Results: &ast.FieldList{List: []*ast.Field{{Type: &ast.Ident{Name: "int"}}}},
+			},
+			Body: body,
+		})
+	}
+
+	// The large function calling all the helpers, some of them more
+	// than once.
+	big := &ast.FuncDecl{
+		Name: pb.FuncIdent(len(pb.funcs)),
+		Type: &ast.FuncType{Params: &ast.FieldList{}, Results: &ast.FieldList{}},
+		Body: &ast.BlockStmt{List: []ast.Stmt{
+			&ast.AssignStmt{
+				Lhs: []ast.Expr{x, y},
+				Tok: token.DEFINE,
+				Rhs: []ast.Expr{&ast.Ident{Name: "i"}, &ast.BasicLit{Kind: token.INT, Value: "1"}},
+			},
+		}},
+	}
+	calls := make([]int, 0, 2*n)
+	for i := 0; i < n; i++ {
+		calls = append(calls, i)
+	}
+	for i := 0; i < n; i++ {
+		calls = append(calls, pb.rs.Intn(n))
+	}
+	pb.rs.Shuffle(len(calls), func(i, j int) { calls[i], calls[j] = calls[j], calls[i] })
+	for k, c := range calls {
+		lhs, args := x, []ast.Expr{x, y}
+		if k%2 == 1 {
+			lhs, args = y, []ast.Expr{y, x}
+		}
+		big.Body.List = append(big.Body.List, &ast.AssignStmt{
+			Lhs: []ast.Expr{lhs},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{&ast.CallExpr{Fun: helperIdent(c), Args: args}},
+		})
+	}
+	big.Body.List = append(big.Body.List, &ast.AssignStmt{
+		Lhs: []ast.Expr{&ast.Ident{Name: "i"}},
+		Tok: token.ASSIGN,
+		Rhs: []ast.Expr{&ast.BinaryExpr{X: x, Op: token.ADD, Y: y}},
+	})
+	pb.funcs = append(pb.funcs, big)
+
+	return append(decls, big)
+}
+
+// cheapStmt returns one of a few cheap statements on the int
+// variables x and y, like
+//
+//	x += y * 3
+//	y ^= x >> 2
+//	if x > y { x, y = y, x }
+func (pb *PackageBuilder) cheapStmt(x, y *ast.Ident) ast.Stmt {
+	if pb.rs.Intn(2) == 0 {
+		x, y = y, x
+	}
+	k := &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(1 + pb.rs.Intn(7))}
+
+	switch pb.rs.Intn(4) {
+	case 0:
+		return &ast.AssignStmt{
+			Lhs: []ast.Expr{x},
+			Tok: token.ADD_ASSIGN,
+			Rhs: []ast.Expr{&ast.BinaryExpr{X: y, Op: token.MUL, Y: k}},
+		}
+	case 1:
+		return &ast.AssignStmt{
+			Lhs: []ast.Expr{x},
+			Tok: token.XOR_ASSIGN,
+			Rhs: []ast.Expr{&ast.BinaryExpr{X: y, Op: token.SHR, Y: k}},
+		}
+	case 2:
+		return &ast.AssignStmt{
+			Lhs: []ast.Expr{x},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{&ast.BinaryExpr{
+				X:  &ast.BinaryExpr{X: x, Op: token.AND, Y: y},
+				Op: token.OR,
+				Y:  k,
+			}},
+		}
+	case 3:
+		return &ast.IfStmt{
+			Cond: &ast.BinaryExpr{X: x, Op: token.GTR, Y: y},
+			Body: &ast.BlockStmt{List: []ast.Stmt{
+				&ast.AssignStmt{Lhs: []ast.Expr{x, y}, Tok: token.ASSIGN, Rhs: []ast.Expr{y, x}},
+			}},
+		}
+	default:
+		panic("unreachable")
+	}
+}
+
+// inlineCost estimates the inlining cost of n, as its number of
+// nodes.
+func inlineCost(n ast.Node) int {
+	cost := 0
+	ast.Inspect(n, func(n ast.Node) bool {
+		if n != nil {
+			cost++
+		}
+		return true
+	})
+	return cost
+}
+
+func helperIdent(i int) *ast.Ident {
+	return &ast.Ident{Name: fmt.Sprintf("H%v", i)}
+}
@@ -0,0 +1,91 @@
+package microsmith
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Journal is an append-only log of the generated Programs, with one
+// line per Program holding its name, the seed of the fuzzing run, the
+// worker and index it was generated by (see ProgramSeed), and the
+// result of building it, like
+//
+//	prog_w1_000042 8412307915873041711 1 42 ok
+//
+// Any Program in the Journal can be regenerated by running microsmith
+// with the flags of the fuzzing run, and
+//
+//	-debug -seed 8412307915873041711 -worker 1 -index 42
+//
+// When the file grows over a size limit, it's rotated: the current
+// file is renamed with a ".1" suffix (replacing the previous one) and
+// a new one is started.
+type Journal struct {
+	path    string
+	maxSize int64 // rotate when the file is larger than this (0 means never)
+
+	mu   sync.Mutex
+	fh   *os.File
+	size int64 // size of the current file
+}
+
+// NewJournal returns a Journal appending to the file at path, which is
+// created if it doesn't exist.
+func NewJournal(path string, maxSize int64) (*Journal, error) {
+	if maxSize < 0 {
+		return nil, fmt.Errorf("invalid journal size %v", maxSize)
+	}
+	j := &Journal{path: path, maxSize: maxSize}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) open() error {
+	fh, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	j.fh, j.size = fh, fi.Size()
+	return nil
+}
+
+// Record appends a line for prog, generated by worker at index in a
+// run started with seed, and built with the given result (like "ok",
+// "crash", or "known"), to the Journal.
+func (j *Journal) Record(prog *Program, seed int64, worker, index int, result string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	n, err := fmt.Fprintf(j.fh, "%v %v %v %v %v\n", prog.Name(), seed, worker, index, result)
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if j.maxSize > 0 && j.size > j.maxSize {
+		if err := j.fh.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(j.path, j.path+".1"); err != nil {
+			return err
+		}
+		return j.open()
+	}
+
+	return nil
+}
+
+// Close closes the Journal's file.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.fh.Close()
+}
@@ -0,0 +1,170 @@
+package microsmith
+
+import (
+	"bytes"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"math/rand"
+	"strings"
+)
+
+// Mutate returns a copy of prog with a small random syntactic change
+// applied to its source, and a description of the change. The
+// returned Program is likely, but not guaranteed, to be invalid.
+//
+// The mutation only depends on prog's seed, so mutating the same
+// Program twice gives the same result. Mutate only supports
+// single-package, single-file Programs. The mutant's Check doesn't run
+// go vet, even with ProgramConf.Vet set.
+func (prog *Program) Mutate() (*Program, string, error) {
+	if len(prog.pkgs) != 1 {
+		return nil, "", errors.New("cannot mutate a multi-package Program")
+	}
+	if len(prog.pkgs[0].files) != 1 {
+		return nil, "", errors.New("cannot mutate a multi-file Program")
+	}
+
+	rs := rand.New(rand.NewSource(prog.seed))
+	src, desc, err := mutate(prog.pkgs[0].files[0].source, rs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	mp := NewProgramFromSource(ProgramConf{}, src)
+	mp.id = prog.id + "_mut"
+	mp.conf, mp.seed = prog.conf, prog.seed
+	mp.conf.Vet = "" // a mutant is only checked with go/types
+	return mp, desc, nil
+}
+
+var mutOps = []token.Token{
+	token.ADD, token.SUB, token.MUL, token.QUO, token.REM,
+	token.AND, token.OR, token.XOR, token.SHL, token.SHR, token.AND_NOT,
+	token.LAND, token.LOR,
+	token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ,
+}
+
+// mutate applies one of the following changes to a random node in
+// the function bodies of src:
+//
+//   - swap the names of two identifiers
+//   - change the operator of a binary expression
+//   - delete a statement
+//   - change the kind of a literal (like 1 to 1.5, or 'a' to "a")
+func mutate(src []byte, rs *rand.Rand) ([]byte, string, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var (
+		idents []*ast.Ident
+		binops []*ast.BinaryExpr
+		blocks []*ast.BlockStmt
+		lits   []*ast.BasicLit
+		tags   = make(map[*ast.BasicLit]bool)
+	)
+	for _, d := range f.Decls {
+		fd, ok := d.(*ast.FuncDecl)
+		if !ok || fd.Body == nil {
+			continue
+		}
+		ast.Inspect(fd.Body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.Ident:
+				if n.Name != "_" {
+					idents = append(idents, n)
+				}
+			case *ast.BinaryExpr:
+				binops = append(binops, n)
+			case *ast.BlockStmt:
+				if len(n.List) > 0 {
+					blocks = append(blocks, n)
+				}
+			case *ast.Field:
+				if n.Tag != nil {
+					tags[n.Tag] = true // must stay a string literal
+				}
+			case *ast.BasicLit:
+				if !tags[n] {
+					lits = append(lits, n)
+				}
+			}
+			return true
+		})
+	}
+
+	var desc string
+	for tries := 0; desc == "" && tries < 100; tries++ {
+		switch rs.Intn(4) {
+		case 0:
+			if len(idents) < 2 {
+				continue
+			}
+			i1, i2 := RandItem(rs, idents), RandItem(rs, idents)
+			if i1.Name == i2.Name {
+				continue
+			}
+			desc = "swapped " + i1.Name + " and " + i2.Name
+			i1.Name, i2.Name = i2.Name, i1.Name
+		case 1:
+			if len(binops) == 0 {
+				continue
+			}
+			be, op := RandItem(rs, binops), RandItem(rs, mutOps)
+			if be.Op == op {
+				continue
+			}
+			desc = "changed " + be.Op.String() + " to " + op.String()
+			be.Op = op
+		case 2:
+			if len(blocks) == 0 {
+				continue
+			}
+			bs := RandItem(rs, blocks)
+			i := rs.Intn(len(bs.List))
+			desc = "deleted statement " + nodeString(bs.List[i])
+			bs.List = append(bs.List[:i], bs.List[i+1:]...)
+		case 3:
+			if len(lits) == 0 {
+				continue
+			}
+			bl := RandItem(rs, lits)
+			old := bl.Value
+			mutateLit(bl)
+			desc = "changed literal " + old + " to " + bl.Value
+		}
+	}
+	if desc == "" {
+		return nil, "", errors.New("nothing to mutate")
+	}
+
+	var buf bytes.Buffer
+	if err := printer.Fprint(&buf, fset, f); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), desc, nil
+}
+
+// mutateLit changes the kind of the literal bl, and so its value
+// too: an int gets a .5 fraction, a float an imaginary unit, an
+// imaginary number loses its fraction and unit, a rune becomes a
+// string, and a string the int 1.
+func mutateLit(bl *ast.BasicLit) {
+	switch bl.Kind {
+	case token.INT:
+		bl.Kind, bl.Value = token.FLOAT, bl.Value+".5"
+	case token.FLOAT:
+		bl.Kind, bl.Value = token.IMAG, bl.Value+"i"
+	case token.IMAG:
+		bl.Kind, bl.Value = token.INT, strings.Split(strings.TrimSuffix(bl.Value, "i"), ".")[0]
+	case token.CHAR:
+		bl.Kind, bl.Value = token.STRING, `"`+strings.Trim(bl.Value, "'")+`"`
+	case token.STRING:
+		bl.Kind, bl.Value = token.INT, "1"
+	}
+}
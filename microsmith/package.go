@@ -6,39 +6,64 @@ import (
 	"go/parser"
 	"go/token"
 	"math/rand"
+	"strconv"
 	"strings"
 )
 
 type PackageBuilder struct {
-	pb        *ProgramBuilder
-	pkg       string
-	ctx       *Context
-	rs        *rand.Rand
-	sb        *StmtBuilder
-	eb        *ExprBuilder
-	baseTypes []Type
-	typedepth int
-	funcs     []*ast.FuncDecl // top level funcs declared in the package
+	pb          *ProgramBuilder
+	pkg         string
+	ctx         *Context
+	rs          *rand.Rand
+	sb          *StmtBuilder
+	eb          *ExprBuilder
+	baseTypes   []Type
+	namedTypes  []NamedType     // types declared at the package level
+	namedSlices []NamedType     // same, but with a slice underlying type
+	structPool  []StructType    // struct types shared by the package, see RandType
+	ifacePool   []InterfaceType // same, for interface types
+	typedepth   int
+	funcs       []*ast.FuncDecl // top level funcs declared in the package
+	multiRet    []multiRetFunc  // the ones returning more than one value
+	impls       []ast.Decl      // types implementing inline interfaces, and their methods
+	nimpls      int
+	archGroups  []archGroup // the per-arch files, see ArchFuncs
 }
 
 func NewPackageBuilder(conf ProgramConf, pkg string, progb *ProgramBuilder) *PackageBuilder {
 	pb := PackageBuilder{
 		pkg: pkg,
 		ctx: NewContext(conf),
-		rs:  rand.New(rand.NewSource(rand.Int63())),
+		rs:  rand.New(rand.NewSource(progb.rs.Int63())),
 		pb:  progb,
 	}
 
 	// Initialize Context.Scope with predeclared and a few stdlib
-	// functions
+	// functions (unless MinImports is set)
 	scope := Scope{pb: &pb, vars: make([]Variable, 0, 64)}
 	for _, f := range BuiltinsFuncs {
+		if conf.Skips(f.N) {
+			continue
+		}
 		scope.vars = append(scope.vars, Variable{f, &ast.Ident{Name: f.N}})
 	}
-	for _, f := range StdlibFuncs {
-		scope.vars = append(scope.vars, Variable{f, &ast.Ident{Name: f.N}})
+	if !conf.MinImports {
+		for _, f := range StdlibFuncs {
+			if (conf.NoFloat && usesFloat(f)) || conf.Skips(f.N) {
+				continue
+			}
+			scope.vars = append(scope.vars, Variable{f, &ast.Ident{Name: f.N}})
+		}
+		scope.vars = append(scope.vars, MakeAtomicFuncs()...)
+	}
+	if conf.Runtime {
+		for _, f := range RuntimeFuncs {
+			if conf.Skips(f.N) {
+				continue
+			}
+			scope.vars = append(scope.vars, Variable{f, &ast.Ident{Name: f.N}})
+		}
 	}
-	scope.vars = append(scope.vars, MakeAtomicFuncs()...)
 
 	pb.ctx.scope = &scope
 
@@ -47,24 +72,23 @@ func NewPackageBuilder(conf ProgramConf, pkg string, progb *ProgramBuilder) *Pac
 	pb.eb = NewExprBuilder(&pb)
 	pb.sb.E = pb.eb // breaks circular dependency in sb and eb inits
 
-	// Add predeclared base types
-	pb.baseTypes = []Type{
-		BT{"bool"},
-		BT{"byte"},
-		BT{"int"},
-		BT{"int8"},
-		BT{"int16"},
-		BT{"int32"},
-		BT{"int64"},
-		BT{"uint32"},
-		BT{"uint64"},
-		BT{"uint"},
-		BT{"uintptr"},
-		BT{"float32"},
-		BT{"float64"},
-		BT{"complex128"},
-		BT{"rune"},
-		BT{"string"},
+	// Add predeclared base types. With OnlyType, keep int and bool,
+	// which are needed for control flow, and the chosen type.
+	pb.baseTypes = append([]Type{}, basicTypes...)
+	if t := conf.OnlyType; t != "" {
+		pb.baseTypes = []Type{BT{"bool"}, BT{"int"}}
+		if t != "bool" && t != "int" {
+			pb.baseTypes = append(pb.baseTypes, BT{t})
+		}
+	}
+	if conf.NoFloat || conf.Target != "" {
+		var types []Type
+		for _, t := range pb.baseTypes {
+			if !(conf.NoFloat && IsFloat(t)) && !conf.Skips(t.Name()) {
+				types = append(types, t)
+			}
+		}
+		pb.baseTypes = types
 	}
 	if conf.TypeParams {
 		pb.baseTypes = append(pb.baseTypes, BT{"any"})
@@ -73,6 +97,54 @@ func NewPackageBuilder(conf ProgramConf, pkg string, progb *ProgramBuilder) *Pac
 	return &pb
 }
 
+// usesFloat reports whether one of f's parameters or results has a
+// floating-point type.
+func usesFloat(f FuncType) bool {
+	for _, t := range f.Args {
+		if IsFloat(t) {
+			return true
+		}
+	}
+	for _, t := range f.Ret {
+		if IsFloat(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// The predeclared types used in the generated programs.
+var basicTypes = []Type{
+	BT{"bool"},
+	BT{"byte"},
+	BT{"int"},
+	BT{"int8"},
+	BT{"int16"},
+	BT{"int32"},
+	BT{"int64"},
+	BT{"uint32"},
+	BT{"uint64"},
+	BT{"uint"},
+	BT{"uintptr"},
+	BT{"float32"},
+	BT{"float64"},
+	BT{"complex128"},
+	BT{"rune"},
+	BT{"string"},
+}
+
+// CheckOnlyType returns an error if t can't be used as
+// ProgramConf.OnlyType, because it's not one of the predeclared types
+// used in the generated programs.
+func CheckOnlyType(t string) error {
+	for _, bt := range basicTypes {
+		if bt.Name() == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported type %q", t)
+}
+
 func (pb *PackageBuilder) FuncDecl() *ast.FuncDecl {
 
 	fd := &ast.FuncDecl{
@@ -84,6 +156,10 @@ func (pb *PackageBuilder) FuncDecl() *ast.FuncDecl {
 			Results:    &ast.FieldList{},
 		},
 	}
+	seq := pb.ctx.Trace("FuncDecl", nil, 0)
+	if pb.Conf().Pragmas {
+		pb.AddPragmas(fd)
+	}
 
 	// choose function return types, at random
 	returnTypes := []Type{}
@@ -96,9 +172,15 @@ func (pb *PackageBuilder) FuncDecl() *ast.FuncDecl {
 		returnTypes = append(returnTypes, typ)
 	}
 
-	// if we're not using type parameters, generate a body and return
-	if !pb.Conf().TypeParams {
+	// if we're not using type parameters, or this function is not
+	// generic, generate a body and return
+	if !pb.Conf().TypeParams || !pb.genericFunc() {
 		fd.Body = pb.sb.FuncBody(returnTypes)
+		if pb.rs.Intn(4) == 0 {
+			pb.sb.DeferStress(fd.Body)
+		}
+		pb.addMultiRet(fd, returnTypes)
+		pb.ctx.TraceNode(seq, fd)
 		return fd
 	}
 
@@ -107,7 +189,7 @@ func (pb *PackageBuilder) FuncDecl() *ast.FuncDecl {
 	tp, tps := Scope{pb: pb, vars: make([]Variable, 0, 8)}, []*ast.Field{}
 	tpDecl, tpVars := []ast.Stmt{}, []*ast.Ident{}
 	for i := 0; i < 1+pb.rs.Intn(8); i++ {
-		ident := &ast.Ident{Name: fmt.Sprintf("G%v", i)}
+		ident := SharedIdent("G" + strconv.Itoa(i))
 		typ := RandItem(pb.rs, pb.ctx.constraints)
 		tps = append(
 			tps,
@@ -130,12 +212,25 @@ func (pb *PackageBuilder) FuncDecl() *ast.FuncDecl {
 	}
 	pb.ctx.typeparams = &tp
 
+	// With more than one type parameter, sometimes also declare a
+	// variable of a type mixing two of them, like
+	//
+	//   var m0 map[G0]G1
+	if len(tp.vars) > 1 && pb.rs.Intn(2) == 0 {
+		st, nv := pb.sb.DeclStmt(1, pb.RandTypeParamPair())
+		tpVars = append(tpVars, nv...)
+		tpDecl = append(tpDecl, st)
+	}
+
 	fd.Type.TypeParams = &ast.FieldList{List: tps}
 
 	// Generate the function body. We can't use FuncBody() here
 	// because later we'll need to append more statements to the body,
 	// but the ReturnStmt needs to be last. We'll add it manually.
 	body := pb.sb.BlockStmt()
+	if pb.rs.Intn(4) == 0 {
+		pb.sb.DeferStress(body)
+	}
 
 	// put the collected DeclStmts at the top of the body
 	body.List = append(tpDecl, body.List...)
@@ -145,6 +240,14 @@ func (pb *PackageBuilder) FuncDecl() *ast.FuncDecl {
 		body.List = append(body.List, pb.sb.UseVars(tpVars))
 	}
 
+	// Sometimes call one of the generic functions declared before
+	// this one, passing along our type parameters.
+	if pb.rs.Intn(2) == 0 {
+		if call, ok := pb.GenericCall(); ok {
+			body.List = append(body.List, call)
+		}
+	}
+
 	// append the return statement (needs to be before removing tpVars
 	// from scope because we may need to return one)
 	body.List = append(body.List, pb.sb.ReturnStmt(returnTypes))
@@ -160,9 +263,163 @@ func (pb *PackageBuilder) FuncDecl() *ast.FuncDecl {
 	// clear them out when we're done generating the body.
 	pb.ctx.typeparams = nil
 
+	pb.addMultiRet(fd, returnTypes)
+	pb.ctx.TraceNode(seq, fd)
 	return fd
 }
 
+// A multiRetFunc is a function of the package returning more than one
+// value, which can be called in a MultiAssignStmt.
+type multiRetFunc struct {
+	fd *ast.FuncDecl // to instantiate its type parameters, if any
+	ft FuncType
+}
+
+// addMultiRet makes fd, which returns ret, available to the functions
+// declared after it for multi-value assignments, if it returns more
+// than one value. It's not added to the scope, where it would be
+// picked by lookups expecting single-value functions.
+func (pb *PackageBuilder) addMultiRet(fd *ast.FuncDecl, ret []Type) {
+	if len(ret) < 2 {
+		return
+	}
+	args := []Type{} // FuncDecl doesn't declare parameters
+	pb.multiRet = append(pb.multiRet, multiRetFunc{fd, FuncType{N: fd.Name.Name, Args: args, Ret: ret}})
+}
+
+// CallMultiRet returns a call to f. If f is generic, it's instantiated
+// with type arguments satisfying its constraints.
+func (pb *PackageBuilder) CallMultiRet(f multiRetFunc) *ast.CallExpr {
+	if f.fd.Type.TypeParams == nil {
+		return pb.eb.CallFunction(Variable{f.ft, f.fd.Name})
+	}
+	var indices []ast.Expr
+	for _, fld := range f.fd.Type.TypeParams.List {
+		c := FindByName(pb.ctx.constraints, fld.Type.(*ast.Ident).Name)
+		indices = append(indices, pb.TypeArg(c).Ast())
+	}
+	return &ast.CallExpr{Fun: &ast.IndexListExpr{X: f.fd.Name, Indices: indices}}
+}
+
+// AddPragmas sometimes attaches compiler directives to fd, like
+//
+//	//go:noinline
+//	//go:norace
+//	func F3() {
+//
+// //go:norace is only used when the programs are compiled with -race.
+func (pb *PackageBuilder) AddPragmas(fd *ast.FuncDecl) {
+	var pragmas []string
+	if pb.rs.Intn(3) == 0 {
+		pragmas = append(pragmas, "noinline")
+	}
+	if pb.Conf().Race && pb.rs.Intn(4) == 0 {
+		pragmas = append(pragmas, "norace")
+	}
+	if len(pragmas) == 0 {
+		return
+	}
+	fd.Doc = &ast.CommentGroup{}
+	for _, p := range pragmas {
+		fd.Doc.List = append(fd.Doc.List, &ast.Comment{Text: "//go:" + p})
+		countPragma(p)
+	}
+}
+
+// genericFunc reports whether the function being declared should
+// have type parameters, according to ProgramConf.GenericRatio.
+func (pb *PackageBuilder) genericFunc() bool {
+	r := pb.Conf().GenericRatio
+	if r <= 0 || r >= 1 {
+		return true
+	}
+	return pb.rs.Float64() < r
+}
+
+// GenericCall returns a call to one of the generic functions already
+// declared in the package (or, in the main package, in the other
+// packages of the program), instantiated with the type parameters of
+// the function being built where their constraints allow it, like
+//
+//	F1[G2, int, G0]()
+//	a_1234.F3[G1, N0]()
+//
+// Type parameters are only passed to a function of the same package
+// if they have the same constraint, and to a function of another
+// package if their constraint implements the callee's one. It returns
+// false if the callee could not be instantiated with any of the
+// caller's type parameters.
+func (pb *PackageBuilder) GenericCall() (ast.Stmt, bool) {
+	type callee struct {
+		p *PackageBuilder
+		f *ast.FuncDecl
+	}
+	var funcs []callee
+	for _, p := range pb.pb.pkgs {
+		if p != pb && pb.pkg != "main" {
+			continue
+		}
+		for _, f := range p.funcs {
+			if f.Type.TypeParams != nil {
+				funcs = append(funcs, callee{p, f})
+			}
+		}
+	}
+	if len(funcs) == 0 {
+		return nil, false
+	}
+
+	g := RandItem(pb.rs, funcs)
+	var indices []ast.Expr
+	generic := false
+	for _, fld := range g.f.Type.TypeParams.List {
+		c := FindByName(g.p.ctx.constraints, fld.Type.(*ast.Ident).Name)
+		var matches []Variable
+		for _, v := range pb.ctx.typeparams.vars {
+			vc := v.Type.(Constraint)
+			if (g.p == pb && vc.N.Name == c.N.Name) || (g.p != pb && vc.Implements(c)) {
+				matches = append(matches, v)
+			}
+		}
+		if len(matches) > 0 && pb.rs.Intn(4) > 0 {
+			indices = append(indices, RandItem(pb.rs, matches).Name)
+			generic = true
+		} else {
+			indices = append(indices, pb.TypeArg(c).Ast())
+		}
+	}
+	if !generic {
+		return nil, false
+	}
+
+	var fun ast.Expr = g.f.Name
+	if g.p != pb {
+		fun = &ast.SelectorExpr{X: &ast.Ident{Name: g.p.pkg}, Sel: g.f.Name}
+	}
+	return &ast.ExprStmt{
+		X: &ast.CallExpr{Fun: &ast.IndexListExpr{X: fun, Indices: indices}},
+	}, true
+}
+
+// TypeArg returns a type satisfying c, to instantiate a generic
+// function called from the package being built: either one of the
+// types in c, or sometimes one of the package's named types, if c
+// allows it.
+func (pb *PackageBuilder) TypeArg(c Constraint) Type {
+	var named []NamedType
+	for _, nts := range [][]NamedType{pb.namedTypes, pb.namedSlices} {
+		for _, nt := range nts {
+			if c.Admits(nt) {
+				named = append(named, nt)
+			}
+		}
+	}
+	if len(named) > 0 && pb.rs.Intn(2) == 0 {
+		return RandItem(pb.rs, named)
+	}
+	return RandItem(pb.rs, c.Types)
+}
+
 func (pb *PackageBuilder) FuncIdent(i int) *ast.Ident {
 	id := new(ast.Ident)
 	id.Obj = &ast.Object{
@@ -184,7 +441,7 @@ func (pb *PackageBuilder) Scope() *Scope {
 
 func (pb *PackageBuilder) File() *ast.File {
 	af := new(ast.File)
-	af.Name = &ast.Ident{0, pb.pkg, nil}
+	af.Name = &ast.Ident{Name: pb.pkg}
 	af.Decls = []ast.Decl{}
 
 	if pb.pkg == "main" && pb.Conf().MultiPkg {
@@ -196,7 +453,35 @@ func (pb *PackageBuilder) File() *ast.File {
 		}
 	}
 
-	pkgs := []string{"sync/atomic", "math", "reflect", "strings", "unsafe", "slices"}
+	// With MinImports, only the packages needed by the other
+	// options are imported.
+	var pkgs []string
+	switch {
+	case pb.Conf().MinImports:
+		if pb.Conf().Inline { // for strings.Count, see InlineFuncs
+			pkgs = append(pkgs, "strings")
+		}
+	case pb.Conf().NoFloat:
+		// the math functions are never called, and using the
+		// package would need a float.
+		pkgs = []string{"sync/atomic", "reflect", "strings", "unsafe", "slices", "fmt", "sort"}
+	default:
+		pkgs = []string{"sync/atomic", "math", "reflect", "strings", "unsafe", "slices", "fmt", "sort"}
+	}
+	if pb.Conf().WriteBarriers || pb.Conf().Runtime {
+		pkgs = append(pkgs, "runtime")
+	}
+	if pb.Conf().Goroutines > 0 {
+		pkgs = append(pkgs, "sync")
+	}
+	n := 0
+	for _, p := range pkgs {
+		if !pb.Conf().Skips(p) {
+			pkgs[n] = p
+			n++
+		}
+	}
+	pkgs = pkgs[:n]
 	for _, p := range pkgs {
 		af.Decls = append(af.Decls, MakeImport(p))
 	}
@@ -212,12 +497,65 @@ func (pb *PackageBuilder) File() *ast.File {
 		}
 	}
 
+	// A few named types with a basic underlying type, like
+	//   type N0 int
+	// Declared after the constraints, since they are not allowed
+	// in constraints' type sets.
+	for i := 0; i < pb.rs.Intn(4); i++ {
+		u := RandItem(pb.rs, pb.baseTypes)
+		for u.Name() == "any" {
+			u = RandItem(pb.rs, pb.baseTypes)
+		}
+		nt := NamedType{N: fmt.Sprintf("N%v", i), U: u}
+		af.Decls = append(af.Decls, MakeTypeDecl(nt))
+		pb.namedTypes = append(pb.namedTypes, nt)
+	}
+	for _, nt := range pb.namedTypes {
+		pb.baseTypes = append(pb.baseTypes, nt)
+	}
+
+	// A few named slice types, like
+	//   type S0 []N1
+	for i := 0; i < pb.rs.Intn(3); i++ {
+		var elem Type
+		if pb.rs.Intn(2) == 0 {
+			elem = RandItem(pb.rs, pb.baseTypes)
+		} else {
+			elem = pb.RandType()
+		}
+		nt := NamedType{N: fmt.Sprintf("S%v", i), U: ArrayOf(elem)}
+		af.Decls = append(af.Decls, MakeTypeDecl(nt))
+		pb.namedSlices = append(pb.namedSlices, nt)
+	}
+
+	// The pools of struct and interface types RandType usually draws
+	// from, so that variables often share a type and can be assigned
+	// to each other, passed to the same functions, and compared. The
+	// types are used everywhere, so they are kept shallow.
+	shallow := *pb
+	shallow.typedepth = 3
+	for i := 0; i < 5+pb.rs.Intn(6); i++ {
+		if pb.rs.Intn(3) == 0 {
+			if it := shallow.RandInterfaceType(); len(it.Methods) > 0 {
+				pb.ifacePool = append(pb.ifacePool, it)
+				continue
+			}
+		}
+		pb.structPool = append(pb.structPool, shallow.RandStructType())
+	}
+
 	// Outside any func:
 	//   var i int
 	// So we always have an int variable in scope.
 	af.Decls = append(af.Decls, MakeInt())
 	pb.Scope().AddVariable(&ast.Ident{Name: "i"}, BT{"int"})
 
+	// With -wb, a package-level sink that makes the values stored
+	// in it escape to the heap.
+	if pb.Conf().WriteBarriers {
+		af.Decls = append(af.Decls, MakeWBSink()...)
+	}
+
 	// half a dozen top-level variables
 	for i := 1; i <= 6; i++ {
 		t := pb.RandType()
@@ -238,6 +576,26 @@ func (pb *PackageBuilder) File() *ast.File {
 		pb.funcs = append(pb.funcs, fd)
 	}
 
+	// With -archfiles, a function declared differently for each
+	// group of GOARCHes, in files with build constraints.
+	if pb.Conf().ArchFiles {
+		pb.ArchFuncs()
+	}
+
+	// With -inline, small functions near the inlining budget, and a
+	// large one calling them.
+	if pb.Conf().Inline {
+		af.Decls = append(af.Decls, pb.InlineFuncs()...)
+	}
+
+	// With -goroutines, a function spawning many goroutines.
+	if pb.Conf().Goroutines > 0 {
+		af.Decls = append(af.Decls, pb.GoroutineFuncs()...)
+	}
+
+	// Types built by MakeImpl while generating the functions.
+	af.Decls = append(af.Decls, pb.impls...)
+
 	// If we're not building the main package, we're done.
 	if pb.pkg != "main" {
 		return af
@@ -252,17 +610,205 @@ func (pb *PackageBuilder) File() *ast.File {
 
 	// call all the functions we declared
 	for _, p := range pb.pb.pkgs {
-		mainF.Body.List = append(mainF.Body.List, p.MakeFuncCalls()...)
+		mainF.Body.List = append(mainF.Body.List, p.MakeFuncCalls(pb)...)
 	}
 
 	af.Decls = append(af.Decls, mainF)
 	return af
 }
 
+// Files returns the package's source files. With
+// ProgramConf.MultiFile, the declarations of File() are split across
+// 2 to 4 files, keeping their relative order, so that functions use
+// types, variables, and functions declared in other files. Each file
+// only imports the packages it uses.
+//
+// With ProgramConf.ArchFiles, the files of ArchFuncs, which have
+// build constraints, come last.
+//
+// Occasionally, one of the imported packages is renamed or
+// dot-imported, and the qualified identifiers referring to it are
+// rewritten accordingly; or a package is also blank-imported.
+func (pb *PackageBuilder) Files() []*ast.File {
+	af := pb.File()
+
+	var paths []string
+	var decls []ast.Decl
+	for _, d := range af.Decls {
+		if gd, ok := d.(*ast.GenDecl); ok && gd.Tok == token.IMPORT {
+			paths = append(paths, strings.Trim(gd.Specs[0].(*ast.ImportSpec).Path.Value, "`"))
+			continue
+		}
+		decls = append(decls, d)
+	}
+
+	files := []*ast.File{af}
+	if pb.Conf().MultiFile {
+		files = make([]*ast.File, 2+pb.rs.Intn(3))
+		for i := range files {
+			files[i] = &ast.File{Name: &ast.Ident{Name: pb.pkg}}
+		}
+		for _, d := range decls {
+			f := RandItem(pb.rs, files)
+			f.Decls = append(f.Decls, d)
+		}
+	} else {
+		af.Decls = decls
+	}
+	for i := range pb.archGroups {
+		f := &ast.File{Name: &ast.Ident{Name: pb.pkg}, Decls: pb.archGroups[i].decls}
+		pb.archGroups[i].file = f
+		files = append(files, f)
+	}
+
+	names := pb.importNames(paths)
+
+	// Find the packages used by each file before rewriting the
+	// qualified identifiers, since after a dot-import they are no
+	// longer qualified.
+	used := make([]map[string]bool, len(files))
+	for i, f := range files {
+		used[i] = usedPackages(f)
+	}
+	for _, f := range files {
+		for _, p := range paths {
+			if name, ok := names[p]; ok && name != "_" {
+				requalify(f, importName(p), name)
+			}
+		}
+	}
+
+	for i, f := range files {
+		var imports []ast.Decl
+		for _, p := range paths {
+			if used[i][importName(p)] {
+				name := names[p]
+				if name == "_" {
+					name = ""
+				}
+				imports = append(imports, MakeNamedImport(name, p))
+			}
+		}
+		if i == 0 {
+			for _, p := range paths {
+				if names[p] == "_" {
+					imports = append(imports, MakeNamedImport("_", p))
+				}
+			}
+		}
+		f.Decls = append(imports, f.Decls...)
+	}
+
+	return files
+}
+
+// importNames randomly chooses the names some of the imported
+// packages in paths are imported with: a new name like r_math, "."
+// for a dot-import, or "_" for an additional blank import. The
+// packages that are not in the returned map are imported with their
+// default name.
+//
+// Only standard library packages are dot-imported, since the
+// exported identifiers of the other generated packages clash with
+// the ones declared in this package.
+func (pb *PackageBuilder) importNames(paths []string) map[string]string {
+	names := make(map[string]string)
+	if len(paths) == 0 {
+		return names
+	}
+
+	if pb.rs.Intn(8) == 0 {
+		p := RandItem(pb.rs, paths)
+		names[p] = "r_" + importName(p)
+	}
+	if pb.rs.Intn(8) == 0 {
+		var std []string
+		for _, p := range paths {
+			if _, ok := names[p]; !ok && p != "unsafe" && !pb.pb.generated(p) {
+				std = append(std, p)
+			}
+		}
+		if len(std) > 0 {
+			names[RandItem(pb.rs, std)] = "."
+		}
+	}
+	if pb.rs.Intn(8) == 0 {
+		p := RandItem(pb.rs, paths)
+		if _, ok := names[p]; !ok {
+			names[p] = "_"
+		}
+	}
+
+	return names
+}
+
+// usedPackages returns the names of the packages referred to by the
+// qualified identifiers in f, either as selector expressions like
+// math.Sqrt or as identifiers named "math.Sqrt".
+func usedPackages(f *ast.File) map[string]bool {
+	used := make(map[string]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SelectorExpr:
+			if id, ok := n.X.(*ast.Ident); ok {
+				used[id.Name] = true
+			}
+		case *ast.Ident:
+			if i := strings.Index(n.Name, "."); i >= 0 {
+				used[n.Name[:i]] = true
+			}
+		}
+		return true
+	})
+	return used
+}
+
+// requalify rewrites the identifiers in f qualified with package
+// pkg to use name instead, dropping the qualifier if name is ".".
+//
+// Qualified identifiers are never shared between packages (see
+// Idents), so it's fine to rewrite them in-place, and rewriting them
+// twice is a no-op.
+func requalify(f *ast.File, pkg, name string) {
+	qualify := func(sel string) string {
+		if name == "." {
+			return sel
+		}
+		return name + "." + sel
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CallExpr:
+			// After a dot-import, the only selector expressions
+			// qualified with pkg are the called functions.
+			if se, ok := n.Fun.(*ast.SelectorExpr); ok && name == "." {
+				if id, ok := se.X.(*ast.Ident); ok && id.Name == pkg {
+					n.Fun = se.Sel
+				}
+			}
+		case *ast.SelectorExpr:
+			if id, ok := n.X.(*ast.Ident); ok && id.Name == pkg && name != "." {
+				n.X = &ast.Ident{Name: name}
+			}
+		case *ast.Ident:
+			if sel, ok := strings.CutPrefix(n.Name, pkg+"."); ok {
+				n.Name = qualify(sel)
+			}
+		}
+		return true
+	})
+}
+
+// importName returns the default name of the package imported with
+// path p, like "atomic" for "sync/atomic".
+func importName(p string) string {
+	return p[strings.LastIndex(p, "/")+1:]
+}
+
 // Returns a slice of ast.ExprStms with calls to every top-level
-// function of the receiver. Takes care of adding explicit type
-// parameters, when the function has them.
-func (p *PackageBuilder) MakeFuncCalls() []ast.Stmt {
+// function of the receiver, made from package from. Takes care of
+// adding explicit type parameters, when the function has them.
+func (p *PackageBuilder) MakeFuncCalls(from *PackageBuilder) []ast.Stmt {
 	calls := make([]ast.Stmt, 0, len(p.funcs))
 	for _, f := range p.funcs {
 		var ce ast.CallExpr
@@ -277,16 +823,16 @@ func (p *PackageBuilder) MakeFuncCalls() []ast.Stmt {
 		}
 
 		// instantiate type parameters
-		if p.Conf().TypeParams {
+		if f.Type.TypeParams != nil {
 			var indices []ast.Expr
 			for _, typ := range f.Type.TypeParams.List {
-				types := FindByName(p.ctx.constraints, typ.Type.(*ast.Ident).Name).Types
-				indices = append(indices, RandItem(p.rs, types).Ast())
+				c := FindByName(p.ctx.constraints, typ.Type.(*ast.Ident).Name)
+				indices = append(indices, from.TypeArg(c).Ast())
 			}
 			ce.Fun = &ast.IndexListExpr{X: ce.Fun, Indices: indices}
 		}
 
-		calls = append(calls, &ast.ExprStmt{&ce})
+		calls = append(calls, &ast.ExprStmt{X: &ce})
 	}
 	return calls
 }
@@ -297,10 +843,24 @@ func (p *PackageBuilder) MakeFuncCalls() []ast.Stmt {
 //
 // p must already include the surrounding "s.
 func MakeImport(p string) *ast.GenDecl {
+	return MakeNamedImport("", p)
+}
+
+// Builds this:
+//
+//	import <name> "p"
+//
+// or a plain import if name is empty.
+func MakeNamedImport(name, p string) *ast.GenDecl {
+	var id *ast.Ident
+	if name != "" {
+		id = &ast.Ident{Name: name}
+	}
 	return &ast.GenDecl{
 		Tok: token.IMPORT,
 		Specs: []ast.Spec{
 			&ast.ImportSpec{
+				Name: id,
 				Path: &ast.BasicLit{Kind: token.STRING, Value: "`" + p + "`"},
 			},
 		},
@@ -315,24 +875,214 @@ func MakeUsePakage(p string) *ast.GenDecl {
 		"math":        {"math", "Sqrt", "0"},
 		"strings":     {"strings", "Title", `""`},
 		"reflect":     {"reflect", "DeepEqual", "1,1"},
+		"runtime":     {"runtime", "NumGoroutine", ""},
+		"fmt":         {"fmt", "Sprint", ""},
+		"sort":        {"sort", "SearchInts", "nil, 0"},
+		"sync":        {"sync", "NewCond", "nil"},
+	}
+	call := &ast.CallExpr{
+		Fun: &ast.SelectorExpr{
+			X:   &ast.Ident{Name: m[p].p},
+			Sel: &ast.Ident{Name: m[p].f},
+		},
+	}
+	if m[p].v != "" {
+		call.Args = []ast.Expr{&ast.Ident{Name: m[p].v}}
 	}
 	return &ast.GenDecl{
 		Tok: token.VAR,
 		Specs: []ast.Spec{
 			&ast.ValueSpec{
-				Names: []*ast.Ident{&ast.Ident{Name: "_"}},
-				Values: []ast.Expr{&ast.CallExpr{
-					Fun: &ast.SelectorExpr{
-						X:   &ast.Ident{Name: m[p].p},
-						Sel: &ast.Ident{Name: m[p].f},
-					},
-					Args: []ast.Expr{&ast.Ident{Name: m[p].v}},
-				}},
+				Names:  []*ast.Ident{&ast.Ident{Name: "_"}},
+				Values: []ast.Expr{call},
 			},
 		},
 	}
 }
 
+// Builds this:
+//
+//	type <t.N> <t.U>
+func MakeTypeDecl(t NamedType) *ast.GenDecl {
+	return &ast.GenDecl{
+		Tok: token.TYPE,
+		Specs: []ast.Spec{
+			&ast.TypeSpec{
+				Name: &ast.Ident{Name: t.N},
+				Type: t.U.Ast(),
+			},
+		},
+	}
+}
+
+// Builds a package-level type implementing the interface t:
+//
+//	type T0 struct{}
+//	func (T0) M0(int) string { return *new(string) }
+//
+// and returns its name. The declarations are appended to the file
+// after the functions.
+func (pb *PackageBuilder) MakeImpl(t InterfaceType) *ast.Ident {
+	name := fmt.Sprintf("T%v", pb.nimpls)
+	pb.nimpls++
+	pb.impls = append(pb.impls, MakeTypeDecl(NamedType{N: name, U: StructType{}}))
+
+	for _, m := range t.Methods {
+		p, r := m.Func.MakeFieldLists(false, 0)
+		ret := &ast.ReturnStmt{}
+		for _, t := range m.Func.Ret {
+			ret.Results = append(ret.Results, &ast.StarExpr{
+				X: &ast.CallExpr{
+					Fun:  &ast.Ident{Name: "new"},
+					Args: []ast.Expr{t.Ast()},
+				},
+			})
+		}
+		pb.impls = append(pb.impls, &ast.FuncDecl{
+			Recv: &ast.FieldList{List: []*ast.Field{{Type: &ast.Ident{Name: name}}}},
+			Name: m.Name,
+			Type: &ast.FuncType{Params: p, Results: r},
+			Body: &ast.BlockStmt{List: []ast.Stmt{ret}},
+		})
+	}
+
+	return &ast.Ident{Name: name}
+}
+
+// Builds a package-level struct type implementing fmt.Stringer:
+//
+//	type T0 struct{ S string }
+//	func (t T0) String() string { return t.S }
+//
+// and returns its name. If ptr is true, the method has a pointer
+// receiver, so only *T0 implements the interface.
+func (pb *PackageBuilder) MakeStringer(ptr bool) *ast.Ident {
+	name := fmt.Sprintf("T%v", pb.nimpls)
+	pb.nimpls++
+	pb.impls = append(pb.impls, MakeTypeDecl(NamedType{
+		N: name,
+		U: StructType{[]Type{BT{"string"}}, []string{"S"}, nil},
+	}))
+
+	recv := &ast.Field{Names: []*ast.Ident{{Name: "t"}}, Type: &ast.Ident{Name: name}}
+	if ptr {
+		recv.Type = &ast.StarExpr{X: recv.Type}
+	}
+	pb.impls = append(pb.impls, &ast.FuncDecl{
+		Recv: &ast.FieldList{List: []*ast.Field{recv}},
+		Name: &ast.Ident{Name: "String"},
+		Type: &ast.FuncType{
+			Params:  &ast.FieldList{},
+			Results: &ast.FieldList{List: []*ast.Field{{Type: &ast.Ident{Name: "string"}}}},
+		},
+		Body: &ast.BlockStmt{List: []ast.Stmt{
+			&ast.ReturnStmt{Results: []ast.Expr{tField("S")}},
+		}},
+	})
+
+	return &ast.Ident{Name: name}
+}
+
+// Builds a package-level struct type implementing sort.Interface
+// on a slice of elements of the ordered type et, with a Compare
+// method usable as a slices.SortFunc comparator:
+//
+//	type T0 struct{ S []et }
+//	func (t T0) Len() int { return len(t.S) }
+//	func (t T0) Less(i, j int) bool { return t.S[i] < t.S[j] }
+//	func (t T0) Swap(i, j int) { t.S[i], t.S[j] = t.S[j], t.S[i] }
+//	func (t T0) Compare(a, b et) int { if a < b { return -1 }; if a > b { return 1 }; return 0 }
+//
+// and returns its name.
+func (pb *PackageBuilder) MakeSorter(et Type) *ast.Ident {
+	name := fmt.Sprintf("T%v", pb.nimpls)
+	pb.nimpls++
+	pb.impls = append(pb.impls, MakeTypeDecl(NamedType{
+		N: name,
+		U: StructType{[]Type{ArrayOf(et)}, []string{"S"}, nil},
+	}))
+
+	i, j := &ast.Ident{Name: "i"}, &ast.Ident{Name: "j"}
+	a, b := &ast.Ident{Name: "a"}, &ast.Ident{Name: "b"}
+	elem := func(idx *ast.Ident) ast.Expr {
+		return &ast.IndexExpr{X: tField("S"), Index: idx}
+	}
+	ij := &ast.FieldList{List: []*ast.Field{{Names: []*ast.Ident{i, j}, Type: &ast.Ident{Name: "int"}}}}
+	result := func(t string) *ast.FieldList {
+		return &ast.FieldList{List: []*ast.Field{{Type: &ast.Ident{Name: t}}}}
+	}
+
+	ret := func(x ast.Expr) *ast.ReturnStmt {
+		return &ast.ReturnStmt{Results: []ast.Expr{x}}
+	}
+	retIf := func(op token.Token, v string) *ast.IfStmt {
+		return &ast.IfStmt{
+			Cond: &ast.BinaryExpr{X: a, Op: op, Y: b},
+			Body: &ast.BlockStmt{List: []ast.Stmt{ret(&ast.BasicLit{Kind: token.INT, Value: v})}},
+		}
+	}
+
+	methods := []struct {
+		name   string
+		params *ast.FieldList
+		result *ast.FieldList
+		body   []ast.Stmt
+	}{
+		{"Len", &ast.FieldList{}, result("int"), []ast.Stmt{
+			ret(&ast.CallExpr{Fun: LenIdent, Args: []ast.Expr{tField("S")}}),
+		}},
+		{"Less", ij, result("bool"), []ast.Stmt{
+			ret(&ast.BinaryExpr{X: elem(i), Op: token.LSS, Y: elem(j)}),
+		}},
+		{"Swap", ij, nil, []ast.Stmt{&ast.AssignStmt{
+			Lhs: []ast.Expr{elem(i), elem(j)},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{elem(j), elem(i)},
+		}}},
+		{"Compare",
+			&ast.FieldList{List: []*ast.Field{{Names: []*ast.Ident{a, b}, Type: et.Ast()}}},
+			result("int"),
+			[]ast.Stmt{retIf(token.LSS, "-1"), retIf(token.GTR, "1"), ret(&ast.BasicLit{Kind: token.INT, Value: "0"})},
+		},
+	}
+	for _, m := range methods {
+		pb.impls = append(pb.impls, &ast.FuncDecl{
+			Recv: &ast.FieldList{List: []*ast.Field{{Names: []*ast.Ident{{Name: "t"}}, Type: &ast.Ident{Name: name}}}},
+			Name: &ast.Ident{Name: m.name},
+			Type: &ast.FuncType{Params: m.params, Results: m.result},
+			Body: &ast.BlockStmt{List: m.body},
+		})
+	}
+
+	return &ast.Ident{Name: name}
+}
+
+// tField returns t.<name>, for the receivers of the methods built by
+// MakeStringer and MakeSorter.
+func tField(name string) *ast.SelectorExpr {
+	return &ast.SelectorExpr{X: &ast.Ident{Name: "t"}, Sel: &ast.Ident{Name: name}}
+}
+
+// Impls returns the declarations of the types built by MakeImpl.
+func (pb *PackageBuilder) Impls() []ast.Decl {
+	return pb.impls
+}
+
+// Builds this:
+//
+//	var wbSink any
+//	func wbEscape(p any) { wbSink = p }
+//
+// Used by EscapeStoreStmt to force variables to escape.
+func MakeWBSink() []ast.Decl {
+	src := "package p\nvar wbSink any\nfunc wbEscape(p any) { wbSink = p }\n"
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+	if err != nil {
+		panic("Parsing write barrier sink failed: " + err.Error())
+	}
+	return f.Decls
+}
+
 func MakeInt() *ast.GenDecl {
 	return &ast.GenDecl{
 		Tok: token.VAR,
@@ -348,9 +1098,23 @@ func MakeInt() *ast.GenDecl {
 }
 
 func (pb *PackageBuilder) MakeRandConstraint(name string) (*ast.GenDecl, Constraint) {
+	// Sometimes only use numeric types, so that values of type
+	// parameters with this constraint can be converted to each
+	// other.
+	randType := pb.RandType
+	if pb.rs.Intn(4) == 0 {
+		var nums []Type
+		for _, t := range pb.baseTypes {
+			if IsNumeric(t) {
+				nums = append(nums, t)
+			}
+		}
+		randType = func() Type { return RandItem(pb.rs, nums) }
+	}
+
 	var types []Type
 	for len(types) < 1+pb.rs.Intn(8) {
-		t := pb.RandType()
+		t := randType()
 		name := t.Name()
 		if strings.Contains(name, "int32") { // conflicts with rune
 			// t.Contains() doesn't work with map[int32] because
@@ -372,11 +1136,13 @@ func (pb *PackageBuilder) MakeRandConstraint(name string) (*ast.GenDecl, Constra
 		}
 	}
 
+	tilde := make([]bool, len(types))
 	src := "package p\n"
 	src += "type " + name + " interface{\n"
-	for _, t := range types {
+	for i, t := range types {
 		if pb.rs.Intn(3) == 0 && t.Name() != "any" {
 			src += "~"
+			tilde[i] = true
 		}
 		src += t.Name() + "|"
 	}
@@ -389,7 +1155,7 @@ func (pb *PackageBuilder) MakeRandConstraint(name string) (*ast.GenDecl, Constra
 	}
 	decl := f.Decls[0].(*ast.GenDecl)
 
-	return decl, Constraint{Types: types, N: &ast.Ident{Name: name}}
+	return decl, Constraint{Types: types, Tilde: tilde, N: &ast.Ident{Name: name}}
 }
 
 func (pb *PackageBuilder) MakeVar(t Type, i int) *ast.GenDecl {
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package microsmith
+
+import "os/exec"
+
+// setProcessGroup does nothing: outside unix, only the process
+// started by cmd is killed when its context is done, and cmd.WaitDelay
+// bounds the wait for its children.
+func setProcessGroup(cmd *exec.Cmd) {}
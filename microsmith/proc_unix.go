@@ -0,0 +1,19 @@
+//go:build unix
+
+package microsmith
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd run in a new process group, which is
+// killed as a whole when the context of cmd is done. go tool starts
+// the compile and link binaries as children, and killing only the go
+// command would leave them running.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -2,6 +2,9 @@ package microsmith
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"go/ast"
@@ -10,11 +13,21 @@ import (
 	"go/printer"
 	"go/token"
 	"go/types"
-	"log"
+	"hash/fnv"
+	"io"
 	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // ----------------------------------------------------------------
@@ -23,24 +36,160 @@ import (
 
 type ProgramBuilder struct {
 	conf ProgramConf
-	id   uint64
+	id   string
+	rs   *rand.Rand // used to seed the PackageBuilders
 	pkgs []*PackageBuilder
 }
 
-func NewProgramBuilder(conf ProgramConf, id uint64) *ProgramBuilder {
+func NewProgramBuilder(conf ProgramConf, id string, seed int64) *ProgramBuilder {
 	return &ProgramBuilder{
 		conf: conf,
 		id:   id,
+		rs:   rand.New(rand.NewSource(seed)),
 	}
 }
 
 func (pb *ProgramBuilder) NewPackage(pkg string) *Package {
 	db := NewPackageBuilder(pb.conf, pkg, pb)
 	pb.pkgs = append(pb.pkgs, db)
-	var buf bytes.Buffer
-	printer.Fprint(&buf, token.NewFileSet(), db.File())
-	src := bytes.ReplaceAll(buf.Bytes(), []byte("func "), []byte("\nfunc "))
-	return &Package{name: pkg, source: src}
+	return db.build()
+}
+
+// NewPackages generates the packages named pkgs concurrently, and
+// returns them in the same order. They must not depend on each other
+// (main, which calls them, is generated afterwards by NewPackage).
+//
+// The PackageBuilders are seeded from pb.rs and registered in pb.pkgs
+// in order, before any of them starts, so the result only depends on
+// pb's seed, and pb.pkgs is not modified while they run.
+func (pb *ProgramBuilder) NewPackages(pkgs ...string) []*Package {
+	dbs := make([]*PackageBuilder, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		dbs = append(dbs, NewPackageBuilder(pb.conf, pkg, pb))
+	}
+	pb.pkgs = append(pb.pkgs, dbs...)
+
+	res := make([]*Package, len(dbs))
+	panics := make([]any, len(dbs))
+	var wg sync.WaitGroup
+	for i, db := range dbs {
+		wg.Add(1)
+		go func(i int, db *PackageBuilder) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					panics[i] = fmt.Sprintf("%v\n\ngoroutine generating %v:\n%s", r, db.pkg, debug.Stack())
+				}
+			}()
+			res[i] = db.build()
+		}(i, db)
+	}
+	wg.Wait()
+
+	// A panic in one of the goroutines would kill the process, so
+	// it's recovered, and raised again here.
+	for _, r := range panics {
+		if r != nil {
+			panic(r)
+		}
+	}
+	return res
+}
+
+// build generates db's package.
+func (db *PackageBuilder) build() *Package {
+	pkg := db.pkg
+
+	// If the generator panics, the last builder calls are the most
+	// useful thing to debug it.
+	if db.ctx.trace != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Fprint(os.Stderr, formatTrace(pkg, db.ctx.trace.Records()))
+				panic(r)
+			}
+		}()
+	}
+
+	p := &Package{name: pkg}
+	for _, f := range db.Files() {
+		var buf bytes.Buffer
+		if c := db.buildConstraint(f); c != "" {
+			buf.WriteString(c + "\n\n")
+		}
+		docs := detachDocs(f)
+		printer.Fprint(&buf, token.NewFileSet(), f)
+		src := bytes.ReplaceAll(buf.Bytes(), []byte("func "), []byte("\nfunc "))
+		src, err := attachDocs(src, docs)
+		if err != nil {
+			panic(err)
+		}
+		p.files = append(p.files, &SourceFile{source: src})
+	}
+	if db.ctx.trace != nil {
+		p.trace = db.ctx.trace.Records()
+	}
+	return p
+}
+
+// A funcDoc is the doc comment of a function, see detachDocs.
+type funcDoc struct {
+	fd  *ast.FuncDecl
+	doc *ast.CommentGroup
+}
+
+// detachDocs removes the doc comments (the compiler directives added
+// by AddPragmas) from the functions of f, for attachDocs to write
+// them back in the printed source. The nodes of the generated files
+// have no positions (or ones from another file), so the printer
+// can't place comments reliably: sometimes it puts them at the end
+// of the previous line, where they are ignored.
+func detachDocs(f *ast.File) []funcDoc {
+	var docs []funcDoc
+	for _, d := range f.Decls {
+		if fd, ok := d.(*ast.FuncDecl); ok && fd.Doc != nil {
+			docs = append(docs, funcDoc{fd, fd.Doc})
+			fd.Doc = nil
+		}
+	}
+	return docs
+}
+
+// attachDocs puts back the doc comments removed by detachDocs in the
+// AST, and in src, the printed file, right before their functions.
+// Each function is found by its printed signature, so methods are
+// told apart by their receivers; it fails if one can't be found.
+func attachDocs(src []byte, docs []funcDoc) ([]byte, error) {
+	for _, d := range docs {
+		d.fd.Doc = d.doc
+		var doc []byte
+		for _, c := range d.doc.List {
+			doc = append(append(doc, c.Text...), '\n')
+		}
+		sig := *d.fd
+		sig.Doc, sig.Body = nil, nil
+		var buf bytes.Buffer
+		buf.WriteByte('\n')
+		printer.Fprint(&buf, token.NewFileSet(), &sig)
+		decl := buf.Bytes()
+		i := bytes.Index(src, decl)
+		if i < 0 {
+			return nil, fmt.Errorf("attachDocs: declaration of %v not found", d.fd.Name.Name)
+		}
+		src = append(src[:i+1:i+1], append(doc, src[i+1:]...)...)
+	}
+	return src, nil
+}
+
+// generated reports whether pkg is one of the packages generated by
+// pb.
+func (pb *ProgramBuilder) generated(pkg string) bool {
+	for _, p := range pb.pkgs {
+		if p.pkg == pkg {
+			return true
+		}
+	}
+	return false
 }
 
 // ----------------------------------------------------------------
@@ -48,22 +197,129 @@ func (pb *ProgramBuilder) NewPackage(pkg string) *Package {
 // ----------------------------------------------------------------
 
 type Program struct {
-	workdir string     // directory where the Program files are written
-	pkgs    []*Package // the program's packages
-	id      uint64     // random id used in the names of the Program files
+	workdir string      // directory where the Program files are written
+	pkgs    []*Package  // the program's packages
+	id      string      // id used in the names of the Program files
+	conf    ProgramConf // the settings used to generate the Program
+	seed    int64       // the seed used to generate the Program
+
+	// set by Compile when the link step fails, so that MoveCrasher
+	// also saves the object files needed to reproduce the crash.
+	linkFailed bool
+
+	// subfolder of workdir where the last Compile call wrote the
+	// object files.
+	objdir string
+
+	// the files written by Compile and not yet deleted by
+	// DeleteBinaries.
+	outputs []string
+
+	// hash of the outputs of the last successful Compile call with
+	// BuildOptions.Hash set.
+	hash string
 }
 
 type Package struct {
-	name     string
+	name  string
+	files []*SourceFile // more than one with ProgramConf.MultiFile
+	trace []TraceRecord // last builder calls, if ProgramConf.Trace
+}
+
+// A SourceFile is one of the files of a Package.
+type SourceFile struct {
 	source   []byte
 	filename string
-	path     *os.File
+	path     string // path of the file written by WriteToDisk
+	astPath  string // path of the AST written by WriteAST, if any
+}
+
+// filenames returns the names of pkg's files, as written on disk by
+// Program.WriteToDisk.
+func (pkg *Package) filenames() []string {
+	res := make([]string, 0, len(pkg.files))
+	for _, f := range pkg.files {
+		res = append(res, f.filename)
+	}
+	return res
 }
 
 type BuildOptions struct {
 	Toolchain             string
 	Noopt, Race, Ssacheck bool
-	Experiment            string
+	Experiments           []string      // GOEXPERIMENTs to enable
+	Diag                  bool          // compile with -m=2 (gc only)
+	Inline                string        // an inlining flag from InlineLevels (gc only)
+	Hash                  bool          // hash the build outputs, see Program.OutputHash
+	Timeout               time.Duration // if > 0, kill a build running for longer
+}
+
+// InlineLevels are the inlining settings that programs generated
+// with ProgramConf.Inline are compiled with: the default, inlining
+// disabled, the more aggressive level, and no inlining of functions
+// with closures.
+var InlineLevels = []string{"", "-l", "-l=4", "-d=inlfuncswithclosures=0"}
+
+// ObjDir returns the workdir subfolder where a build with options bo
+// writes its object files. Builds with and without optimizations use
+// different folders, so that they can't overwrite each other's
+// objects.
+func (bo BuildOptions) ObjDir() string {
+	if bo.Noopt {
+		return "noopt"
+	}
+	return "."
+}
+
+var experimentRe = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+// CheckExperiment returns an error if exp is not a well-formed
+// GOEXPERIMENT name, like "rangefunc" or "noregabi".
+func CheckExperiment(exp string) error {
+	if !experimentRe.MatchString(exp) {
+		return fmt.Errorf("invalid GOEXPERIMENT %q", exp)
+	}
+	return nil
+}
+
+// The GOARCHs where gc supports -race (on linux).
+var raceArchs = map[string]bool{
+	"amd64": true, "amd64_v3": true, "arm64": true, "loong64": true,
+	"ppc64le": true, "riscv64": true, "s390x": true,
+}
+
+// CheckArch returns an error if gc can't build programs for arch
+// with options bo, like -race on wasm. Fuzzing with such options
+// would only report spurious crashes.
+func (bo BuildOptions) CheckArch(arch string) error {
+	if bo.Race && !raceArchs[arch] {
+		return fmt.Errorf("-race is not supported on %v", arch)
+	}
+	return nil
+}
+
+// SetExperiments returns env with bo.Experiments added to its
+// GOEXPERIMENT variable, preserving any experiment already set in
+// env.
+func (bo BuildOptions) SetExperiments(env []string) []string {
+	if len(bo.Experiments) == 0 {
+		return env
+	}
+
+	exps := []string{}
+	res := make([]string, 0, len(env)+1)
+	for _, e := range env {
+		if v, ok := strings.CutPrefix(e, "GOEXPERIMENT="); ok {
+			if v != "" {
+				exps = append(exps, v)
+			}
+			continue
+		}
+		res = append(res, e)
+	}
+	exps = append(exps, bo.Experiments...)
+
+	return append(res, "GOEXPERIMENT="+strings.Join(exps, ","))
 }
 
 var CheckSeed int
@@ -72,16 +328,28 @@ func init() {
 	CheckSeed = rand.Int() % 1e5
 }
 
-func NewProgram(conf ProgramConf) *Program {
-	id := rand.Uint64()
-	pb := NewProgramBuilder(conf, id)
+// NewProgram generates a random Program. Its files are named after
+// id, and seed is used to initialize all the random sources used
+// while generating it, so that two calls with the same conf and seed
+// return the same Program.
+func NewProgram(conf ProgramConf, id string, seed int64) *Program {
+	pb := NewProgramBuilder(conf, id, seed)
 	pg := &Program{
 		id:   id,
 		pkgs: make([]*Package, 0),
+		conf: conf,
+		seed: seed,
+	}
+
+	// With NoMain, the program is a single library package, which
+	// is compiled but not linked.
+	if conf.NoMain {
+		pg.pkgs = append(pg.pkgs, pb.NewPackage("lib_"+id))
+		return pg
 	}
 
 	if conf.MultiPkg {
-		pg.pkgs = append(pg.pkgs, pb.NewPackage(fmt.Sprintf("a_%d", id)))
+		pg.pkgs = append(pg.pkgs, pb.NewPackages("a_"+id)...)
 	}
 
 	// main has to be last because it calls functions from the other
@@ -92,110 +360,540 @@ func NewProgram(conf ProgramConf) *Program {
 	return pg
 }
 
+// NewProgramFromSource returns a single-package Program having src
+// as the source of its main package. Only the Vet setting of conf is
+// used, by Check.
+func NewProgramFromSource(conf ProgramConf, src []byte) *Program {
+	return &Program{
+		id:   RandID(),
+		conf: conf,
+		pkgs: []*Package{&Package{name: "main", files: []*SourceFile{{source: src}}}},
+	}
+}
+
+// NewProgramFromDir returns the Program having as source files the
+// .go files in dir, like the crashers saved by MoveCrasher. The files
+// are grouped in packages by their package clause, and the main
+// package, which imports the others, is the last one. The Program id
+// is taken from the name of the main package's files, so that
+// WriteToDisk writes them with the same names.
+func NewProgramFromDir(dir string) (*Program, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no Go files in %v", dir)
+	}
+	sort.Strings(paths)
+
+	prog := &Program{id: RandID()}
+	pkgs := make(map[string]*Package)
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), path, src, parser.PackageClauseOnly)
+		if err != nil {
+			return nil, err
+		}
+		name := f.Name.Name
+		if id, ok := strings.CutPrefix(filepath.Base(path), "main_"); ok && name == "main" && pkgs[name] == nil {
+			prog.id = strings.TrimSuffix(id, ".go")
+		}
+		if pkgs[name] == nil {
+			pkgs[name] = &Package{name: name}
+			if name != "main" {
+				prog.pkgs = append(prog.pkgs, pkgs[name])
+			}
+		}
+		pkgs[name].files = append(pkgs[name].files, &SourceFile{source: src})
+	}
+	if main, ok := pkgs["main"]; ok {
+		prog.pkgs = append(prog.pkgs, main)
+	}
+	return prog, nil
+}
+
+// clone returns a copy of prog's id, settings and sources, which is
+// not written on disk.
+func (prog *Program) clone() *Program {
+	res := &Program{id: prog.id, conf: prog.conf, seed: prog.seed}
+	for _, pkg := range prog.pkgs {
+		p := &Package{name: pkg.name}
+		for _, f := range pkg.files {
+			p.files = append(p.files, &SourceFile{source: f.source, filename: f.filename})
+		}
+		res.pkgs = append(res.pkgs, p)
+	}
+	return res
+}
+
+// RandID returns a random Program id. It uses the global random
+// source, which is never used while generating a Program, so that
+// its content only depends on the seed passed to NewProgram.
+func RandID() string {
+	return strconv.FormatUint(rand.Uint64(), 10)
+}
+
+// ProgramID returns the id of the index-th Program generated by the
+// given fuzzing worker, like prog_w3_000123.
+func ProgramID(worker, index int) string {
+	return fmt.Sprintf("prog_w%d_%06d", worker, index)
+}
+
+// ProgramSeed derives the seed of the index-th Program generated by
+// the given fuzzing worker in a run started with seed. It allows to
+// regenerate any Program knowing only (seed, worker, index).
+func ProgramSeed(seed int64, worker, index int) int64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%d/%d", seed, worker, index)
+	return int64(h.Sum64())
+}
+
+// WriteToDisk writes prog's source files in the folder at path. If
+// one of them can't be written, the ones already written are deleted.
 func (prog *Program) WriteToDisk(path string) error {
 	prog.workdir = path
-	for i, pkg := range prog.pkgs {
-		var fileName string
+	var written []string
+	for _, pkg := range prog.pkgs {
+		baseName := pkg.name
 		if pkg.name == "main" {
-			fileName = fmt.Sprintf("main_%v.go", prog.id)
-		} else {
-			fileName = fmt.Sprintf("%v.go", pkg.name)
+			baseName = fmt.Sprintf("main_%v", prog.id)
 		}
 
-		fh, err := os.Create(path + "/" + fileName)
-		defer fh.Close()
-		if err != nil {
-			return err
+		for j, file := range pkg.files {
+			fileName := baseName + ".go"
+			if j > 0 {
+				fileName = fmt.Sprintf("%v_%v.go", baseName, j)
+			}
+
+			fp := filepath.Join(path, fileName)
+			if err := os.WriteFile(fp, file.source, 0666); err != nil {
+				for _, w := range written {
+					_ = os.Remove(w)
+				}
+				return fmt.Errorf("could not write %v: %w", fileName, err)
+			}
+			written = append(written, fp)
+			file.filename = fileName
+			file.path = fp
 		}
+	}
+	return nil
+}
 
-		fh.Write(pkg.source)
-		prog.pkgs[i].filename = fileName
-		prog.pkgs[i].path = fh
+// WriteAST writes the AST of each of prog's source files as JSON
+// (see ASTJSON), next to the file written by WriteToDisk, with the
+// extension .json instead of .go. WriteToDisk must be called first.
+// The AST files are then moved and deleted with the source files.
+func (prog *Program) WriteAST() error {
+	for _, pkg := range prog.pkgs {
+		for _, file := range pkg.files {
+			if file.path == "" {
+				return fmt.Errorf("%v was not written to disk", pkg.name)
+			}
+			js, err := ASTJSON(file.source)
+			if err != nil {
+				return fmt.Errorf("could not encode the AST of %v: %w", file.filename, err)
+			}
+			fp := strings.TrimSuffix(file.path, ".go") + ".json"
+			if err := os.WriteFile(fp, js, 0666); err != nil {
+				return fmt.Errorf("could not write the AST of %v: %w", file.filename, err)
+			}
+			file.astPath = fp
+		}
 	}
 	return nil
 }
 
 // Check uses go/parser and go/types to parse and typecheck gp
-// in-memory.
+// in-memory. The packages are checked in order, so that the main
+// package's imports of the other generated packages are resolved from
+// the already checked ones.
+//
+// Programs generated for a 32-bit target (ProgramConf.PtrSize 4)
+// are checked with the sizes of 386.
+//
+// With ProgramConf.Vet set, Check then runs go vet on prog, and
+// returns a *VetError if it reports any issue.
 func (prog *Program) Check() error {
-	if len(prog.pkgs) > 1 {
-		if _, err := os.Stat("work"); os.IsNotExist(err) {
-			err := os.MkdirAll("work", os.ModePerm)
-			if err != nil {
-				return err
+	var conf types.Config
+	if prog.conf.PtrSize == 4 {
+		conf.Sizes = types.SizesFor("gc", "386")
+	}
+	if err := prog.CheckWithConfig(conf); err != nil {
+		return err
+	}
+	if prog.conf.Vet != "" {
+		return prog.vet(prog.conf.Vet)
+	}
+	return nil
+}
+
+// CheckWithConfig is like Check, but typechecks gp with the given
+// go/types configuration, for example to set a GoVersion. If
+// conf.Importer is set, it's used to import the packages that are not
+// part of gp; otherwise the default importer is.
+//
+// A Program with files built only for some GOARCHes (see
+// ProgramConf.ArchFiles) is checked once for each distinct set of
+// files built by one of the GOARCHes.
+func (prog *Program) CheckWithConfig(conf types.Config) error {
+	seen := make(map[string]bool)
+	for _, arch := range goarches {
+		var key strings.Builder
+		sel := make([][]*SourceFile, len(prog.pkgs))
+		for i, pkg := range prog.pkgs {
+			for j, f := range pkg.files {
+				if f.matches(arch) {
+					sel[i] = append(sel[i], f)
+					fmt.Fprintf(&key, "%v/%v ", i, j)
+				}
 			}
 		}
-		defer func() { os.RemoveAll("work") }()
+		if seen[key.String()] {
+			continue
+		}
+		seen[key.String()] = true
+		if err := prog.check(conf, sel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		prog.WriteToDisk("work")
-		tc := "go"
-		if bin := os.Getenv("GO_TC"); bin != "" {
-			tc = bin
+// check typechecks prog using, for each package, only the given
+// files.
+func (prog *Program) check(conf types.Config, files [][]*SourceFile) error {
+	fset := token.NewFileSet()
+	imp := &progImporter{
+		pkgs: make(map[string]*types.Package),
+		std:  conf.Importer,
+	}
+	if imp.std == nil {
+		imp.std = importer.Default()
+	}
+	conf.Importer = imp
+
+	for i, pkg := range prog.pkgs {
+		var afs []*ast.File
+		for _, file := range files[i] {
+			f, err := parser.ParseFile(fset, file.filename, file.source, 0)
+			if err != nil {
+				return err // parse error
+			}
+			afs = append(afs, f)
 		}
-		msg, err := prog.Compile("amd64", BuildOptions{Toolchain: tc})
+
+		tp, err := conf.Check(pkg.name, fset, afs, nil)
 		if err != nil {
-			return errors.Join(err, errors.New(msg))
+			return err // typecheck error
 		}
-		return nil
+		imp.pkgs[pkg.name] = tp
 	}
 
-	pkg, fset := prog.pkgs[0], token.NewFileSet()
-	f, err := parser.ParseFile(fset, pkg.filename, pkg.source, 0)
-	if err != nil {
-		return err // parse error
+	return nil
+}
+
+// progImporter is the types.Importer used by Program.Check. It
+// resolves the packages generated as part of the Program from the ones
+// already typechecked, and the standard library ones with std.
+type progImporter struct {
+	pkgs map[string]*types.Package
+	std  types.Importer
+}
+
+func (imp *progImporter) Import(path string) (*types.Package, error) {
+	if p, ok := imp.pkgs[path]; ok {
+		return p, nil
 	}
+	return imp.std.Import(path)
+}
+
+// Trace returns the last builder calls made while generating prog,
+// one per line, or the empty string if prog was not generated with
+// ProgramConf.Trace set.
+func (prog *Program) Trace() string {
+	var res string
+	for _, pkg := range prog.pkgs {
+		if len(pkg.trace) > 0 {
+			res += formatTrace(pkg.name, pkg.trace)
+		}
+	}
+	return res
+}
 
-	conf := types.Config{Importer: importer.Default()}
-	_, err = conf.Check(pkg.filename, fset, []*ast.File{f}, nil)
+func formatTrace(pkg string, recs []TraceRecord) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "trace of package %v (last %v builder calls):\n", pkg, len(recs))
+	for _, r := range recs {
+		sb.WriteString(r.String() + "\n")
+	}
+	return sb.String()
+}
+
+// A VetError is the error returned by Check when go vet reports an
+// issue with a Program.
+type VetError struct {
+	Output string // what go vet printed
+	Err    error  // the go vet error
+}
+
+func (e *VetError) Error() string {
+	return "go vet failed: " + e.Err.Error() + "\n" + e.Output
+}
+
+func (e *VetError) Unwrap() error {
+	return e.Err
+}
+
+// vet runs go vet, with the go command tc, on a copy of prog written
+// in a temporary GOPATH, where each package is in its own folder, so
+// that go vet resolves the imports of the main package. It also works
+// for Programs not written on disk. go vet applies the files' build
+// constraints for the host.
+//
+// A few checks are disabled because they flag constructs that are
+// generated on purpose: unreachable code after branch statements,
+// redundant boolean expressions, and shifts by large constants.
+func (prog *Program) vet(tc string) error {
+	dir, err := os.MkdirTemp("", "microsmith_vet")
 	if err != nil {
-		return err // typecheck error
+		return err
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	for _, pkg := range prog.pkgs {
+		pkgDir := filepath.Join(src, pkg.name)
+		if err := os.MkdirAll(pkgDir, os.ModePerm); err != nil {
+			return err
+		}
+		for j, file := range pkg.files {
+			fp := filepath.Join(pkgDir, fmt.Sprintf("%v_%v.go", pkg.name, j))
+			if err := os.WriteFile(fp, file.source, 0666); err != nil {
+				return err
+			}
+		}
 	}
 
+	cmd := exec.Command(tc, "vet", "-unreachable=false", "-bools=false", "-shift=false", "./...")
+	cmd.Dir = src
+	cmd.Env = append(os.Environ(), "GOPATH="+dir, "GO111MODULE=off", "GOFLAGS=")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return &VetError{string(out), err}
+	}
 	return nil
 }
 
+// The step of the build that failed.
+type BuildPhase int
+
+const (
+	CompilePhase BuildPhase = iota
+	LinkPhase
+)
+
+func (p BuildPhase) String() string {
+	if p == LinkPhase {
+		return "link"
+	}
+	return "compile"
+}
+
+// BuildError is the error in the CompileResult returned by Compile
+// when one of the build subprocesses fails.
+type BuildError struct {
+	Phase BuildPhase
+	Pkg   string // the package being compiled, for CompilePhase
+	Err   error  // the subprocess error
+}
+
+func (e *BuildError) Error() string {
+	if e.Phase == LinkPhase {
+		return "link failed: " + e.Err.Error()
+	}
+	return "compile of package " + e.Pkg + " failed: " + e.Err.Error()
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// The Outcome of a Compile call.
+type Outcome int
+
+const (
+	Success      Outcome = iota
+	CompileError         // the compiler rejected the program
+	LinkError            // the linker failed
+	Timeout              // the build ran for longer than BuildOptions.Timeout
+	ICE                  // the compiler crashed
+	InfraError           // the build couldn't be run, for reasons unrelated to the toolchain
+	Canceled             // the context passed to CompileContext was canceled
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Success:
+		return "ok"
+	case CompileError:
+		return "compile error"
+	case LinkError:
+		return "link error"
+	case Timeout:
+		return "timeout"
+	case ICE:
+		return "internal compiler error"
+	case InfraError:
+		return "infrastructure error"
+	case Canceled:
+		return "canceled"
+	}
+	return fmt.Sprintf("Outcome(%d)", int(o))
+}
+
+// CompileResult is the result of a Compile call.
+type CompileResult struct {
+	Outcome Outcome
+	Output  string // what the toolchain printed, if the build failed (or the diagnostics of a Diag build)
+	Arch    string // the GOARCH the program was built for
+	Pkg     string // the package that failed to compile, if any
+	Err     error  // nil on Success
+}
+
+// Failed reports whether the build failed.
+func (r CompileResult) Failed() bool {
+	return r.Outcome != Success
+}
+
+// Phase returns the step of the build that failed.
+func (r CompileResult) Phase() BuildPhase {
+	var be *BuildError
+	if errors.As(r.Err, &be) {
+		return be.Phase
+	}
+	return CompilePhase
+}
+
+// The strings printed by a compiler that crashed, as opposed to one
+// that rejected a program with a compilation error.
+var iceMarkers = []string{"internal compiler error", "panic:", "fatal error:", "goroutine "}
+
+// failure returns the CompileResult of a build for arch that failed
+// with err and output out during phase, while building pkg. ctx is
+// the context of the build, used to detect timeouts and
+// cancellations.
+func failure(ctx context.Context, arch string, phase BuildPhase, pkg string, out []byte, err error) CompileResult {
+	res := CompileResult{
+		Output: string(out),
+		Arch:   arch,
+		Pkg:    pkg,
+		Err:    &BuildError{phase, pkg, err},
+	}
+	var ee *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		res.Outcome = Timeout
+	case ctx.Err() != nil:
+		res.Outcome = Canceled
+	case !errors.As(err, &ee): // the toolchain couldn't be started
+		res.Outcome = InfraError
+	case phase == LinkPhase:
+		res.Outcome = LinkError
+	default:
+		res.Outcome = CompileError
+		for _, m := range iceMarkers {
+			if bytes.Contains(out, []byte(m)) {
+				res.Outcome = ICE
+				break
+			}
+		}
+	}
+	return res
+}
+
 // Compile uses the given toolchain to build gp. It assumes that gp's
 // source is already written to disk by Program.WriteToDisk.
 //
-// If the compilation subprocess exits with an error code, Compile
-// returns the error message printed by the toolchain and the
-// subprocess error code.
-func (prog *Program) Compile(arch string, bo BuildOptions) (string, error) {
+// If one of the build subprocesses exits with an error code, the
+// result has the error message printed by the toolchain, and an Err
+// wrapping the subprocess error in a *BuildError. If the link step
+// failed, the object files are kept on disk (and are moved by
+// MoveCrasher); otherwise they are always deleted. When the build
+// can't be run, or its outputs can't be hashed or deleted, the
+// Outcome is InfraError.
+//
+// With a BuildOptions.Timeout, a build running for longer is killed
+// along with the compile and link processes started by go tool.
+func (prog *Program) Compile(arch string, bo BuildOptions) CompileResult {
+	return prog.CompileContext(context.Background(), arch, bo)
+}
+
+// CompileContext is like Compile, but the build is also killed when
+// ctx is done, and then its Outcome is Canceled.
+func (prog *Program) CompileContext(ctx context.Context, arch string, bo BuildOptions) CompileResult {
 	if len(prog.pkgs) == 0 {
-		return "", errors.New("Program has no packages")
+		return CompileResult{Outcome: InfraError, Arch: arch, Err: errors.New("Program has no packages")}
 	}
 
+	// the object files kept by a previous failed link would be
+	// overwritten anyway
+	if err := prog.DeleteBinaries(); err != nil {
+		return CompileResult{Outcome: InfraError, Arch: arch, Err: err}
+	}
+	prog.objdir, prog.hash, prog.linkFailed = bo.ObjDir(), "", false
+	if err := os.MkdirAll(filepath.Join(prog.workdir, prog.objdir), os.ModePerm); err != nil {
+		return CompileResult{Outcome: InfraError, Arch: arch, Err: err}
+	}
+
+	if bo.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bo.Timeout)
+		defer cancel()
+	}
+
+	var diags []byte // the -m=2 output of a Diag build
 	baseName := fmt.Sprintf("%v", prog.id)
-	arcName := "main_" + baseName + ".o"
+	arcName := filepath.Join(prog.objdir, "main_"+baseName+".o")
+	mainPkg := prog.pkgs[len(prog.pkgs)-1]
 
 	switch {
 
 	case strings.Contains(bo.Toolchain, "gccgo"):
+		// gccgo builds for the host, and doesn't look at build
+		// constraints.
+		mainFiles := mainPkg.filenamesFor(runtime.GOARCH)
 		oFlag := "-O2"
 		if bo.Noopt {
 			oFlag = "-Og"
 		}
-		cmd := exec.Command(bo.Toolchain, oFlag, "-o", arcName, "main_"+baseName+".go")
+		cmd := command(ctx, bo.Toolchain, append([]string{oFlag, "-o", prog.produces(arcName)}, mainFiles...)...)
 		cmd.Dir = prog.workdir
 		out, err := cmd.CombinedOutput()
 		if err != nil {
-			return string(out), err
+			prog.DeleteBinaries()
+			return failure(ctx, arch, CompilePhase, "main", out, err)
 		}
 
 	case strings.Contains(bo.Toolchain, "tinygo"):
+		// tinygo applies the build constraints itself.
+		mainFiles := mainPkg.filenames()
 		oFlag := "s"
 		if bo.Noopt {
 			oFlag = "0"
 		}
-		cmd := exec.Command(bo.Toolchain, "build", "-opt", oFlag, "-o", arcName, "main_"+baseName+".go")
+		cmd := command(ctx, bo.Toolchain, append([]string{"build", "-opt", oFlag, "-o", prog.produces(arcName)}, mainFiles...)...)
 		cmd.Dir = prog.workdir
 		out, err := cmd.CombinedOutput()
 		if err != nil {
-			return string(out), err
+			prog.DeleteBinaries()
+			return failure(ctx, arch, CompilePhase, "main", out, err)
 		}
 
 	default:
-
 		// Setup env variables
 		env := os.Environ()
 		if arch == "wasm" {
@@ -212,9 +910,7 @@ func (prog *Program) Compile(arch string, bo BuildOptions) (string, error) {
 			env = append(env, "GOARCH="+arch)
 		}
 
-		if exp := bo.Experiment; exp != "" {
-			env = append(env, "GOEXPERIMENT="+exp)
-		}
+		env = bo.SetExperiments(env)
 
 		// Setup compile args
 		buildArgs := []string{"tool", "compile"}
@@ -228,99 +924,321 @@ func (prog *Program) Compile(arch string, bo BuildOptions) (string, error) {
 			cs := fmt.Sprintf("-d=ssa/check/seed=%v", CheckSeed)
 			buildArgs = append(buildArgs, cs)
 		}
+		if bo.Diag {
+			buildArgs = append(buildArgs, "-m=2")
+		}
+		if bo.Inline != "" {
+			buildArgs = append(buildArgs, bo.Inline)
+		}
 
-		// Compile
+		// Compile. go tool compile doesn't look at build
+		// constraints, so only the files built for arch are passed.
 		for _, pkg := range prog.pkgs {
 			var cmdArgs []string
 			buildArgs = append(buildArgs, []string{"-p", pkg.name}...)
 			if pkg.name == "main" {
-				cmdArgs = append(buildArgs, "-I=.")
-				cmdArgs = append(cmdArgs, pkg.filename)
+				cmdArgs = append(buildArgs, "-I="+prog.objdir, "-o", prog.produces(arcName))
+				cmdArgs = append(cmdArgs, pkg.filenamesFor(arch)...)
 			} else {
-				cmdArgs = append(buildArgs, pkg.filename)
+				obj := filepath.Join(prog.objdir, pkg.name+".o")
+				cmdArgs = append(buildArgs, "-o", prog.produces(obj))
+				cmdArgs = append(cmdArgs, pkg.filenamesFor(arch)...)
 			}
 
-			cmd := exec.Command(bo.Toolchain, cmdArgs...)
+			cmd := command(ctx, bo.Toolchain, cmdArgs...)
 			cmd.Dir, cmd.Env = prog.workdir, env
 			out, err := cmd.CombinedOutput()
 			if err != nil {
-				return string(out), err
+				prog.DeleteBinaries()
+				if bo.Diag {
+					out = stripDiagnostics(out)
+				}
+				return failure(ctx, arch, CompilePhase, pkg.name, out, err)
 			}
+			diags = append(diags, out...)
+		}
+
+		// Library packages are not linked.
+		if !prog.hasMain() {
+			break
 		}
 
 		// Setup link args
-		linkArgs := []string{"tool", "link", "-L=."}
+		linkArgs := []string{"tool", "link", "-L=" + prog.objdir}
 		if bo.Race {
 			linkArgs = append(linkArgs, "-race")
 		}
-		linkArgs = append(linkArgs, "-o", baseName, arcName)
+		binName := filepath.Join(prog.objdir, baseName)
+		linkArgs = append(linkArgs, "-o", binName, arcName)
 
 		// Link
-		cmd := exec.Command(bo.Toolchain, linkArgs...)
+		cmd := command(ctx, bo.Toolchain, linkArgs...)
 		cmd.Dir, cmd.Env = prog.workdir, env
 		out, err := cmd.CombinedOutput()
 		if err != nil {
-			return string(out), err
+			prog.linkFailed = true
+			return failure(ctx, arch, LinkPhase, "", out, err)
 		}
+		prog.produces(binName)
 	}
 
-	prog.DeleteBinaries()
-	return "", nil
+	if bo.Hash {
+		if err := prog.hashOutputs(); err != nil {
+			prog.DeleteBinaries()
+			return CompileResult{Outcome: InfraError, Arch: arch, Err: err}
+		}
+	}
+	if err := prog.DeleteBinaries(); err != nil {
+		return CompileResult{Outcome: InfraError, Arch: arch, Err: err}
+	}
+	return CompileResult{Outcome: Success, Arch: arch, Output: string(diags)}
 }
 
-// DeleteBinaries deletes any binary file written on disk.
-func (prog *Program) DeleteBinaries() {
-	basePath := prog.workdir + "/"
-	for _, pkg := range prog.pkgs {
-		var err error
-		if pkg.name == "main" {
-			err = os.Remove(basePath + fmt.Sprintf("main_%d.o", prog.id))
-		} else {
-			err = os.Remove(basePath + pkg.name + ".o")
+// waitDelay is how long a build killed after its timeout is waited
+// for, before its output pipes are closed by force.
+const waitDelay = 5 * time.Second
+
+// command returns the exec.Cmd running the build step name with the
+// given args, which is killed along with the processes it started
+// when ctx is done.
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = waitDelay
+	return cmd
+}
+
+// hashOutputs sets prog.hash to the hash of the files written by
+// Compile, in the order they were written.
+func (prog *Program) hashOutputs() error {
+	h := sha256.New()
+	for _, out := range prog.outputs {
+		f, err := os.Open(out)
+		if err != nil {
+			return err
 		}
+		_, err = io.Copy(h, f)
+		f.Close()
 		if err != nil {
-			log.Printf("could not remove %s: %s", basePath+"_"+pkg.name+".o", err)
+			return err
 		}
+	}
+	prog.hash = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// Seed returns the seed prog was generated from.
+func (prog *Program) Seed() int64 {
+	return prog.seed
+}
 
+// OutputHash returns the hash of the object files and binary written
+// by the last Compile call, if it succeeded and was made with
+// BuildOptions.Hash set, and the empty string otherwise. Since builds
+// are deterministic, compiling the same program twice with the same
+// options must give the same hash.
+func (prog *Program) OutputHash() string {
+	return prog.hash
+}
+
+// hasMain reports whether prog has a main package, that is whether
+// it can be linked into an executable.
+func (prog *Program) hasMain() bool {
+	return prog.pkgs[len(prog.pkgs)-1].name == "main"
+}
+
+// diagRe matches the diagnostics printed by -m=2 about escape
+// analysis, inlining, and devirtualization.
+var diagRe = regexp.MustCompile(`^[^ ]*:\d+(:\d+)?: (` +
+	`inlining call to |can inline |cannot inline |devirtualizing |` +
+	`moved to heap: |leaking param|parameter .* leaks|\s*flow: |\s*from |` +
+	`zero-copy |function .* considered |.* ignoring self-assignment in |` +
+	`.*(escapes to heap|does not escape|capturing by (value|ref)))`)
+
+// heapMoveRe matches the -m diagnostics reporting that one of the
+// variables declared by NoEscapeStmt was moved to the heap.
+var heapMoveRe = regexp.MustCompile(`moved to heap: p?ne\d+\b`)
+
+// HeapMoves returns the diagnostics in the -m output out reporting
+// that a variable declared by NoEscapeStmt, which escape analysis
+// should keep on the stack, was moved to the heap.
+func HeapMoves(out string) []string {
+	return heapMoveRe.FindAllString(out, -1)
+}
+
+// stripDiagnostics removes from the compiler output out the
+// optimization diagnostics printed by -m, keeping everything else
+// (in particular, the compile errors and the crash report).
+func stripDiagnostics(out []byte) []byte {
+	var res []byte
+	for _, line := range bytes.SplitAfter(out, []byte("\n")) {
+		if diagRe.Match(line) && !bytes.Contains(line, []byte("internal compiler error")) {
+			continue
+		}
+		res = append(res, line...)
 	}
+	return res
+}
 
-	// ignore error since some toolchains don't write a binary
-	_ = os.Remove(basePath + fmt.Sprintf("%v", prog.id))
+// DeleteBinaries deletes any binary file written on disk. It tries
+// to delete all of them, and returns the first error.
+func (prog *Program) DeleteBinaries() error {
+	var first error
+	for _, out := range prog.outputs {
+		// outputs are recorded before running the build step that
+		// writes them, so they may not exist if it failed.
+		if err := os.Remove(out); err != nil && !os.IsNotExist(err) && first == nil {
+			first = err
+		}
+	}
+	prog.outputs = nil
+	return first
+}
+
+// produces records that the build step about to be run by Compile
+// writes the file at path (relative to the workdir), so that
+// DeleteBinaries deletes it. It returns path.
+func (prog *Program) produces(path string) string {
+	prog.outputs = append(prog.outputs, filepath.Join(prog.workdir, path))
+	return path
 }
 
 // DeleteSource deletes all gp files.
 func (gp Program) DeleteSource() {
-	for _, file := range gp.pkgs {
-		_ = os.Remove(file.path.Name())
+	for _, pkg := range gp.pkgs {
+		for _, file := range pkg.files {
+			_ = os.Remove(file.path)
+			if file.astPath != "" {
+				_ = os.Remove(file.astPath)
+			}
+		}
 	}
 }
 
-// Move gp's files in a workdir subfolder named "crash".
-func (gp Program) MoveCrasher() {
-	fld := gp.workdir + "/crash"
-	if _, err := os.Stat(fld); os.IsNotExist(err) {
-		err := os.Mkdir(fld, os.ModePerm)
-		if err != nil {
-			fmt.Printf("Could not create crash folder: %v", err)
-			os.Exit(2)
-		}
+// MoveCrasher moves gp's files in a new subfolder of the workdir
+// folder "crash", and returns the new path of the main package's
+// first file.
+func (gp Program) MoveCrasher() (string, error) {
+	return gp.MoveCrasherTo("crash")
+}
+
+// MoveCrasherTo moves gp's files in a new subfolder of the given
+// workdir folder, named after gp's id and the current time, and
+// returns the new path of the main package's first file.
+//
+// The files are moved together: if one of them can't be moved, the
+// ones already moved are put back, and an error is returned.
+func (gp Program) MoveCrasherTo(folder string) (string, error) {
+	fld := filepath.Join(gp.workdir, folder)
+	if err := os.MkdirAll(fld, os.ModePerm); err != nil {
+		return "", fmt.Errorf("could not create crash folder: %w", err)
 	}
 
+	// The files are first moved in a temporary folder, which is
+	// renamed when all of them are there.
+	tmp, err := os.MkdirTemp(fld, "."+gp.id+"_")
+	if err != nil {
+		return "", fmt.Errorf("could not create crash folder: %w", err)
+	}
+
+	type move struct{ from, to string }
+	var moves []move
 	for _, pkg := range gp.pkgs {
-		err := os.Rename(pkg.path.Name(), fld+"/"+pkg.filename)
-		if err != nil {
-			fmt.Printf("Could not move crasher: %v", err)
-			os.Exit(2)
+		for _, file := range pkg.files {
+			moves = append(moves, move{file.path, filepath.Join(tmp, file.filename)})
+			if file.astPath != "" {
+				moves = append(moves, move{file.astPath, filepath.Join(tmp, filepath.Base(file.astPath))})
+			}
 		}
 	}
+
+	// The crash happened when linking, so we also need the object
+	// files to reproduce it.
+	if gp.linkFailed {
+		if err := os.MkdirAll(filepath.Join(tmp, gp.objdir), os.ModePerm); err != nil {
+			os.RemoveAll(tmp)
+			return "", fmt.Errorf("could not create crash folder: %w", err)
+		}
+		for _, obj := range gp.outputs {
+			moves = append(moves, move{obj, filepath.Join(tmp, gp.objdir, filepath.Base(obj))})
+		}
+	}
+
+	// putBack moves the first n files back where they were, and
+	// deletes the temporary folder.
+	putBack := func(n int) {
+		for _, m := range moves[:n] {
+			_ = moveFile(m.to, m.from)
+		}
+		os.RemoveAll(tmp)
+	}
+
+	for i, m := range moves {
+		if err := moveFile(m.from, m.to); err != nil {
+			putBack(i)
+			return "", fmt.Errorf("could not move crasher: %w", err)
+		}
+	}
+
+	// Two crashers can have the same id (when replaying a seed) and
+	// be moved at the same time, so the name is made unique with a
+	// suffix.
+	name := gp.id + "_" + time.Now().Format("20060102-150405")
+	dir := filepath.Join(fld, name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dir); os.IsNotExist(err) {
+			if err = renameDir(tmp, dir); err == nil {
+				break
+			}
+		}
+		if i == 100 {
+			putBack(len(moves))
+			return "", fmt.Errorf("could not move crasher: no free name for %v in %v", name, fld)
+		}
+		dir = filepath.Join(fld, fmt.Sprintf("%v_%v", name, i))
+	}
+
+	var dest string
+	for _, pkg := range gp.pkgs {
+		dest = filepath.Join(dir, pkg.files[0].filename)
+	}
+	return dest, nil
 }
 
+// moveFile moves the file at from to to. When they are on different
+// filesystems, the file is copied and then removed.
+func moveFile(from, to string) error {
+	err := rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(to, data, 0666); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
+
+// rename is os.Rename, replaced in tests to simulate moves across
+// filesystems.
+var rename = os.Rename
+
+// renameDir is os.Rename, replaced in tests to simulate crash folder
+// names that are all taken.
+var renameDir = os.Rename
+
 func (prog *Program) String() string {
 	var res string
 	for _, pkg := range prog.pkgs {
-		res += string(pkg.source)
-		if len(prog.pkgs) > 1 {
-			res += "\n--------------------------------------------------\n"
+		for _, file := range pkg.files {
+			res += string(file.source)
+			if len(prog.pkgs) > 1 || len(pkg.files) > 1 {
+				res += "\n--------------------------------------------------\n"
+			}
 		}
 	}
 	return res
@@ -1,28 +1,58 @@
 package microsmith_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"go/ast"
+	"go/build"
+	"go/constant"
+	"go/importer"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/ALTree/microsmith/microsmith"
 )
 
 const WorkDir = "work"
 
-// check n generated programs with go/types
+// check n generated programs with go/types. If MICROSMITH_TRACE is
+// set, the generator's trace of a failing program is saved next to
+// it.
 func testProgramGoTypes(t *testing.T, n int, conf microsmith.ProgramConf) {
+	conf.Trace = os.Getenv("MICROSMITH_TRACE") != ""
 	for i := 0; i < n; i++ {
-		gp := microsmith.NewProgram(conf)
+		gp := microsmith.NewProgram(conf, microsmith.RandID(), rand.Int63())
 		err := gp.Check()
 		if err != nil {
 			tmpfile, _ := ioutil.TempFile("", "fail*.go")
 			if _, err := tmpfile.Write([]byte(gp.String())); err != nil {
 				t.Fatal(err)
 			}
+			if conf.Trace {
+				err := os.WriteFile(tmpfile.Name()+".trace", []byte(gp.Trace()), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
 			t.Fatalf("Program failed typechecking:\n%s\n%v", err, gp)
 		}
 	}
@@ -36,6 +66,39 @@ func TestNewProgram(t *testing.T) {
 	testProgramGoTypes(t, n, microsmith.ProgramConf{})
 }
 
+var selftest = flag.Int("selftest", 0, "Number of seeds checked by TestSelfTest (0 for the default)")
+
+// TestSelfTest typechecks the programs generated from sequential
+// seeds, so that a failure can be reproduced exactly from the seed it
+// reports. Run it with more seeds with
+//
+//	go test -run SelfTest -selftest 10000
+func TestSelfTest(t *testing.T) {
+	n := 30
+	if testing.Short() {
+		n = 8
+	}
+	if *selftest > 0 {
+		n = *selftest
+	}
+
+	confs := []microsmith.ProgramConf{
+		{},
+		{MultiPkg: true, TypeParams: true, MultiFile: true},
+		{TypeParams: true, WriteBarriers: true, Runtime: true, Inline: true, PtrSize: 4},
+	}
+	for _, conf := range confs {
+		conf.Trace = true
+		for seed := int64(1); seed <= int64(n); seed++ {
+			gp := microsmith.NewProgram(conf, microsmith.ProgramID(0, int(seed)), seed)
+			if err := gp.Check(); err != nil {
+				t.Fatalf("Program from seed %v with conf %+v failed typechecking:\n%s\n%s%v",
+					seed, conf, err, gp.Trace(), gp)
+			}
+		}
+	}
+}
+
 func TestNewProgramTP(t *testing.T) {
 	n := 50
 	if testing.Short() {
@@ -50,101 +113,2282 @@ func TestNewProgramTP(t *testing.T) {
 		})
 }
 
-func GetToolchain() string {
-	if bin := os.Getenv("GO_TC"); bin != "" {
-		return bin
-	} else {
-		return "go"
+func TestNewProgramMultiPkg(t *testing.T) {
+	n := 50
+	if testing.Short() {
+		n = 10
 	}
+	testProgramGoTypes(t, n, microsmith.ProgramConf{MultiPkg: true, TypeParams: true})
 }
 
-// Check generated programs with gc (from file).
-func compile(t *testing.T, conf microsmith.ProgramConf) {
-	lim := 10
+func TestNewProgramWB(t *testing.T) {
+	n := 50
 	if testing.Short() {
-		lim = 2
+		n = 10
 	}
 
-	if _, err := os.Stat(WorkDir); os.IsNotExist(err) {
-		err := os.MkdirAll(WorkDir, os.ModePerm)
-		if err != nil {
-			t.Fatalf("%v", err)
+	testProgramGoTypes(
+		t, n,
+		microsmith.ProgramConf{
+			TypeParams:    true,
+			WriteBarriers: true,
+		})
+}
+
+func TestNewProgramNoEscape(t *testing.T) {
+	n := 50
+	if testing.Short() {
+		n = 10
+	}
+
+	testProgramGoTypes(
+		t, n,
+		microsmith.ProgramConf{
+			TypeParams: true,
+			NoEscape:   true,
+		})
+}
+
+func TestNewProgramMaps(t *testing.T) {
+	n := 50
+	if testing.Short() {
+		n = 10
+	}
+
+	testProgramGoTypes(
+		t, n,
+		microsmith.ProgramConf{
+			TypeParams: true,
+			Maps:       true,
+		})
+}
+
+// Check that the variables declared by NoEscapeStmt stay on the
+// stack, according to the diagnostics of a Diag build.
+func TestNoEscape(t *testing.T) {
+	out := "./a.go:3:6: moved to heap: ne1\n./a.go:4:2: moved to heap: x\n./a.go:5:2: moved to heap: pne12\n"
+	if got := fmt.Sprint(microsmith.HeapMoves(out)); got != "[moved to heap: ne1 moved to heap: pne12]" {
+		t.Errorf("HeapMoves = %v", got)
+	}
+
+	n := 5
+	if testing.Short() {
+		n = 2
+	}
+	for i := 0; i < n; i++ {
+		gp := microsmith.NewProgram(microsmith.ProgramConf{NoEscape: true}, "x", rand.Int63())
+		if err := gp.WriteToDisk(t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+		res := gp.Compile("amd64", microsmith.BuildOptions{Toolchain: GetToolchain(), Diag: true})
+		gp.DeleteSource()
+		if res.Failed() {
+			t.Fatalf("Compile failed: %v\n%s", res.Err, res.Output)
+		}
+		if !strings.Contains(res.Output, "does not escape") {
+			t.Fatalf("Compile returned no -m diagnostics:\n%s", res.Output)
+		}
+		if m := microsmith.HeapMoves(res.Output); len(m) > 0 {
+			t.Errorf("Program %v: %v", i, m)
 		}
 	}
+}
 
-	// build toolchain
-	cmd := exec.Command(GetToolchain(), "install", "std")
-	env := append(os.Environ(), "GODEBUG=installgoroot=all")
-	cmd.Env = env
+func TestNewProgramRuntime(t *testing.T) {
+	n := 50
+	if testing.Short() {
+		n = 10
+	}
 
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		t.Fatalf("Installing dependencies failed with error:\n----\n%s\n%s\n----\n", out, err)
+	testProgramGoTypes(
+		t, n,
+		microsmith.ProgramConf{
+			TypeParams: true,
+			Runtime:    true,
+		})
+}
+
+func TestNewProgramOnlyType(t *testing.T) {
+	n := 5
+	if testing.Short() {
+		n = 1
 	}
 
-	keepdir := false
-	for i := 0; i < lim; i++ {
-		gp := microsmith.NewProgram(conf)
-		err := gp.WriteToDisk(WorkDir)
+	for _, typ := range []string{"bool", "int", "int8", "uint64", "float32", "complex128", "rune", "string"} {
+		testProgramGoTypes(
+			t, n,
+			microsmith.ProgramConf{
+				TypeParams: true,
+				OnlyType:   typ,
+			})
+	}
+}
+
+func TestNewProgramNoFloat(t *testing.T) {
+	n := 20
+	if testing.Short() {
+		n = 5
+	}
+
+	conf := microsmith.ProgramConf{MultiPkg: true, TypeParams: true, NoFloat: true}
+	testProgramGoTypes(t, n, conf)
+	for i := 0; i < n; i++ {
+		src := microsmith.NewProgram(conf, microsmith.RandID(), rand.Int63()).String()
+		if strings.Contains(src, "float") || strings.Contains(src, "complex") {
+			t.Fatalf("NoFloat program uses floating-point types:\n%v", src)
+		}
+	}
+}
+
+func TestNewProgramMinImports(t *testing.T) {
+	n := 20
+	if testing.Short() {
+		n = 5
+	}
+
+	conf := microsmith.ProgramConf{TypeParams: true, MinImports: true}
+	testProgramGoTypes(t, n, conf)
+	testProgramGoTypes(t, n, microsmith.ProgramConf{MultiFile: true, MinImports: true, Inline: true})
+	testProgramGoTypes(t, n, microsmith.ProgramConf{MultiPkg: true, MinImports: true, Goroutines: 100})
+	for i := 0; i < n; i++ {
+		src := microsmith.NewProgram(conf, microsmith.RandID(), rand.Int63()).String()
+		f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ImportsOnly)
 		if err != nil {
-			t.Fatalf("Could not write to file: %s", err)
+			t.Fatal(err)
 		}
-		bo := microsmith.BuildOptions{
-			Toolchain:  GetToolchain(),
-			Noopt:      false,
-			Race:       false,
-			Ssacheck:   false,
-			Experiment: "",
-		}
-		out, err := gp.Compile("amd64", bo)
-		if err != nil && !strings.Contains(out, "internal compiler error") {
-			t.Fatalf("Generated program failed compilation:\n%s\n%s", out, err)
-			keepdir = true
+		if len(f.Imports) > 0 {
+			t.Fatalf("MinImports program imports packages:\n%v", src)
 		}
 	}
+}
 
-	if !keepdir {
-		os.RemoveAll(WorkDir)
+func TestNewProgramTarget(t *testing.T) {
+	n := 20
+	if testing.Short() {
+		n = 5
+	}
+
+	skipped := map[string]*regexp.Regexp{
+		"gccgo":  regexp.MustCompile(`\bslices\b|\b(min|max)\(`),
+		"tinygo": regexp.MustCompile(`\breflect\b|\bcomplex128\b`),
+	}
+	for target, re := range skipped {
+		conf := microsmith.ProgramConf{MultiPkg: true, TypeParams: true, Target: target}
+		testProgramGoTypes(t, n, conf)
+		for i := 0; i < n; i++ {
+			src := microsmith.NewProgram(conf, microsmith.RandID(), rand.Int63()).String()
+			if m := re.FindString(src); m != "" {
+				t.Fatalf("program for %s uses %q:\n%v", target, m, src)
+			}
+		}
 	}
 }
 
-func TestCompile(t *testing.T) {
-	compile(t,
-		microsmith.ProgramConf{
-			MultiPkg:   false,
-			TypeParams: false,
-		})
+// Check that programs also built for wasm don't call the functions
+// that are pointless there, and that the other archs still allow them.
+func TestNewProgramArchs(t *testing.T) {
+	n := 20
+	if testing.Short() {
+		n = 5
+	}
+
+	if (microsmith.ProgramConf{Archs: []string{"amd64"}}).Skips("runtime.GOMAXPROCS") {
+		t.Error("programs for amd64 can't call runtime.GOMAXPROCS")
+	}
+	conf := microsmith.ProgramConf{MultiPkg: true, Runtime: true, Archs: []string{"amd64", "wasm"}}
+	if !conf.Skips("runtime.GOMAXPROCS") || conf.Skips("runtime.GC") {
+		t.Errorf("wrong runtime functions skipped on wasm")
+	}
+	testProgramGoTypes(t, n, conf)
+	for i := 0; i < n; i++ {
+		src := microsmith.NewProgram(conf, microsmith.RandID(), rand.Int63()).String()
+		if strings.Contains(src, "runtime.GOMAXPROCS") {
+			t.Fatalf("program for wasm calls runtime.GOMAXPROCS:\n%v", src)
+		}
+	}
 }
 
-func TestCompileMultiPkg(t *testing.T) {
-	compile(t,
-		microsmith.ProgramConf{
-			MultiPkg:   true,
-			TypeParams: false,
-		})
+func TestNewProgramGoroutines(t *testing.T) {
+	n := 20
+	if testing.Short() {
+		n = 5
+	}
+	testProgramGoTypes(t, n, microsmith.ProgramConf{MultiPkg: true, TypeParams: true, Goroutines: 500})
+	testProgramGoTypes(t, n, microsmith.ProgramConf{MultiFile: true, Goroutines: microsmith.MaxGoroutines})
 }
 
-func TestCompileTypeParams(t *testing.T) {
-	compile(t,
-		microsmith.ProgramConf{
-			MultiPkg:   false,
-			TypeParams: true,
-		})
+func TestCompileGoroutines(t *testing.T) {
+	compileSeeds(t, microsmith.ProgramConf{MultiPkg: true, TypeParams: true, Goroutines: 1000}, 1, 2)
 }
 
-func TestCompileMultiPkgTypeParams(t *testing.T) {
-	compile(t,
-		microsmith.ProgramConf{
-			MultiPkg:   true,
-			TypeParams: true,
+// Generate many float expressions and typecheck them, to catch
+// constant expressions overflowing the float and complex types.
+func TestFloatExprs(t *testing.T) {
+	n := 2000
+	if testing.Short() {
+		n = 200
+	}
+
+	conf := microsmith.ProgramConf{}
+	for _, typ := range []string{"float32", "float64", "complex128"} {
+		progb := microsmith.NewProgramBuilder(conf, "float", 1)
+		pb := microsmith.NewPackageBuilder(conf, "main", progb)
+		pb.Scope().AddVariable(&ast.Ident{Name: "i"}, microsmith.BT{N: "int"})
+		eb := microsmith.NewExprBuilder(pb)
+
+		var sb strings.Builder
+		sb.WriteString(floatPrelude)
+		for j := 0; j < n; j++ {
+			fmt.Fprintf(&sb, "var _ %v = ", typ)
+			printer.Fprint(&sb, token.NewFileSet(), eb.Expr(microsmith.BT{N: typ}))
+			sb.WriteString("\n")
+		}
+		for _, d := range pb.Impls() {
+			printer.Fprint(&sb, token.NewFileSet(), d)
+			sb.WriteString("\n")
+		}
+
+		gp := microsmith.NewProgramFromSource(microsmith.ProgramConf{}, []byte(sb.String()))
+		if err := gp.Check(); err != nil {
+			t.Fatalf("%v expressions failed typechecking:\n%v", typ, err)
+		}
+	}
+}
+
+const floatPrelude = `package main
+
+import "sync/atomic"
+import "math"
+import "reflect"
+import "strings"
+import "unsafe"
+import "slices"
+
+var _ = atomic.LoadInt32(nil)
+var _ = math.Sqrt(0)
+var _ = reflect.DeepEqual(1,1)
+var _ = strings.Title("")
+var _ = unsafe.Sizeof(0)
+var _ = slices.All([]int{})
+
+var i int
+
+func main() {}
+`
+
+// Check that ChainedCast covers conversions from and to every
+// integer type.
+func TestCastStats(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		microsmith.NewProgram(microsmith.ProgramConf{}, microsmith.RandID(), int64(i))
+	}
+
+	from, to := make(map[string]bool), make(map[string]bool)
+	for p := range microsmith.CastStats() {
+		from[p.From], to[p.To] = true, true
+	}
+	for _, typ := range []string{"byte", "int8", "int16", "int32", "int64", "int", "uint32", "uint64", "uint", "uintptr", "rune"} {
+		if !from[typ] || !to[typ] {
+			t.Errorf("No conversions from or to %v were generated", typ)
+		}
+	}
+}
+
+// Check that conversions of 64-bit integers to uintptr are masked on
+// 32-bit targets, and only there.
+func TestUintptrCasts(t *testing.T) {
+	for _, ptrSize := range []int{4, 8} {
+		var masked, pointers int
+		for i := 0; i < 10; i++ {
+			conf := microsmith.ProgramConf{PtrSize: ptrSize}
+			src := microsmith.NewProgram(conf, microsmith.RandID(), int64(i)).String()
+			f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ast.Inspect(f, func(n ast.Node) bool {
+				ce, ok := n.(*ast.CallExpr)
+				if !ok || types.ExprString(ce.Fun) != "uintptr" {
+					return true
+				}
+				switch arg := ce.Args[0].(type) {
+				case *ast.BinaryExpr:
+					if types.ExprString(arg.Y) == "0xFFFFFFFF" {
+						masked++
+					}
+				case *ast.CallExpr:
+					if types.ExprString(arg.Fun) == "unsafe.Pointer" {
+						pointers++
+					}
+				}
+				return true
+			})
+		}
+		if ptrSize == 4 && masked == 0 {
+			t.Error("No masked conversions to uintptr were generated for a 32-bit target")
+		}
+		if ptrSize == 8 && masked > 0 {
+			t.Errorf("%v masked conversions to uintptr were generated for a 64-bit target", masked)
+		}
+		if pointers == 0 {
+			t.Errorf("No conversions of pointers to uintptr were generated (PtrSize %v)", ptrSize)
+		}
+	}
+}
+
+// Check that the int, uint, and uintptr constants in the generated
+// programs span their type's range in the target arch: they exceed 32
+// bits on 64-bit targets, and they don't (as checked by go/types with
+// the sizes of 386) on 32-bit ones.
+func TestIntLitWidths(t *testing.T) {
+	for _, ptrSize := range []int{4, 8} {
+		arch := map[int]string{4: "386", 8: "amd64"}[ptrSize]
+		var wide int
+		for i := 0; i < 10; i++ {
+			src := microsmith.NewProgram(microsmith.ProgramConf{PtrSize: ptrSize}, microsmith.RandID(), int64(i)).String()
+			fset := token.NewFileSet()
+			f, err := parser.ParseFile(fset, "", src, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conf := types.Config{Importer: importer.Default(), Sizes: types.SizesFor("gc", arch)}
+			info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+			if _, err := conf.Check("main", fset, []*ast.File{f}, info); err != nil {
+				t.Fatalf("Program for %v failed typechecking: %v", arch, err)
+			}
+			for _, tv := range info.Types {
+				bt, ok := tv.Type.Underlying().(*types.Basic)
+				if !ok || tv.Value == nil || tv.Value.Kind() != constant.Int {
+					continue
+				}
+				switch bt.Kind() {
+				case types.Int, types.Uint, types.Uintptr:
+					if v, ok := constant.Uint64Val(tv.Value); ok && v > math.MaxUint32 {
+						wide++
+					}
+				}
+			}
+		}
+		if ptrSize == 8 && wide == 0 {
+			t.Error("No int, uint, or uintptr constants wider than 32 bits were generated for a 64-bit target")
+		}
+	}
+}
+
+// PtrSize must see through the 386sf and amd64_v3 variants.
+func TestPtrSize(t *testing.T) {
+	for _, tc := range []struct {
+		archs []string
+		want  int
+	}{
+		{[]string{"amd64"}, 8},
+		{[]string{"amd64_v3", "wasm"}, 8},
+		{[]string{"386"}, 4},
+		{[]string{"386sf"}, 4},
+		{[]string{"amd64", "386sf"}, 4},
+		{[]string{"arm64", "arm"}, 4},
+	} {
+		if got := microsmith.PtrSize(tc.archs); got != tc.want {
+			t.Errorf("PtrSize(%v) = %v, want %v", tc.archs, got, tc.want)
+		}
+	}
+}
+
+// Check the Type methods on one instance of every Type kind.
+func TestTypes(t *testing.T) {
+	I, S := microsmith.BasicType{N: "int"}, microsmith.BasicType{N: "string"}
+	method := microsmith.Method{
+		Name: &ast.Ident{Name: "M0"},
+		Func: microsmith.FuncType{N: "FU", Args: []microsmith.Type{I}, Ret: []microsmith.Type{I}, Local: true},
+	}
+	cons := microsmith.Constraint{N: &ast.Ident{Name: "I0"}, Types: []microsmith.Type{I}, Tilde: []bool{false}}
+
+	tests := []struct {
+		t          microsmith.Type
+		name       string
+		comparable bool
+		sliceable  bool
+		contains   microsmith.Type // a type contained in t, if any
+	}{
+		{I, "int", true, false, nil},
+		{S, "string", true, true, nil},
+		{microsmith.BasicType{N: "any"}, "any", false, false, nil},
+		{microsmith.PointerOf(I), "*int", true, false, I},
+		{microsmith.ArrayOf(S), "[]string", false, true, S},
+		{microsmith.StructType{Ftypes: []microsmith.Type{I, S}, Fnames: []string{"A0", "A1"}}, "struct {\n\tA0 int\n\tA1 string\n}", true, false, S},
+		{microsmith.StructType{Ftypes: []microsmith.Type{I, S}, Fnames: []string{"A0", "A1"}, Ftags: []string{`json:"a0"`, ""}}, "struct {\n\tA0 int `json:\"a0\"`\n\tA1 string\n}", true, false, S},
+		{microsmith.StructType{Ftypes: []microsmith.Type{I, S}, Fnames: []string{"A0", "A1"}, Ftags: []string{"", "ms:\"`\""}}, "struct {\n\tA0 int\n\tA1 string \"ms:\\\"`\\\"\"\n}", true, false, S},
+		{microsmith.FuncType{N: "FU", Args: []microsmith.Type{I}, Ret: []microsmith.Type{S}, Local: true}, "func(int) string", false, false, S},
+		{microsmith.ChanOf(I), "chan int", false, false, I},
+		{microsmith.MapOf(S, I), "map[string]int", false, true, I},
+		{microsmith.NamedType{N: "T0", U: I}, "T0", true, false, nil},
+		{microsmith.InterfaceType{Methods: []microsmith.Method{method}}, "interface {\n\tM0(int) int\n}", true, false, nil},
+		{microsmith.TypeParam{N: &ast.Ident{Name: "G0"}, Constraint: cons}, "G0", true, false, nil},
+	}
+
+	for i, tc := range tests {
+		if got := tc.t.Name(); got != tc.name {
+			t.Errorf("%T: Name() = %q, want %q", tc.t, got, tc.name)
+		}
+		if got := tc.t.Comparable(); got != tc.comparable {
+			t.Errorf("%s: Comparable() = %v, want %v", tc.name, got, tc.comparable)
+		}
+		if got := tc.t.Sliceable(); got != tc.sliceable {
+			t.Errorf("%s: Sliceable() = %v, want %v", tc.name, got, tc.sliceable)
+		}
+
+		var buf strings.Builder
+		if err := printer.Fprint(&buf, token.NewFileSet(), tc.t.Ast()); err != nil {
+			t.Errorf("%s: cannot print Ast(): %v", tc.name, err)
+		} else if _, err := parser.ParseExpr(buf.String()); err != nil {
+			t.Errorf("%s: Ast() printed as %q does not parse: %v", tc.name, buf.String(), err)
+		}
+
+		for j, tc2 := range tests {
+			if got := tc.t.Equal(tc2.t); got != (i == j) {
+				t.Errorf("%s.Equal(%s) = %v, want %v", tc.name, tc2.name, got, i == j)
+			}
+		}
+		if !tc.t.Contains(tc.t) {
+			t.Errorf("%s does not contain itself", tc.name)
+		}
+		if tc.contains != nil && !tc.t.Contains(tc.contains) {
+			t.Errorf("%s does not contain %s", tc.name, tc.contains.Name())
+		}
+	}
+}
+
+// Check that the results of both generic and non-generic functions
+// are used in multi-value assignments.
+func TestMultiAssign(t *testing.T) {
+	conf := microsmith.ProgramConf{TypeParams: true, GenericRatio: 0.5}
+	var generic, plain int
+	for seed := int64(1); seed <= 10; seed++ {
+		gp := microsmith.NewProgram(conf, microsmith.RandID(), seed)
+		if err := gp.Check(); err != nil {
+			t.Fatalf("Program failed typechecking:\n%s\n%v", err, gp)
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), "", gp.String(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			as, ok := n.(*ast.AssignStmt)
+			if !ok || len(as.Lhs) < 2 || len(as.Rhs) != 1 {
+				return true
+			}
+			if ce, ok := as.Rhs[0].(*ast.CallExpr); ok {
+				switch ce.Fun.(type) {
+				case *ast.IndexExpr, *ast.IndexListExpr:
+					generic++
+				case *ast.Ident:
+					plain++
+				}
+			}
+			return true
 		})
+	}
+	if generic == 0 || plain == 0 {
+		t.Errorf("Got %v multi-value assignments from generic functions and %v from non-generic ones", generic, plain)
+	}
+}
+
+func TestCommonOps(t *testing.T) {
+	BT := func(n string) microsmith.Type { return microsmith.BasicType{N: n} }
+	tp := microsmith.TypeParam{
+		N: &ast.Ident{Name: "G0"},
+		Constraint: microsmith.Constraint{
+			N:     &ast.Ident{Name: "I0"},
+			Types: []microsmith.Type{BT("int"), BT("int8"), BT("rune")},
+			Tilde: []bool{false, false, false},
+		},
+	}
+	want := fmt.Sprint([]token.Token{token.ADD, token.SUB, token.AND, token.OR, token.XOR, token.SHR, token.AND_NOT})
+
+	// The operators must always come in the same order, or programs
+	// generated from the same seed would differ.
+	for i := 0; i < 100; i++ {
+		if got := fmt.Sprint(tp.CommonOps(microsmith.BinOps)); got != want {
+			t.Fatalf("CommonOps(BinOps) = %v, want %v", got, want)
+		}
+	}
+	if got := fmt.Sprint(tp.CommonOps(microsmith.UnaryOps)); got != fmt.Sprint([]token.Token{token.ADD, token.SUB, token.XOR}) {
+		t.Errorf("CommonOps(UnaryOps) = %v", got)
+	}
+
+	tp.Constraint.Types = append(tp.Constraint.Types, BT("string"))
+	if got := fmt.Sprint(tp.CommonOps(microsmith.BinOps)); got != fmt.Sprint([]token.Token{token.ADD}) {
+		t.Errorf("CommonOps(BinOps) with a string = %v, want [+]", got)
+	}
+}
+
+// Check that the ~ elements of a Constraint admit the named types
+// with the same underlying type, and that Implements takes them into
+// account.
+func TestConstraintTilde(t *testing.T) {
+	I, S := microsmith.BasicType{N: "int"}, microsmith.BasicType{N: "string"}
+	constraint := func(name string, types []microsmith.Type, tilde []bool) microsmith.Constraint {
+		return microsmith.Constraint{N: &ast.Ident{Name: name}, Types: types, Tilde: tilde}
+	}
+	exact := constraint("I0", []microsmith.Type{I, S}, []bool{false, false}) // int | string
+	approx := constraint("I1", []microsmith.Type{I, S}, []bool{true, false}) // ~int | string
+	anyC := constraint("I2", []microsmith.Type{microsmith.BasicType{N: "any"}}, []bool{false})
+
+	tests := []struct {
+		c    microsmith.Constraint
+		t    microsmith.NamedType
+		want bool
+	}{
+		{exact, microsmith.NamedType{N: "N0", U: I}, false},
+		{approx, microsmith.NamedType{N: "N0", U: I}, true},
+		{approx, microsmith.NamedType{N: "N1", U: S}, false},
+		{approx, microsmith.NamedType{N: "S0", U: microsmith.ArrayOf(I)}, false},
+		{anyC, microsmith.NamedType{N: "S0", U: microsmith.ArrayOf(I)}, true},
+	}
+	for _, tc := range tests {
+		if got := tc.c.Admits(tc.t); got != tc.want {
+			t.Errorf("%v.Admits(%v) = %v, want %v", tc.c.Name(), tc.t.Name(), got, tc.want)
+		}
+	}
+
+	if !exact.Implements(approx) {
+		t.Errorf("int | string does not implement ~int | string")
+	}
+	if approx.Implements(exact) {
+		t.Errorf("~int | string implements int | string")
+	}
+	if !approx.Implements(anyC) || anyC.Implements(approx) {
+		t.Errorf("wrong Implements between ~int | string and any")
+	}
+}
+
+// Check that RandVarSubType prefers variables needing a shallow
+// derivation over deeply nested ones, compared to picking uniformly
+// among all the variables containing the type.
+func TestRandVarSubTypeDepth(t *testing.T) {
+	I := microsmith.BasicType{N: "int"}
+	deep := microsmith.MapOf(I, microsmith.StructType{
+		Ftypes: []microsmith.Type{microsmith.ArrayOf(microsmith.ChanOf(I))},
+		Fnames: []string{"A0"},
+	})
+	var vars []microsmith.Variable
+	for i, typ := range []microsmith.Type{
+		I,
+		microsmith.ArrayOf(I),
+		microsmith.PointerOf(I),
+		microsmith.MapOf(I, microsmith.ArrayOf(I)),
+		deep,
+		microsmith.ArrayOf(deep),
+		microsmith.PointerOf(microsmith.ArrayOf(deep)),
+	} {
+		vars = append(vars, microsmith.Variable{Type: typ, Name: &ast.Ident{Name: fmt.Sprintf("v%d", i)}})
+	}
+
+	var uniform float64
+	for _, v := range vars {
+		uniform += float64(microsmith.DerivationDepth(v.Type, I))
+	}
+	uniform /= float64(len(vars))
+
+	var avg float64
+	vs := microsmith.RandVarSubTypes(vars, I, 10000)
+	for _, v := range vs {
+		d := microsmith.DerivationDepth(v.Type, I)
+		if d > microsmith.MaxDerivationDepth {
+			t.Fatalf("RandVarSubType returned %v, with derivation depth %v", v, d)
+		}
+		avg += float64(d)
+	}
+	avg /= float64(len(vs))
+
+	t.Logf("average derivation depth: %.2f (uniform: %.2f)", avg, uniform)
+	if avg >= 1 || avg >= uniform/2 {
+		t.Errorf("average derivation depth is %.2f, want < 1 and < %.2f", avg, uniform/2)
+	}
+}
+
+// Check that the builders don't rely on File() declaring a few
+// variables, like i, that they need.
+func TestEmptyScope(t *testing.T) {
+	for seed := int64(0); seed < 50; seed++ {
+		src := microsmith.EmptyScopeSource(seed)
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "", src, 0)
+		if err != nil {
+			t.Fatalf("seed %v: %v\n%s", seed, err, src)
+		}
+		conf := types.Config{Importer: importer.Default()}
+		if _, err := conf.Check("p", fset, []*ast.File{f}, nil); err != nil {
+			t.Fatalf("seed %v: %v\n%s", seed, err, src)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	gp := microsmith.NewProgram(microsmith.ProgramConf{Trace: true}, microsmith.RandID(), 1)
+	lines := strings.Split(strings.TrimSpace(gp.Trace()), "\n")
+	if want := fmt.Sprintf("trace of package main (last %v builder calls):", microsmith.TraceLen); lines[0] != want {
+		t.Fatalf("Trace starts with %q, want %q", lines[0], want)
+	}
+
+	// Every record is a finished call, with consecutive Seqs, and
+	// shows the method, the requested type (if any), the kind of
+	// node built and its source.
+	recRe := regexp.MustCompile(`^#(\d+) +(\w+)( \[.+\])? -> (\w+): (.+)$`)
+	methods := make(map[string]bool)
+	prev := -1
+	for _, l := range lines[1:] {
+		m := recRe.FindStringSubmatch(l)
+		if m == nil {
+			t.Fatalf("Bad trace record %q", l)
+		}
+		seq, _ := strconv.Atoi(m[1])
+		if prev >= 0 && seq != prev+1 {
+			t.Errorf("Record #%v follows #%v", seq, prev)
+		}
+		prev = seq
+		methods[m[2]] = true
+		if m[2] == "Expr" && m[3] == "" {
+			t.Errorf("Expr record %q has no type", l)
+		}
+	}
+	if len(lines)-1 != microsmith.TraceLen {
+		t.Errorf("Trace has %v records, want %v", len(lines)-1, microsmith.TraceLen)
+	}
+	if !methods["Expr"] {
+		t.Errorf("Trace has no Expr records:\n%s", gp.Trace())
+	}
+
+	gp = microsmith.NewProgram(microsmith.ProgramConf{}, microsmith.RandID(), 1)
+	if tr := gp.Trace(); tr != "" {
+		t.Errorf("Trace of program generated without tracing is %q", tr)
+	}
+}
+
+var update = flag.Bool("update", false, "Update the golden programs in testdata")
+
+// Programs generated from fixed seeds, stored in testdata/golden.
+var goldens = []struct {
+	name string
+	conf microsmith.ProgramConf
+	seed int64
+}{
+	{"base", microsmith.ProgramConf{}, 9},
+	{"tp", microsmith.ProgramConf{TypeParams: true}, 14},
+	{"wb", microsmith.ProgramConf{TypeParams: true, WriteBarriers: true, Runtime: true}, 3},
+}
+
+// Check that the programs generated from the golden seeds didn't
+// change. When a change to the generator is intended, run
+//
+//	go test -run Golden -update
+//
+// to regenerate them, and review the diff.
+func TestGolden(t *testing.T) {
+	var selects, rangeFuncs, typeParams int
+	for _, g := range goldens {
+		src := microsmith.NewProgram(g.conf, "golden", g.seed).String()
+		path := filepath.Join("testdata", "golden", g.name+".go.golden")
+
+		if *update {
+			if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src != string(want) {
+			t.Errorf("%v: generated program differs from %v (run with -update if this is expected)", g.name, path)
+			continue
+		}
+
+		f, err := parser.ParseFile(token.NewFileSet(), path, src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.SelectStmt:
+				selects++
+			case *ast.RangeStmt:
+				if _, ok := n.X.(*ast.FuncLit); ok {
+					rangeFuncs++
+				}
+			case *ast.FuncDecl:
+				if n.Type.TypeParams != nil {
+					typeParams++
+				}
+			}
+			return true
+		})
+	}
+
+	// Catch changes that silently stop generating some construct
+	// (TestConstructs checks the rarer ones).
+	if selects == 0 {
+		t.Error("Golden programs have no select statements")
+	}
+	if rangeFuncs == 0 {
+		t.Error("Golden programs have no range-over-func statements")
+	}
+	if typeParams == 0 {
+		t.Error("Golden programs have no functions with type parameters")
+	}
+}
+
+// countingImporter is a types.Importer that counts the packages it
+// imported.
+type countingImporter struct {
+	n   int
+	imp types.Importer
+}
+
+func (ci *countingImporter) Import(path string) (*types.Package, error) {
+	ci.n++
+	return ci.imp.Import(path)
+}
+
+func TestCheckWithConfig(t *testing.T) {
+	conf := microsmith.ProgramConf{MultiPkg: true, TypeParams: true}
+	gp := microsmith.NewProgram(conf, microsmith.RandID(), rand.Int63())
+
+	// the generated packages are imported in-memory, and the std
+	// ones with the given importer
+	ci := &countingImporter{imp: importer.Default()}
+	if err := gp.CheckWithConfig(types.Config{Importer: ci}); err != nil {
+		t.Fatalf("Program failed typechecking with a custom importer: %s\n%s", err, gp)
+	}
+	if ci.n == 0 {
+		t.Fatal("the custom importer was never used")
+	}
+
+	// go/types rejects the type parameters at go1.17, since they
+	// were added in go1.18
+	if err := gp.CheckWithConfig(types.Config{GoVersion: "go1.17"}); err == nil {
+		t.Fatalf("Program with type parameters passed typechecking with go1.17:\n%s", gp)
+	}
+}
+
+// With ProgramConf.Vet, Check also runs go vet, on programs that were
+// never written on disk.
+func TestCheckVet(t *testing.T) {
+	conf := microsmith.ProgramConf{Vet: GetToolchain()}
+	bad := microsmith.NewProgramFromSource(conf, []byte("package main\nimport \"fmt\"\nfunc main() { fmt.Printf(\"%d\", \"s\") }\n"))
+	var vetErr *microsmith.VetError
+	if err := bad.Check(); !errors.As(err, &vetErr) {
+		t.Fatalf("Check of a program failing vet returned %v", err)
+	}
+	if err := microsmith.NewProgram(conf, microsmith.RandID(), 1).Check(); err != nil {
+		t.Fatalf("Program failed checking: %v", err)
+	}
+
+	conf.MultiPkg = true
+	if err := microsmith.NewProgram(conf, microsmith.RandID(), 1).Check(); err != nil {
+		t.Fatalf("Program failed checking: %v", err)
+	}
+
+	// The main package of a multi-package program is vetted too.
+	dir := t.TempDir()
+	files := map[string]string{
+		"a_vet.go":    "package a_vet\n\nfunc F() int { return 1 }\n",
+		"main_vet.go": "package main\n\nimport (\n\t\"a_vet\"\n\t\"fmt\"\n)\n\nfunc main() { fmt.Printf(\"%d\", \"s\", a_vet.F()) }\n",
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gp, err := microsmith.NewProgramFromDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	microsmith.SetVet(gp, GetToolchain())
+	if err := gp.Check(); !errors.As(err, &vetErr) || !strings.Contains(vetErr.Error(), "Printf") {
+		t.Fatalf("Check of a multi-package program whose main fails vet returned %v", err)
+	}
+}
+
+// Check that multi-package programs generated from the same seed are
+// identical, since crashers are reproduced from their seed.
+func TestNewProgramSeed(t *testing.T) {
+	confs := []microsmith.ProgramConf{
+		{MultiPkg: true, TypeParams: true},
+		{MultiPkg: true, TypeParams: true, GenericRatio: 0.5, MultiFile: true},
+		{MultiPkg: true, TypeParams: true, WriteBarriers: true, Runtime: true, Inline: true},
+		{MultiPkg: true, TypeParams: true, Maps: true, NoEscape: true, ArchFiles: true, Goroutines: 4},
+	}
+	for _, conf := range confs {
+		for i := 0; i < 4; i++ {
+			seed := rand.Int63()
+			p1 := microsmith.NewProgram(conf, "seed", seed).String()
+			p2 := microsmith.NewProgram(conf, "seed", seed).String()
+			if p1 != p2 {
+				t.Fatalf("programs generated with conf %+v and seed %v differ", conf, seed)
+			}
+		}
+	}
+}
+
+// Functions built by DeferStress start with a deferred recover, and
+// have either 8 or 9 unconditional defers, or a defer in a loop.
+func TestDeferStress(t *testing.T) {
+	counts := make(map[string]int)
+	for seed := int64(0); seed < 8; seed++ {
+		src := microsmith.NewProgram(microsmith.ProgramConf{}, "defer", seed).String()
+		f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range f.Decls {
+			fd, ok := d.(*ast.FuncDecl)
+			if !ok || len(fd.Body.List) == 0 {
+				continue
+			}
+			if !isDeferredRecover(fd.Body.List[0]) {
+				continue
+			}
+			rs, ok := fd.Body.List[1].(*ast.RangeStmt)
+			switch n := topLevelDefers(fd.Body.List); {
+			case ok && len(rs.Body.List) == 1 && isDefer(rs.Body.List[0]):
+				counts["loop"]++
+			case n == 8 || n == 9:
+				counts[strconv.Itoa(n)]++
+			default:
+				t.Errorf("%v has %v unconditional defers:\n%s", fd.Name.Name, n, src)
+			}
+		}
+	}
+	for _, k := range []string{"8", "9", "loop"} {
+		if counts[k] == 0 {
+			t.Errorf("no function with defers of kind %q, got %v", k, counts)
+		}
+	}
+}
+
+// isDeferredRecover reports whether st is defer func() { recover() }().
+func isDeferredRecover(st ast.Stmt) bool {
+	ds, ok := st.(*ast.DeferStmt)
+	if !ok {
+		return false
+	}
+	fl, ok := ds.Call.Fun.(*ast.FuncLit)
+	if !ok || len(fl.Body.List) != 1 {
+		return false
+	}
+	es, ok := fl.Body.List[0].(*ast.ExprStmt)
+	return ok && types.ExprString(es.X) == "recover()"
+}
+
+func isDefer(st ast.Stmt) bool {
+	_, ok := st.(*ast.DeferStmt)
+	return ok
+}
+
+// topLevelDefers returns the number of defer statements in list that
+// are not in a loop, in a conditional, or in a func literal.
+func topLevelDefers(list []ast.Stmt) int {
+	n := 0
+	for _, st := range list {
+		switch st := st.(type) {
+		case *ast.DeferStmt:
+			n++
+		case *ast.BlockStmt:
+			n += topLevelDefers(st.List)
+		}
+	}
+	return n
+}
+
+// constructTests lists the constructs that the generator only builds
+// now and then. Each one has a configuration enabling it and a seed
+// for which the generated program has at least one, found by has.
+var constructTests = []struct {
+	name string
+	conf microsmith.ProgramConf
+	seed int64
+	has  func(n ast.Node) bool
+}{
+	{"select statements", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		_, ok := n.(*ast.SelectStmt)
+		return ok
+	}},
+	{"range-over-func statements", microsmith.ProgramConf{}, 1, func(n ast.Node) bool {
+		if rs, ok := n.(*ast.RangeStmt); ok {
+			_, ok := rs.X.(*ast.FuncLit)
+			return ok
+		}
+		return false
+	}},
+	{"range loops modifying the ranged variable", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		rs, ok := n.(*ast.RangeStmt)
+		return ok && mutatesRanged(rs)
+	}},
+	{"range loops collecting the runes of a string", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		rs, ok := n.(*ast.RangeStmt)
+		return ok && collectsRunes(rs)
+	}},
+	{"labeled continues from nested loops", microsmith.ProgramConf{}, 3, func(n ast.Node) bool {
+		ls, ok := n.(*ast.LabeledStmt)
+		return ok && continuesFromInnerLoop(ls)
+	}},
+	{"type assertions to interface types", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		if ta, ok := n.(*ast.TypeAssertExpr); ok {
+			_, ok := ta.Type.(*ast.InterfaceType)
+			return ok
+		}
+		return false
+	}},
+	{"func() variables", microsmith.ProgramConf{}, 1, func(n ast.Node) bool {
+		// var fnc0 func() = func() { ... }
+		if vs, ok := n.(*ast.ValueSpec); ok {
+			ft, ok := vs.Type.(*ast.FuncType)
+			return ok && len(vs.Values) > 0 && len(ft.Params.List) == 0 && ft.Results == nil
+		}
+		return false
+	}},
+	{"go and defer statements calling func() variables", microsmith.ProgramConf{}, 1, func(n ast.Node) bool {
+		var call *ast.CallExpr
+		switch n := n.(type) {
+		case *ast.GoStmt:
+			call = n.Call
+		case *ast.DeferStmt:
+			call = n.Call
+		default:
+			return false
+		}
+		id, ok := call.Fun.(*ast.Ident)
+		return ok && strings.HasPrefix(id.Name, "fnc") && len(call.Args) == 0
+	}},
+	{"closures stored in slices or maps", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			// m[k] = func(...) { ... }
+			_, ok1 := n.Lhs[0].(*ast.IndexExpr)
+			_, ok2 := n.Rhs[0].(*ast.FuncLit)
+			return ok1 && ok2
+		case *ast.CompositeLit:
+			// []F{func(...) { ... }}
+			for _, e := range n.Elts {
+				if kv, ok := e.(*ast.KeyValueExpr); ok {
+					e = kv.Value
+				}
+				if _, ok := e.(*ast.FuncLit); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}},
+	{"struct types shared by several declarations", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		f, ok := n.(*ast.File)
+		if !ok {
+			return false
+		}
+		decls := make(map[string]int) // struct type -> declarations
+		shared := false
+		ast.Inspect(f, func(n ast.Node) bool {
+			if vs, ok := n.(*ast.ValueSpec); ok {
+				if st, ok := vs.Type.(*ast.StructType); ok {
+					decls[types.ExprString(st)]++
+					shared = shared || decls[types.ExprString(st)] > 1
+				}
+			}
+			return !shared
+		})
+		return shared
+	}},
+	{"struct field tags", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		f, ok := n.(*ast.Field)
+		return ok && f.Tag != nil
+	}},
+	{"very long struct field tags", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		return len(fieldTag(n)) > 200
+	}},
+	{"struct field tags with duplicate keys", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		return strings.Count(fieldTag(n), "ms:") > 1
+	}},
+	{"struct field tags that are not raw strings", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		f, ok := n.(*ast.Field)
+		return ok && f.Tag != nil && f.Tag.Value[0] == '"'
+	}},
+	{"copies between overlapping slices", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		// copy(a, a[len(a)/2:]) and similar
+		ce, ok := n.(*ast.CallExpr)
+		if !ok || types.ExprString(ce.Fun) != "copy" {
+			return false
+		}
+		if se, ok := ce.Args[1].(*ast.SliceExpr); ok && types.ExprString(se.X) == types.ExprString(ce.Args[0]) {
+			return true
+		}
+		se, ok := ce.Args[0].(*ast.SliceExpr)
+		return ok && types.ExprString(se.X) == types.ExprString(ce.Args[1])
+	}},
+	{"appends spreading a different slice variable", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		// append(s1, s2...)
+		ce, ok := n.(*ast.CallExpr)
+		if !ok || types.ExprString(ce.Fun) != "append" || !ce.Ellipsis.IsValid() {
+			return false
+		}
+		a0, ok0 := ce.Args[0].(*ast.Ident)
+		a1, ok1 := ce.Args[1].(*ast.Ident)
+		return ok0 && ok1 && a0.Name != a1.Name
+	}},
+	{"conversions from slices to array pointers", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		// (*[N]T)(a)
+		if ce, ok := n.(*ast.CallExpr); ok {
+			if pe, ok := ce.Fun.(*ast.ParenExpr); ok {
+				if se, ok := pe.X.(*ast.StarExpr); ok {
+					at, ok := se.X.(*ast.ArrayType)
+					return ok && at.Len != nil
+				}
+			}
+		}
+		return false
+	}},
+	{"make calls with a capacity", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		ce, ok := n.(*ast.CallExpr)
+		return ok && types.ExprString(ce.Fun) == "make" && len(ce.Args) == 3
+	}},
+	{"calls to reflect.TypeOf or reflect.ValueOf", microsmith.ProgramConf{}, 0, func(n ast.Node) bool {
+		ce, ok := n.(*ast.CallExpr)
+		if !ok {
+			return false
+		}
+		f := types.ExprString(ce.Fun)
+		return f == "reflect.TypeOf" || f == "reflect.ValueOf"
+	}},
+	{"functions with type parameters", microsmith.ProgramConf{TypeParams: true}, 0, func(n ast.Node) bool {
+		fd, ok := n.(*ast.FuncDecl)
+		return ok && fd.Type.TypeParams != nil
+	}},
+	{"generic functions calling generic functions", microsmith.ProgramConf{TypeParams: true}, 0, func(n ast.Node) bool {
+		// F1[G0, ...], with G0 a type parameter of the caller
+		if ie, ok := n.(*ast.IndexListExpr); ok {
+			for _, e := range ie.Indices {
+				if typeParamName(e) != "" {
+					return true
+				}
+			}
+		}
+		return false
+	}},
+	{"generic functions instantiated with named types", microsmith.ProgramConf{TypeParams: true}, 15, func(n ast.Node) bool {
+		// F1[N0, ...], with N0 a named type admitted by a ~T
+		if ie, ok := n.(*ast.IndexListExpr); ok {
+			for _, e := range ie.Indices {
+				if id, ok := e.(*ast.Ident); ok && namedTypeRe.MatchString(id.Name) {
+					return true
+				}
+			}
+		}
+		return false
+	}},
+	{"types mixing two type parameters", microsmith.ProgramConf{TypeParams: true}, 0, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.MapType:
+			// map[G0]G1
+			k, v := typeParamName(n.Key), typeParamName(n.Value)
+			return k != "" && v != "" && k != v
+		case *ast.FuncType:
+			// func(G0) G1
+			if n.Results != nil && len(n.Params.List) == 1 && len(n.Results.List) == 1 {
+				p, r := typeParamName(n.Params.List[0].Type), typeParamName(n.Results.List[0].Type)
+				return p != "" && r != "" && p != r
+			}
+		}
+		return false
+	}},
+	{"conversions between type parameters", microsmith.ProgramConf{TypeParams: true}, 4, func(n ast.Node) bool {
+		// G1(g0_0)
+		if ce, ok := n.(*ast.CallExpr); ok {
+			if g := typeParamName(ce.Fun); g != "" && len(ce.Args) == 1 {
+				id, ok := ce.Args[0].(*ast.Ident)
+				return ok && strings.HasPrefix(id.Name, "g") && !strings.HasPrefix(id.Name, strings.ToLower(g)+"_")
+			}
+		}
+		return false
+	}},
+	{"typed nil stores through the write barrier", microsmith.ProgramConf{WriteBarriers: true}, 0, func(n ast.Node) bool {
+		// for wbi, wbp := range wb5, see NilStoreStmt
+		if rs, ok := n.(*ast.RangeStmt); ok {
+			id, ok := rs.X.(*ast.Ident)
+			return ok && id.Name == "wb5"
+		}
+		return false
+	}},
+}
+
+// Check that the generator still builds each of the constructTests
+// constructs for its configuration and seed.
+func TestConstructs(t *testing.T) {
+	for _, tc := range constructTests {
+		src := microsmith.NewProgram(tc.conf, "prog", tc.seed).String()
+		f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		ast.Inspect(f, func(n ast.Node) bool {
+			found = found || (n != nil && tc.has(n))
+			return !found
+		})
+		if !found {
+			t.Errorf("Program generated with seed %v has no %v", tc.seed, tc.name)
+		}
+	}
+}
+
+// fieldTag returns the tag of n, if it's a struct field with one.
+func fieldTag(n ast.Node) string {
+	f, ok := n.(*ast.Field)
+	if !ok || f.Tag == nil {
+		return ""
+	}
+	tag, _ := strconv.Unquote(f.Tag.Value)
+	return tag
+}
+
+// typeParamName returns the name of the type parameter e, like G0,
+// or "" if e is not one.
+func typeParamName(e ast.Expr) string {
+	if id, ok := e.(*ast.Ident); ok && typeParamRe.MatchString(id.Name) {
+		return id.Name
+	}
+	return ""
+}
+
+var typeParamRe = regexp.MustCompile(`^G\d+$`)
+
+// The names of the named types declared by PackageBuilder.File.
+var namedTypeRe = regexp.MustCompile(`^[NS]\d+$`)
+
+// collectsRunes reports whether rs is a loop like
+//
+//	for _, r := range s { rs = append(rs, r) }
+func collectsRunes(rs *ast.RangeStmt) bool {
+	if rs.Value == nil || len(rs.Body.List) != 1 {
+		return false
+	}
+	as, ok := rs.Body.List[0].(*ast.AssignStmt)
+	if !ok {
+		return false
+	}
+	ce, ok := as.Rhs[0].(*ast.CallExpr)
+	return ok && types.ExprString(ce.Fun) == "append" && len(ce.Args) == 2 &&
+		types.ExprString(ce.Args[1]) == types.ExprString(rs.Value)
+}
+
+// mutatesRanged reports whether the body of rs has a statement
+// assigning to the variable being ranged over, or deleting from it.
+func mutatesRanged(rs *ast.RangeStmt) bool {
+	x, ok := rs.X.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	for _, s := range rs.Body.List {
+		switch s := s.(type) {
+		case *ast.AssignStmt:
+			lhs := s.Lhs[0]
+			if ie, ok := lhs.(*ast.IndexExpr); ok {
+				lhs = ie.X
+			}
+			if id, ok := lhs.(*ast.Ident); ok && id.Name == x.Name {
+				return true
+			}
+		case *ast.ExprStmt:
+			if ce, ok := s.X.(*ast.CallExpr); ok && types.ExprString(ce.Fun) == "delete" &&
+				types.ExprString(ce.Args[0]) == x.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// continuesFromInnerLoop reports whether ls is a loop containing
+// another loop with a continue statement targeting ls's label.
+func continuesFromInnerLoop(ls *ast.LabeledStmt) bool {
+	var found bool
+	ast.Inspect(ls.Stmt, func(n ast.Node) bool {
+		if n == ls.Stmt {
+			return true
+		}
+		switch n.(type) {
+		case *ast.ForStmt, *ast.RangeStmt:
+			ast.Inspect(n, func(n ast.Node) bool {
+				if bs, ok := n.(*ast.BranchStmt); ok && bs.Tok == token.CONTINUE &&
+					bs.Label != nil && bs.Label.Name == ls.Label.Name {
+					found = true
+				}
+				return !found
+			})
+			return false
+		}
+		return !found
+	})
+	return found
+}
+
+func GetToolchain() string {
+	if bin := os.Getenv("GO_TC"); bin != "" {
+		return bin
+	} else {
+		return "go"
+	}
+}
+
+// Check generated programs with gc (from file).
+func compile(t *testing.T, conf microsmith.ProgramConf) {
+	lim := 10
+	if testing.Short() {
+		lim = 2
+	}
+	seeds := make([]int64, lim)
+	for i := range seeds {
+		seeds[i] = rand.Int63()
+	}
+	compileSeeds(t, conf, seeds...)
+}
+
+// compileSeeds is like compile, but only builds the programs
+// generated from the given seeds. It's used for the options that
+// are slow to build, whose big loops are left to -selftest, so that
+// the tests fit in go test's default timeout.
+func compileSeeds(t *testing.T, conf microsmith.ProgramConf, seeds ...int64) {
+	if _, err := os.Stat(WorkDir); os.IsNotExist(err) {
+		err := os.MkdirAll(WorkDir, os.ModePerm)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	arch := "amd64"
+	if conf.PtrSize == 4 {
+		arch = "386"
+	}
+
+	// build toolchain
+	cmd := exec.Command(GetToolchain(), "install", "std")
+	env := append(os.Environ(), "GODEBUG=installgoroot=all", "GOARCH="+arch)
+	cmd.Env = env
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Installing dependencies failed with error:\n----\n%s\n%s\n----\n", out, err)
+	}
+
+	keepdir := false
+	for _, seed := range seeds {
+		gp := microsmith.NewProgram(conf, microsmith.RandID(), seed)
+		err := gp.WriteToDisk(WorkDir)
+		if err != nil {
+			t.Fatalf("Could not write to file: %s", err)
+		}
+		bo := microsmith.BuildOptions{
+			Toolchain: GetToolchain(),
+			Noopt:     false,
+			Race:      false,
+			Ssacheck:  false,
+		}
+		res := gp.Compile(arch, bo)
+		if res.Outcome != microsmith.Success && res.Outcome != microsmith.ICE {
+			t.Fatalf("Generated program failed compilation:\n%s\n%s", res.Output, res.Err)
+			keepdir = true
+		}
+	}
+
+	if !keepdir {
+		os.RemoveAll(WorkDir)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	compile(t,
+		microsmith.ProgramConf{
+			MultiPkg:   false,
+			TypeParams: false,
+		})
+}
+
+func TestCompileMultiPkg(t *testing.T) {
+	compile(t,
+		microsmith.ProgramConf{
+			MultiPkg:   true,
+			TypeParams: false,
+		})
+}
+
+func TestCompileTypeParams(t *testing.T) {
+	compile(t,
+		microsmith.ProgramConf{
+			MultiPkg:   false,
+			TypeParams: true,
+		})
+}
+
+func TestCompileMultiPkgTypeParams(t *testing.T) {
+	compile(t,
+		microsmith.ProgramConf{
+			MultiPkg:   true,
+			TypeParams: true,
+		})
+}
+
+func TestCompileGenericRatio(t *testing.T) {
+	compileSeeds(t,
+		microsmith.ProgramConf{
+			MultiPkg:     true,
+			TypeParams:   true,
+			GenericRatio: 0.5,
+		}, 1, 2)
+}
+
+// Build a couple of programs with every inlining level.
+func TestCompileInline(t *testing.T) {
+	conf := microsmith.ProgramConf{TypeParams: true, Inline: true}
+	seeds := []int64{1, 2}
+	if testing.Short() {
+		seeds = seeds[:1]
+	}
+
+	if err := os.MkdirAll(WorkDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(WorkDir)
+	for _, seed := range seeds {
+		gp := microsmith.NewProgram(conf, microsmith.RandID(), seed)
+		if err := gp.WriteToDisk(WorkDir); err != nil {
+			t.Fatalf("Could not write to file: %s", err)
+		}
+		for _, l := range microsmith.InlineLevels {
+			bo := microsmith.BuildOptions{Toolchain: GetToolchain(), Inline: l}
+			if res := gp.Compile("amd64", bo); res.Outcome != microsmith.Success && res.Outcome != microsmith.ICE {
+				t.Fatalf("Generated program failed compilation with %q:\n%s\n%s", l, res.Output, res.Err)
+			}
+		}
+		gp.DeleteSource()
+	}
+}
+
+func TestNewProgramMultiFile(t *testing.T) {
+	n := 50
+	if testing.Short() {
+		n = 10
+	}
+	testProgramGoTypes(t, n, microsmith.ProgramConf{TypeParams: true, MultiFile: true})
+}
+
+func TestNewProgramArchFiles(t *testing.T) {
+	n := 5
+	if testing.Short() {
+		n = 2
+	}
+	testProgramGoTypes(t, n, microsmith.ProgramConf{MultiPkg: true, TypeParams: true, ArchFiles: true})
+}
+
+func TestCompileArchFiles(t *testing.T) {
+	compileSeeds(t, microsmith.ProgramConf{MultiPkg: true, TypeParams: true, ArchFiles: true}, 1, 2)
+}
+
+// The files passed to the compiler for each GOARCH must be the ones
+// the go command would build.
+func TestArchFiles(t *testing.T) {
+	archs := []string{"386", "amd64", "arm", "arm64", "mips64le", "ppc64le", "riscv64", "s390x", "wasm"}
+	conf := microsmith.ProgramConf{MultiPkg: true, ArchFiles: true}
+	for seed := int64(1); seed <= 5; seed++ {
+		dir := t.TempDir()
+		gp := microsmith.NewProgram(conf, "x", seed)
+		if err := gp.WriteToDisk(dir); err != nil {
+			t.Fatal(err)
+		}
+
+		selections := make(map[string]bool)
+		for _, arch := range archs {
+			ctx := build.Default
+			ctx.GOOS, ctx.GOARCH = "linux", arch
+			if arch == "wasm" {
+				ctx.GOOS = "js"
+			}
+			var sel []string
+			for _, files := range microsmith.FilenamesFor(gp, arch) {
+				sel = append(sel, files...)
+			}
+			var want []string
+			all, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+			for _, f := range all {
+				if ok, err := ctx.MatchFile(dir, filepath.Base(f)); err != nil {
+					t.Fatal(err)
+				} else if ok {
+					want = append(want, filepath.Base(f))
+				}
+			}
+			sort.Strings(sel)
+			if fmt.Sprint(sel) != fmt.Sprint(want) {
+				t.Errorf("seed %v: files built for %v are %v, want %v", seed, arch, sel, want)
+			}
+			selections[fmt.Sprint(sel)] = true
+		}
+		if len(selections) < 2 {
+			t.Errorf("seed %v: all the GOARCHes build the same files", seed)
+		}
+	}
+}
+
+func TestCompilePragmas(t *testing.T) {
+	compileSeeds(t, microsmith.ProgramConf{MultiPkg: true, TypeParams: true, Pragmas: true, Race: true}, 1, 2)
+}
+
+// The compiler directives must be printed right before their
+// functions, or they would be ignored.
+func TestPragmas(t *testing.T) {
+	conf := microsmith.ProgramConf{MultiPkg: true, TypeParams: true, Pragmas: true, Race: true}
+	before := microsmith.PragmaStats()
+	pragmas := make(map[string]int64)
+	for seed := int64(1); seed <= 5; seed++ {
+		gp := microsmith.NewProgram(conf, "x", seed)
+		for _, src := range microsmith.Sources(gp) {
+			f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ParseComments)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var inDoc int
+			for _, d := range f.Decls {
+				if fd, ok := d.(*ast.FuncDecl); ok && fd.Doc != nil {
+					for _, c := range fd.Doc.List {
+						pragmas[strings.TrimPrefix(c.Text, "//go:")]++
+					}
+					inDoc += len(fd.Doc.List)
+				}
+			}
+			var all int
+			for _, cg := range f.Comments {
+				all += len(cg.List)
+			}
+			if all != inDoc {
+				t.Errorf("seed %v: %v directives not attached to a function", seed, all-inDoc)
+			}
+		}
+	}
+
+	after := microsmith.PragmaStats()
+	for _, p := range []string{"noinline", "norace"} {
+		if pragmas[p] == 0 {
+			t.Errorf("No functions with //go:%v were generated", p)
+		}
+		if got := after[p] - before[p]; got < pragmas[p] {
+			t.Errorf("PragmaStats counted %v functions with //go:%v, want at least %v", got, p, pragmas[p])
+		}
+	}
+}
+
+func TestCompileMultiFile(t *testing.T) {
+	compileSeeds(t,
+		microsmith.ProgramConf{
+			MultiPkg:   true,
+			TypeParams: true,
+			MultiFile:  true,
+		}, 1, 2)
+}
+
+// Check that Compile deletes everything it writes, both when the
+// build succeeds and when it fails.
+func TestCompileCleanup(t *testing.T) {
+	dir := t.TempDir()
+	bad := microsmith.NewProgramFromSource(microsmith.ProgramConf{}, []byte("package main\nfunc main() { x }\n"))
+	good := microsmith.NewProgram(microsmith.ProgramConf{MultiPkg: true}, "x", 1)
+	for _, gp := range []*microsmith.Program{good, bad} {
+		if err := gp.WriteToDisk(dir); err != nil {
+			t.Fatal(err)
+		}
+		for _, noopt := range []bool{false, true} {
+			gp.Compile("amd64", microsmith.BuildOptions{Toolchain: GetToolchain(), Noopt: noopt})
+		}
+		gp.DeleteSource()
+	}
+
+	filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			t.Errorf("Compile left %v behind", path)
+		}
+		return nil
+	})
+}
+
+// Check that Compile classifies the outcome of a build.
+func TestCompileOutcome(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		src     string
+		timeout time.Duration
+		want    microsmith.Outcome
+	}{
+		{"package main\nfunc main() {}\n", 0, microsmith.Success},
+		{"package main\nfunc main() { x }\n", 0, microsmith.CompileError},
+		{"package main\nfunc main() {}\n", time.Nanosecond, microsmith.Timeout},
+	}
+	for _, tc := range tests {
+		gp := microsmith.NewProgramFromSource(microsmith.ProgramConf{}, []byte(tc.src))
+		if err := gp.WriteToDisk(dir); err != nil {
+			t.Fatal(err)
+		}
+		res := gp.Compile("amd64", microsmith.BuildOptions{Toolchain: GetToolchain(), Timeout: tc.timeout})
+		if res.Outcome != tc.want {
+			t.Errorf("Compile of %q with timeout %v: got outcome %v, want %v\n%s", tc.src, tc.timeout, res.Outcome, tc.want, res.Output)
+		}
+		if res.Arch != "amd64" {
+			t.Errorf("Compile returned Arch %q, want amd64", res.Arch)
+		}
+		if res.Outcome == microsmith.CompileError && (res.Pkg != "main" || res.Phase() != microsmith.CompilePhase) {
+			t.Errorf("Compile error in package %q during %v, want main during compile", res.Pkg, res.Phase())
+		}
+		if err := gp.DeleteBinaries(); err != nil {
+			t.Error(err)
+		}
+		gp.DeleteSource()
+	}
+}
+
+// Check that a build timing out is killed with the processes it
+// started, even when they keep its output open, and that a build
+// whose context is canceled is killed too.
+func TestCompileTimeoutChildren(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake toolchain is a shell script")
+	}
+	dir := t.TempDir()
+	tc := filepath.Join(dir, "go")
+	if err := os.WriteFile(tc, []byte("#!/bin/sh\nsleep 60 &\nwait\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	gp := microsmith.NewProgramFromSource(microsmith.ProgramConf{}, []byte("package main\nfunc main() {}\n"))
+	if err := gp.WriteToDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer gp.DeleteSource()
+
+	start := time.Now()
+	res := gp.Compile("amd64", microsmith.BuildOptions{Toolchain: tc, Timeout: 100 * time.Millisecond})
+	if res.Outcome != microsmith.Timeout {
+		t.Errorf("Compile: got outcome %v, want %v", res.Outcome, microsmith.Timeout)
+	}
+	if d := time.Since(start); d > 30*time.Second {
+		t.Errorf("Compile returned after %v", d)
+	}
+
+	// The same when the build's context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	res = gp.CompileContext(ctx, "amd64", microsmith.BuildOptions{Toolchain: tc, Timeout: time.Minute})
+	if res.Outcome != microsmith.Canceled {
+		t.Errorf("CompileContext: got outcome %v, want %v", res.Outcome, microsmith.Canceled)
+	}
+	if d := time.Since(start); d > 30*time.Second {
+		t.Errorf("CompileContext returned after %v", d)
+	}
+
+	res = gp.Compile("amd64", microsmith.BuildOptions{Toolchain: filepath.Join(dir, "nonexistent")})
+	if res.Outcome != microsmith.InfraError {
+		t.Errorf("Compile with a missing toolchain: got outcome %v, want %v", res.Outcome, microsmith.InfraError)
+	}
+}
+
+func TestCompileDiag(t *testing.T) {
+	dir := t.TempDir()
+	src := "package main\nfunc f(p *int) *int { return p }\nfunc main() { x := 1; _ = f(&x); y }\n"
+	gp := microsmith.NewProgramFromSource(microsmith.ProgramConf{}, []byte(src))
+	if err := gp.WriteToDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer gp.DeleteSource()
+
+	// The -m=2 diagnostics are dropped from the output of failed
+	// builds, but the compile errors must be kept.
+	res := gp.Compile("amd64", microsmith.BuildOptions{Toolchain: GetToolchain(), Diag: true})
+	if res.Outcome != microsmith.CompileError {
+		t.Fatalf("Compile: got outcome %v, want %v\n%s", res.Outcome, microsmith.CompileError, res.Output)
+	}
+	if !strings.Contains(res.Output, "undefined: y") {
+		t.Errorf("Compile output lost the compile error:\n%s", res.Output)
+	}
+}
+
+func TestCompileHash(t *testing.T) {
+	dir := t.TempDir()
+	gp := microsmith.NewProgram(microsmith.ProgramConf{MultiPkg: true}, "x", 1)
+	if err := gp.WriteToDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer gp.DeleteSource()
+
+	bo := microsmith.BuildOptions{Toolchain: GetToolchain(), Hash: true}
+	var hashes []string
+	for i := 0; i < 2; i++ {
+		if res := gp.Compile("amd64", bo); res.Failed() {
+			t.Fatalf("Compile failed: %v\n%s", res.Err, res.Output)
+		}
+		hashes = append(hashes, gp.OutputHash())
+	}
+	if hashes[0] == "" || hashes[0] != hashes[1] {
+		t.Errorf("Compiling the same program twice gave hashes %q", hashes)
+	}
+
+	bo.Hash = false
+	if res := gp.Compile("amd64", bo); res.Failed() {
+		t.Fatal(res.Err)
+	}
+	if h := gp.OutputHash(); h != "" {
+		t.Errorf("Compile without Hash set the hash to %q", h)
+	}
+}
+
+func TestCompileNoMain(t *testing.T) {
+	compile(t,
+		microsmith.ProgramConf{
+			TypeParams: true,
+			NoMain:     true,
+		})
+}
+
+func TestCompile32Bit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping 386 build in short mode (it installs std for GOARCH=386)")
+	}
+	compileSeeds(t,
+		microsmith.ProgramConf{
+			MultiPkg:   false,
+			TypeParams: true,
+			PtrSize:    4,
+		}, 1, 2)
+}
+
+func TestReduce(t *testing.T) {
+	src := []byte(`package main
+
+func main() {
+	var a, b int
+	a = 1
+	if a > 0 {
+		b = 2
+		println("hello")
+	}
+	_, _ = a, b
+}
+`)
+
+	// Like a crash, the println must be kept, and the reduced program
+	// must still compile.
+	red, err := microsmith.Reduce(src, func(s []byte) bool {
+		return strings.Contains(string(s), "println") && microsmith.NewProgramFromSource(microsmith.ProgramConf{}, s).Check() == nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `package main
+
+func main() {
+	var a, b int
+	if a > 0 {
+		println("hello")
+	}
+	_, _ = a, b
+}
+`
+	if string(red) != want {
+		t.Fatalf("Reduce returned:\n%s\nwant:\n%s", red, want)
+	}
+}
+
+// ReduceProgram must reduce all the packages of a program loaded
+// from a crasher folder, keeping them separate.
+func TestReduceProgram(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a_red.go": `package a_red
+
+func F() int {
+	x := 1
+	x++
+	return x
+}
+`,
+		"main_red.go": `package main
+
+import "a_red"
+
+func main() {
+	println(a_red.F())
+	g()
+}
+`,
+		"main_red_1.go": `package main
+
+func g() {
+	y := 2
+	y++
+	_ = y
+}
+`,
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gp, err := microsmith.NewProgramFromDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gp.Name() != "red" {
+		t.Errorf("loaded program has id %v, want red", gp.Name())
+	}
+	if got := strings.Join(microsmith.PackageNames(gp), " "); got != "a_red main" {
+		t.Fatalf("loaded program has packages %v, want [a_red main]", got)
+	}
+
+	red, err := microsmith.ReduceProgram(gp, func(p *microsmith.Program) bool {
+		return strings.Contains(p.String(), "a_red.F()") && p.Check() == nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{`package a_red
+
+func F() int {
+	x := 1
+	return x
+}
+`, `package main
+
+import "a_red"
+
+func main() {
+	println(a_red.F())
+}
+`, `package main
+
+func g() {
+	y := 2
+	y++
+}
+`}
+	for i, src := range microsmith.Sources(red) {
+		if string(src) != want[i] {
+			t.Errorf("file %v of the reduced program is:\n%s\nwant:\n%s", i, src, want[i])
+		}
+	}
+	if got := microsmith.Sources(gp)[0]; string(got) != files["a_red.go"] {
+		t.Errorf("ReduceProgram modified its argument")
+	}
+}
+
+// Reduce must keep the compiler directives of the functions, and tell
+// them apart from the ones of methods with the same name.
+func TestReducePragmas(t *testing.T) {
+	src := []byte(`package main
+
+//go:noinline
+//go:norace
+func F0(a int) int {
+	a++
+	return a + 1
+}
+
+type T int
+
+//go:noinline
+func (t T) F0() int {
+	t++
+	return int(t)
+}
+
+func main() {
+	println(F0(2), T(1).F0())
+}
+`)
+
+	red, err := microsmith.Reduce(src, func(s []byte) bool {
+		return strings.Count(string(s), "return") == 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `package main
+
+//go:noinline
+//go:norace
+func F0(a int) int {
+	return a + 1
+}
+
+type T int
+
+//go:noinline
+func (t T) F0() int {
+	return int(t)
+}
+func main() {
+}
+`
+	if string(red) != want {
+		t.Fatalf("Reduce returned:\n%s\nwant:\n%s", red, want)
+	}
+}
+
+func TestNewPackages(t *testing.T) {
+	conf := microsmith.ProgramConf{MultiPkg: true, TypeParams: true}
+	names := []string{"a", "b", "c", "d"}
+
+	// Generating the packages concurrently gives the same result as
+	// generating them one after the other.
+	pb := microsmith.NewProgramBuilder(conf, "x", 1)
+	var seq []*microsmith.Package
+	for _, n := range names {
+		seq = append(seq, pb.NewPackage(n))
+	}
+	want := microsmith.PackagesSource(seq)
+
+	for i := 0; i < 4; i++ {
+		pb := microsmith.NewProgramBuilder(conf, "x", 1)
+		if got := microsmith.PackagesSource(pb.NewPackages(names...)); got != want {
+			t.Fatalf("NewPackages generated different packages")
+		}
+	}
+}
+
+func TestWriteToDisk(t *testing.T) {
+	conf := microsmith.ProgramConf{MultiPkg: true, MultiFile: true}
+	dir := t.TempDir()
+	gp := microsmith.NewProgram(conf, "x", 1)
+	if err := gp.WriteToDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.go")); len(files) < 4 {
+		t.Errorf("WriteToDisk wrote %v files, want at least 4", len(files))
+	}
+	gp.DeleteSource()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.go")); len(files) > 0 {
+		t.Errorf("DeleteSource left %v behind", files)
+	}
+}
+
+func TestWriteToDiskErrors(t *testing.T) {
+	conf := microsmith.ProgramConf{MultiPkg: true}
+
+	// root can write in read-only folders
+	if os.Getuid() != 0 {
+		dir := t.TempDir()
+		if err := os.Chmod(dir, 0555); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(dir, 0755)
+		gp := microsmith.NewProgram(conf, "ro", 1)
+		if err := gp.WriteToDisk(dir); err == nil {
+			t.Error("WriteToDisk in a read-only folder did not fail")
+		}
+	}
+
+	// The main package's file can't be written, since a folder with
+	// its name exists. The library package's file, written before
+	// it, must be deleted.
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "main_x.go"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gp := microsmith.NewProgram(conf, "x", 1)
+	err := gp.WriteToDisk(dir)
+	if err == nil || !strings.Contains(err.Error(), "main_x.go") {
+		t.Fatalf("WriteToDisk returned %v, want an error about main_x.go", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a_x.go")); !os.IsNotExist(err) {
+		t.Errorf("WriteToDisk did not delete a_x.go after failing")
+	}
+}
+
+func TestMoveCrasher(t *testing.T) {
+	conf := microsmith.ProgramConf{MultiPkg: true, MultiFile: true}
+	dir := t.TempDir()
+
+	// Two programs with the same id are moved in different folders.
+	var paths []string
+	for i := 0; i < 2; i++ {
+		gp := microsmith.NewProgram(conf, "x", 1)
+		if err := gp.WriteToDisk(dir); err != nil {
+			t.Fatal(err)
+		}
+		path, err := gp.MoveCrasher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("MoveCrasher returned %v, which does not exist", path)
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "*.go")); len(files) > 0 {
+			t.Errorf("MoveCrasher left %v behind", files)
+		}
+		paths = append(paths, path)
+	}
+	if filepath.Dir(paths[0]) == filepath.Dir(paths[1]) {
+		t.Errorf("MoveCrasher moved two programs with the same id in %v", filepath.Dir(paths[0]))
+	}
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(paths[1]), "*.go"))
+	if len(files) < 4 {
+		t.Errorf("MoveCrasher moved %v files, want at least 4", len(files))
+	}
+}
+
+func TestMoveCrasherCrossDevice(t *testing.T) {
+	defer microsmith.SetRename(func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+	})()
+
+	dir := t.TempDir()
+	gp := microsmith.NewProgram(microsmith.ProgramConf{}, "x", 1)
+	if err := gp.WriteToDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	path, err := gp.MoveCrasher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(src) != gp.String() {
+		t.Errorf("the copied crasher differs from the program")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "main_x.go")); !os.IsNotExist(err) {
+		t.Errorf("MoveCrasher did not remove main_x.go after copying it")
+	}
+}
+
+func TestASTJSON(t *testing.T) {
+	conf := microsmith.ProgramConf{TypeParams: true}
+	for seed := int64(1); seed <= 5; seed++ {
+		src := []byte(microsmith.NewProgram(conf, "x", seed).String())
+		js, err := microsmith.ASTJSON(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var root map[string]any
+		if err := json.Unmarshal(js, &root); err != nil {
+			t.Fatalf("ASTJSON returned invalid JSON: %v", err)
+		}
+		if root["kind"] != "File" {
+			t.Fatalf("root node is a %v, want File", root["kind"])
+		}
+
+		// Every node of the AST must be in the JSON once.
+		f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]int{}
+		ast.Inspect(f, func(n ast.Node) bool {
+			if n != nil {
+				want[strings.TrimPrefix(fmt.Sprintf("%T", n), "*ast.")]++
+			}
+			return true
+		})
+		got := map[string]int{}
+		var count func(v any)
+		count = func(v any) {
+			switch v := v.(type) {
+			case map[string]any:
+				if k, ok := v["kind"].(string); ok {
+					got[k]++
+					if v["pos"] == nil || v["end"] == nil {
+						t.Errorf("%v node without a position", k)
+					}
+				}
+				for _, c := range v {
+					count(c)
+				}
+			case []any:
+				for _, c := range v {
+					count(c)
+				}
+			}
+		}
+		count(root)
+		for k, n := range want {
+			if got[k] != n {
+				t.Errorf("seed %v: JSON has %v %v nodes, want %v", seed, got[k], k, n)
+			}
+		}
+	}
+
+	if _, err := microsmith.ASTJSON([]byte("package p\nfunc")); err == nil {
+		t.Error("ASTJSON of invalid source did not fail")
+	}
+}
+
+func TestWriteAST(t *testing.T) {
+	conf := microsmith.ProgramConf{MultiPkg: true, MultiFile: true}
+	dir := t.TempDir()
+	gp := microsmith.NewProgram(conf, "x", 1)
+	if err := gp.WriteAST(); err == nil {
+		t.Error("WriteAST before WriteToDisk did not fail")
+	}
+	if err := gp.WriteToDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := gp.WriteAST(); err != nil {
+		t.Fatal(err)
+	}
+	srcs, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	asts, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(asts) != len(srcs) {
+		t.Errorf("WriteAST wrote %v files for %v sources", len(asts), len(srcs))
+	}
+
+	path, err := gp.MoveCrasher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) > 0 {
+		t.Errorf("MoveCrasher left %v behind", files)
+	}
+	moved, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.json"))
+	if len(moved) != len(asts) {
+		t.Errorf("MoveCrasher moved %v AST files, want %v", len(moved), len(asts))
+	}
+
+	gp = microsmith.NewProgram(conf, "y", 1)
+	if err := gp.WriteToDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := gp.WriteAST(); err != nil {
+		t.Fatal(err)
+	}
+	gp.DeleteSource()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) > 0 {
+		t.Errorf("DeleteSource left %v behind", files)
+	}
+}
+
+func TestMoveCrasherErrors(t *testing.T) {
+	// The second file can't be moved: the first one must be put
+	// back, and nothing left in the crash folder.
+	var n int
+	defer microsmith.SetRename(func(from, to string) error {
+		if n++; n == 2 {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EACCES}
+		}
+		return os.Rename(from, to)
+	})()
+
+	dir := t.TempDir()
+	gp := microsmith.NewProgram(microsmith.ProgramConf{MultiPkg: true}, "x", 1)
+	if err := gp.WriteToDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gp.MoveCrasher(); err == nil {
+		t.Fatal("MoveCrasher did not fail")
+	}
+	for _, f := range []string{"a_x.go", "main_x.go"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("%v was not put back after MoveCrasher failed", f)
+		}
+	}
+	if files, _ := os.ReadDir(filepath.Join(dir, "crash")); len(files) > 0 {
+		t.Errorf("MoveCrasher left %v in the crash folder", files[0].Name())
+	}
+}
+
+// Check that MoveCrasher puts the files back and deletes its
+// temporary folder when it can't find a free name for the crasher.
+func TestMoveCrasherNoName(t *testing.T) {
+	defer microsmith.SetRenameDir(func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EEXIST}
+	})()
+
+	dir := t.TempDir()
+	gp := microsmith.NewProgram(microsmith.ProgramConf{MultiPkg: true}, "x", 1)
+	if err := gp.WriteToDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gp.MoveCrasher(); err == nil {
+		t.Fatal("MoveCrasher did not fail")
+	}
+	for _, f := range []string{"a_x.go", "main_x.go"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			t.Errorf("%v was not put back after MoveCrasher failed", f)
+		}
+	}
+	if files, _ := os.ReadDir(filepath.Join(dir, "crash")); len(files) > 0 {
+		t.Errorf("MoveCrasher left %v in the crash folder", files[0].Name())
+	}
+}
+
+func TestCorpus(t *testing.T) {
+	conf := microsmith.ProgramConf{}
+
+	c, err := microsmith.NewCorpus(t.TempDir(), 2, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := c.Add(microsmith.NewProgram(conf, microsmith.ProgramID(0, i), 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := c.Size(); n != 5 {
+		t.Errorf("Corpus has %v files, want 5", n)
+	}
+
+	// with a tiny limit, only the last archived program is kept
+	dir := t.TempDir()
+	c, err = microsmith.NewCorpus(dir, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Add(microsmith.NewProgram(conf, microsmith.ProgramID(0, i), 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs, _ := os.ReadDir(dir)
+	if n, _ := c.Size(); n != 1 || len(fs) != 1 {
+		t.Fatalf("Corpus has %v files (%v on disk), want 1", n, len(fs))
+	}
+	if name := fs[0].Name(); name != microsmith.ProgramID(0, 2)+".go.gz" {
+		t.Errorf("Corpus kept %v, want the last program", name)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	conf := microsmith.ProgramConf{}
+	path := filepath.Join(t.TempDir(), "journal")
+
+	j, err := microsmith.NewJournal(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := j.Record(microsmith.NewProgram(conf, microsmith.ProgramID(0, i), microsmith.ProgramSeed(7, 0, i)), 7, 0, i, "ok"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	// reopening appends to the existing file
+	j, err = microsmith.NewJournal(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Record(microsmith.NewProgram(conf, microsmith.ProgramID(0, 3), microsmith.ProgramSeed(7, 0, 3)), 7, 0, 3, "crash"); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	buf, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Journal has %v lines, want 4:\n%s", len(lines), buf)
+	}
+	if want := microsmith.ProgramID(0, 3) + " 7 0 3 crash"; lines[3] != want {
+		t.Errorf("last line is %q, want %q", lines[3], want)
+	}
+
+	// with a tiny limit, every line rotates the file
+	j, err = microsmith.NewJournal(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Record(microsmith.NewProgram(conf, microsmith.ProgramID(0, 4), microsmith.ProgramSeed(7, 0, 4)), 7, 0, 4, "known"); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 {
+		t.Errorf("Journal was not rotated")
+	}
+	if buf, _ := os.ReadFile(path + ".1"); !strings.HasSuffix(string(buf), " 7 0 4 known\n") {
+		t.Errorf("rotated Journal doesn't end with the last line:\n%s", buf)
+	}
+}
+
+func TestMutate(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		gp := microsmith.NewProgram(microsmith.ProgramConf{}, microsmith.RandID(), int64(i))
+		mp, desc, err := gp.Mutate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mp.String() == gp.String() {
+			t.Errorf("Mutation %q didn't change the program", desc)
+		}
+		if _, err := parser.ParseFile(token.NewFileSet(), "", mp.String(), 0); err != nil {
+			t.Errorf("Mutant doesn't parse: %v", err)
+		}
+
+		// mutations are deterministic
+		mp2, desc2, _ := gp.Mutate()
+		if mp2.String() != mp.String() || desc2 != desc {
+			t.Errorf("Two mutations of the same program differ (%q and %q)", desc, desc2)
+		}
+	}
+
+	// With -mutate -vet, the mutants are only compared with go/types.
+	gp := microsmith.NewProgram(microsmith.ProgramConf{Vet: "go"}, microsmith.RandID(), 1)
+	if mp, _, err := gp.Mutate(); err != nil || microsmith.VetTool(mp) != "" {
+		t.Errorf("Mutant of a program checked with vet is vetted too (err: %v)", err)
+	}
+
+	gp = microsmith.NewProgram(microsmith.ProgramConf{MultiPkg: true}, microsmith.RandID(), 1)
+	if _, _, err := gp.Mutate(); err == nil {
+		t.Error("Mutate of a multi-package program didn't fail")
+	}
+}
+
+// The identifiers in Idents and the literals in IntLits are shared
+// by all the generated ASTs, so nothing must modify them.
+func TestSharedNodes(t *testing.T) {
+	confs := []microsmith.ProgramConf{
+		{},
+		{MultiPkg: true, TypeParams: true},
+		{MultiPkg: true, MultiFile: true, TypeParams: true},
+	}
+	for _, conf := range confs {
+		for seed := int64(1); seed <= 10; seed++ {
+			gp := microsmith.NewProgram(conf, "x", seed)
+			if err := gp.Check(); err != nil {
+				t.Fatalf("seed %v: %v", seed, err)
+			}
+			if len(gp.String()) == 0 {
+				t.Fatal("empty program")
+			}
+		}
+	}
+
+	for name, id := range microsmith.Idents {
+		if id.Name != name || id.NamePos != token.NoPos || id.Obj != nil {
+			t.Errorf("shared ident %q was modified: %+v", name, *id)
+		}
+	}
+	for i, bl := range microsmith.IntLits {
+		if bl.Kind != token.INT || bl.Value != fmt.Sprint(i) || bl.ValuePos != token.NoPos {
+			t.Errorf("shared literal %v was modified: %+v", i, *bl)
+		}
+	}
 }
 
 var sink *ast.File
 
 func benchHelper(b *testing.B, conf microsmith.ProgramConf) {
 	b.ReportAllocs()
-	pb := microsmith.NewProgramBuilder(conf, 1)
+	pb := microsmith.NewProgramBuilder(conf, "1", 1)
 	for i := 0; i < b.N; i++ {
 		db := microsmith.NewPackageBuilder(conf, "main", pb)
 		sink = db.File()
@@ -0,0 +1,97 @@
+package microsmith
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/printer"
+	"go/token"
+)
+
+// Reduce tries to shrink the Go source src by repeatedly deleting
+// statements from its blocks. A deletion is kept only if interesting
+// still returns true on the resulting source, so the returned program
+// is a (locally) minimal one that keeps the property checked by
+// interesting. The returned source is normalized with format.Source.
+func Reduce(src []byte, interesting func([]byte) bool) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	f.Comments = nil // the doc comments are printed by attachDocs
+
+	// collect all the block statements in the file
+	var blocks []*ast.BlockStmt
+	ast.Inspect(f, func(n ast.Node) bool {
+		if bs, ok := n.(*ast.BlockStmt); ok {
+			blocks = append(blocks, bs)
+		}
+		return true
+	})
+
+	print := func() ([]byte, error) {
+		var buf bytes.Buffer
+		docs := detachDocs(f)
+		printer.Fprint(&buf, token.NewFileSet(), f)
+		return attachDocs(buf.Bytes(), docs)
+	}
+
+	// Keep going until a whole pass over the blocks fails to delete
+	// anything.
+	for progress := true; progress; {
+		progress = false
+		for _, bs := range blocks {
+			for i := len(bs.List) - 1; i >= 0; i-- {
+				old := bs.List
+				bs.List = append(append([]ast.Stmt{}, old[:i]...), old[i+1:]...)
+				src, err := print()
+				if err != nil {
+					return nil, err
+				}
+				if interesting(src) {
+					progress = true
+				} else {
+					bs.List = old
+				}
+			}
+		}
+	}
+
+	src, err = print()
+	if err != nil {
+		return nil, err
+	}
+	return NormalizeSource(src)
+}
+
+// NormalizeSource formats src with go/format, so that two programs
+// only differing in layout compare equal.
+func NormalizeSource(src []byte) ([]byte, error) {
+	return format.Source(src)
+}
+
+// ReduceProgram is like Reduce, but shrinks all the source files of
+// prog, one after the other. A deletion in one of them is kept only if
+// interesting still returns true on the whole Program. It returns a
+// new Program with the same id, packages and files as prog, and prog
+// is left unchanged.
+func ReduceProgram(prog *Program, interesting func(*Program) bool) (*Program, error) {
+	red := prog.clone()
+	for _, pkg := range red.pkgs {
+		for _, file := range pkg.files {
+			orig := file.source
+			src, err := Reduce(orig, func(s []byte) bool {
+				file.source = s
+				return interesting(red)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("package %v: %w", pkg.name, err)
+			}
+			file.source = src
+		}
+	}
+	return red, nil
+}
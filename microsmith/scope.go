@@ -135,6 +135,15 @@ func (s Scope) RandFunc() (Variable, bool) {
 	})
 }
 
+// Returns a random function variable in scope with no results, like
+// a func(), which can only be called in a statement.
+func (s Scope) RandNoResultFunc() (Variable, bool) {
+	return s.RandPred(func(v Variable, _ ...Type) bool {
+		f, fnc := v.Type.(FuncType)
+		return fnc && f.Local && len(f.Ret) == 0
+	})
+}
+
 // Return a random variable of type t (exact match)
 func (s Scope) RandVar(t Type) (Variable, bool) {
 	return s.RandPred(func(v Variable, t ...Type) bool {
@@ -142,11 +151,36 @@ func (s Scope) RandVar(t Type) (Variable, bool) {
 	}, t)
 }
 
-// Returns a variable containing t
+// MaxDerivationDepth is the maximum DerivationDepth of the variables
+// returned by RandVarSubType.
+const MaxDerivationDepth = 3
+
+// Returns a variable containing t. Variables needing a shallower
+// derivation are preferred (each step halves the chance of a variable
+// being picked), so that a single deeply nested variable doesn't end
+// up in most of the expressions of type t.
 func (s Scope) RandVarSubType(t Type) (Variable, bool) {
-	return s.RandPred(func(v Variable, t ...Type) bool {
-		return v.Type.Contains(t[0])
-	}, t)
+	var vs []Variable
+	var weights []int
+	total := 0
+	for _, v := range s.vars {
+		if d := DerivationDepth(v.Type, t); d >= 0 && d <= MaxDerivationDepth {
+			w := 1 << (MaxDerivationDepth - d)
+			vs, weights, total = append(vs, v), append(weights, w), total+w
+		}
+	}
+	if total == 0 {
+		return Variable{}, false
+	}
+
+	n := s.pb.rs.Intn(total)
+	for i, w := range weights {
+		if n < w {
+			return vs[i], true
+		}
+		n -= w
+	}
+	panic("unreachable")
 }
 
 // Returns a random variable that can be cleared
@@ -161,6 +195,20 @@ func (s Scope) RandClearable() (Variable, bool) {
 	})
 }
 
+// Returns a map or a pointer whose value or base type is comparable
+func (s Scope) RandComparableElem() (Variable, bool) {
+	return s.RandPred(func(v Variable, _ ...Type) bool {
+		switch t := v.Type.(type) {
+		case MapType:
+			return t.ValueT.Comparable()
+		case PointerType:
+			return t.Base().Comparable()
+		default:
+			return false
+		}
+	})
+}
+
 // Returns a chan (of any subtype)
 func (s Scope) RandChan() (Variable, bool) {
 	return s.RandPred(func(v Variable, _ ...Type) bool {
@@ -169,6 +217,14 @@ func (s Scope) RandChan() (Variable, bool) {
 	})
 }
 
+// Returns a pointer (of any base type)
+func (s Scope) RandPointer() (Variable, bool) {
+	return s.RandPred(func(v Variable, _ ...Type) bool {
+		_, ispointer := v.Type.(PointerType)
+		return ispointer
+	})
+}
+
 // Returns a struct (of any type)
 func (s Scope) RandStruct() (Variable, bool) {
 	return s.RandPred(func(v Variable, _ ...Type) bool {
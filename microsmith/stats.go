@@ -0,0 +1,66 @@
+package microsmith
+
+import "sync"
+
+// CastPair is a conversion between two integer types, identified by
+// their underlying types.
+type CastPair struct {
+	From, To string
+}
+
+// castStats counts the conversions generated by ChainedCast, across
+// all the programs generated by the process.
+var castStats struct {
+	sync.Mutex
+	n map[CastPair]int64
+}
+
+func countCast(from, to Type) {
+	castStats.Lock()
+	defer castStats.Unlock()
+	if castStats.n == nil {
+		castStats.n = make(map[CastPair]int64)
+	}
+	castStats.n[CastPair{underlying(from).N, underlying(to).N}]++
+}
+
+// CastStats returns how many times each conversion was generated by
+// ChainedCast, to verify the coverage of the integer types pairs.
+func CastStats() map[CastPair]int64 {
+	castStats.Lock()
+	defer castStats.Unlock()
+	m := make(map[CastPair]int64, len(castStats.n))
+	for k, v := range castStats.n {
+		m[k] = v
+	}
+	return m
+}
+
+// pragmaStats counts the functions generated by AddPragmas with each
+// compiler directive, across all the programs generated by the
+// process.
+var pragmaStats struct {
+	sync.Mutex
+	n map[string]int64
+}
+
+func countPragma(p string) {
+	pragmaStats.Lock()
+	defer pragmaStats.Unlock()
+	if pragmaStats.n == nil {
+		pragmaStats.n = make(map[string]int64)
+	}
+	pragmaStats.n[p]++
+}
+
+// PragmaStats returns how many functions carried each compiler
+// directive (like "noinline"), with ProgramConf.Pragmas.
+func PragmaStats() map[string]int64 {
+	pragmaStats.Lock()
+	defer pragmaStats.Unlock()
+	m := make(map[string]int64, len(pragmaStats.n))
+	for k, v := range pragmaStats.n {
+		m[k] = v
+	}
+	return m
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"go/ast"
 	"go/token"
+	"go/types"
 	"math/rand"
+	"strconv"
 )
 
 // --------------------------------
@@ -20,10 +22,9 @@ type StmtBuilder struct {
 	S *Scope
 
 	// TODO(alb): move all of these into Context or PackageBuilder
-	depth  int // how deep the stmt hyerarchy is
-	funcp  int // counter for function param names
-	labels []string
-	label  int // counter for labels names
+	depth int // how deep the stmt hyerarchy is
+	funcp int // counter for function param names
+	label int // counter for labels names
 }
 
 func NewStmtBuilder(pb *PackageBuilder) *StmtBuilder {
@@ -46,51 +47,118 @@ func (sb *StmtBuilder) CanNest() bool {
 	return (sb.depth <= 3) && (sb.R.Float64() < 0.8)
 }
 
-func (sb *StmtBuilder) Stmt() ast.Stmt {
+func (sb *StmtBuilder) Stmt() (st ast.Stmt) {
+	seq := sb.C.Trace("Stmt", nil, sb.depth)
+	defer func() { sb.C.TraceNode(seq, st) }()
+
+	// In a loop nested in a labeled one, sometimes conditionally
+	// branch to the outer loop. Since nested loops are usually too
+	// deep for anything else, this is checked before CanNest.
+	if len(sb.outerLabels()) > 0 && sb.R.Intn(8) == 0 {
+		return &ast.IfStmt{
+			Cond: sb.E.Expr(BT{"bool"}),
+			Body: &ast.BlockStmt{List: []ast.Stmt{sb.BranchStmt()}},
+		}
+	}
+
+	// Directly in the body of a labeled loop, sometimes nest another
+	// loop, for the branch statements above.
+	if n := len(sb.C.labels); n > 0 && sb.C.labels[n-1].depth+1 == sb.C.loops && sb.R.Intn(8) == 0 {
+		if sb.R.Intn(2) == 0 {
+			return sb.RangeStmt()
+		}
+		return sb.ForStmt()
+	}
+
 	if !sb.CanNest() {
 		return sb.AssignStmt()
 	}
 
+	if sb.pb.Conf().NoEscape && sb.R.Intn(8) == 0 {
+		return sb.NoEscapeStmt()
+	}
+
+	if sb.pb.Conf().Maps && sb.R.Intn(8) == 0 {
+		return sb.MapStmt()
+	}
+
+	if sb.pb.Conf().WriteBarriers && sb.R.Intn(8) == 0 {
+		switch sb.R.Intn(3) {
+		case 0:
+			return sb.EscapeStoreStmt()
+		case 1:
+			return sb.NilStoreStmt()
+		}
+		return sb.WriteBarrierStmt()
+	}
+
 	switch sb.R.Intn(12) {
 	case 0:
 		return sb.AssignStmt()
 	case 1:
 		return sb.BlockStmt()
 	case 2:
+		if sb.R.Intn(8) == 0 {
+			return sb.RuneRangeStmt()
+		}
 		if sb.R.Intn(2) == 0 { // for range
+			if sb.R.Intn(4) == 0 {
+				return sb.LabeledLoop(token.RANGE)
+			}
 			return sb.RangeStmt()
 		}
 		if sb.R.Intn(4) == 0 { // labelled plain for
-			sb.label++
-			label := fmt.Sprintf("lab%v", sb.label)
-			sb.labels = append(sb.labels, label)
-			fs := &ast.LabeledStmt{
-				Label: &ast.Ident{Name: label},
-				Stmt:  sb.ForStmt(),
-			}
-			return fs
+			return sb.LabeledLoop(token.FOR)
 		}
 		return sb.ForStmt() // plain for
 	case 3:
+		if sb.R.Intn(4) == 0 {
+			if st, ok := sb.NilCheckStmt(); ok {
+				return st
+			}
+		}
 		return sb.IfStmt()
 	case 4:
+		if sb.R.Intn(4) == 0 {
+			return sb.TypeSwitchStmt()
+		}
 		return sb.SwitchStmt()
 	case 5:
 		return sb.SendStmt()
 	case 6:
 		return sb.SelectStmt()
 	case 7:
-		if sb.C.inLoop {
+		if sb.C.inLoop || len(sb.C.labels) > 0 {
 			return sb.BranchStmt()
 		}
 		return sb.AssignStmt()
 	case 8:
+		if sb.R.Intn(4) == 0 {
+			return sb.DeferArgStmt()
+		}
 		return sb.DeferStmt()
 	case 9:
+		if sb.R.Intn(4) == 0 {
+			return sb.CapturingGoStmt()
+		}
 		return sb.GoStmt()
 	case 10:
+		if sb.R.Intn(4) == 0 {
+			if st, ok := sb.InterfaceConvStmt(); ok {
+				return st
+			}
+		}
+		if sb.R.Intn(8) == 0 {
+			return sb.FuncTableStmt()
+		}
 		return sb.ExprStmt()
 	case 11:
+		if sb.R.Intn(4) == 0 {
+			return sb.OverlapCopyStmt()
+		}
+		if sb.R.Intn(4) == 0 {
+			return sb.ArrayPtrConvStmt()
+		}
 		return sb.ClearStmt()
 	default:
 		panic("unreachable")
@@ -100,10 +168,31 @@ func (sb *StmtBuilder) Stmt() ast.Stmt {
 // gets a random variable currently in scope (that we can assign to),
 // and builds an AssignStmt with a random Expr of its type on the RHS
 func (sb *StmtBuilder) AssignStmt() *ast.AssignStmt {
+	as := sb.assignStmt()
+
+	// Avoid generating x = x, which go vet rejects as a useless
+	// self-assignment; assign x to the blank identifier instead.
+	if len(as.Lhs) == 1 && types.ExprString(as.Lhs[0]) == types.ExprString(as.Rhs[0]) {
+		as.Lhs[0] = &noName
+	}
+	return as
+}
+
+func (sb *StmtBuilder) assignStmt() *ast.AssignStmt {
+	if len(sb.pb.multiRet) > 0 && !sb.C.inDefer && sb.R.Intn(8) == 0 {
+		return sb.MultiAssignStmt(RandItem(sb.R, sb.pb.multiRet))
+	}
+
 	v, ok := sb.S.RandAssignable()
 	if !ok {
-		fmt.Println(sb.S)
-		panic("No assignable variable in scope")
+		if v, ok = sb.E.ScopeVar(BT{"int"}); !ok {
+			// _ = <expr>
+			return &ast.AssignStmt{
+				Lhs: []ast.Expr{&noName},
+				Tok: token.ASSIGN,
+				Rhs: []ast.Expr{sb.E.Expr(BT{"int"})},
+			}
+		}
 	}
 
 	switch t := v.Type.(type) {
@@ -154,7 +243,7 @@ func (sb *StmtBuilder) AssignStmt() *ast.AssignStmt {
 
 			fi := RandItem(sb.pb.rs, fis)
 			return &ast.AssignStmt{
-				Lhs: []ast.Expr{&ast.SelectorExpr{X: v.Name, Sel: &ast.Ident{Name: t.Fnames[fi]}}},
+				Lhs: []ast.Expr{&ast.SelectorExpr{X: v.Name, Sel: SharedIdent(t.Fnames[fi])}},
 				Tok: token.ASSIGN,
 				Rhs: []ast.Expr{sb.E.Expr(t.Ftypes[fi])},
 			}
@@ -197,54 +286,209 @@ func (sb *StmtBuilder) AssignStmt() *ast.AssignStmt {
 		}
 
 	default:
+		rhs := sb.E.Expr(v.Type)
+		if sb.E.IntBits(v.Type) > 0 && sb.R.Intn(8) == 0 {
+			rhs = sb.E.ChainedCast(v.Type)
+		}
 		return &ast.AssignStmt{
 			Lhs: []ast.Expr{v.Name},
 			Tok: token.ASSIGN,
-			Rhs: []ast.Expr{sb.E.Expr(v.Type)},
+			Rhs: []ast.Expr{rhs},
+		}
+	}
+}
+
+// MultiAssignStmt builds an assignment of the results of a call to
+// the multi-value function f, like
+//
+//	st.F0, m[k], *p, _ = f()
+//
+// where each LHS is an lvalue of the corresponding result type.
+func (sb *StmtBuilder) MultiAssignStmt(f multiRetFunc) *ast.AssignStmt {
+	as := &ast.AssignStmt{
+		Tok: token.ASSIGN,
+		Rhs: []ast.Expr{sb.pb.CallMultiRet(f)},
+	}
+	for _, t := range f.ft.Ret {
+		as.Lhs = append(as.Lhs, sb.Lvalue(t))
+	}
+	return as
+}
+
+// Lvalue returns an assignable expression of type t: either a
+// variable, a struct field, a map or slice index, or a pointer
+// dereference. If nothing of type t can be assigned to, it returns
+// the blank identifier.
+func (sb *StmtBuilder) Lvalue(t Type) ast.Expr {
+	v, ok := sb.S.RandPred(func(v Variable, t ...Type) bool {
+		if f, ok := v.Type.(FuncType); ok && !f.Local {
+			return false
+		}
+		if v.Type.Equal(t[0]) {
+			return true
+		}
+		switch vt := v.Type.(type) {
+		case StructType:
+			for _, ft := range vt.Ftypes {
+				if ft.Equal(t[0]) {
+					return true
+				}
+			}
+			return false
+		case MapType:
+			return vt.ValueT.Equal(t[0])
+		case PointerType:
+			return vt.Base().Equal(t[0])
+		case ArrayType:
+			return vt.Base().Equal(t[0])
+		default:
+			return false
+		}
+	}, t)
+	if !ok {
+		return &noName
+	}
+
+	if v.Type.Equal(t) {
+		return v.Name
+	}
+
+	switch vt := v.Type.(type) {
+	case StructType:
+		fis := make([]int, 0, len(vt.Ftypes))
+		for i, ft := range vt.Ftypes {
+			if ft.Equal(t) {
+				fis = append(fis, i)
+			}
 		}
+		return &ast.SelectorExpr{
+			X:   v.Name,
+			Sel: SharedIdent(vt.Fnames[RandItem(sb.R, fis)]),
+		}
+	case MapType:
+		return sb.E.MapIndexExpr(v.Name, vt.KeyT)
+	case PointerType:
+		return sb.E.StarExpr(v.Name)
+	case ArrayType:
+		return sb.E.IndexExpr(v.Name)
+	default:
+		return v.Name
 	}
 }
 
-// returns a continue/break statement
+// BranchStmt returns a break or continue statement, either plain or
+// targeting the label of an enclosing loop (a goto is also allowed
+// for labeled plain for loops). Outside a loop body that allows
+// plain ones, there must be a labeled loop enclosing the statement.
+//
+// In a loop nested in a labeled one, the label of the outer loop is
+// chosen half of the times, to generate things like
+//
+//	lab1:
+//	for ... {
+//	  for ... {
+//	    continue lab1
+//	  }
+//	}
 func (sb *StmtBuilder) BranchStmt() *ast.BranchStmt {
-	var bs ast.BranchStmt
+	outer := sb.outerLabels()
+	var l *loopLabel
+	switch {
+	case len(outer) > 0 && sb.R.Intn(2) == 0:
+		l = RandItem(sb.R, outer)
+	case len(sb.C.labels) > 0 && (!sb.C.inLoop || sb.R.Intn(4) == 0):
+		l = RandItem(sb.R, sb.C.labels)
+	default:
+		return &ast.BranchStmt{Tok: RandItem(sb.R, []token.Token{token.BREAK, token.CONTINUE})}
+	}
 
-	bs.Tok = RandItem(sb.R, []token.Token{token.GOTO, token.CONTINUE, token.BREAK})
+	l.used = true
+	return &ast.BranchStmt{Tok: l.branchTok(sb.R), Label: &ast.Ident{Name: l.name}}
+}
 
-	// break/continue/goto to a label with chance 0.25
-	if len(sb.labels) > 0 && sb.R.Intn(4) == 0 {
-		li := sb.R.Intn(len(sb.labels))
-		bs.Label = &ast.Ident{Name: sb.labels[li]}
-		sb.labels = append(sb.labels[:li], sb.labels[li+1:]...)
-	} else {
-		// If we didn't add a label, GOTO is not allowed.
-		if sb.R.Intn(2) == 0 {
-			bs.Tok = token.BREAK
-		} else {
-			bs.Tok = token.CONTINUE
+// outerLabels returns the labels of the loops enclosing the innermost
+// loop the statement being built is in.
+func (sb *StmtBuilder) outerLabels() []*loopLabel {
+	var outer []*loopLabel
+	for _, l := range sb.C.labels {
+		if sb.C.loops > l.depth+1 {
+			outer = append(outer, l)
 		}
 	}
+	return outer
+}
+
+// branchTok returns a random token for a branch statement targeting
+// l.
+func (l *loopLabel) branchTok(r *rand.Rand) token.Token {
+	if l.kind == token.FOR {
+		return RandItem(r, []token.Token{token.GOTO, token.BREAK, token.CONTINUE})
+	}
+	return RandItem(r, []token.Token{token.BREAK, token.CONTINUE})
+}
+
+// LabeledLoop returns a plain for loop (if kind is token.FOR) or a
+// range loop (token.RANGE) with a new label, which the branch
+// statements in its body can target. If none of them does, a branch
+// statement targeting the label is added at the end of the body, to
+// avoid an unused label error.
+func (sb *StmtBuilder) LabeledLoop(kind token.Token) *ast.LabeledStmt {
+	sb.label++
+	l := &loopLabel{name: fmt.Sprintf("lab%v", sb.label), kind: kind, depth: sb.C.loops}
+	sb.C.labels = append(sb.C.labels, l)
+
+	var loop ast.Stmt
+	var body *ast.BlockStmt
+	if kind == token.FOR {
+		fs := sb.ForStmt()
+		loop, body = fs, fs.Body
+	} else {
+		rs := sb.RangeStmt()
+		loop, body = rs, rs.Body
+	}
+	sb.C.labels = sb.C.labels[:len(sb.C.labels)-1]
 
-	return &bs
+	if !l.used {
+		body.List = append(body.List, &ast.BranchStmt{Tok: l.branchTok(sb.R), Label: &ast.Ident{Name: l.name}})
+	}
+	return &ast.LabeledStmt{Label: &ast.Ident{Name: l.name}, Stmt: loop}
 }
 
 // BlockStmt returns a new Block Statement. The returned Stmt is
 // always a valid block. It up to BlockStmt's caller to make sure
 // BlockStmt is only called when we have not yet reached max depth.
 func (sb *StmtBuilder) BlockStmt() *ast.BlockStmt {
+	seq := sb.C.Trace("BlockStmt", nil, sb.depth)
 
 	sb.depth++
 	defer func() { sb.depth-- }()
 
 	bs := new(ast.BlockStmt)
 	stmts := []ast.Stmt{}
+	var newVars []*ast.Ident
+
+	// The variables a statement needs that were not in scope are
+	// declared right before it.
+	outer := sb.C.pending
+	sb.C.pending = &pendingDecls{}
+	defer func() { sb.C.pending = outer }()
+	add := func(s ast.Stmt) {
+		stmts = append(stmts, sb.C.pending.stmts...)
+		stmts = append(stmts, s)
+		newVars = append(newVars, sb.C.pending.vars...)
+		sb.C.pending = &pendingDecls{}
+	}
 
 	// A new block means opening a new scope. Declare a few new vars
-	// of random types.
-	var newVars []*ast.Ident
-	for _, t := range sb.pb.RandTypes(3 + sb.R.Intn(6)) {
+	// of random types. In generic functions, sometimes also one of a
+	// composite type built on the type parameters.
+	types := sb.pb.RandTypes(3 + sb.R.Intn(6))
+	if sb.C.typeparams != nil && sb.R.Intn(2) == 0 {
+		types = append(types, sb.pb.RandTypeParamComposite())
+	}
+	for _, t := range types {
 		newDecl, nv := sb.DeclStmt(1+sb.R.Intn(3), t)
-		stmts = append(stmts, newDecl)
+		add(newDecl)
 		newVars = append(newVars, nv...)
 	}
 
@@ -259,7 +503,7 @@ func (sb *StmtBuilder) BlockStmt() *ast.BlockStmt {
 
 	// Fill the block's body.
 	for i := 0; i < nStmts; i++ {
-		stmts = append(stmts, sb.Stmt())
+		add(sb.Stmt())
 	}
 
 	if len(newVars) > 0 {
@@ -271,6 +515,7 @@ func (sb *StmtBuilder) BlockStmt() *ast.BlockStmt {
 	}
 
 	bs.List = stmts
+	sb.C.TraceNode(seq, bs)
 	return bs
 }
 
@@ -292,6 +537,8 @@ func (sb *StmtBuilder) DeclStmt(nVars int, t Type) (*ast.DeclStmt, []*ast.Ident)
 		panic("nVars < 1")
 	}
 
+	seq := sb.C.Trace("DeclStmt", t, sb.depth)
+
 	if _, ok := t.(FuncType); ok {
 		nVars = 1
 	}
@@ -304,7 +551,7 @@ func (sb *StmtBuilder) DeclStmt(nVars int, t Type) (*ast.DeclStmt, []*ast.Ident)
 	var rhs []ast.Expr
 
 	switch t2 := t.(type) {
-	case BasicType, ArrayType, PointerType, StructType, ChanType, MapType, InterfaceType:
+	case BasicType, ArrayType, PointerType, StructType, ChanType, MapType, InterfaceType, NamedType:
 		typ = t2.Ast()
 
 	case FuncType:
@@ -319,8 +566,8 @@ func (sb *StmtBuilder) DeclStmt(nVars int, t Type) (*ast.DeclStmt, []*ast.Ident)
 		// But 10% of the times we don't (and the func variable will
 		// be nil).
 
-		// First off all, remove all the labels currently in scope.
-		// The Go Specification says:
+		// First off all, hide the labels currently in scope. The Go
+		// Specification says:
 		//
 		//    The scope of a label is the body of the function in which
 		//    it is declared and excludes the body of any nested
@@ -328,8 +575,7 @@ func (sb *StmtBuilder) DeclStmt(nVars int, t Type) (*ast.DeclStmt, []*ast.Ident)
 		//
 		// So the nested function we're about to create cannot use
 		// labels created outside its body.
-		oldLabels := sb.labels
-		sb.labels = []string{}
+		exitFunc := sb.C.enterFunc()
 
 		// LHS is the type specifier for the given FuncType, with no
 		// parameter names
@@ -390,7 +636,7 @@ func (sb *StmtBuilder) DeclStmt(nVars int, t Type) (*ast.DeclStmt, []*ast.Ident)
 			}
 		}
 		// and restore the labels.
-		sb.labels = oldLabels
+		exitFunc()
 
 	case TypeParam:
 		typ = t2.Ast()
@@ -415,6 +661,7 @@ func (sb *StmtBuilder) DeclStmt(nVars int, t Type) (*ast.DeclStmt, []*ast.Ident)
 	ds := new(ast.DeclStmt)
 	ds.Decl = gd
 
+	sb.C.TraceNode(seq, ds)
 	return ds, idents
 }
 
@@ -458,23 +705,14 @@ func (sb *StmtBuilder) ForStmt() *ast.ForStmt {
 	if sb.R.Intn(32) > 0 {
 		old := sb.C.inLoop
 		sb.C.inLoop = false
-		defer func() { sb.C.inLoop = old }()
+		sb.C.loops++
+		defer func() { sb.C.inLoop = old; sb.C.loops-- }()
 		fs.Body = sb.BlockStmt()
 	} else {
 		// empty loop body
 		fs.Body = &ast.BlockStmt{}
 	}
 
-	// consume all active labels to avoid unused compilation errors
-	for _, l := range sb.labels {
-		fs.Body.List = append(fs.Body.List,
-			&ast.BranchStmt{
-				Tok:   RandItem(sb.R, []token.Token{token.GOTO, token.BREAK, token.CONTINUE}),
-				Label: &ast.Ident{Name: l},
-			})
-	}
-	sb.labels = []string{}
-
 	return &fs
 }
 
@@ -485,14 +723,18 @@ func (sb *StmtBuilder) RangeStmt() *ast.RangeStmt {
 	defer func() { sb.depth--; sb.C.inLoop = old }()
 
 	// it's either
-	//   k := range [int]
+	//   [k] := range [int]
 	// or
-	//   k, v := range [string or slice]
+	//   k, v := range [string, slice, or map]
 	// or
 	//  [k, v] := range [function]
+	//
+	// When ranging over a slice or map variable, the body sometimes
+	// modifies it, see MutateRangedStmt.
 
 	var k, v *ast.Ident
 	var e ast.Expr
+	var ranged *Variable
 
 	f := sb.E.Expr
 	if !sb.E.Deepen() {
@@ -500,10 +742,17 @@ func (sb *StmtBuilder) RangeStmt() *ast.RangeStmt {
 	}
 
 	// randomly choose a type for the expression we range on
-	switch sb.R.Intn(4) {
+	switch sb.R.Intn(5) {
 	case 0: // slice
 		t := ArrayOf(sb.pb.RandType())
-		e = f(t)
+		if sv, ok := sb.S.RandPred(func(v Variable, _ ...Type) bool {
+			_, ok := v.Type.(ArrayType)
+			return ok
+		}); ok && sb.R.Intn(3) == 0 {
+			t, e, ranged = sv.Type.(ArrayType), sv.Name, &sv
+		} else {
+			e = f(t)
+		}
 		k = sb.S.NewIdent(BT{"int"})
 		v = sb.S.NewIdent(t.Base())
 	case 1: // string
@@ -511,13 +760,16 @@ func (sb *StmtBuilder) RangeStmt() *ast.RangeStmt {
 		k = sb.S.NewIdent(BT{"int"})
 		v = sb.S.NewIdent(BT{"rune"})
 	case 2: // int
-		e = f(BT{"int"})
-		k = sb.S.NewIdent(BT{"int"})
+		var t Type
+		e, t = sb.RangeIntExpr()
+		if sb.R.Intn(2) == 0 {
+			k = sb.S.NewIdent(t)
+		}
 	case 3: // func
 
 		// 50/50 between generating a new Rangeable func type or a
 		// call to a function from the slices package.
-		if sb.R.Intn(2) == 0 {
+		if sb.R.Intn(2) == 0 && !sb.pb.Conf().MinImports && !sb.pb.Conf().Skips("slices") {
 			t := sb.pb.RandType()
 			f := FuncType{N: "slices.All"}
 			e = sb.E.CallFunction(Variable{f, &ast.Ident{Name: f.N}}, t)
@@ -538,7 +790,9 @@ func (sb *StmtBuilder) RangeStmt() *ast.RangeStmt {
 			if sb.CanNest() {
 				old := sb.C.inLoop
 				sb.C.inLoop = false
+				exitFunc := sb.C.enterFunc()
 				body = sb.BlockStmt()
+				exitFunc()
 				sb.C.inLoop = old
 			} else {
 				body = &ast.BlockStmt{List: []ast.Stmt{sb.AssignStmt()}}
@@ -563,11 +817,34 @@ func (sb *StmtBuilder) RangeStmt() *ast.RangeStmt {
 				v = sb.S.NewIdent(args[1])
 			}
 		}
+	case 4: // map variable, or a slice if there are none
+		if mv, ok := sb.S.RandPred(func(v Variable, _ ...Type) bool {
+			_, ok := v.Type.(MapType)
+			return ok
+		}); ok {
+			mt := mv.Type.(MapType)
+			e, ranged = mv.Name, &mv
+			k = sb.S.NewIdent(mt.KeyT)
+			v = sb.S.NewIdent(mt.ValueT)
+		} else {
+			t := ArrayOf(sb.pb.RandType())
+			e = f(t)
+			k = sb.S.NewIdent(BT{"int"})
+			v = sb.S.NewIdent(t.Base())
+		}
 	default:
 		panic("unreachable")
 	}
 
+	sb.C.loops++
 	rs := &ast.RangeStmt{Tok: token.DEFINE, X: e, Body: sb.BlockStmt()}
+	sb.C.loops--
+
+	if ranged != nil && sb.R.Intn(2) == 0 {
+		i := sb.R.Intn(len(rs.Body.List) + 1)
+		rs.Body.List = append(rs.Body.List[:i],
+			append([]ast.Stmt{sb.MutateRangedStmt(*ranged, k)}, rs.Body.List[i:]...)...)
+	}
 
 	if k != nil {
 		rs.Key = k
@@ -584,7 +861,162 @@ func (sb *StmtBuilder) RangeStmt() *ast.RangeStmt {
 	return rs
 }
 
+// MutateRangedStmt returns a statement that modifies the variable v
+// being ranged over, from inside the loop body. k is the loop key. It's
+// one of:
+//
+//	s = append(s, <expr>)
+//	s = s[:len(s)/2]
+//	delete(m, k)
+//	m[<expr>] = <expr>
+func (sb *StmtBuilder) MutateRangedStmt(v Variable, k *ast.Ident) ast.Stmt {
+	switch t := v.Type.(type) {
+	case ArrayType:
+		var rhs ast.Expr
+		if sb.R.Intn(2) == 0 {
+			rhs = &ast.CallExpr{Fun: AppendIdent, Args: []ast.Expr{v.Name, sb.E.Expr(t.Base())}}
+		} else {
+			rhs = &ast.SliceExpr{
+				X: v.Name,
+				High: &ast.BinaryExpr{
+					X:  &ast.CallExpr{Fun: LenIdent, Args: []ast.Expr{v.Name}},
+					Op: token.QUO,
+					Y:  &ast.BasicLit{Kind: token.INT, Value: "2"},
+				},
+			}
+		}
+		return &ast.AssignStmt{Lhs: []ast.Expr{v.Name}, Tok: token.ASSIGN, Rhs: []ast.Expr{rhs}}
+	case MapType:
+		if sb.R.Intn(2) == 0 {
+			return &ast.ExprStmt{X: &ast.CallExpr{Fun: DeleteIdent, Args: []ast.Expr{v.Name, k}}}
+		}
+		return &ast.AssignStmt{
+			Lhs: []ast.Expr{&ast.IndexExpr{X: v.Name, Index: sb.E.Expr(t.KeyT)}},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{sb.E.Expr(t.ValueT)},
+		}
+	default:
+		panic("MutateRangedStmt: bad type " + v.Type.Name())
+	}
+}
+
+// RuneRangeStmt returns a block collecting the runes of a string by
+// ranging over it, and comparing the result with the string and its
+// []rune conversion:
+//
+//	{
+//		str1 := string([]rune{'a', '\u3b7f'})  // or a string expr
+//		rns1 := make([]rune, 0, len(str1))
+//		for _, rn1 := range str1 {
+//			rns1 = append(rns1, rn1)
+//		}
+//		_ = string(rns1) == str1 && len([]rune(str1)) == len(rns1)
+//	}
+//
+// The string is built from rune literals half of the time, since the
+// string literals we generate are ASCII only.
+func (sb *StmtBuilder) RuneRangeStmt() *ast.BlockStmt {
+	str := &ast.Ident{Name: fmt.Sprintf("str%v", sb.depth)}
+	rns := &ast.Ident{Name: fmt.Sprintf("rns%v", sb.depth)}
+	rn := &ast.Ident{Name: fmt.Sprintf("rn%v", sb.depth)}
+	runesT := ArrayOf(BT{"rune"}).Ast()
+
+	var e ast.Expr
+	if sb.R.Intn(2) == 0 {
+		lit := &ast.CompositeLit{Type: runesT}
+		for i := 0; i < 1+sb.R.Intn(6); i++ {
+			lit.Elts = append(lit.Elts, &ast.BasicLit{Kind: token.CHAR, Value: RandRune(sb.R)})
+		}
+		e = &ast.CallExpr{Fun: TypeIdent("string"), Args: []ast.Expr{lit}}
+	} else {
+		e = sb.E.Expr(BT{"string"})
+	}
+
+	call := func(f ast.Expr, args ...ast.Expr) *ast.CallExpr {
+		return &ast.CallExpr{Fun: f, Args: args}
+	}
+	return &ast.BlockStmt{List: []ast.Stmt{
+		&ast.AssignStmt{Lhs: []ast.Expr{str}, Tok: token.DEFINE, Rhs: []ast.Expr{e}},
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{rns},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{call(MakeIdent, runesT, &ast.BasicLit{Kind: token.INT, Value: "0"}, call(LenIdent, str))},
+		},
+		&ast.RangeStmt{
+			Key:   &noName,
+			Value: rn,
+			Tok:   token.DEFINE,
+			X:     str,
+			Body: &ast.BlockStmt{List: []ast.Stmt{
+				&ast.AssignStmt{Lhs: []ast.Expr{rns}, Tok: token.ASSIGN, Rhs: []ast.Expr{call(AppendIdent, rns, rn)}},
+			}},
+		},
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{&noName},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{&ast.BinaryExpr{
+				X:  &ast.BinaryExpr{X: call(TypeIdent("string"), rns), Op: token.EQL, Y: str},
+				Op: token.LAND,
+				Y: &ast.BinaryExpr{
+					X:  call(LenIdent, call(runesT, str)),
+					Op: token.EQL,
+					Y:  call(LenIdent, rns),
+				},
+			}},
+		},
+	}}
+}
+
+// RangeIntExpr returns an integer expression to range over, and its
+// type. It's one of:
+//
+//	<int expr>
+//	len(s)          // for a slice s in scope
+//	4 * 3           // a non-negative constant expression
+//	<G expr>        // in generic functions, for a type parameter G
+//	                // whose constraint is a single integer type
+func (sb *StmtBuilder) RangeIntExpr() (ast.Expr, Type) {
+	switch sb.R.Intn(4) {
+	case 1:
+		if v, ok := sb.S.RandPred(func(v Variable, _ ...Type) bool {
+			_, ok := v.Type.(ArrayType)
+			return ok
+		}); ok {
+			return &ast.CallExpr{Fun: LenIdent, Args: []ast.Expr{v.Name}}, BT{"int"}
+		}
+	case 2:
+		lit := func() ast.Expr {
+			return &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(sb.R.Intn(16))}
+		}
+		return &ast.BinaryExpr{
+			X:  lit(),
+			Op: RandItem(sb.R, []token.Token{token.ADD, token.MUL, token.SHL, token.OR}),
+			Y:  lit(),
+		}, BT{"int"}
+	case 3:
+		if sb.C.typeparams == nil {
+			break
+		}
+		if v, ok := sb.C.typeparams.RandPred(func(v Variable, _ ...Type) bool {
+			c := v.Type.(Constraint)
+			return len(c.Types) == 1 && sb.E.IntBits(c.Types[0]) > 0
+		}); ok {
+			t := MakeTypeParam(v)
+			return sb.E.Expr(t), t
+		}
+	}
+
+	if sb.E.Deepen() {
+		return sb.E.Expr(BT{"int"}), BT{"int"}
+	}
+	return sb.E.VarOrLit(BT{"int"}), BT{"int"}
+}
+
 func (sb *StmtBuilder) DeferStmt() *ast.DeferStmt {
+	// defer fnc0(), with a function variable with no results
+	if v, ok := sb.S.RandNoResultFunc(); ok && sb.R.Intn(2) == 0 {
+		return &ast.DeferStmt{Call: sb.E.CallFunction(v)}
+	}
 	if v, ok := sb.S.RandFunc(); ok && sb.R.Intn(4) > 0 {
 		return &ast.DeferStmt{Call: sb.E.CallFunction(v)}
 	} else {
@@ -595,7 +1027,135 @@ func (sb *StmtBuilder) DeferStmt() *ast.DeferStmt {
 	}
 }
 
+// DeferArgStmt returns a block that defers a call taking a variable
+// as argument, and then modifies the variable:
+//
+//	{
+//	  var d T = <expr>
+//	  defer func(x T) { println(x) }(d)
+//	  d = <expr>
+//	}
+//
+// The argument of a deferred call is evaluated when the defer
+// statement is executed, so the deferred function must print the
+// first value of d, not the second one.
+func (sb *StmtBuilder) DeferArgStmt() *ast.BlockStmt {
+	sb.depth++
+	defer func() { sb.depth-- }()
+
+	t := RandItem(sb.R, sb.pb.baseTypes)
+
+	// Build both expressions before d enters the scope, so we never
+	// generate d = d.
+	init, upd := sb.E.Expr(t), sb.E.Expr(t)
+
+	d := sb.S.NewIdent(t)
+	defer sb.S.DeleteIdentByName(d)
+
+	x := &ast.Ident{Name: "x"}
+	fl := &ast.FuncLit{
+		Type: &ast.FuncType{
+			Params: &ast.FieldList{List: []*ast.Field{{Names: []*ast.Ident{x}, Type: t.Ast()}}},
+		},
+		Body: &ast.BlockStmt{List: []ast.Stmt{
+			&ast.ExprStmt{X: &ast.CallExpr{Fun: SharedIdent("println"), Args: []ast.Expr{x}}},
+		}},
+	}
+
+	return &ast.BlockStmt{List: []ast.Stmt{
+		&ast.DeclStmt{Decl: &ast.GenDecl{
+			Tok:   token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{d}, Type: t.Ast(), Values: []ast.Expr{init}}},
+		}},
+		&ast.DeferStmt{Call: &ast.CallExpr{Fun: fl, Args: []ast.Expr{d}}},
+		&ast.AssignStmt{Lhs: []ast.Expr{d}, Tok: token.ASSIGN, Rhs: []ast.Expr{upd}},
+	}}
+}
+
+// The max number of defer statements in a function for which gc
+// generates open-coded defers.
+const maxOpenCodedDefers = 8
+
+// DeferStress adds defer statements to body, the body of the function
+// being built, to exercise both of gc's defer implementations. Either
+//
+//   - the function gets exactly maxOpenCodedDefers unconditional
+//     defers, the most for which they can be open-coded, or
+//   - it gets one more, or
+//   - a defer is added in a loop, which forces defers to be heap
+//     allocated.
+//
+// The first defer recovers from a panic that is added (under a random
+// condition) at the end of the function, so both the normal and the
+// panicking paths run the deferred calls.
+func (sb *StmtBuilder) DeferStress(body *ast.BlockStmt) {
+	recov := &ast.DeferStmt{Call: &ast.CallExpr{
+		Fun: &ast.FuncLit{
+			Type: &ast.FuncType{Params: &ast.FieldList{}},
+			Body: &ast.BlockStmt{List: []ast.Stmt{
+				&ast.ExprStmt{X: &ast.CallExpr{Fun: SharedIdent("recover")}},
+			}},
+		},
+	}}
+	stmts := []ast.Stmt{recov}
+
+	if k := sb.R.Intn(3); k < 2 {
+		n := topLevelDefers(body) + 1
+		for ; n < maxOpenCodedDefers+k; n++ {
+			stmts = append(stmts, sb.DeferStmt())
+		}
+	} else {
+		sb.depth++
+		stmts = append(stmts, &ast.RangeStmt{
+			Tok:  token.ILLEGAL,
+			X:    &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(1 + sb.R.Intn(4))},
+			Body: &ast.BlockStmt{List: []ast.Stmt{sb.DeferStmt()}},
+		})
+		sb.depth--
+	}
+	body.List = append(stmts, body.List...)
+
+	// if <cond> { panic(<string>) }, before the return statement
+	sb.depth++
+	pnc := &ast.IfStmt{
+		Cond: sb.E.Expr(BT{"bool"}),
+		Body: &ast.BlockStmt{List: []ast.Stmt{
+			&ast.ExprStmt{X: &ast.CallExpr{
+				Fun:  SharedIdent("panic"),
+				Args: []ast.Expr{sb.E.Expr(BT{"string"})},
+			}},
+		}},
+	}
+	sb.depth--
+	n := len(body.List)
+	if _, ok := body.List[n-1].(*ast.ReturnStmt); ok {
+		body.List = append(body.List[:n-1], pnc, body.List[n-1])
+	} else {
+		body.List = append(body.List, pnc)
+	}
+}
+
+// topLevelDefers returns the number of defer statements in body that
+// run unconditionally, that is the ones not nested in a loop, in a
+// conditional, or in a func literal.
+func topLevelDefers(body *ast.BlockStmt) int {
+	n := 0
+	for _, st := range body.List {
+		switch st := st.(type) {
+		case *ast.DeferStmt:
+			n++
+		case *ast.BlockStmt:
+			n += topLevelDefers(st)
+		}
+	}
+	return n
+}
+
 func (sb *StmtBuilder) GoStmt() *ast.GoStmt {
+	// go fnc0(), with a function variable with no results
+	if v, ok := sb.S.RandNoResultFunc(); ok && sb.R.Intn(2) == 0 {
+		return &ast.GoStmt{Call: sb.E.CallFunction(v)}
+	}
 	if v, ok := sb.S.RandFunc(); ok && sb.R.Intn(4) > 0 {
 		return &ast.GoStmt{Call: sb.E.CallFunction(v)}
 	} else {
@@ -606,86 +1166,946 @@ func (sb *StmtBuilder) GoStmt() *ast.GoStmt {
 	}
 }
 
-func (sb *StmtBuilder) IfStmt() *ast.IfStmt {
-
+// CapturingGoStmt returns a go statement calling a closure that
+// mutates a captured variable, which is also written to by the
+// parent, in one of these forms:
+//
+//	{
+//	  var x T = <expr>
+//	  go func() { x = <expr>; ch <- x }()
+//	  x = <expr>
+//	}
+//
+//	for _, x := range <[]T expr> {
+//	  go func() { x = <expr>; ch <- x }()
+//	  x = <expr>
+//	}
+//
+// where ch is a chan T in scope. If there isn't one, the closure
+// assigns x to _ instead. In the second form, every iteration has
+// its own x.
+func (sb *StmtBuilder) CapturingGoStmt() ast.Stmt {
 	sb.depth++
 	defer func() { sb.depth-- }()
 
-	is := &ast.IfStmt{
-		Cond: sb.E.Expr(BT{"bool"}),
-		Body: sb.BlockStmt(),
+	var t Type
+	var ch ast.Expr
+	if v, ok := sb.S.RandChan(); ok {
+		t, ch = v.Type.(ChanType).Base(), v.Name
+	} else {
+		t = sb.pb.RandType()
 	}
 
-	// optionally attach an else
-	if sb.R.Intn(2) == 0 {
-		is.Else = sb.BlockStmt()
+	// x is never in scope while the expressions are built, so we
+	// don't generate x = x (which go vet rejects).
+	x := sb.S.NewIdent(t)
+	sb.S.DeleteIdentByName(x)
+
+	loop := sb.R.Intn(2) == 0
+	var init ast.Expr
+	switch {
+	case loop:
+		init = sb.E.VarOrLit(ArrayOf(t))
+	case sb.E.Deepen():
+		init = sb.E.Expr(t)
+	default:
+		init = sb.E.VarOrLit(t)
 	}
 
-	return is
-}
-
-// ReturnStmt builds a return statement with expression of the given
-// types.
-func (sb *StmtBuilder) ReturnStmt(types []Type) *ast.ReturnStmt {
-	sb.depth++
-	defer func() { sb.depth-- }()
-
-	ret := &ast.ReturnStmt{Results: make([]ast.Expr, len(types))}
-
-	for i, t := range types {
-		ret.Results[i] = sb.E.Expr(t)
+	body := []ast.Stmt{
+		&ast.GoStmt{Call: &ast.CallExpr{Fun: sb.E.BuildCapturingClosure(Variable{t, x}, ch)}},
+		&ast.AssignStmt{Lhs: []ast.Expr{x}, Tok: token.ASSIGN, Rhs: []ast.Expr{sb.E.Expr(t)}},
 	}
 
-	return ret
+	if loop {
+		return &ast.RangeStmt{
+			Key:   &noName,
+			Value: x,
+			Tok:   token.DEFINE,
+			X:     init,
+			Body:  &ast.BlockStmt{List: body},
+		}
+	}
 
+	decl := &ast.DeclStmt{Decl: &ast.GenDecl{
+		Tok:   token.VAR,
+		Specs: []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{x}, Type: t.Ast(), Values: []ast.Expr{init}}},
+	}}
+	return &ast.BlockStmt{List: append([]ast.Stmt{decl}, body...)}
 }
 
-func (sb *StmtBuilder) SwitchStmt() *ast.SwitchStmt {
+func (sb *StmtBuilder) IfStmt() *ast.IfStmt {
+
 	sb.depth++
 	defer func() { sb.depth-- }()
 
-	t := sb.pb.RandComparableType()
-	if sb.R.Intn(2) == 0 && sb.S.Has(PointerOf(t)) {
-		// sometimes switch on a pointer value
-		t = PointerOf(t)
+	is := new(ast.IfStmt)
+
+	// Optionally add an init statement. Half of the times it declares
+	// a new variable, like
+	//
+	//   if x := T(<expr>); x == <expr> {
+	//
+	// which is in scope in the condition and in all the branches,
+	// including the ones in an else-if chain, so it's only removed
+	// from the scope once the whole statement has been built.
+	switch sb.R.Intn(8) {
+	case 0:
+		t := sb.pb.RandComparableType()
+		rhs := sb.E.Expr(t)
+		iv := sb.S.NewIdent(t)
+		defer sb.S.DeleteIdentByName(iv)
+		is.Init = &ast.AssignStmt{
+			Lhs: []ast.Expr{iv},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{typedExpr(t, rhs)},
+		}
+		is.Cond = &ast.BinaryExpr{
+			X:  iv,
+			Op: RandItem(sb.R, []token.Token{token.EQL, token.NEQ}),
+			Y:  sb.E.Expr(t),
+		}
+	case 1:
+		is.Init = sb.AssignStmt()
 	}
 
-	ss := &ast.SwitchStmt{
-		Tag:  sb.E.Expr(t),
-		Body: &ast.BlockStmt{List: []ast.Stmt{}},
+	if is.Cond == nil {
+		is.Cond = sb.E.Expr(BT{"bool"})
 	}
+	is.Body = sb.BlockStmt()
 
-	// add a few cases
-	for i := 0; i < sb.R.Intn(4); i++ {
-		cc, ok := sb.CaseClause(t, false)
-		ss.Body.List = append(ss.Body.List, cc)
-		if !ok {
-			break
+	// optionally attach an else, which is sometimes the start of an
+	// else-if chain of 3 to 5 conditions.
+	if sb.R.Intn(2) == 0 {
+		if sb.R.Intn(4) == 0 {
+			is.Else = sb.elseIf(2 + sb.R.Intn(3))
+		} else {
+			is.Else = sb.BlockStmt()
 		}
 	}
 
-	// optionally add a default case
-	if sb.R.Intn(3) != 0 {
-		cc, _ := sb.CaseClause(t, true)
-		ss.Body.List = append(ss.Body.List, cc)
-	}
-	return ss
+	return is
 }
 
-// builds and returns a single CaseClause switching on type kind. If
-// def is true, returns a 'default' switch case.
-func (sb *StmtBuilder) CaseClause(t Type, def bool) (*ast.CaseClause, bool) {
-	cc := new(ast.CaseClause)
-	ret := true
-	if !def {
-		e, ok := sb.E.NonConstantExpr(t)
-		if !ok {
-			ret = false
-		}
-		cc.List = []ast.Expr{e}
+// elseIf returns a chain of n if statements, each one in the Else
+// of the previous one, optionally ending with a plain else.
+func (sb *StmtBuilder) elseIf(n int) *ast.IfStmt {
+	is := &ast.IfStmt{
+		Cond: sb.E.Expr(BT{"bool"}),
+		Body: sb.BlockStmt(),
 	}
-	cc.Body = sb.BlockStmt().List
-	return cc, ret
+	if n > 1 {
+		is.Else = sb.elseIf(n - 1)
+	} else if sb.R.Intn(2) == 0 {
+		is.Else = sb.BlockStmt()
+	}
+	return is
+}
+
+// typedExpr returns e converted to t, so that a variable declared
+// with := from it has type t even if e is an untyped constant or nil.
+func typedExpr(t Type, e ast.Expr) ast.Expr {
+	switch t.(type) {
+	case BasicType, NamedType, TypeParam:
+		return &ast.CallExpr{Fun: t.Ast(), Args: []ast.Expr{e}}
+	default:
+		return &ast.CallExpr{Fun: &ast.ParenExpr{X: t.Ast()}, Args: []ast.Expr{e}}
+	}
+}
+
+// NilCheckStmt returns a statement that dereferences a pointer p in
+// scope only after checking that it's not nil, in one of the
+// following shapes:
+//
+//	if p != nil { _ = *p }
+//	if p != nil && *p == <expr> { _ = *p }
+//	{ if p == nil { p = new(T) }; _ = *p }
+//	if p != nil { _ = *p; p = <expr>; if p != nil { _ = *p } }
+//
+// In the first three the compiler's prove pass can drop the nil check
+// on the dereferences; in the last one the reassignment forces a new
+// check. It returns false if there are no pointers in scope.
+func (sb *StmtBuilder) NilCheckStmt() (ast.Stmt, bool) {
+	v, ok := sb.S.RandPointer()
+	if !ok {
+		return nil, false
+	}
+
+	sb.depth++
+	defer func() { sb.depth-- }()
+
+	pt := v.Type.(PointerType)
+	p, nilId := v.Name, NilIdent
+	load := func() ast.Stmt {
+		return &ast.AssignStmt{
+			Lhs: []ast.Expr{&noName},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{sb.E.StarExpr(p)},
+		}
+	}
+	notNil := &ast.BinaryExpr{X: p, Op: token.NEQ, Y: nilId}
+
+	switch n := sb.R.Intn(4); n {
+	case 0, 1:
+		var cond ast.Expr = notNil
+		if n == 1 && pt.Base().Comparable() {
+			cond = &ast.BinaryExpr{
+				X:  notNil,
+				Op: token.LAND,
+				Y: &ast.BinaryExpr{
+					X:  sb.E.StarExpr(p),
+					Op: RandItem(sb.R, []token.Token{token.EQL, token.NEQ}),
+					Y:  sb.E.VarOrLit(pt.Base()),
+				},
+			}
+		}
+		return &ast.IfStmt{
+			Cond: cond,
+			Body: &ast.BlockStmt{List: []ast.Stmt{load()}},
+		}, true
+	case 2:
+		return &ast.BlockStmt{List: []ast.Stmt{
+			&ast.IfStmt{
+				Cond: &ast.BinaryExpr{X: p, Op: token.EQL, Y: nilId},
+				Body: &ast.BlockStmt{List: []ast.Stmt{
+					&ast.AssignStmt{
+						Lhs: []ast.Expr{p},
+						Tok: token.ASSIGN,
+						Rhs: []ast.Expr{&ast.CallExpr{
+							Fun:  NewIdent,
+							Args: []ast.Expr{pt.Base().Ast()},
+						}},
+					},
+				}},
+			},
+			load(),
+		}}, true
+	case 3:
+		// p = p would be reported by go vet as a self-assignment
+		rhs := sb.E.Expr(pt)
+		if types.ExprString(rhs) == p.Name {
+			rhs = &ast.CallExpr{Fun: NewIdent, Args: []ast.Expr{pt.Base().Ast()}}
+		}
+		return &ast.IfStmt{
+			Cond: notNil,
+			Body: &ast.BlockStmt{List: []ast.Stmt{
+				load(),
+				&ast.AssignStmt{
+					Lhs: []ast.Expr{p},
+					Tok: token.ASSIGN,
+					Rhs: []ast.Expr{rhs},
+				},
+				&ast.IfStmt{
+					Cond: &ast.BinaryExpr{X: p, Op: token.NEQ, Y: nilId},
+					Body: &ast.BlockStmt{List: []ast.Stmt{load()}},
+				},
+			}},
+		}, true
+	default:
+		panic("unreachable")
+	}
+}
+
+// ReturnStmt builds a return statement with expression of the given
+// types.
+func (sb *StmtBuilder) ReturnStmt(types []Type) *ast.ReturnStmt {
+	sb.depth++
+	defer func() { sb.depth-- }()
+
+	ret := &ast.ReturnStmt{Results: make([]ast.Expr, len(types))}
+
+	for i, t := range types {
+		ret.Results[i] = sb.E.Expr(t)
+	}
+
+	return ret
+
+}
+
+// TypeSwitchStmt returns a block that builds a slice of values of a
+// few different concrete types, and then type-switches on its
+// elements:
+//
+//	{
+//	  tys1 := []any{int8(<expr>), <string expr>, N0(<expr>), ...}
+//	  for _, ty1 := range tys1 {
+//	    switch ty1 := ty1.(type) {
+//	    case int8:
+//	      ...
+//	    case string, N0:
+//	      ...
+//	    default:
+//	      ...
+//	    }
+//	  }
+//	}
+func (sb *StmtBuilder) TypeSwitchStmt() *ast.BlockStmt {
+	sb.depth++
+	old := sb.C.inLoop
+	sb.C.inLoop = true
+	sb.C.loops++
+	defer func() { sb.depth--; sb.C.inLoop = old; sb.C.loops-- }()
+
+	// Choose 2 to 4 distinct concrete types. rune and int32 are the
+	// same type, and can't both appear in the cases.
+	canon := func(t Type) string {
+		if t.Name() == "rune" {
+			return "int32"
+		}
+		return t.Name()
+	}
+	var types []Type
+	seen := make(map[string]bool)
+	for _, t := range sb.pb.baseTypes {
+		if t.Name() == "any" || seen[canon(t)] {
+			continue
+		}
+		seen[canon(t)] = true
+		types = append(types, t)
+	}
+	sb.R.Shuffle(len(types), func(i, j int) { types[i], types[j] = types[j], types[i] })
+	if n := 2 + sb.R.Intn(3); n < len(types) {
+		types = types[:n]
+	}
+
+	var elems []ast.Expr
+	for _, t := range types {
+		for i := 0; i < 1+sb.R.Intn(2); i++ {
+			elems = append(elems, typedExpr(t, sb.E.VarOrLit(t)))
+		}
+	}
+	sb.R.Shuffle(len(elems), func(i, j int) { elems[i], elems[j] = elems[j], elems[i] })
+
+	// Neither the slice nor the switched-on variable are put in the
+	// scope, since without type parameters any is not one of the
+	// types we generate expressions of. The variable declared by the
+	// switch is, in the single-type cases. They are named after the
+	// depth, so they are unique among nested type switches and never
+	// clash with the names given by NewIdent.
+	any := BT{"any"}
+	hs := &ast.Ident{Name: fmt.Sprintf("tys%v", sb.depth)}
+	h := &ast.Ident{Name: fmt.Sprintf("ty%v", sb.depth)}
+
+	body := func() []ast.Stmt {
+		var stmts []ast.Stmt
+		if sb.CanNest() {
+			stmts = append(stmts, sb.BlockStmt())
+		}
+		return append(stmts, sb.UseVars([]*ast.Ident{h}))
+	}
+
+	var clauses []ast.Stmt
+	for i := 0; i < len(types); i++ {
+		if i < len(types)-1 && sb.R.Intn(4) == 0 {
+			// a case with two types, where h has type any
+			clauses = append(clauses, &ast.CaseClause{
+				List: []ast.Expr{types[i].Ast(), types[i+1].Ast()},
+				Body: body(),
+			})
+			i++
+			continue
+		}
+		sb.S.AddVariable(h, types[i])
+		clauses = append(clauses, &ast.CaseClause{
+			List: []ast.Expr{types[i].Ast()},
+			Body: body(),
+		})
+		sb.S.DeleteIdentByName(h)
+	}
+	if sb.R.Intn(2) == 0 {
+		clauses = append(clauses, &ast.CaseClause{Body: body()})
+	}
+
+	return &ast.BlockStmt{List: []ast.Stmt{
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{hs},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.CompositeLit{Type: ArrayOf(any).Ast(), Elts: elems}},
+		},
+		&ast.RangeStmt{
+			Key:   &noName,
+			Value: h,
+			Tok:   token.DEFINE,
+			X:     hs,
+			Body: &ast.BlockStmt{List: []ast.Stmt{
+				&ast.TypeSwitchStmt{
+					Assign: &ast.AssignStmt{
+						Lhs: []ast.Expr{h},
+						Tok: token.DEFINE,
+						Rhs: []ast.Expr{&ast.TypeAssertExpr{X: h}},
+					},
+					Body: &ast.BlockStmt{List: clauses},
+				},
+			}},
+		},
+	}}
+}
+
+func (sb *StmtBuilder) SwitchStmt() *ast.SwitchStmt {
+	sb.depth++
+	defer func() { sb.depth-- }()
+
+	t := sb.pb.RandComparableType()
+	if sb.R.Intn(2) == 0 {
+		// sometimes switch on a pointer value, with cases comparing
+		// it with nil and other pointers.
+		if v, ok := sb.S.RandPointer(); ok {
+			t = v.Type
+		}
+	}
+
+	ss := &ast.SwitchStmt{
+		Tag:  sb.E.Expr(t),
+		Body: &ast.BlockStmt{List: []ast.Stmt{}},
+	}
+
+	// add a few cases
+	for i := 0; i < sb.R.Intn(4); i++ {
+		cc, ok := sb.CaseClause(t, false)
+		ss.Body.List = append(ss.Body.List, cc)
+		if !ok {
+			break
+		}
+	}
+
+	// optionally add a default case
+	if sb.R.Intn(3) != 0 {
+		cc, _ := sb.CaseClause(t, true)
+		ss.Body.List = append(ss.Body.List, cc)
+	}
+	return ss
+}
+
+// builds and returns a single CaseClause switching on type kind. If
+// def is true, returns a 'default' switch case. The returned bool is
+// false if the case contains a constant expression, in which case the
+// caller must not add more cases to the switch.
+func (sb *StmtBuilder) CaseClause(t Type, def bool) (*ast.CaseClause, bool) {
+	cc := new(ast.CaseClause)
+	ret := true
+	if !def {
+		// One to three expressions per case. NonConstantExpr failing
+		// means we got a constant, and since duplicate constant cases
+		// are not allowed, we stop after the first one.
+		for i := 0; i < 1+sb.R.Intn(3); i++ {
+			e, ok := sb.E.NonConstantExpr(t)
+			cc.List = append(cc.List, e)
+			if !ok {
+				ret = false
+				break
+			}
+		}
+	}
+	cc.Body = sb.BlockStmt().List
+	return cc, ret
+}
+
+// EscapeStoreStmt returns a block that forces a local struct to
+// escape, and then stores pointers into its fields in a loop:
+//
+//	{
+//	  var wb3 struct{ P0, P1 *T; S []*T; M map[int]*T }
+//	  wbSink = &wb3              // or wbEscape(&wb3)
+//	  wb3.S, wb3.M = make([]*T, <n>), make(map[int]*T)
+//	  for wbi := range wb3.S {
+//	    wb3.P0 = <*T expr>
+//	    wb3.P0, wb3.P1 = wb3.P1, wb3.P0
+//	    wb3.S[wbi] = wb3.P1
+//	    wb3.M[wbi] = wb3.S[wbi]
+//	  }
+//	  runtime.GC()               // sometimes
+//	}
+//
+// Since wb3 lives on the heap, every store into it goes through the
+// GC write barrier. Requires the sink built by MakeWBSink.
+func (sb *StmtBuilder) EscapeStoreStmt() *ast.BlockStmt {
+	sb.depth++
+	defer func() { sb.depth-- }()
+
+	pt := PointerOf(sb.pb.RandType())
+	st := StructType{
+		[]Type{pt, pt, ArrayOf(pt), MapOf(BT{"int"}, pt)},
+		[]string{"P0", "P1", "S", "M"},
+		nil,
+	}
+	wb3, wbi := &ast.Ident{Name: "wb3"}, &ast.Ident{Name: "wbi"}
+
+	field := func(n string) *ast.SelectorExpr {
+		return &ast.SelectorExpr{X: wb3, Sel: &ast.Ident{Name: n}}
+	}
+	elem := func(x ast.Expr) *ast.IndexExpr {
+		return &ast.IndexExpr{X: x, Index: wbi}
+	}
+	assign := func(lhs, rhs []ast.Expr) *ast.AssignStmt {
+		return &ast.AssignStmt{Lhs: lhs, Tok: token.ASSIGN, Rhs: rhs}
+	}
+
+	// the pointer to store: either new(T) or a random *T expression
+	var ptr ast.Expr
+	if sb.R.Intn(2) == 0 {
+		ptr = &ast.CallExpr{Fun: NewIdent, Args: []ast.Expr{pt.Base().Ast()}}
+	} else {
+		ptr = sb.E.Expr(pt)
+	}
+
+	// make wb3 escape, either by storing its address in the sink or
+	// by passing it to a function that does
+	addr := &ast.UnaryExpr{Op: token.AND, X: wb3}
+	var escape ast.Stmt
+	if sb.R.Intn(2) == 0 {
+		escape = assign([]ast.Expr{&ast.Ident{Name: "wbSink"}}, []ast.Expr{addr})
+	} else {
+		escape = &ast.ExprStmt{X: &ast.CallExpr{Fun: &ast.Ident{Name: "wbEscape"}, Args: []ast.Expr{addr}}}
+	}
+
+	stmts := []ast.Stmt{
+		&ast.DeclStmt{Decl: &ast.GenDecl{
+			Tok:   token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{wb3}, Type: st.Ast()}},
+		}},
+		escape,
+		assign(
+			[]ast.Expr{field("S"), field("M")},
+			[]ast.Expr{
+				&ast.CallExpr{
+					Fun: MakeIdent,
+					Args: []ast.Expr{
+						ArrayOf(pt).Ast(),
+						&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(1 + sb.R.Intn(64))},
+					},
+				},
+				&ast.CallExpr{Fun: MakeIdent, Args: []ast.Expr{MapOf(BT{"int"}, pt).Ast()}},
+			},
+		),
+		&ast.RangeStmt{
+			Key: wbi,
+			Tok: token.DEFINE,
+			X:   field("S"),
+			Body: &ast.BlockStmt{List: []ast.Stmt{
+				assign([]ast.Expr{field("P0")}, []ast.Expr{ptr}),
+				assign([]ast.Expr{field("P0"), field("P1")}, []ast.Expr{field("P1"), field("P0")}),
+				assign([]ast.Expr{elem(field("S"))}, []ast.Expr{field("P1")}),
+				assign([]ast.Expr{elem(field("M"))}, []ast.Expr{elem(field("S"))}),
+			}},
+		},
+	}
+
+	if sb.R.Intn(2) == 0 {
+		gc := RuntimeFuncs[0]
+		stmts = append(stmts, &ast.ExprStmt{X: sb.E.CallFunction(Variable{gc, &ast.Ident{Name: gc.N}})})
+	}
+
+	return &ast.BlockStmt{List: stmts}
+}
+
+// NoEscapeStmt returns a block using a local variable in a way that
+// escape analysis should always keep on the stack, in one of these
+// forms:
+//
+//	{
+//		var ne1 T = <expr>
+//		pne1 := &ne1
+//		*pne1 = <expr>
+//		_ = *pne1
+//	}
+//
+//	{
+//		ne1 := make([]T, 8)
+//		ne1[<int expr>&7] = <expr>
+//		_ = ne1[0]
+//	}
+//
+//	{
+//		var ne1 T = <expr>
+//		func() { ne1 = <expr> }()
+//		_ = ne1
+//	}
+//
+// The variables are not added to the scope, so the other statements
+// can't make them escape, and a "moved to heap" diagnostic for one of
+// them in the -m output is an escape analysis regression.
+func (sb *StmtBuilder) NoEscapeStmt() *ast.BlockStmt {
+	t := sb.pb.RandType()
+	ne := &ast.Ident{Name: fmt.Sprintf("ne%v", sb.depth)}
+	decl := func() ast.Stmt {
+		return &ast.DeclStmt{Decl: &ast.GenDecl{
+			Tok:   token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{ne}, Type: t.Ast(), Values: []ast.Expr{sb.E.Expr(t)}}},
+		}}
+	}
+	assign := func(lhs ast.Expr, rhs ast.Expr) ast.Stmt {
+		return &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Tok: token.ASSIGN, Rhs: []ast.Expr{rhs}}
+	}
+
+	switch sb.R.Intn(3) {
+	case 0:
+		pne := &ast.Ident{Name: fmt.Sprintf("pne%v", sb.depth)}
+		return &ast.BlockStmt{List: []ast.Stmt{
+			decl(),
+			&ast.AssignStmt{
+				Lhs: []ast.Expr{pne},
+				Tok: token.DEFINE,
+				Rhs: []ast.Expr{&ast.UnaryExpr{Op: token.AND, X: ne}},
+			},
+			assign(&ast.StarExpr{X: pne}, sb.E.Expr(t)),
+			assign(&noName, &ast.StarExpr{X: pne}),
+		}}
+	case 1:
+		size := &ast.BasicLit{Kind: token.INT, Value: "8"}
+		return &ast.BlockStmt{List: []ast.Stmt{
+			&ast.AssignStmt{
+				Lhs: []ast.Expr{ne},
+				Tok: token.DEFINE,
+				Rhs: []ast.Expr{&ast.CallExpr{Fun: MakeIdent, Args: []ast.Expr{ArrayOf(t).Ast(), size}}},
+			},
+			assign(
+				&ast.IndexExpr{X: ne, Index: &ast.BinaryExpr{
+					X:  sb.E.Expr(BT{"int"}),
+					Op: token.AND,
+					Y:  &ast.BasicLit{Kind: token.INT, Value: "7"},
+				}},
+				sb.E.Expr(t),
+			),
+			assign(&noName, &ast.IndexExpr{X: ne, Index: &ast.BasicLit{Kind: token.INT, Value: "0"}}),
+		}}
+	case 2:
+		return &ast.BlockStmt{List: []ast.Stmt{
+			decl(),
+			&ast.ExprStmt{X: &ast.CallExpr{Fun: &ast.FuncLit{
+				Type: &ast.FuncType{Params: &ast.FieldList{}},
+				Body: &ast.BlockStmt{List: []ast.Stmt{assign(ne, sb.E.Expr(t))}},
+			}}},
+			assign(&noName, ne),
+		}}
+	default:
+		panic("unreachable")
+	}
+}
+
+// The number of entries in the maps built by MapStmt: around the
+// size of a map group (8 slots), the load factor limits (7/8), and
+// the maximum size of a map table (1024 slots).
+var mapSizes = []int{1, 7, 8, 9, 14, 15, 56, 57, 896, 897, 1024, 1025, 4096}
+
+// MapStmt returns a block that fills a map with n entries and then
+// deletes half of them, checking the map's length:
+//
+//	{
+//		mp1 := make(map[K]V, <hint>)
+//		for mi1 := range <n> {
+//			mp1[<key from mi1>] = <expr>
+//		}
+//		if len(mp1) != <n> {
+//			panic("mp1: wrong len")
+//		}
+//		mc1 := 0
+//		for mk1 := range mp1 {
+//			if mc1%2 == 0 {
+//				delete(mp1, mk1)
+//			}
+//			mc1++
+//		}
+//		if len(mp1) != <n/2> {
+//			panic("mp1: wrong len")
+//		}
+//	}
+//
+// n and the size hint span the small maps, the growth thresholds, and
+// the split of the map tables. The keys are ints, strings, structs,
+// or pointers, which are hashed and compared differently.
+func (sb *StmtBuilder) MapStmt() *ast.BlockStmt {
+	mp := &ast.Ident{Name: fmt.Sprintf("mp%v", sb.depth)}
+	mi := &ast.Ident{Name: fmt.Sprintf("mi%v", sb.depth)}
+	mc := &ast.Ident{Name: fmt.Sprintf("mc%v", sb.depth)}
+	mk := &ast.Ident{Name: fmt.Sprintf("mk%v", sb.depth)}
+	intLit := func(n int) *ast.BasicLit {
+		return &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(n)}
+	}
+
+	// string(rune(mi))
+	str := &ast.CallExpr{
+		Fun:  TypeIdent("string"),
+		Args: []ast.Expr{&ast.CallExpr{Fun: TypeIdent("rune"), Args: []ast.Expr{mi}}},
+	}
+	var kt Type
+	var key, loopVar ast.Expr = nil, mi
+	switch sb.R.Intn(4) {
+	case 0:
+		kt, key = BT{"int"}, mi
+	case 1:
+		kt, key = BT{"string"}, str
+	case 2:
+		kt = StructType{[]Type{BT{"int"}, BT{"string"}}, []string{"K0", "K1"}, nil}
+		key = &ast.CompositeLit{Type: kt.Ast(), Elts: []ast.Expr{mi, str}}
+	case 3:
+		kt = PointerOf(BT{"int"})
+		key = &ast.CallExpr{Fun: NewIdent, Args: []ast.Expr{TypeIdent("int")}}
+		loopVar = nil // for range <n>
+	}
+	vt := sb.pb.RandType()
+
+	n := RandItem(sb.R, mapSizes)
+	mkArgs := []ast.Expr{MapOf(kt, vt).Ast()}
+	if sb.R.Intn(2) == 0 {
+		mkArgs = append(mkArgs, intLit(RandItem(sb.R, mapSizes)))
+	}
+
+	checkLen := func(n int) ast.Stmt {
+		return &ast.IfStmt{
+			Cond: &ast.BinaryExpr{
+				X:  &ast.CallExpr{Fun: LenIdent, Args: []ast.Expr{mp}},
+				Op: token.NEQ,
+				Y:  intLit(n),
+			},
+			Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ExprStmt{X: &ast.CallExpr{
+				Fun:  SharedIdent("panic"),
+				Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(mp.Name + ": wrong len")}},
+			}}}},
+		}
+	}
+
+	return &ast.BlockStmt{List: []ast.Stmt{
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{mp},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.CallExpr{Fun: MakeIdent, Args: mkArgs}},
+		},
+		&ast.RangeStmt{
+			Key: loopVar,
+			Tok: token.DEFINE,
+			X:   intLit(n),
+			Body: &ast.BlockStmt{List: []ast.Stmt{&ast.AssignStmt{
+				Lhs: []ast.Expr{&ast.IndexExpr{X: mp, Index: key}},
+				Tok: token.ASSIGN,
+				Rhs: []ast.Expr{sb.E.Expr(vt)},
+			}}},
+		},
+		checkLen(n),
+		&ast.AssignStmt{Lhs: []ast.Expr{mc}, Tok: token.DEFINE, Rhs: []ast.Expr{intLit(0)}},
+		&ast.RangeStmt{
+			Key: mk,
+			Tok: token.DEFINE,
+			X:   mp,
+			Body: &ast.BlockStmt{List: []ast.Stmt{
+				&ast.IfStmt{
+					Cond: &ast.BinaryExpr{
+						X:  &ast.BinaryExpr{X: mc, Op: token.REM, Y: intLit(2)},
+						Op: token.EQL,
+						Y:  intLit(0),
+					},
+					Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ExprStmt{
+						X: &ast.CallExpr{Fun: DeleteIdent, Args: []ast.Expr{mp, mk}},
+					}}},
+				},
+				&ast.IncDecStmt{X: mc, Tok: token.INC},
+			}},
+		},
+		checkLen(n / 2),
+	}}
+}
+
+// WriteBarrierStmt returns a block that stores pointers into a
+// slice, a map, and a struct, then forces a garbage collection:
+//
+//	{
+//	  wb0 := make([]*T, <n>)
+//	  wb1 := make(map[int]*T)
+//	  var wb2 struct{ P0, P1 *T }
+//	  for wbi := range wb0 {
+//	    wb0[wbi] = <*T expr>
+//	    wb1[wbi] = wb0[wbi]
+//	    wb2.P0, wb2.P1 = wb0[wbi], wb2.P0
+//	  }
+//	  runtime.GC()
+//	  _, _, _ = wb0, wb1, wb2
+//	}
+//
+// Since the pointers are all stored in heap-allocated objects, every
+// store goes through the GC write barrier.
+func (sb *StmtBuilder) WriteBarrierStmt() *ast.BlockStmt {
+	sb.depth++
+	defer func() { sb.depth-- }()
+
+	pt := PointerOf(sb.pb.RandType())
+	st := StructType{[]Type{pt, pt}, []string{"P0", "P1"}, nil}
+	wb0, wb1, wb2 := &ast.Ident{Name: "wb0"}, &ast.Ident{Name: "wb1"}, &ast.Ident{Name: "wb2"}
+	wbi := &ast.Ident{Name: "wbi"}
+
+	field := func(n string) *ast.SelectorExpr {
+		return &ast.SelectorExpr{X: wb2, Sel: &ast.Ident{Name: n}}
+	}
+	elem := func(x ast.Expr) *ast.IndexExpr {
+		return &ast.IndexExpr{X: x, Index: wbi}
+	}
+
+	// the pointer to store: either new(T) or a random *T expression
+	var ptr ast.Expr
+	if sb.R.Intn(2) == 0 {
+		ptr = &ast.CallExpr{Fun: NewIdent, Args: []ast.Expr{pt.Base().Ast()}}
+	} else {
+		ptr = sb.E.Expr(pt)
+	}
+
+	gc := RuntimeFuncs[0]
+	stmts := []ast.Stmt{
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{wb0},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.CallExpr{
+				Fun: MakeIdent,
+				Args: []ast.Expr{
+					ArrayOf(pt).Ast(),
+					&ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(1 + sb.R.Intn(64))},
+				},
+			}},
+		},
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{wb1},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.CallExpr{
+				Fun:  MakeIdent,
+				Args: []ast.Expr{MapOf(BT{"int"}, pt).Ast()},
+			}},
+		},
+		&ast.DeclStmt{Decl: &ast.GenDecl{
+			Tok:   token.VAR,
+			Specs: []ast.Spec{&ast.ValueSpec{Names: []*ast.Ident{wb2}, Type: st.Ast()}},
+		}},
+		&ast.RangeStmt{
+			Key: wbi,
+			Tok: token.DEFINE,
+			X:   wb0,
+			Body: &ast.BlockStmt{List: []ast.Stmt{
+				&ast.AssignStmt{Lhs: []ast.Expr{elem(wb0)}, Tok: token.ASSIGN, Rhs: []ast.Expr{ptr}},
+				&ast.AssignStmt{Lhs: []ast.Expr{elem(wb1)}, Tok: token.ASSIGN, Rhs: []ast.Expr{elem(wb0)}},
+				&ast.AssignStmt{
+					Lhs: []ast.Expr{field("P0"), field("P1")},
+					Tok: token.ASSIGN,
+					Rhs: []ast.Expr{elem(wb0), field("P0")},
+				},
+			}},
+		},
+		&ast.ExprStmt{X: sb.E.CallFunction(Variable{gc, &ast.Ident{Name: gc.N}})},
+		sb.UseVars([]*ast.Ident{wb0, wb1, wb2}),
+	}
+
+	return &ast.BlockStmt{List: stmts}
+}
+
+// NilStoreStmt returns a block alternately storing typed nil and
+// non-nil pointers into a heap-allocated slice and map, then forcing
+// a garbage collection and reading them back:
+//
+//	{
+//	  wb4, wb5 := make([]*T, <n>), make(map[int]*T)
+//	  wbSink = &wb4
+//	  wbEscape(wb5)
+//	  for wbi := range wb4 {
+//	    wbp := (*T)(nil)
+//	    if wbi%2 == 0 {
+//	      wbp = <*T expr>
+//	    }
+//	    wb4[wbi] = wbp
+//	    wb5[wbi] = wbp
+//	    wb4[wbi/2] = nil
+//	  }
+//	  runtime.GC()
+//	  for wbi, wbp := range wb5 {
+//	    if wbi%2 == 1 && wbp != nil {
+//	      panic("wb5: nil store lost")
+//	    }
+//	    if wbp != nil {
+//	      wbSink = *wbp
+//	    }
+//	  }
+//	}
+//
+// The nil stores go through the GC write barrier like the others.
+// Requires the sink built by MakeWBSink.
+func (sb *StmtBuilder) NilStoreStmt() *ast.BlockStmt {
+	sb.depth++
+	defer func() { sb.depth-- }()
+
+	pt := PointerOf(sb.pb.RandType())
+	wb4, wb5 := &ast.Ident{Name: "wb4"}, &ast.Ident{Name: "wb5"}
+	wbi, wbp := &ast.Ident{Name: "wbi"}, &ast.Ident{Name: "wbp"}
+	wbSink := &ast.Ident{Name: "wbSink"}
+
+	assign := func(lhs, rhs ast.Expr) *ast.AssignStmt {
+		return &ast.AssignStmt{Lhs: []ast.Expr{lhs}, Tok: token.ASSIGN, Rhs: []ast.Expr{rhs}}
+	}
+	parity := func(n int) *ast.BinaryExpr {
+		return &ast.BinaryExpr{
+			X:  &ast.BinaryExpr{X: wbi, Op: token.REM, Y: IntLits[2]},
+			Op: token.EQL,
+			Y:  IntLits[n],
+		}
+	}
+	notNil := &ast.BinaryExpr{X: wbp, Op: token.NEQ, Y: NilIdent}
+
+	// the non-nil pointer to store: usually new(T), sometimes a
+	// random *T expression (which can still be nil)
+	var ptr ast.Expr
+	if sb.R.Intn(4) > 0 {
+		ptr = &ast.CallExpr{Fun: NewIdent, Args: []ast.Expr{pt.Base().Ast()}}
+	} else {
+		ptr = sb.E.Expr(pt)
+	}
+
+	gc := RuntimeFuncs[0]
+	stmts := []ast.Stmt{
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{wb4, wb5},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{
+				&ast.CallExpr{Fun: MakeIdent, Args: []ast.Expr{ArrayOf(pt).Ast(), IntLits[1+sb.R.Intn(64)]}},
+				&ast.CallExpr{Fun: MakeIdent, Args: []ast.Expr{MapOf(BT{"int"}, pt).Ast()}},
+			},
+		},
+		assign(wbSink, &ast.UnaryExpr{Op: token.AND, X: wb4}),
+		&ast.ExprStmt{X: &ast.CallExpr{Fun: &ast.Ident{Name: "wbEscape"}, Args: []ast.Expr{wb5}}},
+		&ast.RangeStmt{
+			Key: wbi,
+			Tok: token.DEFINE,
+			X:   wb4,
+			Body: &ast.BlockStmt{List: []ast.Stmt{
+				&ast.AssignStmt{
+					Lhs: []ast.Expr{wbp},
+					Tok: token.DEFINE,
+					Rhs: []ast.Expr{&ast.CallExpr{Fun: &ast.ParenExpr{X: pt.Ast()}, Args: []ast.Expr{NilIdent}}},
+				},
+				&ast.IfStmt{Cond: parity(0), Body: &ast.BlockStmt{List: []ast.Stmt{assign(wbp, ptr)}}},
+				assign(&ast.IndexExpr{X: wb4, Index: wbi}, wbp),
+				assign(&ast.IndexExpr{X: wb5, Index: wbi}, wbp),
+				assign(
+					&ast.IndexExpr{X: wb4, Index: &ast.BinaryExpr{X: wbi, Op: token.QUO, Y: IntLits[2]}},
+					NilIdent,
+				),
+			}},
+		},
+		&ast.ExprStmt{X: sb.E.CallFunction(Variable{gc, &ast.Ident{Name: gc.N}})},
+		&ast.RangeStmt{
+			Key:   wbi,
+			Value: wbp,
+			Tok:   token.DEFINE,
+			X:     wb5,
+			Body: &ast.BlockStmt{List: []ast.Stmt{
+				&ast.IfStmt{
+					Cond: &ast.BinaryExpr{X: parity(1), Op: token.LAND, Y: notNil},
+					Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ExprStmt{X: &ast.CallExpr{
+						Fun:  SharedIdent("panic"),
+						Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote("wb5: nil store lost")}},
+					}}}},
+				},
+				&ast.IfStmt{
+					Cond: notNil,
+					Body: &ast.BlockStmt{List: []ast.Stmt{assign(wbSink, &ast.StarExpr{X: wbp})}},
+				},
+			}},
+		},
+	}
+
+	return &ast.BlockStmt{List: stmts}
 }
 
 func (sb *StmtBuilder) IncDecStmt(t Type) *ast.IncDecStmt {
@@ -749,7 +2169,7 @@ func (sb *StmtBuilder) CommClause(def bool) *ast.CommClause {
 				X: &ast.UnaryExpr{
 					Op: token.ARROW,
 					X: &ast.CallExpr{
-						Fun: &ast.Ident{Name: "make"},
+						Fun: MakeIdent,
 						Args: []ast.Expr{
 							&ast.ChanType{
 								Dir:   3,
@@ -773,6 +2193,265 @@ func (sb *StmtBuilder) CommClause(def bool) *ast.CommClause {
 
 }
 
+// StdlibIfaceStmt returns a call to a standard library function
+// taking an interface, passing a value of a package-level type that
+// implements it:
+//
+//	fmt.Print(T0{<string expr>})  // or &T0{...}, for a fmt.Stringer
+//	sort.Sort(T1{<[]E expr>})     // for a sort.Interface
+//
+// It returns false if neither function is in scope.
+func (sb *StmtBuilder) StdlibIfaceStmt() (*ast.ExprStmt, bool) {
+	var fns []Variable
+	for _, name := range []string{"fmt.Print", "sort.Sort"} {
+		if v, ok := sb.S.FindVarByName(name); ok {
+			fns = append(fns, v)
+		}
+	}
+	if len(fns) == 0 {
+		return nil, false
+	}
+
+	f := RandItem(sb.R, fns)
+	if f.Name.Name == "fmt.Print" {
+		ptr := sb.R.Intn(2) == 0
+		var arg ast.Expr = &ast.CompositeLit{
+			Type: sb.pb.MakeStringer(ptr),
+			Elts: []ast.Expr{sb.E.Expr(BT{"string"})},
+		}
+		if ptr {
+			arg = &ast.UnaryExpr{Op: token.AND, X: arg}
+		}
+		return &ast.ExprStmt{X: &ast.CallExpr{Fun: f.Name, Args: []ast.Expr{arg}}}, true
+	}
+
+	et := RandItem(sb.R, sb.pb.baseTypes)
+	for !IsOrdered(et) || et.Name() == "any" {
+		et = RandItem(sb.R, sb.pb.baseTypes)
+	}
+	arg := &ast.CompositeLit{
+		Type: sb.pb.MakeSorter(et),
+		Elts: []ast.Expr{sb.E.Expr(ArrayOf(et))},
+	}
+	return &ast.ExprStmt{X: &ast.CallExpr{Fun: f.Name, Args: []ast.Expr{arg}}}, true
+}
+
+// MethodValueStmt returns a call passing a method value of a type
+// built by MakeSorter as a comparison function, for a slice s of an
+// ordered type in scope. One of:
+//
+//	sort.Slice(s, T0{s}.Less)
+//	slices.SortFunc(s, T0{}.Compare)
+//	func(less func(int, int) bool) { if len(s) > 1 { _ = less(0, 1) } }(T0{s}.Less)
+//
+// The first two only when sort.Slice and slices.SortFunc are in
+// scope. It returns false if there are no such slices in scope.
+func (sb *StmtBuilder) MethodValueStmt() (*ast.ExprStmt, bool) {
+	v, ok := sb.S.RandPred(func(v Variable, _ ...Type) bool {
+		at, ok := v.Type.(ArrayType)
+		return ok && IsOrdered(at.Base()) && at.Base().Name() != "any"
+	})
+	if !ok {
+		return nil, false
+	}
+
+	T := sb.pb.MakeSorter(v.Type.(ArrayType).Base())
+	method := func(name string, elts ...ast.Expr) *ast.SelectorExpr {
+		return &ast.SelectorExpr{
+			X:   &ast.CompositeLit{Type: T, Elts: elts},
+			Sel: &ast.Ident{Name: name},
+		}
+	}
+	lit := func(v string) *ast.BasicLit {
+		return &ast.BasicLit{Kind: token.INT, Value: v}
+	}
+
+	fns := []Variable{{}} // the zero Variable is the func literal
+	for _, name := range []string{"sort.Slice", "slices.SortFunc"} {
+		if f, ok := sb.S.FindVarByName(name); ok {
+			fns = append(fns, f)
+		}
+	}
+
+	var call *ast.CallExpr
+	switch f := RandItem(sb.R, fns); {
+	case f.Name == nil:
+		less := &ast.Ident{Name: "less"}
+		lessT := FuncType{"FU", []Type{BT{"int"}, BT{"int"}}, []Type{BT{"bool"}}, true}
+		call = &ast.CallExpr{
+			Fun: &ast.FuncLit{
+				Type: &ast.FuncType{Params: &ast.FieldList{List: []*ast.Field{
+					{Names: []*ast.Ident{less}, Type: lessT.Ast()},
+				}}},
+				Body: &ast.BlockStmt{List: []ast.Stmt{&ast.IfStmt{
+					Cond: &ast.BinaryExpr{
+						X:  &ast.CallExpr{Fun: LenIdent, Args: []ast.Expr{v.Name}},
+						Op: token.GTR,
+						Y:  lit("1"),
+					},
+					Body: &ast.BlockStmt{List: []ast.Stmt{&ast.AssignStmt{
+						Lhs: []ast.Expr{&noName},
+						Tok: token.ASSIGN,
+						Rhs: []ast.Expr{&ast.CallExpr{Fun: less, Args: []ast.Expr{lit("0"), lit("1")}}},
+					}}},
+				}}},
+			},
+			Args: []ast.Expr{method("Less", v.Name)},
+		}
+	case f.Name.Name == "sort.Slice":
+		call = &ast.CallExpr{
+			Fun:  f.Name,
+			Args: []ast.Expr{v.Name, method("Less", v.Name)},
+		}
+	default: // slices.SortFunc
+		call = &ast.CallExpr{
+			Fun:  f.Name,
+			Args: []ast.Expr{v.Name, method("Compare")},
+		}
+	}
+
+	return &ast.ExprStmt{X: call}, true
+}
+
+// FieldMethodCallStmt returns a call to a method of an interface
+// field of a struct in scope, like
+//
+//	st1.In2.M0(i, "a")
+//
+// which combines a field access with a dynamic dispatch. It returns
+// false if there are no structs with interface fields in scope.
+func (sb *StmtBuilder) FieldMethodCallStmt() (*ast.ExprStmt, bool) {
+	hasIface := func(st StructType) (int, bool) {
+		for i, t := range st.Ftypes {
+			if it, ok := t.(InterfaceType); ok && len(it.Methods) > 0 {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+	v, ok := sb.S.RandPred(func(v Variable, _ ...Type) bool {
+		st, ok := v.Type.(StructType)
+		if !ok {
+			return false
+		}
+		_, ok = hasIface(st)
+		return ok
+	})
+	if !ok {
+		return nil, false
+	}
+
+	st := v.Type.(StructType)
+	i, _ := hasIface(st)
+	m := RandItem(sb.R, st.Ftypes[i].(InterfaceType).Methods)
+	field := &ast.SelectorExpr{X: v.Name, Sel: SharedIdent(st.Fnames[i])}
+	sel := &ast.SelectorExpr{X: field, Sel: m.Name}
+	return &ast.ExprStmt{X: sb.E.CallExpr(sel, m.Func.Args)}, true
+}
+
+// InterfaceConvStmt returns a statement converting the value of a
+// variable v of interface type to another interface type. It's either
+// an implicit conversion, to an interface with a subset of the
+// methods of v's type:
+//
+//	i1 = v
+//	{ var ic1 interface{ M1(int) bool } = v; _ = ic1 }
+//
+// or a type assertion, which is checked at runtime against the
+// dynamic type of v:
+//
+//	if ic1, ok1 := v.(interface{ M0(); M3(string) }); ok1 { ic1.M0(); _ = ic1 }
+//
+// The asserted type is either the type of another interface variable
+// in scope, or one with some of the methods of v's type and possibly
+// some new ones. It returns false if there are no interface variables
+// with methods in scope.
+func (sb *StmtBuilder) InterfaceConvStmt() (ast.Stmt, bool) {
+	v, ok := sb.S.RandPred(func(v Variable, _ ...Type) bool {
+		it, ok := v.Type.(InterfaceType)
+		return ok && len(it.Methods) > 0
+	})
+	if !ok {
+		return nil, false
+	}
+	it := v.Type.(InterfaceType)
+
+	// a random subset of the methods of it
+	subset := func() InterfaceType {
+		var t InterfaceType
+		for _, m := range it.Methods {
+			if sb.R.Intn(2) == 0 {
+				t.Methods = append(t.Methods, m)
+			}
+		}
+		return t
+	}
+
+	// Like in TypeSwitchStmt, the new variables are named after the
+	// depth, so they don't clash with the ones in scope.
+	i := &ast.Ident{Name: fmt.Sprintf("ic%v", sb.depth)}
+	if sb.R.Intn(2) == 0 {
+		if w, ok := sb.S.RandPred(func(w Variable, _ ...Type) bool {
+			wt, ok := w.Type.(InterfaceType)
+			return ok && w.Name.Name != v.Name.Name && it.Implements(wt)
+		}); ok {
+			return &ast.AssignStmt{
+				Lhs: []ast.Expr{w.Name},
+				Tok: token.ASSIGN,
+				Rhs: []ast.Expr{v.Name},
+			}, true
+		}
+		return &ast.BlockStmt{List: []ast.Stmt{
+			&ast.DeclStmt{Decl: &ast.GenDecl{
+				Tok: token.VAR,
+				Specs: []ast.Spec{&ast.ValueSpec{
+					Names:  []*ast.Ident{i},
+					Type:   subset().Ast(),
+					Values: []ast.Expr{v.Name},
+				}},
+			}},
+			sb.UseVars([]*ast.Ident{i}),
+		}}, true
+	}
+
+	var target InterfaceType
+	if w, ok := sb.S.RandPred(func(w Variable, _ ...Type) bool {
+		wt, ok := w.Type.(InterfaceType)
+		return ok && w.Name.Name != v.Name.Name && !it.Conflicts(wt)
+	}); ok && sb.R.Intn(2) == 0 {
+		target = w.Type.(InterfaceType)
+	} else {
+		// The methods of it are named M0, M1, ..., so the new ones
+		// can't clash with them.
+		target = subset()
+		for j := 0; j < sb.R.Intn(3); j++ {
+			target.Methods = append(target.Methods, Method{
+				&ast.Ident{Name: "M" + strconv.Itoa(len(it.Methods)+j)},
+				sb.pb.RandFuncType(),
+			})
+		}
+	}
+
+	okIdent := &ast.Ident{Name: fmt.Sprintf("ok%v", sb.depth)}
+	var body []ast.Stmt
+	if len(target.Methods) > 0 {
+		m := RandItem(sb.R, target.Methods)
+		sel := &ast.SelectorExpr{X: i, Sel: m.Name}
+		body = append(body, &ast.ExprStmt{X: sb.E.CallExpr(sel, m.Func.Args)})
+	}
+	body = append(body, sb.UseVars([]*ast.Ident{i}))
+
+	return &ast.IfStmt{
+		Init: &ast.AssignStmt{
+			Lhs: []ast.Expr{i, okIdent},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.TypeAssertExpr{X: v.Name, Type: target.Ast()}},
+		},
+		Cond: okIdent,
+		Body: &ast.BlockStmt{List: body},
+	}, true
+}
+
 func (sb *StmtBuilder) ExprStmt() *ast.ExprStmt {
 
 	// Close(ch) or <-ch.
@@ -791,11 +2470,325 @@ func (sb *StmtBuilder) ExprStmt() *ast.ExprStmt {
 		}
 	}
 
+	// runtime.GC() has no return value, so it's never chosen by
+	// RandCallExpr(). Call it here.
+	if sb.pb.Conf().Runtime && sb.R.Intn(4) == 0 {
+		gc := RuntimeFuncs[0]
+		return &ast.ExprStmt{X: sb.E.CallFunction(Variable{gc, &ast.Ident{Name: gc.N}})}
+	}
+
+	if sb.R.Intn(8) == 0 {
+		if st, ok := sb.StdlibIfaceStmt(); ok {
+			return st
+		}
+	}
+	if sb.R.Intn(8) == 0 {
+		if st, ok := sb.MethodValueStmt(); ok {
+			return st
+		}
+	}
+	if sb.R.Intn(4) == 0 {
+		if st, ok := sb.FieldMethodCallStmt(); ok {
+			return st
+		}
+	}
+
+	// Call a function variable with no results, like a func(), which
+	// can't be called anywhere else.
+	if v, ok := sb.S.RandNoResultFunc(); ok && sb.R.Intn(2) == 0 {
+		return &ast.ExprStmt{X: sb.E.CallFunction(v)}
+	}
+
 	// Call a random function. We don't use RandCallExpr() because
 	// that could choose a built-in (like len), which is not allowed
 	// as an ExprStmt. Conjuring a new function and calling it will
 	// always work.
-	return &ast.ExprStmt{sb.E.ConjureAndCallFunc(sb.pb.RandType())}
+	return &ast.ExprStmt{X: sb.E.ConjureAndCallFunc(sb.pb.RandType())}
+}
+
+// FuncTableStmt returns a block storing closures of a random func
+// type F in a slice or in a map, and calling them through it:
+//
+//	{
+//		fns1 := []F{func(...) { ... }, fnc0, ...}
+//		fns1 = append(fns1, func(...) { ... })
+//		for fi1 := range fns1 {
+//			if fns1[fi1] != nil {
+//				fns1[fi1](<args>)
+//			}
+//		}
+//	}
+//
+// or
+//
+//	{
+//		fns1 := map[K]F{}
+//		fns1[<K expr>] = func(...) { ... }
+//		if fncel1, ok1 := fns1[<K expr>]; ok1 {
+//			fncel1(<args>)
+//		}
+//		for _, fncel1 := range fns1 {
+//			fncel1(<args>)
+//		}
+//	}
+//
+// The slice literal can have nil elements, so they are checked before
+// calling them. The map only ever holds closures.
+func (sb *StmtBuilder) FuncTableStmt() *ast.BlockStmt {
+	ft := sb.pb.RandFuncType()
+	fns := &ast.Ident{Name: fmt.Sprintf("fns%v", sb.depth)}
+	// CallExpr only takes idents starting with fnc as func variables
+	fn := &ast.Ident{Name: fmt.Sprintf("fncel%v", sb.depth)}
+	call := func(f ast.Expr) ast.Stmt {
+		return &ast.ExprStmt{X: sb.E.CallExpr(f, ft.Args)}
+	}
+
+	if sb.R.Intn(2) == 0 {
+		t := ArrayOf(ft)
+		fi := &ast.Ident{Name: fmt.Sprintf("fi%v", sb.depth)}
+		elem := &ast.IndexExpr{X: fns, Index: fi}
+		return &ast.BlockStmt{List: []ast.Stmt{
+			&ast.AssignStmt{Lhs: []ast.Expr{fns}, Tok: token.DEFINE, Rhs: []ast.Expr{sb.E.CompositeLit(t)}},
+			&ast.AssignStmt{
+				Lhs: []ast.Expr{fns},
+				Tok: token.ASSIGN,
+				Rhs: []ast.Expr{&ast.CallExpr{Fun: AppendIdent, Args: []ast.Expr{fns, sb.E.FuncLit(ft)}}},
+			},
+			&ast.RangeStmt{
+				Key: fi,
+				Tok: token.DEFINE,
+				X:   fns,
+				Body: &ast.BlockStmt{List: []ast.Stmt{&ast.IfStmt{
+					Cond: &ast.BinaryExpr{X: elem, Op: token.NEQ, Y: NilIdent},
+					Body: &ast.BlockStmt{List: []ast.Stmt{call(elem)}},
+				}}},
+			},
+		}}
+	}
+
+	t := MapOf(sb.pb.RandComparableType(), ft)
+	ok := &ast.Ident{Name: fmt.Sprintf("ok%v", sb.depth)}
+	stmts := []ast.Stmt{
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{fns},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.CompositeLit{Type: t.Ast()}},
+		},
+	}
+	for i := 0; i < 1+sb.R.Intn(3); i++ {
+		stmts = append(stmts, &ast.AssignStmt{
+			Lhs: []ast.Expr{&ast.IndexExpr{X: fns, Index: sb.E.Expr(t.KeyT)}},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{sb.E.FuncLit(ft)},
+		})
+	}
+	return &ast.BlockStmt{List: append(stmts,
+		&ast.IfStmt{
+			Init: &ast.AssignStmt{
+				Lhs: []ast.Expr{fn, ok},
+				Tok: token.DEFINE,
+				Rhs: []ast.Expr{&ast.IndexExpr{X: fns, Index: sb.E.Expr(t.KeyT)}},
+			},
+			Cond: ok,
+			Body: &ast.BlockStmt{List: []ast.Stmt{call(fn)}},
+		},
+		&ast.RangeStmt{
+			Key:   &noName,
+			Value: fn,
+			Tok:   token.DEFINE,
+			X:     fns,
+			Body:  &ast.BlockStmt{List: []ast.Stmt{call(fn)}},
+		},
+	)}
+}
+
+// OverlapCopyStmt returns a statement copying between overlapping
+// parts of the same slice, which copy and append must handle like
+// memmove, in one of these forms:
+//
+//	copy(a[len(a)/2:], a)
+//	copy(a, a[len(a)/2:])
+//	if len(a) > k { copy(a[k:], a[:len(a)-k]) }
+//	if len(a) > k { a = append(a[:k], a[k+1:]...) }
+//
+// where a is a slice variable in scope. If there isn't one, the
+// statement is wrapped in a block declaring a new slice.
+func (sb *StmtBuilder) OverlapCopyStmt() ast.Stmt {
+	var a *ast.Ident
+	var decl ast.Stmt
+	if v, ok := sb.S.RandPred(func(v Variable, _ ...Type) bool {
+		_, isSlice := v.Type.(ArrayType)
+		return isSlice
+	}); ok {
+		a = v.Name
+	} else {
+		t := ArrayOf(sb.pb.RandType())
+		init := sb.E.VarOrLit(t)
+		a = sb.S.NewIdent(t)
+		sb.S.DeleteIdentByName(a)
+		decl = &ast.AssignStmt{Lhs: []ast.Expr{a}, Tok: token.DEFINE, Rhs: []ast.Expr{init}}
+	}
+
+	intLit := func(n int) *ast.BasicLit {
+		return &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(n)}
+	}
+	lenA := &ast.CallExpr{Fun: LenIdent, Args: []ast.Expr{a}}
+	copyCall := func(dst, src ast.Expr) ast.Stmt {
+		return &ast.ExprStmt{X: &ast.CallExpr{Fun: CopyIdent, Args: []ast.Expr{dst, src}}}
+	}
+	half := &ast.SliceExpr{X: a, Low: &ast.BinaryExpr{X: lenA, Op: token.QUO, Y: intLit(2)}}
+	k := 1 + sb.R.Intn(3)
+
+	var st ast.Stmt
+	switch sb.R.Intn(4) {
+	case 0:
+		st = copyCall(half, a)
+	case 1:
+		st = copyCall(a, half)
+	case 2, 3:
+		var body ast.Stmt
+		if sb.R.Intn(2) == 0 {
+			body = copyCall(
+				&ast.SliceExpr{X: a, Low: intLit(k)},
+				&ast.SliceExpr{X: a, High: &ast.BinaryExpr{X: lenA, Op: token.SUB, Y: intLit(k)}},
+			)
+		} else {
+			body = &ast.AssignStmt{
+				Lhs: []ast.Expr{a},
+				Tok: token.ASSIGN,
+				Rhs: []ast.Expr{&ast.CallExpr{
+					Fun: AppendIdent,
+					Args: []ast.Expr{
+						&ast.SliceExpr{X: a, High: intLit(k)},
+						&ast.SliceExpr{X: a, Low: intLit(k + 1)},
+					},
+					Ellipsis: 1,
+				}},
+			}
+		}
+		st = &ast.IfStmt{
+			Cond: &ast.BinaryExpr{X: lenA, Op: token.GTR, Y: intLit(k)},
+			Body: &ast.BlockStmt{List: []ast.Stmt{body}},
+		}
+	}
+
+	if decl != nil {
+		return &ast.BlockStmt{List: []ast.Stmt{decl, st}}
+	}
+	return st
+}
+
+// ArrayPtrConvStmt returns a statement converting a slice to an
+// array pointer, and slicing the array pointer back:
+//
+//	if len(a) >= N {
+//		ap0 := (*[N]T)(a)
+//		ap0[k] = <expr>
+//		as0 := ap0[lo:hi]
+//		if len(as0) != hi-lo || cap(as0) != N-lo || as0[0] != a[lo] {
+//			panic("ap0: bad round-trip")
+//		}
+//		println(len(as0), cap(as0))
+//	}
+//
+// where a is a slice variable in scope (or a new one, as in
+// OverlapCopyStmt). The conversion panics if the slice is shorter
+// than the array, hence the check on len(a). The as0[0] != a[lo]
+// check is only generated for the element types whose values are
+// equal to themselves. Instead of printing the lengths, as0 is
+// sometimes assigned back to a.
+func (sb *StmtBuilder) ArrayPtrConvStmt() ast.Stmt {
+	var a *ast.Ident
+	var t ArrayType
+	var decl ast.Stmt
+	if v, ok := sb.S.RandPred(func(v Variable, _ ...Type) bool {
+		_, isSlice := v.Type.(ArrayType)
+		return isSlice
+	}); ok {
+		a, t = v.Name, v.Type.(ArrayType)
+	} else {
+		t = ArrayOf(sb.pb.RandType())
+		init := sb.E.VarOrLit(t)
+		a = sb.S.NewIdent(t)
+		sb.S.DeleteIdentByName(a)
+		decl = &ast.AssignStmt{Lhs: []ast.Expr{a}, Tok: token.DEFINE, Rhs: []ast.Expr{init}}
+	}
+
+	intLit := func(n int) *ast.BasicLit {
+		return &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(n)}
+	}
+	call := func(fun *ast.Ident, arg ast.Expr) *ast.CallExpr {
+		return &ast.CallExpr{Fun: fun, Args: []ast.Expr{arg}}
+	}
+	ap := &ast.Ident{Name: fmt.Sprintf("ap%v", sb.depth)}
+	as := &ast.Ident{Name: fmt.Sprintf("as%v", sb.depth)}
+
+	n := 1 + sb.R.Intn(8)
+	lo := sb.R.Intn(n)
+	hi := lo + 1 + sb.R.Intn(n-lo)
+	slice := &ast.SliceExpr{X: ap, Low: intLit(lo), High: intLit(hi)}
+	if sb.R.Intn(3) == 0 {
+		slice.Max, slice.Slice3 = intLit(n), true
+	}
+
+	body := []ast.Stmt{
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{ap},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.CallExpr{
+				Fun:  &ast.ParenExpr{X: &ast.StarExpr{X: &ast.ArrayType{Len: intLit(n), Elt: t.Base().Ast()}}},
+				Args: []ast.Expr{a},
+			}},
+		},
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{&ast.IndexExpr{X: ap, Index: intLit(sb.R.Intn(n))}},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{sb.E.Expr(t.Base())},
+		},
+		&ast.AssignStmt{Lhs: []ast.Expr{as}, Tok: token.DEFINE, Rhs: []ast.Expr{slice}},
+	}
+
+	cond := ast.Expr(&ast.BinaryExpr{
+		X:  &ast.BinaryExpr{X: call(LenIdent, as), Op: token.NEQ, Y: intLit(hi - lo)},
+		Op: token.LOR,
+		Y:  &ast.BinaryExpr{X: call(SharedIdent("cap"), as), Op: token.NEQ, Y: intLit(n - lo)},
+	})
+	if bt, ok := t.Base().(BasicType); ok && bt.Comparable() && !IsFloat(bt) {
+		cond = &ast.BinaryExpr{
+			X:  cond,
+			Op: token.LOR,
+			Y: &ast.BinaryExpr{
+				X:  &ast.IndexExpr{X: as, Index: intLit(0)},
+				Op: token.NEQ,
+				Y:  &ast.IndexExpr{X: a, Index: intLit(lo)},
+			},
+		}
+	}
+	body = append(body, &ast.IfStmt{
+		Cond: cond,
+		Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ExprStmt{X: call(
+			SharedIdent("panic"),
+			&ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(ap.Name + ": bad round-trip")},
+		)}}},
+	})
+
+	if decl == nil && sb.R.Intn(2) == 0 {
+		body = append(body, &ast.AssignStmt{Lhs: []ast.Expr{a}, Tok: token.ASSIGN, Rhs: []ast.Expr{as}})
+	} else {
+		body = append(body, &ast.ExprStmt{X: &ast.CallExpr{
+			Fun:  SharedIdent("println"),
+			Args: []ast.Expr{call(LenIdent, as), call(SharedIdent("cap"), as)},
+		}})
+	}
+
+	st := &ast.IfStmt{
+		Cond: &ast.BinaryExpr{X: call(LenIdent, a), Op: token.GEQ, Y: intLit(n)},
+		Body: &ast.BlockStmt{List: body},
+	}
+	if decl != nil {
+		return &ast.BlockStmt{List: []ast.Stmt{decl, st}}
+	}
+	return st
 }
 
 func (sb *StmtBuilder) ClearStmt() *ast.ExprStmt {
@@ -0,0 +1,115 @@
+package microsmith
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"strings"
+)
+
+// TraceLen is the number of builder calls remembered by a package
+// builder when ProgramConf.Trace is set.
+const TraceLen = 256
+
+// TraceRecord describes a call to one of the builder methods.
+type TraceRecord struct {
+	Seq    int      // monotonically increasing call counter
+	Method string   // the builder method, like "Expr"
+	Type   Type     // the requested type, nil if there isn't one
+	Depth  int      // the builder depth at the time of the call
+	Node   ast.Node // the returned node, nil if the call didn't return
+}
+
+func (r TraceRecord) String() string {
+	s := fmt.Sprintf("#%-6d %s%s", r.Seq, strings.Repeat("  ", r.Depth), r.Method)
+	if r.Type != nil {
+		s += " [" + shorten(types.ExprString(r.Type.Ast())) + "]"
+	}
+	if r.Node == nil {
+		return s + " (unfinished)"
+	}
+
+	// the branch chosen by the builder, like ForStmt or BinaryExpr
+	branch := strings.TrimPrefix(fmt.Sprintf("%T", r.Node), "*ast.")
+	return s + " -> " + branch + ": " + nodeString(r.Node)
+}
+
+// nodeString returns the first line of n's source, shortened.
+func nodeString(n ast.Node) string {
+	var s string
+	if e, ok := n.(ast.Expr); ok {
+		s = types.ExprString(e)
+	} else {
+		var buf bytes.Buffer
+		printer.Fprint(&buf, token.NewFileSet(), n)
+		s, _, _ = strings.Cut(buf.String(), "\n")
+	}
+	return shorten(s)
+}
+
+func shorten(s string) string {
+	if len(s) > 60 {
+		return s[:57] + "..."
+	}
+	return s
+}
+
+// tracer is a ring buffer holding the last TraceLen TraceRecords.
+type tracer struct {
+	recs []TraceRecord
+	seq  int // Seq of the next record
+}
+
+func (t *tracer) add(r TraceRecord) int {
+	r.Seq = t.seq
+	t.seq++
+	if len(t.recs) < TraceLen {
+		t.recs = append(t.recs, r)
+	} else {
+		t.recs[r.Seq%TraceLen] = r
+	}
+	return r.Seq
+}
+
+// get returns the record with the given Seq, or nil if it was
+// already overwritten.
+func (t *tracer) get(seq int) *TraceRecord {
+	r := &t.recs[seq%TraceLen]
+	if r.Seq != seq {
+		return nil
+	}
+	return r
+}
+
+// Records returns the records in the buffer, oldest first.
+func (t *tracer) Records() []TraceRecord {
+	if len(t.recs) < TraceLen {
+		return append([]TraceRecord(nil), t.recs...)
+	}
+	i := t.seq % TraceLen
+	return append(append([]TraceRecord(nil), t.recs[i:]...), t.recs[:i]...)
+}
+
+// Trace records a call to the builder method m, asked to build a
+// node of type t (which can be nil) at the given depth. It returns
+// the record's Seq, to be passed to TraceNode once the node is
+// built. It's a no-op returning -1 if tracing is disabled.
+func (c *Context) Trace(m string, t Type, depth int) int {
+	if c.trace == nil {
+		return -1
+	}
+	return c.trace.add(TraceRecord{Method: m, Type: t, Depth: depth})
+}
+
+// TraceNode sets the node built by the call traced with seq.
+func (c *Context) TraceNode(seq int, n ast.Node) {
+	if c.trace == nil || seq < 0 {
+		return
+	}
+	if r := c.trace.get(seq); r != nil {
+		r.Node = n
+	}
+}
@@ -2,10 +2,11 @@ package microsmith
 
 import (
 	"bytes"
-	"fmt"
 	"go/ast"
 	"go/format"
 	"go/token"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -81,6 +82,8 @@ func Ident(t Type) string {
 		return strings.ToLower(t.N.Name) + "_"
 	case InterfaceType:
 		return "in"
+	case NamedType:
+		return "n"
 	default:
 		panic("Ident: unknown type " + t.Name())
 	}
@@ -139,6 +142,17 @@ func IsNumeric(t Type) bool {
 	}
 }
 
+// IsFloat reports whether t is one of the floating-point or complex
+// types.
+func IsFloat(t Type) bool {
+	switch t.Name() {
+	case "float32", "float64", "complex128":
+		return true
+	default:
+		return false
+	}
+}
+
 func IsOrdered(t Type) bool {
 	if bt, ok := t.(BasicType); !ok {
 		return false
@@ -264,6 +278,15 @@ func ArrayOf(t Type) ArrayType {
 type StructType struct {
 	Ftypes []Type   // fields types
 	Fnames []string // field names
+	Ftags  []string // field tags ("" for no tag), or nil
+}
+
+// Tag returns the tag of the i-th field, or "" if it has none.
+func (t StructType) Tag(i int) string {
+	if i < len(t.Ftags) {
+		return t.Ftags[i]
+	}
+	return ""
 }
 
 func (t StructType) Comparable() bool {
@@ -279,9 +302,15 @@ func (t StructType) Ast() ast.Expr {
 	fields := make([]*ast.Field, 0, len(t.Fnames))
 	for i := range t.Fnames {
 		field := &ast.Field{
-			Names: []*ast.Ident{&ast.Ident{Name: t.Fnames[i]}},
+			Names: []*ast.Ident{SharedIdent(t.Fnames[i])},
 			Type:  t.Ftypes[i].Ast(),
 		}
+		if tag := t.Tag(i); tag != "" {
+			field.Tag = &ast.BasicLit{Kind: token.STRING, Value: "`" + tag + "`"}
+			if !strconv.CanBackquote(tag) {
+				field.Tag.Value = strconv.Quote(tag)
+			}
+		}
 		fields = append(fields, field)
 	}
 
@@ -310,8 +339,9 @@ func (st StructType) Equal(t Type) bool {
 		if len(st.Ftypes) != len(t2.Ftypes) {
 			return false
 		}
+		// The tags are part of the type's identity.
 		for i := range st.Ftypes {
-			if !st.Ftypes[i].Equal(t2.Ftypes[i]) {
+			if !st.Ftypes[i].Equal(t2.Ftypes[i]) || st.Tag(i) != t2.Tag(i) {
 				return false
 			}
 		}
@@ -382,7 +412,67 @@ func (f FuncType) Contains(t Type) bool {
 	if f.Equal(t) {
 		return true
 	}
-	return len(f.Ret) > 0 && t.Equal(f.Ret[0])
+	return len(f.Ret) == 1 && t.Equal(f.Ret[0])
+}
+
+// DerivationDepth returns the number of steps (index, selector,
+// receive, dereference, or call) that ExprBuilder.SubTypeExpr takes to
+// derive an expression of type t2 from one of type t, or -1 if t
+// doesn't contain t2.
+func DerivationDepth(t, t2 Type) int {
+	if t.Equal(t2) {
+		return 0
+	}
+	if !t.Contains(t2) {
+		return -1
+	}
+
+	switch t := t.(type) {
+	case ArrayType:
+		return 1 + DerivationDepth(t.Base(), t2)
+	case ChanType:
+		return 1 + DerivationDepth(t.Base(), t2)
+	case MapType:
+		return 1 + DerivationDepth(t.ValueT, t2)
+	case PointerType:
+		return 1 + DerivationDepth(t.Base(), t2)
+	case StructType:
+		for _, ft := range t.Ftypes {
+			if ft.Contains(t2) {
+				return 1 + DerivationDepth(ft, t2)
+			}
+		}
+	case FuncType, InterfaceType:
+		return 1
+	}
+	panic("unhandled type " + t.Name())
+}
+
+// ConvFun returns the type expression of a conversion to t. Types
+// ending in a func type with no results are parenthesized, since the
+// parser takes the (x) in []func()(x) as the func's result list.
+func ConvFun(t Type) ast.Expr {
+	var endsInFunc func(t Type) bool
+	endsInFunc = func(t Type) bool {
+		switch t := t.(type) {
+		case ArrayType:
+			return endsInFunc(t.Etype)
+		case ChanType:
+			return endsInFunc(t.T)
+		case MapType:
+			return endsInFunc(t.ValueT)
+		case PointerType:
+			return endsInFunc(t.Btype)
+		case FuncType:
+			return len(t.Ret) == 0 || endsInFunc(t.Ret[len(t.Ret)-1])
+		default:
+			return false
+		}
+	}
+	if endsInFunc(t) {
+		return &ast.ParenExpr{X: t.Ast()}
+	}
+	return t.Ast()
 }
 
 func (ft FuncType) Name() string {
@@ -429,9 +519,7 @@ func (ft FuncType) MakeFieldLists(named bool, s int) (*ast.FieldList, *ast.Field
 	for i, arg := range ft.Args {
 		p := ast.Field{Type: arg.Ast()}
 		if named {
-			p.Names = []*ast.Ident{
-				&ast.Ident{Name: fmt.Sprintf("p%d", s+i)},
-			}
+			p.Names = []*ast.Ident{ParamIdent(s + i)}
 		}
 		params.List = append(params.List, &p)
 	}
@@ -537,6 +625,29 @@ var StdlibFuncs = []FuncType{
 		Ret: []Type{BT{"string"}},
 	},
 
+	// fmt and sort, called with the types built by MakeStringer and
+	// MakeSorter, see StdlibIfaceStmt and MethodValueStmt
+	{
+		N:    "fmt.Print",
+		Args: nil,
+		Ret:  []Type{},
+	},
+	{
+		N:    "sort.Sort",
+		Args: nil,
+		Ret:  []Type{},
+	},
+	{
+		N:    "sort.Slice",
+		Args: nil,
+		Ret:  []Type{},
+	},
+	{
+		N:    "slices.SortFunc",
+		Args: nil,
+		Ret:  []Type{},
+	},
+
 	// reflect
 	{
 		N:    "reflect.DeepEqual",
@@ -577,6 +688,21 @@ var StdlibFuncs = []FuncType{
 	},
 }
 
+// Functions from the runtime package. The package is only imported
+// by some of the generation modes, so these are not in StdlibFuncs.
+var RuntimeFuncs = []FuncType{
+	{
+		N:    "runtime.GC",
+		Args: []Type{},
+		Ret:  []Type{},
+	},
+	{
+		N:    "runtime.GOMAXPROCS",
+		Args: []Type{BT{"int"}},
+		Ret:  []Type{BT{"int"}},
+	},
+}
+
 func MakeAtomicFuncs() []Variable {
 
 	types := []string{"uint32", "uint64", "uintptr"}
@@ -705,6 +831,50 @@ func MapOf(kt, vt Type) MapType {
 	return MapType{kt, vt}
 }
 
+// --------------------------------
+//   Named
+// --------------------------------
+
+// A type declared at the package level, like
+//
+//	type N0 int
+type NamedType struct {
+	N string
+	U Type // the underlying type
+}
+
+func (t NamedType) Comparable() bool {
+	return t.U.Comparable()
+}
+
+func (t NamedType) Ast() ast.Expr {
+	return TypeIdent(t.N)
+}
+
+func (t NamedType) Contains(t2 Type) bool {
+	return t.Equal(t2)
+}
+
+func (t NamedType) Equal(t2 Type) bool {
+	if t2, ok := t2.(NamedType); !ok {
+		return false
+	} else {
+		return t.N == t2.N
+	}
+}
+
+func (t NamedType) Name() string {
+	return t.N
+}
+
+func (t NamedType) Sliceable() bool {
+	return false
+}
+
+func (t NamedType) Underlying() Type {
+	return t.U
+}
+
 // --------------------------------
 //
 //	InterfaceType
@@ -775,6 +945,36 @@ func (t InterfaceType) Contains(t2 Type) bool {
 	return false
 }
 
+// Implements reports whether the method set of t includes all the
+// methods of t2, so that values of type t can be assigned to
+// variables of type t2 without a type assertion.
+func (t InterfaceType) Implements(t2 InterfaceType) bool {
+outer:
+	for _, m2 := range t2.Methods {
+		for _, m := range t.Methods {
+			if m.Equal(m2) {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Conflicts reports whether t and t2 have a method with the same name
+// but different signatures. If they do, no type implements both, and
+// type assertions between them are rejected by the typechecker.
+func (t InterfaceType) Conflicts(t2 InterfaceType) bool {
+	for _, m := range t.Methods {
+		for _, m2 := range t2.Methods {
+			if m.Name.Name == m2.Name.Name && !m.Func.Equal(m2.Func) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // --------------------------------
 //   Constraint
 // --------------------------------
@@ -786,6 +986,7 @@ func (t InterfaceType) Contains(t2 Type) bool {
 type Constraint struct {
 	N     *ast.Ident
 	Types []Type
+	Tilde []bool // Tilde[i] is set if Types[i] is written as ~T
 }
 
 func (c Constraint) Comparable() bool {
@@ -821,6 +1022,49 @@ func (c Constraint) Name() string {
 	return c.N.Name
 }
 
+// Implements reports whether c's type set is a subset of c2's, that
+// is whether a type parameter constrained by c satisfies c2.
+func (c Constraint) Implements(c2 Constraint) bool {
+	if c2.hasAny() {
+		return true
+	}
+	if c.hasAny() {
+		return false
+	}
+	for i, t := range c.Types {
+		found := false
+		for j, t2 := range c2.Types {
+			if t.Equal(t2) && (c2.Tilde[j] || !c.Tilde[i]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Admits reports whether the named type t is in c's type set.
+func (c Constraint) Admits(t NamedType) bool {
+	for i, t2 := range c.Types {
+		if t2.Name() == "any" || (c.Tilde[i] && t.U.Equal(t2)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Constraint) hasAny() bool {
+	for _, t := range c.Types {
+		if t.Name() == "any" {
+			return true
+		}
+	}
+	return false
+}
+
 func (c Constraint) Sliceable() bool {
 	return false
 }
@@ -876,6 +1120,20 @@ func (tp TypeParam) Contains(t Type) bool {
 	return tp.Equal(t)
 }
 
+// ConvertibleTo reports whether values of type tp can be converted to
+// type tp2, that is whether every type in tp's type set converts to
+// every type in tp2's. Only numeric type sets are considered.
+func (tp TypeParam) ConvertibleTo(tp2 TypeParam) bool {
+	for _, c := range []Constraint{tp.Constraint, tp2.Constraint} {
+		for _, t := range c.Types {
+			if !IsNumeric(t) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (tp TypeParam) HasLiterals() bool {
 	for _, t := range tp.Constraint.Types {
 		if !IsNumeric(t) {
@@ -893,66 +1151,165 @@ func MakeTypeParam(v Variable) TypeParam {
 //   preallocated                       //
 // ------------------------------------ //
 
-var Idents = map[string]*ast.Ident{
-	"bool":       &ast.Ident{Name: "bool"},
-	"byte":       &ast.Ident{Name: "byte"},
-	"int":        &ast.Ident{Name: "int"},
-	"int8":       &ast.Ident{Name: "int8"},
-	"int16":      &ast.Ident{Name: "int16"},
-	"int32":      &ast.Ident{Name: "int32"},
-	"int64":      &ast.Ident{Name: "int64"},
-	"uint":       &ast.Ident{Name: "uint"},
-	"uintptr":    &ast.Ident{Name: "uintptr"},
-	"float32":    &ast.Ident{Name: "float32"},
-	"float64":    &ast.Ident{Name: "float64"},
-	"complex128": &ast.Ident{Name: "complex128"},
-	"rune":       &ast.Ident{Name: "rune"},
-	"string":     &ast.Ident{Name: "string"},
+// Idents holds the identifiers shared by all the generated ASTs:
+// the basic types, the predeclared functions and constants, and the
+// most common names of parameters, type parameters, and struct
+// fields. Since they are shared, they must never be modified (not
+// even to set their position). Qualified names (like "math.Sqrt")
+// are never shared, since requalify rewrites them in-place.
+var Idents = sharedIdents()
+
+func sharedIdents() map[string]*ast.Ident {
+	basic := []string{
+		"bool", "byte", "int", "int8", "int16", "int32", "int64",
+		"uint", "uint32", "uint64", "uintptr", "float32", "float64",
+		"complex128", "rune", "string", "any",
+	}
+	names := []string{
+		"append", "cap", "clear", "close", "complex", "copy",
+		"delete", "imag", "len", "make", "new", "panic", "print",
+		"println", "real", "recover", "false", "nil", "true", "_",
+		"Sizeof",
+	}
+	names = append(names, basic...)
+	for i := 0; i < sharedParams; i++ {
+		names = append(names, "p"+strconv.Itoa(i))
+	}
+	for i := 0; i < 8; i++ {
+		names = append(names, "G"+strconv.Itoa(i))
+	}
+
+	// Field names, see RandStructType and RandBigStructType.
+	prefixes := []string{"St", "Ch", "M", "In", "N"}
+	for _, t := range basic {
+		prefixes = append(prefixes, strings.Title(Ident(BT{t})))
+	}
+	for _, p := range prefixes {
+		for i := 0; i <= 16; i++ {
+			names = append(names, p+strconv.Itoa(i))
+		}
+	}
+
+	idents := make(map[string]*ast.Ident, len(names))
+	for _, n := range names {
+		idents[n] = &ast.Ident{Name: n}
+	}
+	return idents
 }
 
-func TypeIdent(t string) *ast.Ident {
-	if i, ok := Idents[t]; ok {
+// SharedIdent returns the shared identifier for name, if there's
+// one, or a new identifier.
+func SharedIdent(name string) *ast.Ident {
+	if i, ok := Idents[name]; ok {
 		return i
 	} else {
-		return &ast.Ident{Name: t}
+		return &ast.Ident{Name: name}
 	}
 }
 
-var AppendIdent = &ast.Ident{Name: "append"}
-var CopyIdent = &ast.Ident{Name: "copy"}
-var LenIdent = &ast.Ident{Name: "len"}
-var MakeIdent = &ast.Ident{Name: "make"}
-var CloseIdent = &ast.Ident{Name: "close"}
-var ClearIdent = &ast.Ident{Name: "clear"}
-var SizeofIdent = &ast.Ident{Name: "Sizeof"}
-var TrueIdent = &ast.Ident{Name: "true"}
-var FalseIdent = &ast.Ident{Name: "false"}
+func TypeIdent(t string) *ast.Ident {
+	return SharedIdent(t)
+}
+
+// ParamIdent returns the identifier of the i-th named parameter of
+// a function (p<i>), see FuncType.MakeFieldLists.
+func ParamIdent(i int) *ast.Ident {
+	if i < len(paramIdents) {
+		return paramIdents[i]
+	}
+	return &ast.Ident{Name: "p" + strconv.Itoa(i)}
+}
+
+// The number of shared parameter identifiers.
+const sharedParams = 32
+
+var paramIdents = func() (ids [sharedParams]*ast.Ident) {
+	for i := range ids {
+		ids[i] = Idents["p"+strconv.Itoa(i)]
+	}
+	return ids
+}()
+
+var AppendIdent = Idents["append"]
+var CopyIdent = Idents["copy"]
+var LenIdent = Idents["len"]
+var MakeIdent = Idents["make"]
+var NewIdent = Idents["new"]
+var CloseIdent = Idents["close"]
+var ClearIdent = Idents["clear"]
+var DeleteIdent = Idents["delete"]
+var SizeofIdent = Idents["Sizeof"]
+var TrueIdent = Idents["true"]
+var FalseIdent = Idents["false"]
+var NilIdent = Idents["nil"]
+
+// IntLits holds the integer literals 0 to 99, shared like Idents.
+var IntLits = func() (lits [100]*ast.BasicLit) {
+	for i := range lits {
+		lits[i] = &ast.BasicLit{Kind: token.INT, Value: strconv.Itoa(i)}
+	}
+	return lits
+}()
 
 // ------------------------------------
 //   Ops
 // ------------------------------------
 
+// The operators returned by UnaryOps and BinOps. They are shared,
+// so callers must not modify them.
+var (
+	unsignedUnaryOps = []token.Token{token.ADD}
+	signedUnaryOps   = []token.Token{token.ADD, token.SUB, token.XOR}
+	floatUnaryOps    = []token.Token{token.ADD, token.SUB}
+	boolUnaryOps     = []token.Token{token.NOT}
+
+	intBinOps = []token.Token{
+		token.ADD, token.AND, token.AND_NOT, token.MUL,
+		token.OR, token.QUO, token.REM, token.SHL, token.SHR,
+		token.SUB, token.XOR,
+	}
+	uintptrBinOps = []token.Token{
+		token.ADD, token.AND, token.AND_NOT, token.OR, token.XOR,
+	}
+	runeBinOps = []token.Token{
+		token.ADD, token.AND, token.AND_NOT,
+		token.OR, token.SHR, token.SUB, token.XOR,
+	}
+	floatBinOps  = []token.Token{token.ADD, token.SUB, token.MUL, token.QUO}
+	boolBinOps   = []token.Token{token.LAND, token.LOR}
+	stringBinOps = []token.Token{token.ADD}
+
+	// comparisons, for BinaryExpr
+	eqOps  = []token.Token{token.EQL, token.NEQ}
+	ordOps = []token.Token{
+		token.EQL, token.NEQ,
+		token.LSS, token.LEQ, token.GTR, token.GEQ,
+	}
+)
+
 func UnaryOps(t Type) []token.Token {
 	switch t2 := t.(type) {
 	case BasicType:
 		switch t.Name() {
 		case "byte", "uint32", "uint64", "uint", "uintptr":
-			return []token.Token{token.ADD}
+			return unsignedUnaryOps
 		case "int", "rune", "int8", "int16", "int32", "int64":
-			return []token.Token{token.ADD, token.SUB, token.XOR}
+			return signedUnaryOps
 		case "float32", "float64", "complex128":
-			return []token.Token{token.ADD, token.SUB}
+			return floatUnaryOps
 		case "bool":
-			return []token.Token{token.NOT}
+			return boolUnaryOps
 		case "string", "any":
-			return []token.Token{}
+			return nil
 		default:
 			panic("Unhandled BasicType " + t.Name())
 		}
 	case TypeParam:
 		return t2.CommonOps(UnaryOps)
+	case NamedType:
+		return UnaryOps(t2.U)
 	default:
-		return []token.Token{}
+		return nil
 	}
 }
 
@@ -962,56 +1319,23 @@ func BinOps(t Type) []token.Token {
 	case BasicType:
 		switch t.Name() {
 		case "byte", "uint32", "uint64", "uint", "int8", "int16", "int32", "int64":
-			return []token.Token{
-				token.ADD, token.AND, token.AND_NOT, token.MUL,
-				token.OR, token.QUO, token.REM, token.SHL, token.SHR,
-				token.SUB, token.XOR,
-			}
+			return intBinOps
 		case "uintptr":
-			return []token.Token{
-				token.ADD, token.AND, token.AND_NOT, token.OR, token.XOR,
-			}
+			return uintptrBinOps
 		case "int":
-			// We can't generate shifts for ints, because int expressions
-			// are used as args for float64() conversions, and in this:
-			//
-			//   var i int = 2
-			// 	 float64(8 >> i)
-			//
-			// 8 is actually of type float64; because, from the spec:
-			//
-			//   If the left operand of a non-constant shift expression is
-			//   an untyped constant, it is first implicitly converted to
-			//   the type it would assume if the shift expression were
-			//   replaced by its left operand alone.
-			//
-			// ans apparently in float64(8), 8 is a float64. So
-			//
-			//   float64(8 >> i)
-			//
-			// fails to compile with error:
-			//
-			//   invalid operation: 8 >> i (shift of type float64)
-			return []token.Token{
-				token.ADD, token.AND, token.AND_NOT, token.MUL,
-				token.OR, token.QUO, token.REM, /*token.SHL, token.SHR,*/
-				token.SUB, token.XOR,
-			}
+			// Shifts of ints are built by ShiftExpr, see the comment
+			// there.
+			return intBinOps
 		case "rune":
-			return []token.Token{
-				token.ADD, token.AND, token.AND_NOT,
-				token.OR, token.SHR, token.SUB, token.XOR,
-			}
-		case "float32", "float64":
-			return []token.Token{token.ADD, token.SUB, token.MUL, token.QUO}
-		case "complex128":
-			return []token.Token{token.ADD, token.SUB, token.MUL}
+			return runeBinOps
+		case "float32", "float64", "complex128":
+			return floatBinOps
 		case "bool":
-			return []token.Token{token.LAND, token.LOR}
+			return boolBinOps
 		case "string":
-			return []token.Token{token.ADD}
+			return stringBinOps
 		case "any":
-			return []token.Token{}
+			return nil
 		default:
 			panic("Unhandled BasicType " + t.Name())
 		}
@@ -1019,24 +1343,47 @@ func BinOps(t Type) []token.Token {
 	case TypeParam:
 		return t2.CommonOps(BinOps)
 
+	case NamedType:
+		return BinOps(t2.U)
+
 	default:
-		return []token.Token{}
+		return nil
 	}
 }
 
+// CommonOps returns the operators that fn returns for all the types
+// in t's constraint. They are returned sorted, without going through
+// a map, so that programs generated from the same seed are the same.
 func (t TypeParam) CommonOps(fn func(t Type) []token.Token) []token.Token {
 	// TODO(alb): cache this
-	m := make(map[token.Token]int)
-	for _, st := range t.Constraint.Types {
-		for _, t2 := range fn(st) {
-			m[t2]++
-		}
+	types := t.Constraint.Types
+	if len(types) == 0 {
+		return nil
+	}
+	ops := make([][]token.Token, 0, len(types))
+	for _, st := range types {
+		ops = append(ops, fn(st))
 	}
+
 	res := make([]token.Token, 0, 8)
-	for i, k := range m {
-		if k == len(t.Constraint.Types) {
-			res = append(res, i)
+outer:
+	for _, op := range ops[0] {
+		for _, o := range ops[1:] {
+			if !containsOp(o, op) {
+				continue outer
+			}
 		}
+		res = append(res, op)
 	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
 	return res
 }
+
+func containsOp(ops []token.Token, op token.Token) bool {
+	for _, o := range ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// profiles are the presets selected by -profile. Each one sets the
+// generation flags targeting a compiler subsystem; the flags given on
+// the command line take precedence.
+var profiles = map[string]map[string]string{
+	// type parameters everywhere, across packages
+	"generics": {
+		"singlepkg": "false",
+		"notp":      "false",
+		"generic":   "1",
+	},
+
+	// goroutines and channels, with the GC running concurrently
+	"concurrency": {
+		"goroutines": "8",
+		"runtime":    "true",
+		"wb":         "true",
+	},
+
+	// integer arithmetic and conversions, with no floating-point
+	// values and no generics hiding the concrete types
+	"integer": {
+		"nofloat": "true",
+		"notp":    "true",
+	},
+
+	// heap allocations, write barriers, escape analysis, and maps
+	"memory": {
+		"wb":       "true",
+		"runtime":  "true",
+		"noescape": "true",
+		"maps":     "true",
+	},
+
+	// the code layout: compiler directives, and several files and
+	// build constraints per package
+	"layout": {
+		"singlepkg": "false",
+		"pragmas":   "true",
+		"multifile": "true",
+		"archfiles": "true",
+	},
+}
+
+// profileNames returns the names of the profiles, sorted.
+func profileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for p := range profiles {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile sets the flags of the given profile, except the ones
+// set on the command line.
+func applyProfile(name string) error {
+	p, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q (want one of %v)", name, strings.Join(profileNames(), ", "))
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	flags := make([]string, 0, len(p))
+	for f := range p {
+		flags = append(flags, f)
+	}
+	sort.Strings(flags)
+	for _, f := range flags {
+		if set[f] {
+			continue
+		}
+		if err := flag.Set(f, p[f]); err != nil {
+			return fmt.Errorf("profile %v: %v", name, err)
+		}
+	}
+	return nil
+}